@@ -338,6 +338,12 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Telegram: enabled=%v\n", cfg.Channels.Telegram.Enabled)
 	fmt.Printf("Feishu: enabled=%v\n", cfg.Channels.Feishu.Enabled)
 	fmt.Printf("WeCom: enabled=%v\n", cfg.Channels.WeCom.Enabled)
+	fmt.Printf("Slack: enabled=%v\n", cfg.Channels.Slack.Enabled)
+	fmt.Printf("Discord: enabled=%v\n", cfg.Channels.Discord.Enabled)
+	fmt.Printf("Matrix: enabled=%v\n", cfg.Channels.Matrix.Enabled)
+	fmt.Printf("Webhook: enabled=%v\n", cfg.Channels.Webhook.Enabled)
+	fmt.Printf("Email: enabled=%v\n", cfg.Channels.Email.Enabled)
+	fmt.Printf("Webchat: enabled=%v\n", cfg.Channels.Webchat.Enabled)
 
 	if _, err := os.Stat(cfg.Agent.Workspace); err != nil {
 		fmt.Println("Workspace: not found (run 'aevitas onboard')")
@@ -2,16 +2,37 @@ package bus
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
+// Outbound delivery runs one worker per channel/chat pair, so a slow upload or
+// a hung API call only delays its own chat. Each worker keeps messages in order.
+const (
+	outboundQueueSize  = 64
+	outboundWorkerIdle = time.Minute
+)
+
+// ErrOutboundQueueFull is the dead-letter reason for a message that arrived
+// while its chat already had a full delivery queue.
+var ErrOutboundQueueFull = errors.New("outbound queue full")
+
 type MessageBus struct {
 	Inbound  chan InboundMessage
 	Outbound chan OutboundMessage
 
-	mu   sync.RWMutex
-	subs map[string][]func(OutboundMessage)
+	mu          sync.RWMutex
+	subs        map[string][]func(OutboundMessage)
+	journal     Journal
+	deadLetters DeadLetterSink
+
+	workersMu  sync.Mutex
+	workers    map[string]chan OutboundMessage
+	queueSize  int
+	workerIdle time.Duration
 }
 
 func NewMessageBus(bufSize int) *MessageBus {
@@ -19,9 +40,12 @@ func NewMessageBus(bufSize int) *MessageBus {
 		bufSize = 100
 	}
 	return &MessageBus{
-		Inbound:  make(chan InboundMessage, bufSize),
-		Outbound: make(chan OutboundMessage, bufSize),
-		subs:     make(map[string][]func(OutboundMessage)),
+		Inbound:    make(chan InboundMessage, bufSize),
+		Outbound:   make(chan OutboundMessage, bufSize),
+		subs:       make(map[string][]func(OutboundMessage)),
+		workers:    make(map[string]chan OutboundMessage),
+		queueSize:  outboundQueueSize,
+		workerIdle: outboundWorkerIdle,
 	}
 }
 
@@ -31,20 +55,118 @@ func (b *MessageBus) SubscribeOutbound(channel string, fn func(OutboundMessage))
 	b.subs[channel] = append(b.subs[channel], fn)
 }
 
+func (b *MessageBus) subscribers(channel string) []func(OutboundMessage) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.subs[channel]
+}
+
+// DispatchOutbound hands each outbound message to the delivery queue of its
+// channel/chat pair. It never waits on a channel: when a chat's queue is full
+// the ephemeral messages queued there are dropped to make room, and only when
+// there are none is the message dropped too, or dead-lettered with
+// ErrOutboundQueueFull unless it is ephemeral itself.
 func (b *MessageBus) DispatchOutbound(ctx context.Context) {
 	for {
 		select {
 		case msg := <-b.Outbound:
-			b.mu.RLock()
-			cbs := b.subs[msg.Channel]
-			b.mu.RUnlock()
-			for _, cb := range cbs {
+			if len(b.subscribers(msg.Channel)) == 0 {
+				log.Printf("[bus] no subscriber for channel %q, dropping message", msg.Channel)
+				b.DeadLetter(msg, fmt.Errorf("no subscriber for channel %q", msg.Channel))
+				continue
+			}
+			if b.enqueueOutbound(ctx, msg) {
+				continue
+			}
+			if msg.Kind.Ephemeral() {
+				log.Printf("[bus] outbound queue for %s/%s is full, dropping %s message", msg.Channel, msg.ChatID, msg.Kind)
+				continue
+			}
+			log.Printf("[bus] outbound queue for %s/%s is full, dead-lettering message", msg.Channel, msg.ChatID)
+			b.DeadLetter(msg, ErrOutboundQueueFull)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *MessageBus) enqueueOutbound(ctx context.Context, msg OutboundMessage) bool {
+	key := msg.Channel + ":" + msg.ChatID
+	b.workersMu.Lock()
+	defer b.workersMu.Unlock()
+	queue, ok := b.workers[key]
+	if !ok {
+		queue = make(chan OutboundMessage, b.queueSize)
+		b.workers[key] = queue
+		go b.runOutboundWorker(ctx, key, queue)
+	}
+	select {
+	case queue <- msg:
+		return true
+	default:
+	}
+	if !dropEphemeral(queue) {
+		return false
+	}
+	queue <- msg
+	return true
+}
+
+// dropEphemeral removes the ephemeral messages from a full queue, keeping
+// the others in order, and reports whether that made room. The caller holds
+// workersMu, so nothing else is queued meanwhile; the worker may still take
+// the head of the queue.
+func dropEphemeral(queue chan OutboundMessage) bool {
+	var kept []OutboundMessage
+	dropped := 0
+	for n := len(queue); n > 0; n-- {
+		select {
+		case msg := <-queue:
+			if msg.Kind.Ephemeral() {
+				dropped++
+				continue
+			}
+			kept = append(kept, msg)
+		default:
+		}
+	}
+	for _, msg := range kept {
+		queue <- msg
+	}
+	if dropped > 0 {
+		log.Printf("[bus] outbound queue is full, dropped %d queued ephemeral messages", dropped)
+	}
+	return len(kept) < cap(queue)
+}
+
+// runOutboundWorker delivers queued messages for one channel/chat pair and
+// exits after sitting idle, or when ctx is done. Undelivered messages are
+// left to the journal.
+func (b *MessageBus) runOutboundWorker(ctx context.Context, key string, queue chan OutboundMessage) {
+	idle := time.NewTimer(b.workerIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case msg := <-queue:
+			for _, cb := range b.subscribers(msg.Channel) {
 				cb(msg)
 			}
-			if len(cbs) == 0 {
-				log.Printf("[bus] no subscriber for channel %q, dropping message", msg.Channel)
+			idle.Reset(b.workerIdle)
+		case <-idle.C:
+			b.workersMu.Lock()
+			if len(queue) == 0 {
+				delete(b.workers, key)
+				b.workersMu.Unlock()
+				return
 			}
+			b.workersMu.Unlock()
+			idle.Reset(b.workerIdle)
 		case <-ctx.Done():
+			b.workersMu.Lock()
+			if b.workers[key] == queue {
+				delete(b.workers, key)
+			}
+			b.workersMu.Unlock()
 			return
 		}
 	}
@@ -2,6 +2,10 @@ package bus
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -111,3 +115,270 @@ func TestDispatch_ContextCancel(t *testing.T) {
 		t.Fatal("DispatchOutbound did not exit after context cancel")
 	}
 }
+
+type deadLetterRecorder struct {
+	mu      sync.Mutex
+	reasons []error
+	added   chan struct{}
+}
+
+func (d *deadLetterRecorder) Add(msg OutboundMessage, reason error) {
+	d.mu.Lock()
+	d.reasons = append(d.reasons, reason)
+	d.mu.Unlock()
+	d.added <- struct{}{}
+}
+
+func TestDispatch_SlowChatDoesNotBlockOthers(t *testing.T) {
+	b := NewMessageBus(10)
+	release := make(chan struct{})
+	delivered := make(chan OutboundMessage, 10)
+	b.SubscribeOutbound("telegram", func(msg OutboundMessage) {
+		if msg.ChatID == "stuck" {
+			<-release
+		}
+		delivered <- msg
+	})
+	b.SubscribeOutbound("feishu", func(msg OutboundMessage) {
+		delivered <- msg
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.DispatchOutbound(ctx)
+	defer close(release)
+
+	b.Outbound <- OutboundMessage{Channel: "telegram", ChatID: "stuck", Content: "upload"}
+	b.Outbound <- OutboundMessage{Channel: "telegram", ChatID: "other", Content: "same channel"}
+	b.Outbound <- OutboundMessage{Channel: "feishu", ChatID: "oc", Content: "other channel"}
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case msg := <-delivered:
+			got[msg.Content] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("deliveries blocked behind a stuck chat, got %v", got)
+		}
+	}
+	if got["upload"] {
+		t.Fatal("stuck chat should still be blocked")
+	}
+}
+
+func TestDispatch_KeepsOrderWithinChat(t *testing.T) {
+	b := NewMessageBus(100)
+	var mu sync.Mutex
+	var order []string
+	done := make(chan struct{})
+	b.SubscribeOutbound("test", func(msg OutboundMessage) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		order = append(order, msg.Content)
+		n := len(order)
+		mu.Unlock()
+		if n == 20 {
+			close(done)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.DispatchOutbound(ctx)
+
+	for i := 0; i < 20; i++ {
+		b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1", Content: fmt.Sprintf("%02d", i)}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for deliveries")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, content := range order {
+		if want := fmt.Sprintf("%02d", i); content != want {
+			t.Fatalf("delivery %d = %s, want %s (order %v)", i, content, want, order)
+		}
+	}
+}
+
+func TestDispatch_FullChatQueueDeadLetters(t *testing.T) {
+	b := NewMessageBus(10)
+	b.queueSize = 1
+	sink := &deadLetterRecorder{added: make(chan struct{}, 10)}
+	b.SetDeadLetterSink(sink)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	b.SubscribeOutbound("test", func(msg OutboundMessage) {
+		started <- struct{}{}
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.DispatchOutbound(ctx)
+	defer close(release)
+
+	b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1", Content: "in flight"}
+	<-started
+	b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1", Content: "queued"}
+	b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1", Content: "overflow"}
+
+	select {
+	case <-sink.added:
+	case <-time.After(2 * time.Second):
+		t.Fatal("overflowing message should be dead-lettered")
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.reasons) != 1 || !errors.Is(sink.reasons[0], ErrOutboundQueueFull) {
+		t.Fatalf("unexpected dead letters: %v", sink.reasons)
+	}
+}
+
+func TestDispatch_FullChatQueueDropsEphemeralFirst(t *testing.T) {
+	b := NewMessageBus(10)
+	b.queueSize = 3
+	sink := &deadLetterRecorder{added: make(chan struct{}, 10)}
+	b.SetDeadLetterSink(sink)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	delivered := make(chan string, 10)
+	b.SubscribeOutbound("test", func(msg OutboundMessage) {
+		if msg.Content == "in flight" {
+			started <- struct{}{}
+			<-release
+		}
+		delivered <- msg.Content
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.DispatchOutbound(ctx)
+
+	b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1", Content: "in flight"}
+	<-started
+	for _, msg := range []OutboundMessage{
+		{Content: "a"},
+		{Content: "draft", Kind: KindPreviewUpdate},
+		{Content: "b"},
+		{Content: "c"}, // replaces the queued draft
+		{Content: "tool", Kind: KindToolProgress}, // no room, dropped
+		{Content: "d"}, // no room, dead-lettered
+	} {
+		msg.Channel, msg.ChatID = "test", "1"
+		b.Outbound <- msg
+	}
+
+	select {
+	case <-sink.added:
+	case <-time.After(2 * time.Second):
+		t.Fatal("overflowing reply should be dead-lettered")
+	}
+	close(release)
+
+	var got []string
+	for len(got) < 4 {
+		select {
+		case content := <-delivered:
+			got = append(got, content)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting deliveries, got %v", got)
+		}
+	}
+	if want := []string{"in flight", "a", "b", "c"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.reasons) != 1 || !errors.Is(sink.reasons[0], ErrOutboundQueueFull) {
+		t.Fatalf("only the last reply should be dead-lettered: %v", sink.reasons)
+	}
+}
+
+func TestDispatch_IdleWorkerExits(t *testing.T) {
+	b := NewMessageBus(10)
+	b.workerIdle = 10 * time.Millisecond
+	delivered := make(chan struct{}, 2)
+	b.SubscribeOutbound("test", func(OutboundMessage) { delivered <- struct{}{} })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.DispatchOutbound(ctx)
+
+	b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1"}
+	<-delivered
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.workersMu.Lock()
+		n := len(b.workers)
+		b.workersMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle worker should exit, %d left", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// A later message starts a fresh worker.
+	b.Outbound <- OutboundMessage{Channel: "test", ChatID: "1"}
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message after idle exit was not delivered")
+	}
+}
+
+func TestTyping_StopOnce(t *testing.T) {
+	calls := 0
+	typing := NewTyping(func() { calls++ })
+	typing.Stop()
+	typing.Stop()
+	if calls != 1 {
+		t.Fatalf("stop called %d times, want 1", calls)
+	}
+	var none *Typing
+	none.Stop() // must not panic
+}
+
+func TestMessages_JSONRoundTrip(t *testing.T) {
+	in := InboundMessage{
+		Channel: "telegram", ChatID: "1", MessageID: "42", Content: "look",
+		Attachments: []Attachment{{Path: "/tmp/a.jpg", Kind: AttachmentImage, MIME: "image/jpeg", Size: 10}},
+		Typing:      NewTyping(func() {}),
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal inbound: %v", err)
+	}
+	var gotIn InboundMessage
+	if err := json.Unmarshal(data, &gotIn); err != nil {
+		t.Fatalf("unmarshal inbound: %v", err)
+	}
+	if gotIn.MessageID != "42" || len(gotIn.Attachments) != 1 || gotIn.Attachments[0] != in.Attachments[0] {
+		t.Fatalf("inbound round trip = %+v", gotIn)
+	}
+	if gotIn.Typing != nil {
+		t.Fatal("typing handle should not be encoded")
+	}
+
+	out := OutboundMessage{
+		Channel: "feishu", ChatID: "oc", Kind: KindToolProgress, Content: "⏳ WebSearch",
+		Tool: &ToolProgress{Name: "WebSearch", Params: `{"q":"x"}`},
+	}
+	data, err = json.Marshal(out)
+	if err != nil {
+		t.Fatalf("marshal outbound: %v", err)
+	}
+	var gotOut OutboundMessage
+	if err := json.Unmarshal(data, &gotOut); err != nil {
+		t.Fatalf("unmarshal outbound: %v", err)
+	}
+	if gotOut.Kind != KindToolProgress || gotOut.Tool == nil || gotOut.Tool.Name != "WebSearch" {
+		t.Fatalf("outbound round trip = %+v", gotOut)
+	}
+	if !gotOut.Kind.Ephemeral() || KindPreviewFinal.Ephemeral() {
+		t.Fatal("tool progress is ephemeral, preview final is not")
+	}
+}
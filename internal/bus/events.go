@@ -1,26 +1,160 @@
 package bus
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
+// MessageKind tells a channel how to render an outbound message.
+type MessageKind string
+
+const (
+	KindPlain         MessageKind = ""               // a regular reply
+	KindPreviewUpdate MessageKind = "preview_update" // partial streamed output, edits the preview
+	KindPreviewFinal  MessageKind = "preview_final"  // final output, replaces the preview
+	KindToolProgress  MessageKind = "tool_progress"  // tool call notice
+	KindUsageHUD      MessageKind = "usage_hud"      // standalone status notice
+)
+
+// Ephemeral reports whether messages of this kind are superseded by a later
+// message. They are neither journaled nor dead-lettered.
+func (k MessageKind) Ephemeral() bool {
+	switch k {
+	case KindPreviewUpdate, KindToolProgress, KindUsageHUD:
+		return true
+	}
+	return false
+}
+
+// AttachmentKind is the media class of an attachment.
+type AttachmentKind string
+
+const (
+	AttachmentImage AttachmentKind = "image"
+	AttachmentAudio AttachmentKind = "audio"
+	AttachmentFile  AttachmentKind = "file"
+)
+
+// Attachment is a local media file carried by a message. Kind and MIME may be
+// empty on outbound messages; channels then detect them from the file.
+type Attachment struct {
+	Path string         `json:"path"`
+	Kind AttachmentKind `json:"kind,omitempty"`
+	MIME string         `json:"mime,omitempty"`
+	Size int64          `json:"size,omitempty"`
+}
+
+// PathAttachments wraps plain file paths as attachments.
+func PathAttachments(paths ...string) []Attachment {
+	if len(paths) == 0 {
+		return nil
+	}
+	out := make([]Attachment, 0, len(paths))
+	for _, p := range paths {
+		out = append(out, Attachment{Path: p})
+	}
+	return out
+}
+
+// ToolProgress describes the tool call a KindToolProgress message reports.
+type ToolProgress struct {
+	Name   string    `json:"name,omitempty"`
+	Params string    `json:"params,omitempty"`
+	At     time.Time `json:"at,omitempty"`
+}
+
+// Typing is a handle on a channel's typing indicator. The gateway stops it
+// once the reply is under way. Stop is idempotent and safe on a nil handle.
+type Typing struct {
+	once sync.Once
+	stop func()
+}
+
+// NewTyping returns a handle that calls stop the first time it is stopped.
+func NewTyping(stop func()) *Typing {
+	return &Typing{stop: stop}
+}
+
+// Stop ends the typing indicator.
+func (t *Typing) Stop() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		if t.stop != nil {
+			t.stop()
+		}
+	})
+}
+
+// Button is a reply option shown under a message. Pressing it sends Data
+// back as the user's message.
+type Button struct {
+	Label string `json:"label"`
+	Data  string `json:"data"`
+}
+
+// InboundMessage is a message received by a channel. It is JSON-encodable;
+// the typing handle and merge hook are process-local and never encoded.
 type InboundMessage struct {
-	Channel   string
-	SenderID  string
-	ChatID    string
-	Content   string
-	Timestamp time.Time
-	Media     []string
-	Metadata  map[string]any
+	Channel     string         `json:"channel"`
+	SenderID    string         `json:"senderId,omitempty"`
+	ChatID      string         `json:"chatId"`
+	MessageID   string         `json:"messageId,omitempty"` // platform message ID, the target for replies
+	Content     string         `json:"content,omitempty"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Attachments []Attachment   `json:"attachments,omitempty"`
+	Typing      *Typing        `json:"-"`
+	Metadata    map[string]any `json:"metadata,omitempty"` // channel-specific extras
+	// Merged, when set, is called with the ID of the message this one was
+	// merged into by debouncing. The turn's replies go to that message.
+	Merged func(into string) `json:"-"`
+	// Session overrides the session the message belongs to, which is
+	// otherwise its chat's. Replies still go to the chat.
+	Session string `json:"session,omitempty"`
+	// Direct marks a one-to-one chat with the bot, as opposed to a group.
+	// Each channel sets it from what its platform reports.
+	Direct bool `json:"direct,omitempty"`
+	// Instructions are extra instructions the channel attaches to the chat,
+	// such as a group's systemPrompt. They extend the turn's system prompt.
+	Instructions string `json:"instructions,omitempty"`
+	// JournalID is the journal entry of the message, set when it is
+	// published. JournalIDs are the entries of the messages a debounced
+	// turn was merged from. Replayed marks a message re-queued from the
+	// journal after a restart.
+	JournalID  string   `json:"journalId,omitempty"`
+	JournalIDs []string `json:"journalIds,omitempty"`
+	Replayed   bool     `json:"-"`
+	// Role is the sender's role (owner, member or guest) and User the user
+	// the sender's account is linked to, if any. The gateway sets both on
+	// every message it handles; channels leave them empty.
+	Role string `json:"role,omitempty"`
+	User string `json:"user,omitempty"`
 }
 
 func (m *InboundMessage) SessionKey() string {
+	if m.Session != "" {
+		return m.Session
+	}
 	return m.Channel + ":" + m.ChatID
 }
 
+// OutboundMessage is a message to be delivered by a channel.
 type OutboundMessage struct {
-	Channel  string
-	ChatID   string
-	Content  string
-	ReplyTo  string
-	Media    []string
-	Metadata map[string]any
+	Channel     string         `json:"channel"`
+	ChatID      string         `json:"chatId"`
+	Kind        MessageKind    `json:"kind,omitempty"`
+	Content     string         `json:"content,omitempty"`
+	ReplyTo     string         `json:"replyTo,omitempty"` // platform message ID to reply to
+	Attachments []Attachment   `json:"attachments,omitempty"`
+	Tool        *ToolProgress  `json:"tool,omitempty"`
+	Buttons     [][]Button     `json:"buttons,omitempty"`  // rows of reply options
+	Metadata    map[string]any `json:"metadata,omitempty"` // channel-specific extras
+	// Part is the 1-based index of a part of a message that was split for
+	// delivery. It is set on parts that are dead-lettered, so each is
+	// stored on its own.
+	Part int `json:"part,omitempty"`
+	// JournalID is the journal entry of the message, set when it is
+	// published.
+	JournalID string `json:"journalId,omitempty"`
 }
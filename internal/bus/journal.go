@@ -0,0 +1,79 @@
+package bus
+
+// Journal persists messages passing through the bus so unfinished work can be
+// replayed after a crash or restart. Implementations must be safe for
+// concurrent use; they may stamp a JournalID on the message.
+type Journal interface {
+	// RecordInbound stores msg and reports false if it was already seen.
+	RecordInbound(msg *InboundMessage) bool
+	// RecordOutbound stores msg before it is handed to a channel.
+	RecordOutbound(msg *OutboundMessage)
+	// AckOutbound records the delivery result of a recorded message.
+	AckOutbound(msg OutboundMessage, err error)
+	// DeadLetterOutbound records that msg was given up on and must not be replayed.
+	DeadLetterOutbound(msg OutboundMessage)
+}
+
+// DeadLetterSink stores outbound messages that could not be delivered.
+type DeadLetterSink interface {
+	Add(msg OutboundMessage, reason error)
+}
+
+// SetJournal attaches j to the bus. Messages published afterwards are recorded.
+func (b *MessageBus) SetJournal(j Journal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.journal = j
+}
+
+// SetDeadLetterSink attaches the store for undeliverable messages.
+func (b *MessageBus) SetDeadLetterSink(s DeadLetterSink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadLetters = s
+}
+
+func (b *MessageBus) currentJournal() Journal {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.journal
+}
+
+// PublishInbound records msg in the journal and queues it for the gateway.
+// It returns false, without queueing, when msg is a duplicate delivery.
+func (b *MessageBus) PublishInbound(msg InboundMessage) bool {
+	if j := b.currentJournal(); j != nil && !j.RecordInbound(&msg) {
+		return false
+	}
+	b.Inbound <- msg
+	return true
+}
+
+// PublishOutbound records msg in the journal and queues it for delivery.
+func (b *MessageBus) PublishOutbound(msg OutboundMessage) {
+	if j := b.currentJournal(); j != nil {
+		j.RecordOutbound(&msg)
+	}
+	b.Outbound <- msg
+}
+
+// AckOutbound reports the delivery result of msg to the journal, if any.
+func (b *MessageBus) AckOutbound(msg OutboundMessage, err error) {
+	if j := b.currentJournal(); j != nil {
+		j.AckOutbound(msg, err)
+	}
+}
+
+// DeadLetter gives up on msg: it is moved to the dead-letter sink, if any,
+// and marked in the journal so it is not replayed.
+func (b *MessageBus) DeadLetter(msg OutboundMessage, reason error) {
+	b.mu.RLock()
+	j, sink := b.journal, b.deadLetters
+	b.mu.RUnlock()
+	if j != nil {
+		j.DeadLetterOutbound(msg)
+	}
+	if sink != nil {
+		sink.Add(msg, reason)
+	}
+}
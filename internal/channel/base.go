@@ -12,6 +12,7 @@ type Channel interface {
 	Start(ctx context.Context) error
 	Stop() error
 	Send(msg bus.OutboundMessage) error
+	Capabilities() Capabilities
 }
 
 type BaseChannel struct {
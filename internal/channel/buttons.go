@@ -0,0 +1,79 @@
+package channel
+
+import (
+	"sync"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+// maxPendingButtons bounds how many unanswered button sets are remembered.
+const maxPendingButtons = 256
+
+// buttonSet is the reply options of one sent message. Buttons are numbered
+// row by row, which is how channels refer to them in callbacks.
+type buttonSet struct {
+	rows [][]bus.Button
+	text string // message text, for channels that redraw the whole message
+}
+
+// buttonRegistry remembers the buttons of sent messages until one of them
+// is pressed, so each question is answered once. The oldest sets are
+// forgotten first, and all of them on restart.
+type buttonRegistry struct {
+	mu    sync.Mutex
+	sets  map[string]buttonSet
+	order []string
+}
+
+func buttonKey(chatID, messageID string) string {
+	return chatID + ":" + messageID
+}
+
+// add remembers the buttons shown under messageID.
+func (r *buttonRegistry) add(chatID, messageID, text string, rows [][]bus.Button) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sets == nil {
+		r.sets = make(map[string]buttonSet)
+	}
+	key := buttonKey(chatID, messageID)
+	if _, ok := r.sets[key]; !ok {
+		r.order = append(r.order, key)
+	}
+	r.sets[key] = buttonSet{rows: rows, text: text}
+	for len(r.order) > maxPendingButtons {
+		delete(r.sets, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// take returns the index-th button under messageID and forgets the whole
+// set. It reports false when the set is unknown or already answered.
+func (r *buttonRegistry) take(chatID, messageID string, index int) (bus.Button, buttonSet, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := buttonKey(chatID, messageID)
+	set, ok := r.sets[key]
+	if !ok || index < 0 {
+		return bus.Button{}, buttonSet{}, false
+	}
+	for _, row := range set.rows {
+		if index < len(row) {
+			delete(r.sets, key)
+			for i, k := range r.order {
+				if k == key {
+					r.order = append(r.order[:i], r.order[i+1:]...)
+					break
+				}
+			}
+			return row[index], set, true
+		}
+		index -= len(row)
+	}
+	return bus.Button{}, buttonSet{}, false
+}
+
+// answeredLabel is what replaces the buttons once one is pressed.
+func answeredLabel(button bus.Button) string {
+	return "✅ " + button.Label
+}
@@ -0,0 +1,305 @@
+package channel
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+// MarkdownDialect is how much Markdown a channel can show. Replies are
+// written in CommonMark and downgraded to the channel's dialect.
+type MarkdownDialect string
+
+const (
+	MarkdownPlain MarkdownDialect = ""      // no formatting, markers are stripped
+	MarkdownBasic MarkdownDialect = "basic" // headings, bold, inline code, links and quotes
+	MarkdownFull  MarkdownDialect = "full"  // CommonMark, rendered by the channel itself
+)
+
+// Capabilities describes what a channel can show. The zero value is a plain
+// text channel without media or length limits.
+type Capabilities struct {
+	MaxMessageLen   int // runes per message, 0 for no limit
+	MaxMessageBytes int // UTF-8 bytes per message, 0 for no limit
+	Edit            bool
+	Markdown        MarkdownDialect
+	Media           []bus.AttachmentKind
+	Voice           bool // audio attachments play as voice messages
+	Buttons         bool
+	Threads         bool
+}
+
+// SupportsMedia reports whether attachments of kind can be sent as such.
+func (c Capabilities) SupportsMedia(kind bus.AttachmentKind) bool {
+	for _, k := range c.Media {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// AdaptOutbound reshapes msg for a channel with caps. Markdown is downgraded
+// to the channel's dialect, attachments the channel cannot show are sent as
+// files or listed in the text, and long text is split into ordered chunks.
+// Only the first chunk carries the attachments and the reply target, and
+// only the last one the buttons; channels without buttons drop them, as the
+// text already lists the options. Stream events are left to the channel's
+// renderer.
+func AdaptOutbound(msg bus.OutboundMessage, caps Capabilities) []bus.OutboundMessage {
+	if !caps.Buttons {
+		msg.Buttons = nil
+	}
+	if msg.Kind != bus.KindPlain && msg.Kind != bus.KindUsageHUD {
+		return []bus.OutboundMessage{msg}
+	}
+
+	content := msg.Content
+	var attachments []bus.Attachment
+	var links []string
+	for _, att := range msg.Attachments {
+		if att.Kind == "" {
+			att.Kind = attachmentKindOf(att.Path, att.MIME)
+		}
+		switch {
+		case caps.SupportsMedia(att.Kind):
+			attachments = append(attachments, att)
+		case caps.SupportsMedia(bus.AttachmentFile):
+			att.Kind = bus.AttachmentFile
+			attachments = append(attachments, att)
+		default:
+			links = append(links, attachmentLink(att, caps.Markdown))
+		}
+	}
+	if len(links) > 0 {
+		content = strings.TrimRight(content, "\n")
+		if content != "" {
+			content += "\n\n"
+		}
+		content += strings.Join(links, "\n")
+	}
+
+	content = downgradeMarkdown(content, caps.Markdown)
+	chunks := splitMessage(content, caps.MaxMessageLen, caps.MaxMessageBytes)
+
+	out := make([]bus.OutboundMessage, 0, len(chunks)+1)
+	for i, chunk := range chunks {
+		part := msg
+		part.Content = chunk
+		part.Attachments = nil
+		if i > 0 {
+			part.ReplyTo = ""
+		}
+		if i < len(chunks)-1 {
+			part.Buttons = nil
+		}
+		out = append(out, part)
+	}
+	if len(out) == 0 {
+		out = append(out, msg)
+		out[0].Content = ""
+	}
+	out[0].Attachments = attachments
+	return out
+}
+
+func attachmentKindOf(path, mimeType string) bus.AttachmentKind {
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+	}
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return bus.AttachmentImage
+	case strings.HasPrefix(mimeType, "audio/"):
+		return bus.AttachmentAudio
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return bus.AttachmentImage
+	case ".ogg", ".opus", ".mp3", ".wav", ".m4a", ".aac", ".flac", ".amr":
+		return bus.AttachmentAudio
+	}
+	return bus.AttachmentFile
+}
+
+// attachmentLink names an attachment in the text. Remote files become links;
+// local ones can only be named.
+func attachmentLink(att bus.Attachment, dialect MarkdownDialect) string {
+	name := filepath.Base(att.Path)
+	remote := strings.HasPrefix(att.Path, "http://") || strings.HasPrefix(att.Path, "https://")
+	switch {
+	case remote && dialect != MarkdownPlain:
+		return fmt.Sprintf("📎 [%s](%s)", name, att.Path)
+	case remote:
+		return fmt.Sprintf("📎 %s: %s", name, att.Path)
+	default:
+		return fmt.Sprintf("📎 %s (%s)", name, att.Kind)
+	}
+}
+
+var (
+	mdImage       = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	mdLink        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrike      = regexp.MustCompile(`~~([^~\n]+)~~`)
+	mdBold        = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	mdInlineCode  = regexp.MustCompile("`([^`\n]+)`")
+	mdHeading     = regexp.MustCompile(`(?m)^#{1,6}\s+`)
+	mdQuote       = regexp.MustCompile(`(?m)^>\s?`)
+	mdTableRule   = regexp.MustCompile(`^\s*\|?\s*:?-{3,}:?\s*(\|\s*:?-{3,}:?\s*)*\|?\s*$`)
+	mdFenceHeader = regexp.MustCompile("^\\s*(```|~~~)")
+)
+
+// downgradeMarkdown rewrites CommonMark for a channel that shows less of it.
+// Code blocks and tables, which basic dialects lack, become quoted lines and
+// pipe-separated rows; plain channels lose all markers but keep link targets.
+func downgradeMarkdown(text string, dialect MarkdownDialect) string {
+	if dialect == MarkdownFull || text == "" {
+		return text
+	}
+	var b strings.Builder
+	inFence := false
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if mdFenceHeader.MatchString(line) {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			if dialect == MarkdownBasic {
+				b.WriteString("> ")
+			}
+			b.WriteString(line)
+			continue
+		}
+		if mdTableRule.MatchString(line) && strings.Contains(line, "-") && strings.Contains(line, "|") {
+			continue
+		}
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "|") && strings.HasSuffix(t, "|") && len(t) > 1 {
+			cells := strings.Split(strings.Trim(t, "|"), "|")
+			for j := range cells {
+				cells[j] = strings.TrimSpace(cells[j])
+			}
+			line = strings.Join(cells, " | ")
+		}
+		line = mdImage.ReplaceAllString(line, "[$1]($2)")
+		line = mdStrike.ReplaceAllString(line, "$1")
+		if dialect == MarkdownPlain {
+			line = mdLink.ReplaceAllString(line, "$1 ($2)")
+			line = mdBold.ReplaceAllString(line, "$1")
+			line = mdInlineCode.ReplaceAllString(line, "$1")
+			line = mdHeading.ReplaceAllString(line, "")
+			line = mdQuote.ReplaceAllString(line, "")
+		}
+		b.WriteString(line)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// splitMessage cuts text into chunks within both limits, preferring
+// paragraph, then line, then word boundaries. A code fence cut in two is
+// closed at the end of one chunk and reopened in the next.
+func splitMessage(text string, maxRunes, maxBytes int) []string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	fits := func(s string) bool {
+		return (maxRunes <= 0 || utf8.RuneCountInString(s) <= maxRunes) &&
+			(maxBytes <= 0 || len(s) <= maxBytes)
+	}
+	if fits(text) {
+		return []string{text}
+	}
+
+	// Reserve room for the fence a chunk may need to close or reopen.
+	const fenceReserve = 32
+	limitRunes, limitBytes := maxRunes, maxBytes
+	if limitRunes > fenceReserve*4 {
+		limitRunes -= fenceReserve
+	}
+	if limitBytes > fenceReserve*4 {
+		limitBytes -= fenceReserve
+	}
+
+	var chunks []string
+	openFence := ""
+	rest := text
+	for rest != "" {
+		cut := cutPoint(rest, limitRunes, limitBytes)
+		chunk := strings.TrimRight(rest[:cut], " \n")
+		rest = strings.TrimLeft(rest[cut:], "\n")
+
+		prefix := ""
+		if openFence != "" {
+			prefix = openFence + "\n"
+		}
+		openFence = fenceStateAfter(chunk, openFence)
+		if openFence != "" {
+			chunk += "\n" + mdFenceHeader.FindStringSubmatch(openFence)[1]
+		}
+		if chunk = strings.TrimSpace(prefix + chunk); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// cutPoint returns the byte offset at which to end the next chunk of s.
+func cutPoint(s string, maxRunes, maxBytes int) int {
+	end := len(s)
+	if maxBytes > 0 && end > maxBytes {
+		end = maxBytes
+	}
+	if maxRunes > 0 {
+		n := 0
+		for i := range s {
+			if i >= end {
+				break
+			}
+			if n == maxRunes {
+				end = i
+				break
+			}
+			n++
+		}
+	}
+	for end > 0 && end < len(s) && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	if end == 0 {
+		_, end = utf8.DecodeRuneInString(s)
+	}
+	if end == len(s) {
+		return end
+	}
+	window := s[:end]
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(window, sep); i > len(window)/2 {
+			return i + len(sep)
+		}
+	}
+	return end
+}
+
+// fenceStateAfter returns the fence header still open after chunk, given
+// the one open before it.
+func fenceStateAfter(chunk, open string) string {
+	for _, line := range strings.Split(chunk, "\n") {
+		if !mdFenceHeader.MatchString(line) {
+			continue
+		}
+		if open == "" {
+			open = strings.TrimSpace(line)
+		} else {
+			open = ""
+		}
+	}
+	return open
+}
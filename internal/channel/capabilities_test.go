@@ -0,0 +1,165 @@
+package channel
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+func TestSplitMessage_RespectsLimitsAndOrder(t *testing.T) {
+	var paras []string
+	for i := 0; i < 30; i++ {
+		paras = append(paras, strings.Repeat("字", 40))
+	}
+	text := strings.Join(paras, "\n\n")
+
+	chunks := splitMessage(text, 0, 500)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if len(c) > 500 {
+			t.Fatalf("chunk %d is %d bytes, limit 500", i, len(c))
+		}
+		if !utf8.ValidString(c) {
+			t.Fatalf("chunk %d cuts a rune", i)
+		}
+	}
+	if got := strings.Join(chunks, "\n\n"); got != text {
+		t.Fatal("chunks should rebuild the original text in order")
+	}
+}
+
+func TestSplitMessage_ReopensCodeFence(t *testing.T) {
+	code := strings.Repeat("fmt.Println(\"hello\")\n", 20)
+	text := "intro\n```go\n" + code + "```\nafter"
+
+	chunks := splitMessage(text, 200, 0)
+	if len(chunks) < 2 {
+		t.Fatalf("expected a split, got %d chunk", len(chunks))
+	}
+	for i, c := range chunks {
+		if n := utf8.RuneCountInString(c); n > 200 {
+			t.Fatalf("chunk %d has %d runes, limit 200", i, n)
+		}
+		if strings.Count(c, "```")%2 != 0 {
+			t.Fatalf("chunk %d leaves a code fence open:\n%s", i, c)
+		}
+	}
+	if !strings.HasPrefix(chunks[1], "```go\n") {
+		t.Fatalf("second chunk should reopen the fence, got %q", chunks[1][:10])
+	}
+}
+
+func TestDowngradeMarkdown(t *testing.T) {
+	md := "# Title\n\n**bold** and `code`, see [docs](https://example.com)\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n```\nx := 1\n```"
+
+	basic := downgradeMarkdown(md, MarkdownBasic)
+	for _, want := range []string{"# Title", "**bold**", "[docs](https://example.com)", "a | b", "1 | 2", "> x := 1"} {
+		if !strings.Contains(basic, want) {
+			t.Errorf("basic output should contain %q:\n%s", want, basic)
+		}
+	}
+	if strings.Contains(basic, "```") || strings.Contains(basic, "---") {
+		t.Errorf("basic output should drop fences and table rules:\n%s", basic)
+	}
+
+	plain := downgradeMarkdown(md, MarkdownPlain)
+	for _, want := range []string{"Title", "bold and code, see docs (https://example.com)", "x := 1"} {
+		if !strings.Contains(plain, want) {
+			t.Errorf("plain output should contain %q:\n%s", want, plain)
+		}
+	}
+	if strings.ContainsAny(plain, "#*`") {
+		t.Errorf("plain output should have no markers:\n%s", plain)
+	}
+
+	if got := downgradeMarkdown(md, MarkdownFull); got != md {
+		t.Errorf("full markdown should pass through, got:\n%s", got)
+	}
+}
+
+func TestAdaptOutbound_MediaFallback(t *testing.T) {
+	msg := bus.OutboundMessage{
+		Channel: "c",
+		ChatID:  "1",
+		Content: "here you go",
+		ReplyTo: "9",
+		Attachments: []bus.Attachment{
+			{Path: "/tmp/chart.png"},
+			{Path: "/tmp/song.mp3"},
+			{Path: "https://example.com/report.pdf", Kind: bus.AttachmentFile},
+		},
+	}
+
+	filesOnly := AdaptOutbound(msg, Capabilities{Markdown: MarkdownFull, Media: []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentFile}})
+	if len(filesOnly) != 1 {
+		t.Fatalf("expected one message, got %d", len(filesOnly))
+	}
+	kinds := []bus.AttachmentKind{}
+	for _, att := range filesOnly[0].Attachments {
+		kinds = append(kinds, att.Kind)
+	}
+	if len(kinds) != 3 || kinds[0] != bus.AttachmentImage || kinds[1] != bus.AttachmentFile {
+		t.Fatalf("audio should fall back to a file attachment, got %v", kinds)
+	}
+
+	textOnly := AdaptOutbound(msg, Capabilities{Markdown: MarkdownBasic})
+	out := textOnly[0]
+	if len(out.Attachments) != 0 {
+		t.Fatalf("text-only channel should get no attachments, got %+v", out.Attachments)
+	}
+	for _, want := range []string{"here you go", "📎 chart.png (image)", "📎 [report.pdf](https://example.com/report.pdf)"} {
+		if !strings.Contains(out.Content, want) {
+			t.Errorf("content should mention %q, got:\n%s", want, out.Content)
+		}
+	}
+}
+
+func TestAdaptOutbound_ChunksKeepReplyOnFirst(t *testing.T) {
+	msg := bus.OutboundMessage{
+		Channel:     "c",
+		ChatID:      "1",
+		ReplyTo:     "9",
+		Content:     strings.Repeat("word ", 100),
+		Attachments: []bus.Attachment{{Path: "/tmp/a.txt"}},
+	}
+	parts := AdaptOutbound(msg, Capabilities{MaxMessageLen: 150, Markdown: MarkdownFull, Media: []bus.AttachmentKind{bus.AttachmentFile}})
+	if len(parts) < 3 {
+		t.Fatalf("expected at least 3 chunks, got %d", len(parts))
+	}
+	if parts[0].ReplyTo != "9" || len(parts[0].Attachments) != 1 {
+		t.Fatalf("first chunk should carry reply and attachments: %+v", parts[0])
+	}
+	for _, p := range parts[1:] {
+		if p.ReplyTo != "" || len(p.Attachments) != 0 {
+			t.Fatalf("later chunks should be bare text: %+v", p)
+		}
+	}
+
+	stream := bus.OutboundMessage{Kind: bus.KindPreviewUpdate, Content: msg.Content}
+	if got := AdaptOutbound(stream, Capabilities{MaxMessageLen: 10}); len(got) != 1 || got[0].Content != msg.Content {
+		t.Fatal("stream events should pass through untouched")
+	}
+}
+
+func TestAdaptOutbound_ButtonsOnLastChunk(t *testing.T) {
+	buttons := [][]bus.Button{{{Label: "Yes", Data: "yes"}, {Label: "No", Data: "no"}}}
+	msg := bus.OutboundMessage{Content: strings.Repeat("word ", 100), Buttons: buttons}
+
+	parts := AdaptOutbound(msg, Capabilities{MaxMessageLen: 150, Buttons: true})
+	for i, p := range parts {
+		if last := i == len(parts)-1; (len(p.Buttons) > 0) != last {
+			t.Fatalf("chunk %d of %d has buttons %v", i+1, len(parts), p.Buttons)
+		}
+	}
+	if parts := AdaptOutbound(msg, Capabilities{MaxMessageLen: 150}); parts[len(parts)-1].Buttons != nil {
+		t.Fatal("channels without buttons should drop them")
+	}
+	final := bus.OutboundMessage{Kind: bus.KindPreviewFinal, Content: "Pick one", Buttons: buttons}
+	if got := AdaptOutbound(final, Capabilities{}); got[0].Buttons != nil {
+		t.Fatal("stream events should drop buttons the channel cannot show")
+	}
+}
@@ -88,6 +88,7 @@ type mockChannel struct {
 	startErr error
 	stopErr  error
 	sentMsgs []bus.OutboundMessage
+	caps     Capabilities
 }
 
 func (m *mockChannel) Name() string { return m.name }
@@ -107,6 +108,8 @@ func (m *mockChannel) Send(msg bus.OutboundMessage) error {
 	return nil
 }
 
+func (m *mockChannel) Capabilities() Capabilities { return m.caps }
+
 func TestChannelManager_WithMockChannel(t *testing.T) {
 	mock := &mockChannel{name: "mock"}
 
@@ -7,8 +7,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/identity"
+	"github.com/riverfjs/aevitas/internal/journal"
 	"github.com/riverfjs/aevitas/internal/usagehud"
 	"github.com/riverfjs/aevitas/pkg/utils"
 	"github.com/riverfjs/agentsdk-go/pkg/api"
@@ -19,16 +22,70 @@ type SessionResetter interface {
 	ClearSession(sessionID string) error
 }
 
+// RoleRuntimes is implemented by runtimes that keep the sessions of some
+// roles on a runtime of their own.
+type RoleRuntimes interface {
+	ForRole(role string) SessionResetter
+}
+
 type UsageReporter interface {
 	GetSessionStats(sessionID string) *api.SessionTokenStats
 	GetTotalStats() *api.SessionTokenStats
 }
 
+// QueueStats is a snapshot of the gateway turn queue.
+type QueueStats struct {
+	Running       int // Turns currently running across all sessions
+	Queued        int // Turns waiting across all sessions
+	Sessions      int // Sessions with running or waiting turns
+	MaxConcurrent int
+	MaxPerSession int
+	SessionActive bool // Whether the requesting session has a turn in flight
+	SessionQueued int  // Turns waiting in the requesting session
+	Rejected      int64
+	LastWait      time.Duration
+	AvgWait       time.Duration
+	MaxWait       time.Duration
+}
+
+// QueueReporter exposes turn queue state for /status.
+type QueueReporter interface {
+	QueueStats(sessionKey string) QueueStats
+}
+
+// TurnStopper cancels the agent turn running for a session and drops the
+// messages waiting for one. It reports whether a turn was running and how
+// many messages were dropped.
+type TurnStopper interface {
+	StopTurn(sessionKey string) (stopped bool, dropped int)
+}
+
+// DeadLetterAdmin lists and resolves outbound messages that could not be delivered.
+type DeadLetterAdmin interface {
+	ListDeadLetters() []journal.DeadLetter
+	RetryDeadLetters(id string) (int, error)
+	DropDeadLetters(id string) (int, error)
+}
+
+// IdentityLinker links sender accounts ("channel:senderID") across
+// channels for /link and /unlink.
+type IdentityLinker interface {
+	User(account string) string
+	Accounts(user string) []string
+	StartLink(account string) (string, error)
+	Link(code, account string) (string, error)
+	Unlink(account string) error
+}
+
 // CommandHandler handles special commands before they reach the agent
 type CommandHandler struct {
 	runtime             SessionResetter // Runtime for session management
 	workspace           string          // Workspace path for listing skills
 	contextWindowTokens int
+	queue               QueueReporter   // Optional turn queue for /status
+	stopper             TurnStopper     // Optional turn canceller for /stop
+	deadLetters         DeadLetterAdmin // Optional dead-letter store for /deadletters
+	identities          IdentityLinker  // Optional identity registry for /link
 }
 
 // NewCommandHandler creates a new command handler
@@ -40,13 +97,81 @@ func NewCommandHandler(runtime SessionResetter, workspace string, contextWindowT
 	}
 }
 
+// SetQueueReporter attaches the turn queue shown by /status.
+func (h *CommandHandler) SetQueueReporter(q QueueReporter) {
+	h.queue = q
+}
+
+// SetTurnStopper attaches the turn canceller used by /stop.
+func (h *CommandHandler) SetTurnStopper(s TurnStopper) {
+	h.stopper = s
+}
+
+// SetDeadLetterAdmin attaches the dead-letter store used by /deadletters.
+func (h *CommandHandler) SetDeadLetterAdmin(d DeadLetterAdmin) {
+	h.deadLetters = d
+}
+
+// SetIdentityLinker attaches the identity registry used by /link and /unlink.
+func (h *CommandHandler) SetIdentityLinker(l IdentityLinker) {
+	h.identities = l
+}
+
 // CommandResult represents the result of command processing
 type CommandResult struct {
-	Handled  bool     // Whether the command was handled
-	Response string   // Response message to send back
-	Files    []string // File paths to send (e.g., log files)
-	Event    string   // Optional event hint for channel rendering
-	Restart  bool     // Whether gateway should execute restart flow
+	Handled  bool            // Whether the command was handled
+	Response string          // Response message to send back
+	Files    []string        // File paths to send (e.g., log files)
+	Kind     bus.MessageKind // Optional rendering hint for the response
+	Buttons  [][]bus.Button  // Optional reply options shown under the response
+	Restart  bool            // Whether gateway should execute restart flow
+}
+
+// CommandSpec describes a built-in command for channels that register
+// commands natively, such as Discord slash commands.
+type CommandSpec struct {
+	Name        string // without the leading slash
+	Description string
+	Arg         string // name of the optional free-text argument, "" for none
+	ArgHelp     string
+	Role        string // lowest role allowed to run it, "" for everyone
+}
+
+// BuiltinCommands lists the commands HandleCommand understands.
+var BuiltinCommands = []CommandSpec{
+	{Name: "start", Description: "Welcome message"},
+	{Name: "help", Description: "Show available commands"},
+	{Name: "skill", Description: "List installed skills", Arg: "action", ArgHelp: "list", Role: identity.RoleMember},
+	{Name: "reset", Description: "Clear conversation history"},
+	{Name: "stop", Description: "Cancel the task currently running in this chat"},
+	{Name: "restart", Description: "Restart gateway (production only)", Role: identity.RoleOwner},
+	{Name: "logs", Description: "Show logs", Arg: "lines", ArgHelp: "Number of lines (max 1000) or \"all\"", Role: identity.RoleOwner},
+	{Name: "status", Description: "Show gateway status", Role: identity.RoleMember},
+	{Name: "usage", Description: "Show token usage", Arg: "mode", ArgHelp: "\"total\" for all sessions", Role: identity.RoleMember},
+	{Name: "chatid", Description: "Show your chat ID"},
+	{Name: "link", Description: "Link this account with your account on another channel", Arg: "code", ArgHelp: "Code shown by /link on the other account"},
+	{Name: "unlink", Description: "Unlink this account from your other accounts"},
+	{Name: "deadletters", Description: "List or resolve replies that failed to deliver", Arg: "args", ArgHelp: "retry|drop <id|all>", Role: identity.RoleOwner},
+	{Name: "cleanup", Description: "Clean project temp files and voice cache", Arg: "confirm", ArgHelp: "\"confirm\" to delete, \"cancel\" to drop the list", Role: identity.RoleOwner},
+}
+
+// commandRole returns the lowest role allowed to run a built-in command.
+func commandRole(command string) string {
+	for _, spec := range BuiltinCommands {
+		if "/"+spec.Name == command {
+			return spec.Role
+		}
+	}
+	return ""
+}
+
+// senderRole returns the role the gateway resolved for the sender. Without
+// one, as when no identities are configured, the sender is the owner.
+func senderRole(msg bus.InboundMessage) string {
+	if msg.Role != "" {
+		return msg.Role
+	}
+	return identity.RoleOwner
 }
 
 // HandleCommand processes special commands and returns whether it was handled.
@@ -65,6 +190,12 @@ func (h *CommandHandler) HandleCommand(msg bus.InboundMessage) CommandResult {
 	}
 
 	command := strings.ToLower(parts[0])
+	if min := commandRole(command); !identity.Allows(senderRole(msg), min) {
+		return CommandResult{
+			Handled:  true,
+			Response: fmt.Sprintf("⛔ %s needs the %s role", command, min),
+		}
+	}
 
 	switch command {
 	case "/start":
@@ -80,7 +211,12 @@ func (h *CommandHandler) HandleCommand(msg bus.InboundMessage) CommandResult {
 	case "/reset":
 		return CommandResult{
 			Handled:  true,
-			Response: h.handleReset(msg.SessionKey()),
+			Response: h.handleReset(msg),
+		}
+	case "/stop":
+		return CommandResult{
+			Handled:  true,
+			Response: h.handleStop(msg.SessionKey()),
 		}
 	case "/restart":
 		resp, ok := h.handleRestart()
@@ -120,7 +256,7 @@ func (h *CommandHandler) HandleCommand(msg bus.InboundMessage) CommandResult {
 	case "/status":
 		return CommandResult{
 			Handled: true,
-			Response: h.handleStatus(),
+			Response: h.handleStatus() + h.formatQueueStatus(msg.SessionKey()),
 		}
 	case "/usage":
 		mode := ""
@@ -129,19 +265,48 @@ func (h *CommandHandler) HandleCommand(msg bus.InboundMessage) CommandResult {
 		}
 		return CommandResult{
 			Handled:  true,
-			Response: h.handleUsage(msg.SessionKey(), mode),
-			Event:    "usage_hud",
+			Response: h.handleUsage(msg, mode),
+			Kind:     bus.KindUsageHUD,
+		}
+	case "/deadletters":
+		action, id := "list", ""
+		if len(parts) > 1 {
+			action = strings.ToLower(parts[1])
+		}
+		if len(parts) > 2 {
+			id = parts[2]
+		}
+		return CommandResult{
+			Handled:  true,
+			Response: h.handleDeadLetters(action, id),
 		}
 	case "/chatid":
 		return CommandResult{
 			Handled:  true,
 			Response: fmt.Sprintf("💬 **Your Chat Information**\n\nChannel: %s\nChat ID: `%s`\nSender ID: `%s`", msg.Channel, msg.ChatID, msg.SenderID),
 		}
+	case "/link":
+		code := ""
+		if len(parts) > 1 {
+			code = parts[1]
+		}
+		return CommandResult{
+			Handled:  true,
+			Response: h.handleLink(msg, code),
+		}
+	case "/unlink":
+		return CommandResult{
+			Handled:  true,
+			Response: h.handleUnlink(msg),
+		}
 	case "/cleanup":
 		// Check if user is confirming previous cleanup request
 		if len(parts) > 1 && (strings.ToLower(parts[1]) == "confirm" || strings.ToLower(parts[1]) == "yes") {
 			return h.handleCleanupConfirm(msg.ChatID)
 		}
+		if len(parts) > 1 && strings.ToLower(parts[1]) == "cancel" {
+			return h.handleCleanupCancel(msg.ChatID)
+		}
 		// Initial cleanup request - scan and show stats
 		return h.handleCleanupScan(msg.ChatID)
 	case "/skill":
@@ -191,11 +356,15 @@ Use /skill list to see installed skills
 • /help - Show this help  
 • /skill list - List installed skills
 • /reset - Clear conversation history
+• /stop - Cancel the task currently running in this chat
 • /restart - Restart gateway (production only)
 • /logs [lines|all] - Show logs (default 100 lines, max 1000, or "all" for full file)
 • /status - Show gateway status
 • /usage [total] - Show token usage (session or total)
 • /chatid - Show your chat ID
+• /link [code] - Link this account with your account on another channel
+• /unlink - Unlink this account from your other accounts
+• /deadletters [retry|drop <id|all>] - List or resolve replies that failed to deliver
 • /cleanup - Clean project temp files + .claude/voice/tts cache (requires confirmation)
 
 **Multimodal:**
@@ -204,17 +373,123 @@ Send images with text - I can analyze photos, diagrams, screenshots, etc.
 Just send a message or image to get started!`
 }
 
-func (h *CommandHandler) handleReset(sessionKey string) string {
+// sessionRuntime returns the runtime that holds the sender's session.
+func (h *CommandHandler) sessionRuntime(msg bus.InboundMessage) SessionResetter {
+	if rr, ok := h.runtime.(RoleRuntimes); ok {
+		return rr.ForRole(senderRole(msg))
+	}
+	return h.runtime
+}
+
+func (h *CommandHandler) handleReset(msg bus.InboundMessage) string {
 	if h.runtime == nil {
 		return "⚠️ Session reset is not available"
 	}
-	if err := h.runtime.ClearSession(sessionKey); err != nil {
+	if err := h.sessionRuntime(msg).ClearSession(msg.SessionKey()); err != nil {
 		return fmt.Sprintf("❌ Failed to reset session: %v", err)
 	}
 	return "✅ **Session Reset**\n\nLet's start fresh!"
 }
 
 
+// handleLink starts a link without a code and completes it with one.
+func (h *CommandHandler) handleLink(msg bus.InboundMessage, code string) string {
+	if h.identities == nil {
+		return "⚠️ Account linking is not available"
+	}
+	account := msg.Channel + ":" + msg.SenderID
+	if code != "" {
+		user, err := h.identities.Link(code, account)
+		if err != nil {
+			return fmt.Sprintf("❌ Failed to link: %v", err)
+		}
+		return fmt.Sprintf("✅ **Accounts Linked**\n\n%s", formatLinkedAccounts(h.identities.Accounts(user)))
+	}
+
+	code, err := h.identities.StartLink(account)
+	if err != nil {
+		return fmt.Sprintf("❌ Failed to create a link code: %v", err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "🔗 **Link Accounts**\n\nSend this from your other account within 10 minutes:\n\n`/link %s`", code)
+	if user := h.identities.User(account); user != "" {
+		fmt.Fprintf(&b, "\n\nLinked now:\n%s", formatLinkedAccounts(h.identities.Accounts(user)))
+	}
+	return b.String()
+}
+
+func (h *CommandHandler) handleUnlink(msg bus.InboundMessage) string {
+	if h.identities == nil {
+		return "⚠️ Account linking is not available"
+	}
+	account := msg.Channel + ":" + msg.SenderID
+	if err := h.identities.Unlink(account); err != nil {
+		return fmt.Sprintf("❌ Failed to unlink: %v", err)
+	}
+	return fmt.Sprintf("✅ Unlinked `%s`", account)
+}
+
+func formatLinkedAccounts(accounts []string) string {
+	lines := make([]string, len(accounts))
+	for i, a := range accounts {
+		lines[i] = "• `" + a + "`"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (h *CommandHandler) handleStop(sessionKey string) string {
+	if h.stopper == nil {
+		return "⚠️ Stop is not available"
+	}
+	stopped, dropped := h.stopper.StopTurn(sessionKey)
+	switch {
+	case stopped && dropped > 0:
+		return fmt.Sprintf("⏹️ Stopping the current task and dropped %d waiting message(s)...", dropped)
+	case stopped:
+		return "⏹️ Stopping the current task..."
+	case dropped > 0:
+		return fmt.Sprintf("⏹️ Dropped %d waiting message(s)", dropped)
+	}
+	return "ℹ️ Nothing is running in this chat"
+}
+
+func (h *CommandHandler) handleDeadLetters(action, id string) string {
+	if h.deadLetters == nil {
+		return "⚠️ Dead letters are not available"
+	}
+	switch action {
+	case "list":
+		letters := h.deadLetters.ListDeadLetters()
+		if len(letters) == 0 {
+			return "📭 No dead letters"
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "📮 **Dead Letters (%d)**\n", len(letters))
+		for _, l := range letters {
+			fmt.Fprintf(&b, "\n`%s` → %s/%s (%s)\n%s\nError: %s\n",
+				l.ID, l.Channel, l.ChatID, l.FailedAt.Format("2006-01-02 15:04:05"),
+				truncateTelegramText(strings.TrimSpace(l.Content), 80), l.Error)
+		}
+		b.WriteString("\nUse `/deadletters retry <id|all>` or `/deadletters drop <id|all>`.")
+		return b.String()
+	case "retry", "drop":
+		if id == "" {
+			return fmt.Sprintf("❓ Usage: /deadletters %s <id|all>", action)
+		}
+		resolve, verb := h.deadLetters.RetryDeadLetters, "Re-queued"
+		if action == "drop" {
+			resolve, verb = h.deadLetters.DropDeadLetters, "Dropped"
+		}
+		n, err := resolve(id)
+		if err != nil {
+			return fmt.Sprintf("❌ %v", err)
+		}
+		return fmt.Sprintf("✅ %s %d dead letter(s)", verb, n)
+	default:
+		return "❓ Unknown subcommand. Use `/deadletters`, `/deadletters retry <id|all>` or `/deadletters drop <id|all>`."
+	}
+}
+
 func (h *CommandHandler) handleSkillList() string {
 	if h.workspace == "" {
 		return "⚠️ Skill listing is not available (workspace not configured)"
@@ -239,13 +514,16 @@ func (h *CommandHandler) handleSkillList() string {
 	return sb.String()
 }
 
-func (h *CommandHandler) handleUsage(sessionKey, mode string) string {
+func (h *CommandHandler) handleUsage(msg bus.InboundMessage, mode string) string {
 	reporter, ok := h.runtime.(UsageReporter)
 	if !ok || reporter == nil {
 		return "⚠️ Usage report is not available"
 	}
 
-	stats := reporter.GetSessionStats(sessionKey)
+	var stats *api.SessionTokenStats
+	if session, ok := h.sessionRuntime(msg).(UsageReporter); ok {
+		stats = session.GetSessionStats(msg.SessionKey())
+	}
 	title := "📊 Usage (Current Session)"
 	inputTokens := 0
 	if stats != nil {
@@ -443,6 +721,35 @@ func (h *CommandHandler) handleStatus() string {
 	return statusMsg
 }
 
+// formatQueueStatus renders the turn queue section of /status.
+func (h *CommandHandler) formatQueueStatus(sessionKey string) string {
+	if h.queue == nil {
+		return ""
+	}
+	st := h.queue.QueueStats(sessionKey)
+	session := "idle"
+	if st.SessionActive {
+		session = fmt.Sprintf("running, %d waiting", st.SessionQueued)
+	}
+	var b strings.Builder
+	b.WriteString("\n\n📥 **Turn Queue**\n")
+	fmt.Fprintf(&b, "\nRunning: %d/%d", st.Running, st.MaxConcurrent)
+	fmt.Fprintf(&b, "\nWaiting: %d (across %d sessions)", st.Queued, st.Sessions)
+	fmt.Fprintf(&b, "\nThis chat: %s (max %d waiting)", session, st.MaxPerSession)
+	fmt.Fprintf(&b, "\nWait: last %s, avg %s, max %s", formatWait(st.LastWait), formatWait(st.AvgWait), formatWait(st.MaxWait))
+	if st.Rejected > 0 {
+		fmt.Fprintf(&b, "\nRejected (busy): %d", st.Rejected)
+	}
+	return b.String()
+}
+
+func formatWait(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
 // handleCleanupScan scans for temporary screenshot files and shows statistics
 func (h *CommandHandler) handleCleanupScan(chatID string) CommandResult {
 	// Scan project temp files in common temp directories + workspace TTS cache.
@@ -574,6 +881,25 @@ func (h *CommandHandler) handleCleanupScan(chatID string) CommandResult {
 	return CommandResult{
 		Handled:  true,
 		Response: response,
+		Buttons: [][]bus.Button{{
+			{Label: "🗑️ Delete", Data: "/cleanup confirm"},
+			{Label: "Cancel", Data: "/cleanup cancel"},
+		}},
+	}
+}
+
+// handleCleanupCancel drops the pending cleanup list
+func (h *CommandHandler) handleCleanupCancel(chatID string) CommandResult {
+	cleanupFile := filepath.Join(os.TempDir(), fmt.Sprintf("cleanup_%s.txt", chatID))
+	if err := os.Remove(cleanupFile); err != nil {
+		return CommandResult{
+			Handled:  true,
+			Response: "⚠️ No pending cleanup request found.",
+		}
+	}
+	return CommandResult{
+		Handled:  true,
+		Response: "👌 Cleanup cancelled. No files were deleted.",
 	}
 }
 
@@ -7,8 +7,12 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	"github.com/riverfjs/aevitas/internal/identity"
+	"github.com/riverfjs/aevitas/internal/journal"
 	"github.com/riverfjs/agentsdk-go/pkg/api"
 )
 
@@ -91,6 +95,18 @@ func TestCommandHandler_HandleHelp(t *testing.T) {
 	}
 }
 
+func TestBuiltinCommands_MatchHelp(t *testing.T) {
+	help := NewCommandHandler(nil, "", 200000).handleHelp()
+	for _, cmd := range BuiltinCommands {
+		if !strings.Contains(help, "• /"+cmd.Name) {
+			t.Errorf("/%s is registered natively but missing from /help", cmd.Name)
+		}
+		if len(cmd.Description) == 0 || len(cmd.Description) > 100 || (cmd.Arg != "" && cmd.ArgHelp == "") {
+			t.Errorf("/%s needs a description of 1-100 chars and help for its argument", cmd.Name)
+		}
+	}
+}
+
 func TestCommandHandler_HandleReset_Success(t *testing.T) {
 	resetCalled := false
 	var capturedSessionKey string
@@ -312,8 +328,8 @@ func TestCommandHandler_HandleUsage_Default(t *testing.T) {
 	if !result.Handled {
 		t.Fatal("expected /usage handled")
 	}
-	if result.Event != "usage_hud" {
-		t.Fatalf("expected usage_hud event, got %q", result.Event)
+	if result.Kind != bus.KindUsageHUD {
+		t.Fatalf("expected usage_hud kind, got %q", result.Kind)
 	}
 	if !strings.Contains(result.Response, "Usage (Current Session)") ||
 		!strings.Contains(result.Response, "Context window:") ||
@@ -339,8 +355,8 @@ func TestCommandHandler_HandleUsage_Total(t *testing.T) {
 	if !result.Handled {
 		t.Fatal("expected /usage total handled")
 	}
-	if result.Event != "usage_hud" {
-		t.Fatalf("expected usage_hud event, got %q", result.Event)
+	if result.Kind != bus.KindUsageHUD {
+		t.Fatalf("expected usage_hud kind, got %q", result.Kind)
 	}
 	if !strings.Contains(result.Response, "Usage (Total)") ||
 		!strings.Contains(result.Response, "⬜") ||
@@ -363,6 +379,209 @@ func TestCommandHandler_HandleUsage_NoReporter(t *testing.T) {
 	}
 }
 
+type mockQueueReporter struct {
+	stats   QueueStats
+	lastKey string
+}
+
+func (m *mockQueueReporter) QueueStats(sessionKey string) QueueStats {
+	m.lastKey = sessionKey
+	return m.stats
+}
+
+func TestCommandHandler_HandleStatus_IncludesQueue(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	queue := &mockQueueReporter{stats: QueueStats{
+		Running:       2,
+		Queued:        3,
+		Sessions:      4,
+		MaxConcurrent: 4,
+		MaxPerSession: 5,
+		SessionActive: true,
+		SessionQueued: 1,
+		Rejected:      2,
+		LastWait:      1500 * time.Millisecond,
+		AvgWait:       250 * time.Millisecond,
+		MaxWait:       3 * time.Second,
+	}}
+	handler := NewCommandHandler(nil, "", 200000)
+	handler.SetQueueReporter(queue)
+
+	result := handler.HandleCommand(bus.InboundMessage{Channel: "telegram", ChatID: "42", Content: "/status"})
+	if !result.Handled {
+		t.Fatal("expected /status handled")
+	}
+	if queue.lastKey != "telegram:42" {
+		t.Fatalf("queue stats requested for %q, want telegram:42", queue.lastKey)
+	}
+	for _, want := range []string{
+		"Turn Queue",
+		"Running: 2/4",
+		"Waiting: 3 (across 4 sessions)",
+		"This chat: running, 1 waiting (max 5 waiting)",
+		"Wait: last 1.5s, avg 250ms, max 3s",
+		"Rejected (busy): 2",
+	} {
+		if !strings.Contains(result.Response, want) {
+			t.Fatalf("missing %q in response: %s", want, result.Response)
+		}
+	}
+}
+
+type mockTurnStopper struct {
+	running map[string]bool
+	waiting map[string]int
+	stopped []string
+}
+
+func (m *mockTurnStopper) StopTurn(sessionKey string) (bool, int) {
+	m.stopped = append(m.stopped, sessionKey)
+	return m.running[sessionKey], m.waiting[sessionKey]
+}
+
+func TestCommandHandler_HandleStop(t *testing.T) {
+	handler := NewCommandHandler(nil, "", 200000)
+	msg := bus.InboundMessage{Channel: "feishu", ChatID: "oc_1", Content: "/stop"}
+
+	result := handler.HandleCommand(msg)
+	if !result.Handled || !strings.Contains(result.Response, "not available") {
+		t.Fatalf("unexpected response without stopper: %+v", result)
+	}
+
+	stopper := &mockTurnStopper{running: map[string]bool{"feishu:oc_1": true}}
+	handler.SetTurnStopper(stopper)
+	result = handler.HandleCommand(msg)
+	if !strings.Contains(result.Response, "Stopping") {
+		t.Fatalf("unexpected response: %s", result.Response)
+	}
+	if len(stopper.stopped) != 1 || stopper.stopped[0] != "feishu:oc_1" {
+		t.Fatalf("stop requested for %v, want [feishu:oc_1]", stopper.stopped)
+	}
+
+	msg.ChatID = "oc_2"
+	result = handler.HandleCommand(msg)
+	if !strings.Contains(result.Response, "Nothing is running") {
+		t.Fatalf("unexpected response for idle chat: %s", result.Response)
+	}
+
+	stopper.waiting = map[string]int{"feishu:oc_2": 2}
+	result = handler.HandleCommand(msg)
+	if !strings.Contains(result.Response, "Dropped 2 waiting") {
+		t.Fatalf("unexpected response for queued chat: %s", result.Response)
+	}
+}
+
+func TestCommandHandler_HandleLink(t *testing.T) {
+	handler := NewCommandHandler(nil, "", 200000)
+	reg, err := identity.Open(config.IdentitiesConfig{}, filepath.Join(t.TempDir(), "identities.json"))
+	if err != nil {
+		t.Fatalf("identity.Open: %v", err)
+	}
+	handler.SetIdentityLinker(reg)
+
+	result := handler.HandleCommand(bus.InboundMessage{Channel: "telegram", SenderID: "1", ChatID: "1", Content: "/link"})
+	_, code, ok := strings.Cut(result.Response, "`/link ")
+	if !result.Handled || !ok {
+		t.Fatalf("unexpected /link response: %s", result.Response)
+	}
+	code = strings.TrimSuffix(code, "`")
+
+	result = handler.HandleCommand(bus.InboundMessage{Channel: "feishu", SenderID: "ou_a", ChatID: "oc_1", Content: "/link " + code})
+	if !strings.Contains(result.Response, "Accounts Linked") || !strings.Contains(result.Response, "`telegram:1`") || !strings.Contains(result.Response, "`feishu:ou_a`") {
+		t.Fatalf("unexpected link response: %s", result.Response)
+	}
+	if reg.User("telegram:1") == "" || reg.User("telegram:1") != reg.User("feishu:ou_a") {
+		t.Fatal("accounts not linked")
+	}
+
+	result = handler.HandleCommand(bus.InboundMessage{Channel: "feishu", SenderID: "ou_a", ChatID: "oc_1", Content: "/unlink"})
+	if !strings.Contains(result.Response, "Unlinked") || reg.User("feishu:ou_a") != "" {
+		t.Fatalf("unexpected unlink response: %s", result.Response)
+	}
+}
+
+func TestCommandHandler_RoleLimits(t *testing.T) {
+	handler := NewCommandHandler(nil, "", 200000)
+	guest := bus.InboundMessage{Channel: "telegram", SenderID: "2", ChatID: "2", Role: identity.RoleGuest}
+
+	for _, cmd := range []string{"/logs all", "/restart", "/cleanup confirm", "/status"} {
+		guest.Content = cmd
+		result := handler.HandleCommand(guest)
+		if !result.Handled || result.Restart || len(result.Files) > 0 || !strings.HasPrefix(result.Response, "⛔") {
+			t.Fatalf("%s for a guest: %+v", cmd, result)
+		}
+	}
+	guest.Content = "/chatid"
+	if result := handler.HandleCommand(guest); strings.HasPrefix(result.Response, "⛔") {
+		t.Fatalf("/chatid for a guest: %s", result.Response)
+	}
+	guest.Role = identity.RoleMember
+	guest.Content = "/status"
+	if result := handler.HandleCommand(guest); strings.HasPrefix(result.Response, "⛔") {
+		t.Fatalf("/status for a member: %s", result.Response)
+	}
+	guest.Content = "/deadletters"
+	if result := handler.HandleCommand(guest); !strings.HasPrefix(result.Response, "⛔") {
+		t.Fatalf("/deadletters for a member: %s", result.Response)
+	}
+	// Without a role, as when identities are not configured, all commands run.
+	if result := handler.HandleCommand(bus.InboundMessage{Channel: "telegram", ChatID: "1", Content: "/deadletters"}); strings.HasPrefix(result.Response, "⛔") {
+		t.Fatalf("/deadletters without a role: %s", result.Response)
+	}
+}
+
+type mockDeadLetterAdmin struct {
+	letters []journal.DeadLetter
+	retried []string
+}
+
+func (m *mockDeadLetterAdmin) ListDeadLetters() []journal.DeadLetter { return m.letters }
+
+func (m *mockDeadLetterAdmin) RetryDeadLetters(id string) (int, error) {
+	m.retried = append(m.retried, id)
+	return len(m.letters), nil
+}
+
+func (m *mockDeadLetterAdmin) DropDeadLetters(id string) (int, error) {
+	return 0, fmt.Errorf("dead letter %q not found", id)
+}
+
+func TestCommandHandler_HandleDeadLetters(t *testing.T) {
+	handler := NewCommandHandler(nil, "", 200000)
+	msg := bus.InboundMessage{Channel: "telegram", ChatID: "1", Content: "/deadletters"}
+	if result := handler.HandleCommand(msg); !strings.Contains(result.Response, "not available") {
+		t.Fatalf("unexpected response without store: %s", result.Response)
+	}
+
+	admin := &mockDeadLetterAdmin{letters: []journal.DeadLetter{{
+		ID: "telegram:1:9", Channel: "telegram", ChatID: "1", Content: "lost reply",
+		Error: "Forbidden: bot was blocked by the user", FailedAt: time.Now(),
+	}}}
+	handler.SetDeadLetterAdmin(admin)
+	result := handler.HandleCommand(msg)
+	for _, want := range []string{"telegram:1:9", "lost reply", "bot was blocked"} {
+		if !strings.Contains(result.Response, want) {
+			t.Fatalf("list should mention %q: %s", want, result.Response)
+		}
+	}
+
+	msg.Content = "/deadletters retry all"
+	if result = handler.HandleCommand(msg); !strings.Contains(result.Response, "Re-queued 1") {
+		t.Fatalf("unexpected retry response: %s", result.Response)
+	}
+	if len(admin.retried) != 1 || admin.retried[0] != "all" {
+		t.Fatalf("retried %v, want [all]", admin.retried)
+	}
+	msg.Content = "/deadletters drop nope"
+	if result = handler.HandleCommand(msg); !strings.Contains(result.Response, "not found") {
+		t.Fatalf("unexpected drop response: %s", result.Response)
+	}
+	msg.Content = "/deadletters retry"
+	if result = handler.HandleCommand(msg); !strings.Contains(result.Response, "Usage") {
+		t.Fatalf("missing id should show usage: %s", result.Response)
+	}
+}
+
 func TestCommandHandler_CleanupScanIncludesTempAndTTS(t *testing.T) {
 	workspace := t.TempDir()
 	handler := NewCommandHandler(nil, workspace, 200000)
@@ -421,6 +640,20 @@ func TestCommandHandler_CleanupScanIncludesTempAndTTS(t *testing.T) {
 	if !contains(list, ttsFile) {
 		t.Fatalf("cleanup list missing tts file: %s", list)
 	}
+
+	if len(result.Buttons) != 1 || len(result.Buttons[0]) != 2 || result.Buttons[0][1].Data != "/cleanup cancel" {
+		t.Fatalf("expected confirm and cancel buttons, got %+v", result.Buttons)
+	}
+	cancel := handler.HandleCommand(bus.InboundMessage{Channel: "telegram", ChatID: chatID, Content: "/cleanup cancel"})
+	if !contains(cancel.Response, "cancelled") {
+		t.Fatalf("unexpected cancel response: %s", cancel.Response)
+	}
+	if _, err := os.Stat(cleanupFile); !os.IsNotExist(err) {
+		t.Fatalf("cleanup list should be dropped on cancel: %v", err)
+	}
+	if _, err := os.Stat(tempScreenshot); err != nil {
+		t.Fatalf("cancel should not delete files: %v", err)
+	}
 }
 
 func TestCommandHandler_HandleRestart_PreparesTrigger(t *testing.T) {
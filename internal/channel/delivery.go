@@ -0,0 +1,125 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/riverfjs/aevitas/internal/bus"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+var (
+	outboundRetryMaxAttempts = 4
+	outboundRetryInitial     = 500 * time.Millisecond
+	outboundRetryMax         = 8 * time.Second
+)
+
+// retryableError is implemented by channel API errors that know whether a
+// repeated request can succeed.
+type retryableError interface {
+	IsRetryable() bool
+}
+
+// PartialSendError reports a Send that delivered only the start of a
+// message, such as the first chunks of a long text. Rest is what is still to
+// be sent; retries and dead letters carry only that.
+type PartialSendError struct {
+	Rest bus.OutboundMessage
+	Err  error
+}
+
+func (e *PartialSendError) Error() string { return e.Err.Error() }
+
+func (e *PartialSendError) Unwrap() error { return e.Err }
+
+// IsRetryableSendError reports whether a failed Send is worth repeating.
+// Errors that classify themselves via IsRetryable decide; otherwise network
+// errors and Telegram rate limits or server errors are retried.
+func IsRetryableSendError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var retryable retryableError
+	if errors.As(err, &retryable) {
+		return retryable.IsRetryable()
+	}
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) {
+		return tgErr.Code == 429 || tgErr.Code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// subscribeOutbound delivers bus messages for ch, adapted to its
+// capabilities. Retryable failures are repeated with exponential backoff;
+// this is the only place sends are retried. When a part still fails, what
+// is left of it and the parts after it go to the dead-letter store. The
+// result is reported to the bus journal once per message.
+func subscribeOutbound(b *bus.MessageBus, ch Channel, logger sdklogger.Logger) {
+	b.SubscribeOutbound(ch.Name(), func(msg bus.OutboundMessage) {
+		parts := AdaptOutbound(msg, ch.Capabilities())
+		var err error
+		for i, part := range parts {
+			var unsent bus.OutboundMessage
+			if unsent, err = sendWithRetry(ch, part, logger); err == nil {
+				continue
+			}
+			logger.Errorf("[channel-mgr] send to %s failed: %v", ch.Name(), err)
+			// Superseded stream events are not worth keeping.
+			if !msg.Kind.Ephemeral() {
+				parts[i] = unsent
+				for n := i; n < len(parts); n++ {
+					rest := parts[n]
+					if len(parts) > 1 {
+						rest.Part = n + 1
+					}
+					b.DeadLetter(rest, err)
+				}
+			}
+			break
+		}
+		b.AckOutbound(msg, err)
+	})
+}
+
+// sendWithRetry sends msg, resuming after what a partly failed attempt
+// delivered. On failure it returns the part of msg that was not sent.
+func sendWithRetry(ch Channel, msg bus.OutboundMessage, logger sdklogger.Logger) (bus.OutboundMessage, error) {
+	attempts := outboundRetryMaxAttempts
+	if msg.Kind.Ephemeral() {
+		attempts = 1
+	}
+	backoff := outboundRetryInitial
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = ch.Send(msg); err == nil {
+			return msg, nil
+		}
+		var partial *PartialSendError
+		if errors.As(err, &partial) {
+			msg = partial.Rest
+		}
+		if attempt >= attempts || !IsRetryableSendError(err) {
+			return msg, err
+		}
+		wait := backoff
+		var tgErr *tgbotapi.Error
+		if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+			wait = time.Duration(tgErr.RetryAfter) * time.Second
+		}
+		logger.Warnf("[channel-mgr] send to %s failed (attempt %d/%d), retrying in %s: %v",
+			ch.Name(), attempt, attempts, wait, err)
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > outboundRetryMax {
+			backoff = outboundRetryMax
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/riverfjs/aevitas/internal/bus"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+// failingChannel returns the queued errors from Send, then succeeds.
+type failingChannel struct {
+	mockChannel
+	mu    sync.Mutex
+	errs  []error
+	calls int
+}
+
+func (f *failingChannel) Send(msg bus.OutboundMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	return f.mockChannel.Send(msg)
+}
+
+func (f *failingChannel) sendCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// ackCounter is a bus journal that only counts delivery results.
+type ackCounter struct {
+	mu   sync.Mutex
+	acks int
+}
+
+func (a *ackCounter) RecordInbound(*bus.InboundMessage) bool { return true }
+func (a *ackCounter) RecordOutbound(*bus.OutboundMessage)    {}
+func (a *ackCounter) DeadLetterOutbound(bus.OutboundMessage) {}
+
+func (a *ackCounter) AckOutbound(bus.OutboundMessage, error) {
+	a.mu.Lock()
+	a.acks++
+	a.mu.Unlock()
+}
+
+func (a *ackCounter) waitFor(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		a.mu.Lock()
+		got := a.acks
+		a.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d deliveries", n)
+}
+
+type recordingDeadLetters struct {
+	mu      sync.Mutex
+	msgs    []bus.OutboundMessage
+	reasons []error
+}
+
+func (r *recordingDeadLetters) Add(msg bus.OutboundMessage, reason error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+	r.reasons = append(r.reasons, reason)
+}
+
+// startDelivery subscribes ch and runs the bus dispatcher until the test ends.
+func startDelivery(t *testing.T, ch Channel) (*bus.MessageBus, *ackCounter, *recordingDeadLetters) {
+	t.Helper()
+	b := bus.NewMessageBus(10)
+	acks := &ackCounter{}
+	sink := &recordingDeadLetters{}
+	b.SetJournal(acks)
+	b.SetDeadLetterSink(sink)
+	subscribeOutbound(b, ch, sdklogger.NewDefault())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go b.DispatchOutbound(ctx)
+	return b, acks, sink
+}
+
+func shortOutboundRetry(t *testing.T) {
+	t.Helper()
+	oldAttempts, oldInitial, oldMax := outboundRetryMaxAttempts, outboundRetryInitial, outboundRetryMax
+	outboundRetryMaxAttempts = 3
+	outboundRetryInitial = time.Millisecond
+	outboundRetryMax = 2 * time.Millisecond
+	t.Cleanup(func() {
+		outboundRetryMaxAttempts, outboundRetryInitial, outboundRetryMax = oldAttempts, oldInitial, oldMax
+	})
+}
+
+func TestIsRetryableSendError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("bad request"), false},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{&tgbotapi.Error{Code: 429, Message: "Too Many Requests"}, true},
+		{&tgbotapi.Error{Code: 400, Message: "chat not found"}, false},
+		{fmt.Errorf("wrapped: %w", &weComHTTPStatusError{Code: 502}), true},
+		{&weComHTTPStatusError{Code: 404}, false},
+		{&slackAPIError{Method: "chat.postMessage", Code: "ratelimited"}, true},
+		{&slackAPIError{Method: "chat.postMessage", Code: "channel_not_found"}, false},
+		{&discordAPIError{Method: "POST", Status: 429}, true},
+		{&discordAPIError{Method: "POST", Status: 403, Message: "Missing Permissions"}, false},
+		{&matrixAPIError{Method: "send", Status: 429, ErrCode: "M_LIMIT_EXCEEDED"}, true},
+		{&matrixAPIError{Method: "send", Status: 403, ErrCode: "M_FORBIDDEN"}, false},
+		{&webhookCallbackError{Status: 503}, true},
+		{&webhookCallbackError{Status: 400}, false},
+		{&emailSMTPError{Code: 451, Message: "try again later"}, true},
+		{&emailSMTPError{Code: 550, Message: "mailbox unavailable"}, false},
+	}
+	for _, tc := range cases {
+		if got := IsRetryableSendError(tc.err); got != tc.want {
+			t.Errorf("IsRetryableSendError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestSubscribeOutbound_RetriesTransientErrors(t *testing.T) {
+	shortOutboundRetry(t)
+	ch := &failingChannel{
+		mockChannel: mockChannel{name: "mock"},
+		errs:        []error{&net.OpError{Op: "write", Err: errors.New("reset")}},
+	}
+	b, acks, sink := startDelivery(t, ch)
+
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "hello"})
+	acks.waitFor(t, 1)
+	if ch.sendCalls() != 2 || len(ch.sentMsgs) != 1 {
+		t.Fatalf("calls = %d, sent = %d; want one retry then success", ch.calls, len(ch.sentMsgs))
+	}
+	if len(sink.msgs) != 0 {
+		t.Fatalf("delivered message should not be dead-lettered: %+v", sink.msgs)
+	}
+}
+
+func TestSubscribeOutbound_DeadLettersPermanentFailures(t *testing.T) {
+	shortOutboundRetry(t)
+	permanent := &tgbotapi.Error{Code: 403, Message: "bot was blocked by the user"}
+	transient := &tgbotapi.Error{Code: 502, Message: "Bad Gateway"}
+	ch := &failingChannel{
+		mockChannel: mockChannel{name: "mock"},
+		errs:        []error{permanent, transient, transient, transient},
+	}
+	b, acks, sink := startDelivery(t, ch)
+
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "blocked"})
+	acks.waitFor(t, 1)
+	if n := ch.sendCalls(); n != 1 {
+		t.Fatalf("non-retryable error should not be retried, calls = %d", n)
+	}
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "flaky"})
+	acks.waitFor(t, 2)
+	if n := ch.sendCalls(); n != 1+outboundRetryMaxAttempts {
+		t.Fatalf("retryable error should use all attempts, calls = %d", n)
+	}
+	// Preview edits are superseded by later ones and are not kept.
+	ch.mu.Lock()
+	ch.errs = []error{permanent}
+	ch.mu.Unlock()
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "draft",
+		Kind: bus.KindPreviewUpdate})
+	acks.waitFor(t, 3)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if len(sink.msgs) != 2 || sink.msgs[0].Content != "blocked" || sink.msgs[1].Content != "flaky" {
+		t.Fatalf("unexpected dead letters: %+v", sink.msgs)
+	}
+	if !errors.Is(sink.reasons[1], transient) {
+		t.Fatalf("dead letter should keep the last error, got %v", sink.reasons[1])
+	}
+}
+
+func TestSubscribeOutbound_SendsAdaptedChunksInOrder(t *testing.T) {
+	ch := &failingChannel{mockChannel: mockChannel{name: "mock", caps: Capabilities{MaxMessageLen: 200}}}
+	b, acks, sink := startDelivery(t, ch)
+
+	var lines, bold []string
+	for i := 0; i < 40; i++ {
+		lines = append(lines, fmt.Sprintf("line %02d", i))
+		bold = append(bold, fmt.Sprintf("**line %02d**", i))
+	}
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: strings.Join(bold, "\n")})
+	acks.waitFor(t, 1)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if len(ch.sentMsgs) < 2 {
+		t.Fatalf("expected the reply in several parts, got %d", len(ch.sentMsgs))
+	}
+	var got []string
+	for _, m := range ch.sentMsgs {
+		got = append(got, m.Content)
+	}
+	if strings.Join(got, "\n") != strings.Join(lines, "\n") {
+		t.Fatalf("parts should arrive in order with markdown stripped, got %q", got)
+	}
+	if len(sink.msgs) != 0 {
+		t.Fatalf("unexpected dead letters: %+v", sink.msgs)
+	}
+}
+
+func TestSubscribeOutbound_DeadLettersEachSplitPart(t *testing.T) {
+	shortOutboundRetry(t)
+	ch := &failingChannel{
+		mockChannel: mockChannel{name: "mock", caps: Capabilities{MaxMessageLen: 5}},
+	}
+	ch.errs = []error{nil, errors.New("forbidden")}
+	b, acks, sink := startDelivery(t, ch)
+
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "aaaa bbbb cccc",
+		JournalID: "out-1"})
+	acks.waitFor(t, 1)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.msgs) != 2 {
+		t.Fatalf("dead letters = %d, want the failed part and the one after it", len(sink.msgs))
+	}
+	for i, msg := range sink.msgs {
+		if msg.Part != i+2 || msg.JournalID != "out-1" {
+			t.Fatalf("part %d = %d, journal id %q", i, msg.Part, msg.JournalID)
+		}
+	}
+}
+
+func TestSubscribeOutbound_RetriesOnlyWhatWasNotSent(t *testing.T) {
+	shortOutboundRetry(t)
+	ch := &failingChannel{mockChannel: mockChannel{name: "mock"}}
+	ch.errs = []error{&PartialSendError{
+		Rest: bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "second half"},
+		Err:  &net.OpError{Op: "write", Err: errors.New("reset")},
+	}}
+	b, acks, sink := startDelivery(t, ch)
+
+	b.PublishOutbound(bus.OutboundMessage{Channel: "mock", ChatID: "1", Content: "first half, second half"})
+	acks.waitFor(t, 1)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.calls != 2 || len(ch.sentMsgs) != 1 || ch.sentMsgs[0].Content != "second half" {
+		t.Fatalf("retry should resend only the rest: calls %d, sent %+v", ch.calls, ch.sentMsgs)
+	}
+	if len(sink.msgs) != 0 {
+		t.Fatalf("unexpected dead letters: %+v", sink.msgs)
+	}
+}
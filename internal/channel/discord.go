@@ -0,0 +1,890 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+const discordChannelName = "discord"
+
+const (
+	discordDefaultAPIURL   = "https://discord.com/api/v10/"
+	discordMaxMessageLen   = 2000
+	discordReconnectMax    = 30 * time.Second
+	discordInteractionTTL  = 15 * time.Minute // lifetime of an interaction token
+	discordGatewayQuery    = "?v=10&encoding=json"
+	discordEphemeralFlag   = 1 << 6
+	discordCommandTypeChat = 1
+	discordOptionString    = 3
+)
+
+// Gateway opcodes.
+const (
+	discordOpDispatch       = 0
+	discordOpHeartbeat      = 1
+	discordOpIdentify       = 2
+	discordOpResume         = 6
+	discordOpReconnect      = 7
+	discordOpInvalidSession = 9
+	discordOpHello          = 10
+)
+
+// GUILDS | GUILD_MESSAGES | DIRECT_MESSAGES | MESSAGE_CONTENT
+const discordIntents = 1<<0 | 1<<9 | 1<<12 | 1<<15
+
+// DiscordFile is a file attached to an outgoing Discord message.
+type DiscordFile struct {
+	Name string
+	Data []byte
+}
+
+// DiscordClient is the part of the Discord REST API the channel uses.
+type DiscordClient interface {
+	// GatewayURL returns the websocket URL to connect to.
+	GatewayURL(ctx context.Context) (string, error)
+	CreateMessage(ctx context.Context, channelID, content, replyTo string, files []DiscordFile) (string, error)
+	EditMessage(ctx context.Context, channelID, messageID, content string) error
+	DeleteMessage(ctx context.Context, channelID, messageID string) error
+	// RegisterCommands overwrites the bot's slash commands, on one guild
+	// when guildID is set and globally otherwise.
+	RegisterCommands(ctx context.Context, appID, guildID string, cmds []CommandSpec) error
+	// RespondInteraction answers a slash command: deferred shows a
+	// "thinking" state to fill in later, otherwise content is shown to the
+	// caller only.
+	RespondInteraction(ctx context.Context, interactionID, token string, deferred bool, content string) error
+	EditInteractionResponse(ctx context.Context, appID, token, content string) error
+	DownloadFile(ctx context.Context, fileURL string) ([]byte, error)
+}
+
+type DiscordClientFactory func(cfg config.DiscordConfig) DiscordClient
+
+type discordAPIError struct {
+	Method  string
+	Path    string
+	Status  int
+	Message string
+}
+
+func (e *discordAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("discord %s %s: http status %d", e.Method, e.Path, e.Status)
+	}
+	return fmt.Sprintf("discord %s %s: %d %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+func (e *discordAPIError) IsRetryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+type defaultDiscordClient struct {
+	token      string
+	apiURL     string
+	httpClient *http.Client
+}
+
+func newDefaultDiscordClient(cfg config.DiscordConfig) DiscordClient {
+	apiURL := strings.TrimSpace(cfg.APIURL)
+	if apiURL == "" {
+		apiURL = discordDefaultAPIURL
+	}
+	return &defaultDiscordClient{
+		token:      cfg.Token,
+		apiURL:     strings.TrimRight(apiURL, "/") + "/",
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type discordMessageReference struct {
+	MessageID       string `json:"message_id"`
+	FailIfNotExists bool   `json:"fail_if_not_exists"`
+}
+
+type discordMessagePayload struct {
+	Content          string                   `json:"content,omitempty"`
+	Flags            int                      `json:"flags,omitempty"`
+	MessageReference *discordMessageReference `json:"message_reference,omitempty"`
+	// Replies never ping: model output may contain @everyone or user IDs.
+	AllowedMentions *struct {
+		Parse []string `json:"parse"`
+	} `json:"allowed_mentions,omitempty"`
+	Attachments []map[string]any `json:"attachments,omitempty"`
+}
+
+func newDiscordPayload(content string) discordMessagePayload {
+	p := discordMessagePayload{Content: content}
+	p.AllowedMentions = &struct {
+		Parse []string `json:"parse"`
+	}{Parse: []string{}}
+	return p
+}
+
+// do sends a JSON request to the REST API and decodes the reply into out.
+func (c *defaultDiscordClient) do(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encode discord %s body: %w", path, err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("create discord %s request: %w", path, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+func (c *defaultDiscordClient) send(req *http.Request, out any) error {
+	req.Header.Set("Authorization", "Bot "+c.token)
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("discord %s %s: %w", req.Method, path, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(raw, &apiErr)
+		return &discordAPIError{Method: req.Method, Path: path, Status: resp.StatusCode, Message: apiErr.Message}
+	}
+	if out != nil && len(raw) > 0 {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return fmt.Errorf("decode discord %s response: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (c *defaultDiscordClient) GatewayURL(ctx context.Context) (string, error) {
+	var out struct {
+		URL string `json:"url"`
+	}
+	if err := c.do(ctx, http.MethodGet, "gateway/bot", nil, &out); err != nil {
+		return "", err
+	}
+	return out.URL, nil
+}
+
+func (c *defaultDiscordClient) CreateMessage(ctx context.Context, channelID, content, replyTo string, files []DiscordFile) (string, error) {
+	payload := newDiscordPayload(content)
+	if replyTo != "" {
+		payload.MessageReference = &discordMessageReference{MessageID: replyTo}
+	}
+	path := "channels/" + channelID + "/messages"
+	var out struct {
+		ID string `json:"id"`
+	}
+	if len(files) == 0 {
+		if err := c.do(ctx, http.MethodPost, path, payload, &out); err != nil {
+			return "", err
+		}
+		return out.ID, nil
+	}
+
+	// Files go as multipart parts next to the JSON payload.
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for i, f := range files {
+		payload.Attachments = append(payload.Attachments, map[string]any{"id": i, "filename": f.Name})
+	}
+	raw, _ := json.Marshal(payload)
+	if err := w.WriteField("payload_json", string(raw)); err != nil {
+		return "", fmt.Errorf("write discord payload: %w", err)
+	}
+	for i, f := range files {
+		part, err := w.CreateFormFile(fmt.Sprintf("files[%d]", i), f.Name)
+		if err != nil {
+			return "", fmt.Errorf("write discord file: %w", err)
+		}
+		part.Write(f.Data)
+	}
+	w.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL+path, &buf)
+	if err != nil {
+		return "", fmt.Errorf("create discord upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if err := c.send(req, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+func (c *defaultDiscordClient) EditMessage(ctx context.Context, channelID, messageID, content string) error {
+	return c.do(ctx, http.MethodPatch, "channels/"+channelID+"/messages/"+messageID, newDiscordPayload(content), nil)
+}
+
+func (c *defaultDiscordClient) DeleteMessage(ctx context.Context, channelID, messageID string) error {
+	return c.do(ctx, http.MethodDelete, "channels/"+channelID+"/messages/"+messageID, nil, nil)
+}
+
+func (c *defaultDiscordClient) RegisterCommands(ctx context.Context, appID, guildID string, cmds []CommandSpec) error {
+	body := make([]map[string]any, 0, len(cmds))
+	for _, cmd := range cmds {
+		entry := map[string]any{
+			"name":        cmd.Name,
+			"description": cmd.Description,
+			"type":        discordCommandTypeChat,
+		}
+		if cmd.Arg != "" {
+			entry["options"] = []map[string]any{{
+				"type":        discordOptionString,
+				"name":        cmd.Arg,
+				"description": cmd.ArgHelp,
+				"required":    false,
+			}}
+		}
+		body = append(body, entry)
+	}
+	path := "applications/" + appID + "/commands"
+	if guildID != "" {
+		path = "applications/" + appID + "/guilds/" + guildID + "/commands"
+	}
+	return c.do(ctx, http.MethodPut, path, body, nil)
+}
+
+func (c *defaultDiscordClient) RespondInteraction(ctx context.Context, interactionID, token string, deferred bool, content string) error {
+	body := map[string]any{"type": 5} // DEFERRED_CHANNEL_MESSAGE_WITH_SOURCE
+	if !deferred {
+		data := newDiscordPayload(content)
+		data.Flags = discordEphemeralFlag
+		body = map[string]any{"type": 4, "data": data} // CHANNEL_MESSAGE_WITH_SOURCE
+	}
+	return c.do(ctx, http.MethodPost, "interactions/"+interactionID+"/"+token+"/callback", body, nil)
+}
+
+func (c *defaultDiscordClient) EditInteractionResponse(ctx context.Context, appID, token, content string) error {
+	return c.do(ctx, http.MethodPatch, "webhooks/"+appID+"/"+token+"/messages/@original", newDiscordPayload(content), nil)
+}
+
+func (c *defaultDiscordClient) DownloadFile(ctx context.Context, fileURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create discord download request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discord download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &discordAPIError{Method: http.MethodGet, Path: "attachment", Status: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type discordGatewayPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  int64           `json:"s"`
+	T  string          `json:"t"`
+}
+
+type discordUser struct {
+	ID  string `json:"id"`
+	Bot bool   `json:"bot"`
+}
+
+type discordAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"`
+}
+
+type discordMessage struct {
+	ID          string              `json:"id"`
+	ChannelID   string              `json:"channel_id"`
+	GuildID     string              `json:"guild_id"`
+	Author      discordUser         `json:"author"`
+	Content     string              `json:"content"`
+	Mentions    []discordUser       `json:"mentions"`
+	Attachments []discordAttachment `json:"attachments"`
+}
+
+type discordInteraction struct {
+	ID        string       `json:"id"`
+	Type      int          `json:"type"`
+	Token     string       `json:"token"`
+	ChannelID string       `json:"channel_id"`
+	GuildID   string       `json:"guild_id"`
+	User      *discordUser `json:"user"`
+	Member    *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Value any `json:"value"`
+		} `json:"options"`
+	} `json:"data"`
+}
+
+// discordPendingCommand is a deferred slash command waiting for its reply.
+// An answered command keeps its entry, without token, until it expires so
+// that later replies to it do not reference the interaction as a message.
+type discordPendingCommand struct {
+	token string
+	at    time.Time
+}
+
+// DiscordChannel connects to the Discord gateway. Guild channels, threads and
+// DMs are all Discord channels, so their channel ID is the ChatID.
+type DiscordChannel struct {
+	BaseChannel
+	cfg           config.DiscordConfig
+	client        DiscordClient
+	clientFactory DiscordClientFactory
+	dialer        *websocket.Dialer
+	cancel        context.CancelFunc
+	stream        *streamRenderer
+
+	mu           sync.Mutex
+	gatewayURL   string
+	resumeURL    string
+	sessionID    string
+	seq          int64
+	botUserID    string
+	appID        string
+	registered   bool
+	interactions map[string]discordPendingCommand // interaction ID -> deferred command
+}
+
+func NewDiscordChannel(cfg config.DiscordConfig, b *bus.MessageBus, logger sdklogger.Logger) (*DiscordChannel, error) {
+	return NewDiscordChannelWithFactory(cfg, b, newDefaultDiscordClient, logger)
+}
+
+// NewDiscordChannelWithFactory creates a DiscordChannel with a custom client factory (for testing)
+func NewDiscordChannelWithFactory(cfg config.DiscordConfig, b *bus.MessageBus, factory DiscordClientFactory, logger sdklogger.Logger) (*DiscordChannel, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("discord token is required")
+	}
+	ch := &DiscordChannel{
+		BaseChannel:   NewBaseChannel(discordChannelName, b, cfg.AllowFrom, logger),
+		cfg:           cfg,
+		clientFactory: factory,
+		dialer:        websocket.DefaultDialer,
+		interactions:  make(map[string]discordPendingCommand),
+	}
+	ch.stream = newStreamingRenderer(ch, streamOptions{
+		name:          discordChannelName,
+		maxDraftRunes: discordMaxMessageLen - 100,
+		maxToolRunes:  discordMaxMessageLen - 100,
+		editInterval:  defaultStreamEditInterval,
+	}, logger)
+	return ch, nil
+}
+
+func (d *DiscordChannel) Start(ctx context.Context) error {
+	d.client = d.clientFactory(d.cfg)
+	gatewayURL, err := d.client.GatewayURL(ctx)
+	if err != nil {
+		return fmt.Errorf("discord gateway/bot: %w", err)
+	}
+	d.mu.Lock()
+	d.gatewayURL = gatewayURL
+	d.mu.Unlock()
+	ctx, d.cancel = context.WithCancel(ctx)
+	go d.runGateway(ctx)
+	d.logger.Infof("[discord] gateway started")
+	return nil
+}
+
+func (d *DiscordChannel) Stop() error {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.logger.Infof("[discord] stopped")
+	return nil
+}
+
+// runGateway keeps a gateway connection open until ctx is done, resuming
+// the session when it can and backing off between failed attempts.
+func (d *DiscordChannel) runGateway(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		connected, err := d.serveGateway(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = time.Second
+		}
+		if err == nil {
+			continue
+		}
+		d.logger.Warnf("[discord] gateway connection lost: %v (reconnect in %s)", err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > discordReconnectMax {
+			backoff = discordReconnectMax
+		}
+	}
+}
+
+// serveGateway runs one gateway connection: hello, identify or resume, then
+// heartbeats alongside dispatch handling. It returns nil when Discord asks
+// for a reconnect.
+func (d *DiscordChannel) serveGateway(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	wsURL, sessionID, seq := d.gatewayURL, d.sessionID, d.seq
+	if sessionID != "" && d.resumeURL != "" {
+		wsURL = d.resumeURL
+	}
+	d.mu.Unlock()
+
+	conn, _, err := d.dialer.DialContext(ctx, strings.TrimRight(wsURL, "/")+"/"+discordGatewayQuery, nil)
+	if err != nil {
+		return false, fmt.Errorf("dial gateway: %w", err)
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var writeMu sync.Mutex
+	send := func(op int, data any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(map[string]any{"op": op, "d": data})
+	}
+
+	var hello discordGatewayPayload
+	if err := conn.ReadJSON(&hello); err != nil {
+		return false, err
+	}
+	var helloData struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	if hello.Op != discordOpHello || json.Unmarshal(hello.D, &helloData) != nil || helloData.HeartbeatInterval <= 0 {
+		return false, fmt.Errorf("expected hello, got op %d", hello.Op)
+	}
+
+	if sessionID != "" {
+		err = send(discordOpResume, map[string]any{"token": d.cfg.Token, "session_id": sessionID, "seq": seq})
+	} else {
+		err = send(discordOpIdentify, map[string]any{
+			"token":      d.cfg.Token,
+			"intents":    discordIntents,
+			"properties": map[string]string{"os": "linux", "browser": "aevitas", "device": "aevitas"},
+		})
+	}
+	if err != nil {
+		return false, fmt.Errorf("identify: %w", err)
+	}
+
+	heartbeat := func() error {
+		d.mu.Lock()
+		last := d.seq
+		d.mu.Unlock()
+		if last == 0 {
+			return send(discordOpHeartbeat, nil)
+		}
+		return send(discordOpHeartbeat, last)
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(helloData.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := heartbeat(); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	connected := false
+	for {
+		var p discordGatewayPayload
+		if err := conn.ReadJSON(&p); err != nil {
+			return connected, err
+		}
+		switch p.Op {
+		case discordOpDispatch:
+			connected = true
+			if p.S > 0 {
+				d.mu.Lock()
+				d.seq = p.S
+				d.mu.Unlock()
+			}
+			d.handleDispatch(ctx, p.T, p.D)
+		case discordOpHeartbeat:
+			if err := heartbeat(); err != nil {
+				return connected, err
+			}
+		case discordOpReconnect:
+			return connected, nil
+		case discordOpInvalidSession:
+			var resumable bool
+			_ = json.Unmarshal(p.D, &resumable)
+			if !resumable {
+				d.mu.Lock()
+				d.sessionID, d.resumeURL, d.seq = "", "", 0
+				d.mu.Unlock()
+			}
+			return connected, fmt.Errorf("invalid session")
+		}
+	}
+}
+
+func (d *DiscordChannel) handleDispatch(ctx context.Context, event string, data json.RawMessage) {
+	switch event {
+	case "READY":
+		var ready struct {
+			SessionID        string      `json:"session_id"`
+			ResumeGatewayURL string      `json:"resume_gateway_url"`
+			User             discordUser `json:"user"`
+			Application      struct {
+				ID string `json:"id"`
+			} `json:"application"`
+		}
+		if err := json.Unmarshal(data, &ready); err != nil {
+			d.logger.Warnf("[discord] parse READY: %v", err)
+			return
+		}
+		d.mu.Lock()
+		d.sessionID = ready.SessionID
+		d.resumeURL = ready.ResumeGatewayURL
+		d.botUserID = ready.User.ID
+		d.appID = ready.Application.ID
+		register := !d.registered
+		d.registered = true
+		d.mu.Unlock()
+		d.logger.Infof("[discord] connected as %s", ready.User.ID)
+		if register {
+			if err := d.client.RegisterCommands(ctx, ready.Application.ID, d.cfg.GuildID, BuiltinCommands); err != nil {
+				d.logger.Warnf("[discord] register slash commands failed: %v", err)
+				d.mu.Lock()
+				d.registered = false
+				d.mu.Unlock()
+			}
+		}
+	case "RESUMED":
+		d.logger.Debugf("[discord] session resumed")
+	case "MESSAGE_CREATE":
+		var m discordMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			d.logger.Warnf("[discord] parse MESSAGE_CREATE: %v", err)
+			return
+		}
+		d.handleMessage(m)
+	case "INTERACTION_CREATE":
+		var it discordInteraction
+		if err := json.Unmarshal(data, &it); err != nil {
+			d.logger.Warnf("[discord] parse INTERACTION_CREATE: %v", err)
+			return
+		}
+		d.handleInteraction(it)
+	}
+}
+
+// handleMessage publishes DMs and guild messages that mention the bot.
+func (d *DiscordChannel) handleMessage(m discordMessage) {
+	d.mu.Lock()
+	botUserID := d.botUserID
+	d.mu.Unlock()
+	if m.Author.Bot || m.Author.ID == "" || m.Author.ID == botUserID {
+		return
+	}
+	if m.GuildID != "" {
+		mentioned := false
+		for _, u := range m.Mentions {
+			if u.ID == botUserID {
+				mentioned = true
+				break
+			}
+		}
+		if !mentioned {
+			return
+		}
+	}
+	if !d.IsAllowed(m.Author.ID) {
+		return
+	}
+
+	content := m.Content
+	if botUserID != "" {
+		content = strings.NewReplacer("<@"+botUserID+">", "", "<@!"+botUserID+">", "").Replace(content)
+	}
+	content = strings.TrimSpace(content)
+
+	var attachments []bus.Attachment
+	for _, a := range m.Attachments {
+		att, err := d.downloadAttachment(a)
+		if err != nil {
+			d.logger.Warnf("[discord] download attachment %s failed: %v", a.Filename, err)
+			continue
+		}
+		attachments = append(attachments, att)
+	}
+	if content == "" && len(attachments) == 0 {
+		return
+	}
+
+	var metadata map[string]any
+	if m.GuildID != "" {
+		metadata = map[string]any{"guild_id": m.GuildID}
+	}
+	if !d.bus.PublishInbound(bus.InboundMessage{
+		Channel:     discordChannelName,
+		SenderID:    m.Author.ID,
+		ChatID:      m.ChannelID,
+		MessageID:   m.ID,
+		Content:     content,
+		Attachments: attachments,
+		Timestamp:   time.Now(),
+		Direct:      m.GuildID == "",
+		Metadata:    metadata,
+	}) {
+		d.logger.Debugf("[discord] duplicate message dropped: %s", m.ID)
+	}
+}
+
+// handleInteraction turns a slash command into a "/name args" message. The
+// command is deferred right away, as Discord requires an answer within three
+// seconds, and its reply later fills in the deferred response.
+func (d *DiscordChannel) handleInteraction(it discordInteraction) {
+	const applicationCommand = 2
+	if it.Type != applicationCommand {
+		return
+	}
+	var user discordUser
+	if it.Member != nil {
+		user = it.Member.User
+	} else if it.User != nil {
+		user = *it.User
+	}
+	ctx := context.Background()
+	if !d.IsAllowed(user.ID) {
+		if err := d.client.RespondInteraction(ctx, it.ID, it.Token, false, "⛔ 你没有使用此机器人的权限"); err != nil {
+			d.logger.Warnf("[discord] reject interaction failed: %v", err)
+		}
+		return
+	}
+	if err := d.client.RespondInteraction(ctx, it.ID, it.Token, true, ""); err != nil {
+		d.logger.Warnf("[discord] defer interaction failed: %v", err)
+		return
+	}
+	d.mu.Lock()
+	for id, pending := range d.interactions {
+		if time.Since(pending.at) > discordInteractionTTL {
+			delete(d.interactions, id)
+		}
+	}
+	d.interactions[it.ID] = discordPendingCommand{token: it.Token, at: time.Now()}
+	d.mu.Unlock()
+
+	parts := []string{"/" + it.Data.Name}
+	for _, opt := range it.Data.Options {
+		if v := strings.TrimSpace(fmt.Sprint(opt.Value)); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	var metadata map[string]any
+	if it.GuildID != "" {
+		metadata = map[string]any{"guild_id": it.GuildID}
+	}
+	d.bus.PublishInbound(bus.InboundMessage{
+		Channel:   discordChannelName,
+		SenderID:  user.ID,
+		ChatID:    it.ChannelID,
+		MessageID: it.ID,
+		Content:   strings.Join(parts, " "),
+		Timestamp: time.Now(),
+		Direct:    it.GuildID == "",
+		Metadata:  metadata,
+	})
+}
+
+// takeInteraction returns the token of the deferred command with the given
+// interaction ID, if it is still waiting for its reply.
+func (d *DiscordChannel) takeInteraction(id string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending, ok := d.interactions[id]
+	if !ok || pending.token == "" || time.Since(pending.at) > discordInteractionTTL {
+		return "", false
+	}
+	d.interactions[id] = discordPendingCommand{at: pending.at}
+	return pending.token, true
+}
+
+// messageReference returns replyTo unless it is a slash command's
+// interaction ID, which is not a message Discord can reply to.
+func (d *DiscordChannel) messageReference(replyTo string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.interactions[replyTo]; ok {
+		return ""
+	}
+	return replyTo
+}
+
+func (d *DiscordChannel) downloadAttachment(a discordAttachment) (bus.Attachment, error) {
+	data, err := d.client.DownloadFile(context.Background(), a.URL)
+	if err != nil {
+		return bus.Attachment{}, err
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-discord-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return bus.Attachment{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(a.Filename)))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return bus.Attachment{}, fmt.Errorf("save file: %w", err)
+	}
+	return bus.Attachment{
+		Path: localPath,
+		Kind: attachmentKindOf(a.Filename, a.ContentType),
+		MIME: a.ContentType,
+		Size: int64(len(data)),
+	}, nil
+}
+
+func (d *DiscordChannel) Capabilities() Capabilities {
+	return Capabilities{
+		MaxMessageLen: discordMaxMessageLen,
+		Edit:          true,
+		Markdown:      MarkdownFull,
+		Media:         []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+		Threads:       true,
+	}
+}
+
+func (d *DiscordChannel) Send(msg bus.OutboundMessage) error {
+	if d.client == nil {
+		return fmt.Errorf("discord client not initialized")
+	}
+	chatID := strings.TrimSpace(msg.ChatID)
+	if chatID == "" {
+		return fmt.Errorf("discord channel id is required")
+	}
+	switch msg.Kind {
+	case bus.KindPreviewUpdate:
+		return d.stream.Update(chatID, msg.Content, msg.ReplyTo)
+	case bus.KindPreviewFinal:
+		return d.stream.Finalize(chatID, msg.Content, msg.ReplyTo)
+	case bus.KindToolProgress:
+		return d.stream.ToolProgress(chatID, msg)
+	}
+
+	var files []DiscordFile
+	for _, att := range msg.Attachments {
+		data, err := os.ReadFile(att.Path)
+		if err != nil {
+			d.logger.Warnf("[discord] read media %s failed: %v", att.Path, err)
+			continue
+		}
+		files = append(files, DiscordFile{Name: filepath.Base(att.Path), Data: data})
+	}
+
+	content := strings.TrimSpace(msg.Content)
+	// A reply to a slash command fills in its deferred response.
+	if content != "" && msg.ReplyTo != "" {
+		if token, ok := d.takeInteraction(msg.ReplyTo); ok {
+			d.mu.Lock()
+			appID := d.appID
+			d.mu.Unlock()
+			if err := d.client.EditInteractionResponse(context.Background(), appID, token, content); err != nil {
+				d.logger.Warnf("[discord] answer slash command failed, sending as message: %v", err)
+			} else {
+				content = ""
+			}
+		}
+	}
+	if content == "" && len(files) == 0 {
+		return nil
+	}
+	_, err := d.client.CreateMessage(context.Background(), chatID, content, d.messageReference(msg.ReplyTo), files)
+	return err
+}
+
+// StreamingRenderer implements Streamer.
+func (d *DiscordChannel) StreamingRenderer() StreamingRenderer {
+	return d.stream
+}
+
+// clampDiscordText keeps text within the message limit, closing any code
+// fence the cut leaves open.
+func clampDiscordText(text string) string {
+	if len([]rune(text)) <= discordMaxMessageLen {
+		return text
+	}
+	return closeOpenMarkdown(truncateTelegramText(text, discordMaxMessageLen-10))
+}
+
+// CreateBlock implements StreamTarget.
+func (d *DiscordChannel) CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error) {
+	return d.client.CreateMessage(context.Background(), chatID, clampDiscordText(text), d.messageReference(replyTo), nil)
+}
+
+// EditBlock implements StreamTarget.
+func (d *DiscordChannel) EditBlock(chatID, messageID string, block StreamBlock, text string) error {
+	return d.client.EditMessage(context.Background(), chatID, messageID, clampDiscordText(text))
+}
+
+// DeleteBlock implements StreamTarget.
+func (d *DiscordChannel) DeleteBlock(chatID, messageID string) error {
+	return d.client.DeleteMessage(context.Background(), chatID, messageID)
+}
+
+// SendReply implements StreamTarget. Discord renders the Markdown itself;
+// a reply longer than one message is split and the first chunk replaces
+// the draft.
+func (d *DiscordChannel) SendReply(chatID, text, draftID, replyTo string) error {
+	ctx := context.Background()
+	replyTo = d.messageReference(replyTo)
+	for _, chunk := range splitMessage(text, discordMaxMessageLen, 0) {
+		if draftID != "" {
+			err := d.client.EditMessage(ctx, chatID, draftID, chunk)
+			draftID = ""
+			if err == nil {
+				replyTo = ""
+				continue
+			}
+		}
+		if _, err := d.client.CreateMessage(ctx, chatID, chunk, replyTo, nil); err != nil {
+			return err
+		}
+		replyTo = ""
+	}
+	return nil
+}
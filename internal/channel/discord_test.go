@@ -0,0 +1,396 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+type discordCall struct {
+	method      string
+	path        string
+	body        string
+	contentType string
+}
+
+// fakeDiscord is a local Discord: the REST API under /api/, a gateway
+// websocket at /gateway/ driven by the test, and attachment downloads.
+type fakeDiscord struct {
+	srv     *httptest.Server
+	mu      sync.Mutex
+	calls   []discordCall
+	nextID  int
+	sockets chan *websocket.Conn
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	f := &fakeDiscord{sockets: make(chan *websocket.Conn, 4)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", f.handleAPI)
+	mux.HandleFunc("/gateway/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		f.sockets <- conn
+	})
+	mux.HandleFunc("/attachments/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image-bytes"))
+	})
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeDiscord) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bot discord-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "401: Unauthorized", "code": 0}`))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	f.mu.Lock()
+	f.calls = append(f.calls, discordCall{method: r.Method, path: path, body: string(body), contentType: r.Header.Get("Content-Type")})
+	f.mu.Unlock()
+
+	switch {
+	case path == "gateway/bot":
+		json.NewEncoder(w).Encode(map[string]string{"url": "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/gateway"})
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/messages"):
+		f.mu.Lock()
+		f.nextID++
+		id := fmt.Sprintf("m%d", f.nextID)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	case r.Method == http.MethodDelete, strings.HasSuffix(path, "/callback"):
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+func (f *fakeDiscord) callsMatching(method, pathPart string) []discordCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []discordCall
+	for _, c := range f.calls {
+		if c.method == method && strings.Contains(c.path, pathPart) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (f *fakeDiscord) waitFor(t *testing.T, method, pathPart string, n int) []discordCall {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		calls := f.callsMatching(method, pathPart)
+		if len(calls) >= n || time.Now().After(deadline) {
+			return calls
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startTestDiscordChannel(t *testing.T, f *fakeDiscord, allowFrom []string) (*DiscordChannel, *bus.MessageBus) {
+	t.Helper()
+	b := bus.NewMessageBus(10)
+	ch, err := NewDiscordChannel(config.DiscordConfig{
+		Enabled:   true,
+		Token:     "discord-test",
+		GuildID:   "G1",
+		APIURL:    f.srv.URL + "/api",
+		AllowFrom: allowFrom,
+	}, b, sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewDiscordChannel: %v", err)
+	}
+	if err := ch.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { ch.Stop() })
+	return ch, b
+}
+
+// connectGateway accepts the channel's gateway connection and completes the
+// hello/identify/ready handshake.
+func connectGateway(t *testing.T, f *fakeDiscord) *websocket.Conn {
+	t.Helper()
+	var conn *websocket.Conn
+	select {
+	case conn = <-f.sockets:
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel did not connect to the gateway")
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.WriteJSON(map[string]any{"op": discordOpHello, "d": map[string]int{"heartbeat_interval": 20}})
+	identify := readGatewayOp(t, conn, discordOpIdentify)
+	var data struct {
+		Token   string `json:"token"`
+		Intents int    `json:"intents"`
+	}
+	json.Unmarshal(identify.D, &data)
+	if data.Token != "discord-test" || data.Intents&(1<<15) == 0 {
+		t.Fatalf("unexpected identify: %s", identify.D)
+	}
+	readGatewayOp(t, conn, discordOpHeartbeat)
+	dispatch(t, conn, 1, "READY", map[string]any{
+		"session_id":         "S1",
+		"resume_gateway_url": "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/gateway",
+		"user":               map[string]any{"id": "BOT", "bot": true},
+		"application":        map[string]any{"id": "APP"},
+	})
+	return conn
+}
+
+func readGatewayOp(t *testing.T, conn *websocket.Conn, op int) discordGatewayPayload {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var p discordGatewayPayload
+		if err := conn.ReadJSON(&p); err != nil {
+			t.Fatalf("waiting for op %d: %v", op, err)
+		}
+		if p.Op == op {
+			return p
+		}
+	}
+}
+
+func dispatch(t *testing.T, conn *websocket.Conn, seq int, event string, data any) {
+	t.Helper()
+	if err := conn.WriteJSON(map[string]any{"op": discordOpDispatch, "s": seq, "t": event, "d": data}); err != nil {
+		t.Fatalf("dispatch %s: %v", event, err)
+	}
+}
+
+func TestDiscordChannel_GatewayInbound(t *testing.T) {
+	f := newFakeDiscord(t)
+	_, b := startTestDiscordChannel(t, f, []string{"U1"})
+	conn := connectGateway(t, f)
+
+	register := f.waitFor(t, http.MethodPut, "applications/APP/guilds/G1/commands", 1)
+	if len(register) != 1 {
+		t.Fatal("slash commands were not registered on the guild")
+	}
+	var cmds []struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal([]byte(register[0].body), &cmds)
+	if len(cmds) != len(BuiltinCommands) {
+		t.Fatalf("registered %d commands, want %d", len(cmds), len(BuiltinCommands))
+	}
+
+	author := map[string]any{"id": "U1"}
+	dispatch(t, conn, 2, "MESSAGE_CREATE", map[string]any{"id": "1", "channel_id": "C1", "guild_id": "G1", "author": author, "content": "no mention"})
+	dispatch(t, conn, 3, "MESSAGE_CREATE", map[string]any{"id": "2", "channel_id": "C1", "guild_id": "G1", "author": map[string]any{"id": "U2"}, "content": "<@BOT> stranger", "mentions": []any{map[string]any{"id": "BOT"}}})
+	dispatch(t, conn, 4, "MESSAGE_CREATE", map[string]any{"id": "3", "channel_id": "D1", "author": map[string]any{"id": "BOT", "bot": true}, "content": "echo"})
+	dispatch(t, conn, 5, "MESSAGE_CREATE", map[string]any{"id": "4", "channel_id": "T1", "guild_id": "G1", "author": author, "content": "<@!BOT> in a thread", "mentions": []any{map[string]any{"id": "BOT"}}})
+	dispatch(t, conn, 6, "MESSAGE_CREATE", map[string]any{"id": "5", "channel_id": "D1", "author": author, "content": "",
+		"attachments": []any{map[string]any{"filename": "cat.png", "content_type": "image/png", "url": f.srv.URL + "/attachments/cat.png"}}})
+
+	select {
+	case msg := <-b.Inbound:
+		if msg.Channel != "discord" || msg.ChatID != "T1" || msg.MessageID != "4" || msg.Content != "in a thread" || msg.Metadata["guild_id"] != "G1" {
+			t.Fatalf("unexpected guild message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mention was not published")
+	}
+	select {
+	case msg := <-b.Inbound:
+		if msg.ChatID != "D1" || len(msg.Attachments) != 1 || msg.Attachments[0].Kind != bus.AttachmentImage {
+			t.Fatalf("unexpected DM: %+v", msg)
+		}
+		data, _ := os.ReadFile(msg.Attachments[0].Path)
+		os.Remove(msg.Attachments[0].Path)
+		if string(data) != "image-bytes" {
+			t.Fatalf("attachment not downloaded: %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DM was not published")
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("filtered message was published: %+v", msg)
+	default:
+	}
+
+	// Heartbeats carry the last sequence number seen.
+	var hb discordGatewayPayload
+	for i := 0; i < 20; i++ {
+		hb = readGatewayOp(t, conn, discordOpHeartbeat)
+		if string(hb.D) == "6" {
+			break
+		}
+	}
+	if string(hb.D) != "6" {
+		t.Fatalf("heartbeat seq = %s, want 6", hb.D)
+	}
+}
+
+func TestDiscordChannel_ResumesAfterReconnect(t *testing.T) {
+	f := newFakeDiscord(t)
+	startTestDiscordChannel(t, f, nil)
+	conn := connectGateway(t, f)
+	dispatch(t, conn, 7, "MESSAGE_CREATE", map[string]any{"id": "1", "channel_id": "C1", "author": map[string]any{"id": "BOT"}})
+	conn.WriteJSON(map[string]any{"op": discordOpReconnect})
+
+	var next *websocket.Conn
+	select {
+	case next = <-f.sockets:
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel did not reconnect")
+	}
+	defer next.Close()
+	next.WriteJSON(map[string]any{"op": discordOpHello, "d": map[string]int{"heartbeat_interval": 1000}})
+	resume := readGatewayOp(t, next, discordOpResume)
+	var data struct {
+		SessionID string `json:"session_id"`
+		Seq       int64  `json:"seq"`
+	}
+	json.Unmarshal(resume.D, &data)
+	if data.SessionID != "S1" || data.Seq != 7 {
+		t.Fatalf("unexpected resume: %s", resume.D)
+	}
+}
+
+func TestDiscordChannel_SlashCommandRoundTrip(t *testing.T) {
+	f := newFakeDiscord(t)
+	ch, b := startTestDiscordChannel(t, f, []string{"U1"})
+	connectGateway(t, f)
+	f.waitFor(t, http.MethodPut, "commands", 1)
+
+	ch.handleInteraction(discordInteraction{ID: "I0", Type: 2, Token: "tok0", ChannelID: "C1", User: &discordUser{ID: "U2"}})
+	it := discordInteraction{ID: "I1", Type: 2, Token: "tok1", ChannelID: "C1", GuildID: "G1"}
+	it.Member = &struct {
+		User discordUser `json:"user"`
+	}{User: discordUser{ID: "U1"}}
+	it.Data.Name = "logs"
+	it.Data.Options = append(it.Data.Options, struct {
+		Value any `json:"value"`
+	}{Value: "50"})
+	ch.handleInteraction(it)
+
+	callbacks := f.callsMatching(http.MethodPost, "/callback")
+	if len(callbacks) != 2 || !strings.Contains(callbacks[0].body, `"type":4`) || !strings.Contains(callbacks[0].body, `"flags":64`) {
+		t.Fatalf("stranger should get an ephemeral refusal: %+v", callbacks)
+	}
+	if callbacks[1].path != "interactions/I1/tok1/callback" || !strings.Contains(callbacks[1].body, `"type":5`) {
+		t.Fatalf("command should be deferred: %+v", callbacks[1])
+	}
+	select {
+	case msg := <-b.Inbound:
+		if msg.Content != "/logs 50" || msg.ChatID != "C1" || msg.SenderID != "U1" || msg.MessageID != "I1" {
+			t.Fatalf("unexpected command message: %+v", msg)
+		}
+	default:
+		t.Fatal("command was not published")
+	}
+
+	// A second command in the same channel must not take the first one's reply.
+	ch.handleInteraction(discordInteraction{ID: "I2", Type: 2, Token: "tok2", ChannelID: "C1", User: &discordUser{ID: "U1"}, Data: it.Data})
+	<-b.Inbound
+
+	if err := ch.Send(bus.OutboundMessage{ChatID: "C1", ReplyTo: "I2", Content: "📋 second"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := ch.Send(bus.OutboundMessage{ChatID: "C1", ReplyTo: "I1", Content: "📋 logs"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := ch.Send(bus.OutboundMessage{ChatID: "C1", ReplyTo: "I1", Content: "later"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := ch.Send(bus.OutboundMessage{ChatID: "C1", Content: "unrelated"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	edits := f.callsMatching(http.MethodPatch, "webhooks/APP/tok1/messages/@original")
+	if len(edits) != 1 || !strings.Contains(edits[0].body, "📋 logs") {
+		t.Fatalf("reply should fill in its own deferred response: %+v", edits)
+	}
+	edits = f.callsMatching(http.MethodPatch, "webhooks/APP/tok2/messages/@original")
+	if len(edits) != 1 || !strings.Contains(edits[0].body, "📋 second") {
+		t.Fatalf("reply should fill in its own deferred response: %+v", edits)
+	}
+	posts := f.callsMatching(http.MethodPost, "channels/C1/messages")
+	if len(posts) != 2 || !strings.Contains(posts[0].body, "later") || !strings.Contains(posts[1].body, "unrelated") {
+		t.Fatalf("other replies should be normal messages: %+v", posts)
+	}
+	if strings.Contains(posts[0].body, "message_reference") {
+		t.Fatalf("an interaction ID is not a message to reply to: %s", posts[0].body)
+	}
+}
+
+func TestDiscordChannel_SendAttachmentsAsMultipart(t *testing.T) {
+	f := newFakeDiscord(t)
+	ch, _ := startTestDiscordChannel(t, f, nil)
+
+	path := filepath.Join(t.TempDir(), "chart.png")
+	os.WriteFile(path, []byte("png-data"), 0644)
+	err := ch.Send(bus.OutboundMessage{ChatID: "C1", ReplyTo: "9", Content: "see @everyone", Attachments: bus.PathAttachments(path)})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	posts := f.callsMatching(http.MethodPost, "channels/C1/messages")
+	if len(posts) != 1 || !strings.HasPrefix(posts[0].contentType, "multipart/form-data") {
+		t.Fatalf("expected one multipart post: %+v", posts)
+	}
+	for _, want := range []string{`name="payload_json"`, `"message_id":"9"`, `"parse":[]`, `name="files[0]"; filename="chart.png"`, "png-data"} {
+		if !strings.Contains(posts[0].body, want) {
+			t.Errorf("multipart body should contain %q", want)
+		}
+	}
+}
+
+func TestDiscordChannel_PreviewStreamEditsMessages(t *testing.T) {
+	f := newFakeDiscord(t)
+	ch, _ := startTestDiscordChannel(t, f, nil)
+	ch.stream.opts.editInterval = 0
+
+	if err := ch.Send(bus.OutboundMessage{Kind: bus.KindPreviewUpdate, ChatID: "C1", ReplyTo: "9", Content: "partial"}); err != nil {
+		t.Fatalf("preview update: %v", err)
+	}
+	final := strings.Repeat("word ", 500)
+	if err := ch.Send(bus.OutboundMessage{Kind: bus.KindPreviewFinal, ChatID: "C1", ReplyTo: "9", Content: final}); err != nil {
+		t.Fatalf("preview final: %v", err)
+	}
+
+	posts := f.callsMatching(http.MethodPost, "channels/C1/messages")
+	if len(posts) != 3 {
+		t.Fatalf("expected tool block, draft and overflow posts, got %d", len(posts))
+	}
+	if !strings.Contains(posts[1].body, `"message_id":"9"`) || strings.Contains(posts[2].body, "message_reference") {
+		t.Fatalf("only the draft should reply to the user: %+v", posts)
+	}
+	edits := f.callsMatching(http.MethodPatch, "channels/C1/messages/m2")
+	if len(edits) != 2 || !strings.Contains(edits[1].body, "word word") {
+		t.Fatalf("final should replace the draft: %+v", edits)
+	}
+	var payload struct {
+		Content string `json:"content"`
+	}
+	json.Unmarshal([]byte(edits[1].body), &payload)
+	if n := len([]rune(payload.Content)); n > discordMaxMessageLen {
+		t.Fatalf("draft edit is %d runes, limit %d", n, discordMaxMessageLen)
+	}
+	if deletes := f.callsMatching(http.MethodDelete, "channels/C1/messages/m1"); len(deletes) != 1 {
+		t.Fatalf("unused tool block should be deleted: %+v", deletes)
+	}
+}
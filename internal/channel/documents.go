@@ -0,0 +1,122 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxDocumentTextBytes bounds the text of one document inlined into a
+// prompt; longer text is cut and marked as truncated.
+const maxDocumentTextBytes = 64 << 10
+
+// textDocumentExts are extensions read as plain text whatever their MIME
+// type, which clients often report as application/octet-stream.
+var textDocumentExts = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".log": true,
+	".csv": true, ".tsv": true, ".json": true, ".jsonl": true, ".yaml": true, ".yml": true,
+	".toml": true, ".ini": true, ".conf": true, ".env": true, ".xml": true, ".html": true, ".htm": true,
+	".css": true, ".sql": true, ".sh": true, ".bash": true, ".zsh": true, ".ps1": true,
+	".go": true, ".py": true, ".js": true, ".jsx": true, ".ts": true, ".tsx": true, ".java": true,
+	".kt": true, ".swift": true, ".c": true, ".h": true, ".cc": true, ".cpp": true, ".hpp": true,
+	".cs": true, ".rs": true, ".rb": true, ".php": true, ".lua": true, ".dart": true, ".scala": true,
+	".vue": true, ".svelte": true, ".proto": true, ".gradle": true, ".mod": true, ".sum": true,
+}
+
+func isTextDocument(name, mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	switch {
+	case strings.HasPrefix(mimeType, "text/"):
+		return true
+	case mimeType == "application/json", mimeType == "application/xml", mimeType == "application/x-yaml",
+		mimeType == "application/javascript", mimeType == "application/x-sh", mimeType == "application/sql":
+		return true
+	}
+	return textDocumentExts[strings.ToLower(filepath.Ext(name))]
+}
+
+func isPDFDocument(name, mimeType string) bool {
+	return strings.EqualFold(strings.TrimSpace(mimeType), "application/pdf") || strings.EqualFold(filepath.Ext(name), ".pdf")
+}
+
+// documentText returns the readable text of a document: text files as they
+// are, PDFs through pdftotext. It returns "" for other documents and for
+// files that turn out not to be UTF-8 text.
+func documentText(path, name, mimeType string) (string, error) {
+	var data []byte
+	switch {
+	case isPDFDocument(name, mimeType):
+		text, err := pdfText(path)
+		if err != nil {
+			return "", err
+		}
+		data = []byte(text)
+	case isTextDocument(name, mimeType):
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		// One extra byte tells whether the file was cut.
+		if data, err = io.ReadAll(io.LimitReader(f, maxDocumentTextBytes+1)); err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+
+	truncated := len(data) > maxDocumentTextBytes
+	if truncated {
+		data = data[:maxDocumentTextBytes]
+		// Drop a rune cut in half.
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return "", nil
+	}
+	text := strings.TrimSpace(string(data))
+	if text != "" && truncated {
+		text += "\n[... truncated]"
+	}
+	return text, nil
+}
+
+func pdfText(path string) (string, error) {
+	pdftotextPath, err := resolveLocalOrSystemBinary("pdftotext")
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftotextPath, "-layout", "-enc", "UTF-8", path, "-")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("pdftotext failed: %v output=%s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// appendDocument adds a document's text to a message, tagged with its name
+// and local path so the agent can also open the file itself. Documents
+// without text are only named.
+func appendDocument(content, name, path, text string) string {
+	block := fmt.Sprintf("<document name=%q path=%q />", name, path)
+	if text != "" {
+		block = fmt.Sprintf("<document name=%q path=%q>\n%s\n</document>", name, path, text)
+	}
+	if strings.TrimSpace(content) == "" {
+		return block
+	}
+	return content + "\n\n" + block
+}
@@ -0,0 +1,33 @@
+package channel
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDocumentText(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, data, 0644)
+		return path
+	}
+
+	if text, err := documentText(write("notes.md", []byte("  # Notes\n")), "notes.md", ""); err != nil || text != "# Notes" {
+		t.Fatalf("markdown: %q, %v", text, err)
+	}
+	if text, _ := documentText(write("data.bin", []byte("a\x00b")), "data.csv", "text/csv"); text != "" {
+		t.Fatalf("binary file read as text: %q", text)
+	}
+	if text, _ := documentText(write("app.zip", []byte("PK")), "app.zip", "application/zip"); text != "" {
+		t.Fatalf("zip read as text: %q", text)
+	}
+
+	long := strings.Repeat("é", maxDocumentTextBytes) // two bytes each
+	text, err := documentText(write("long.txt", []byte(long)), "long.txt", "text/plain")
+	if err != nil || !strings.HasSuffix(text, "\n[... truncated]") || len(text) > maxDocumentTextBytes+20 {
+		t.Fatalf("long text: %d bytes, %v", len(text), err)
+	}
+}
@@ -0,0 +1,843 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const emailChannelName = "email"
+
+const (
+	emailDefaultMailbox     = "INBOX"
+	emailReconnectInitial   = time.Second
+	emailReconnectMax       = time.Minute
+	emailThreadCacheEntries = 2048
+	emailSecurityNone       = "none"
+)
+
+// EmailClient is the mail transport the channel uses.
+type EmailClient interface {
+	// Watch passes every unseen mail in the mailbox to handle as raw RFC 5322
+	// bytes and marks it seen, then waits for new mail with IMAP IDLE. It
+	// returns when ctx is done or the connection fails.
+	Watch(ctx context.Context, handle func(raw []byte)) error
+	// SendMail submits raw over SMTP.
+	SendMail(ctx context.Context, from string, to []string, raw []byte) error
+}
+
+type EmailClientFactory func(cfg config.EmailConfig) EmailClient
+
+type emailSMTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *emailSMTPError) Error() string {
+	return fmt.Sprintf("email smtp: %d %s", e.Code, e.Message)
+}
+
+// IsRetryable reports transient (4xx) SMTP replies.
+func (e *emailSMTPError) IsRetryable() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+type defaultEmailClient struct {
+	cfg config.EmailConfig
+}
+
+func newDefaultEmailClient(cfg config.EmailConfig) EmailClient {
+	return &defaultEmailClient{cfg: cfg}
+}
+
+// implicitTLS reports whether addr is a TLS-wrapped port (IMAPS, SMTPS).
+func (c *defaultEmailClient) implicitTLS(addr string) bool {
+	_, port, _ := net.SplitHostPort(addr)
+	return port == "993" || port == "465"
+}
+
+func (c *defaultEmailClient) tlsConfig(addr string) *tls.Config {
+	host, _, _ := net.SplitHostPort(addr)
+	return &tls.Config{ServerName: host}
+}
+
+func (c *defaultEmailClient) dialIMAP() (*imapclient.Client, error) {
+	addr := c.cfg.IMAPAddr
+	switch {
+	case strings.EqualFold(c.cfg.Security, emailSecurityNone):
+		return imapclient.Dial(addr)
+	case c.implicitTLS(addr):
+		return imapclient.DialTLS(addr, c.tlsConfig(addr))
+	}
+	cl, err := imapclient.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := cl.StartTLS(c.tlsConfig(addr)); err != nil {
+		cl.Logout()
+		return nil, fmt.Errorf("imap starttls: %w", err)
+	}
+	return cl, nil
+}
+
+func (c *defaultEmailClient) Watch(ctx context.Context, handle func(raw []byte)) error {
+	cl, err := c.dialIMAP()
+	if err != nil {
+		return err
+	}
+	defer cl.Logout()
+	updates := make(chan imapclient.Update, 64)
+	cl.Updates = updates
+	if err := cl.Login(c.cfg.Username, c.cfg.Password); err != nil {
+		return fmt.Errorf("imap login: %w", err)
+	}
+	mailbox := c.cfg.Mailbox
+	if mailbox == "" {
+		mailbox = emailDefaultMailbox
+	}
+	if _, err := cl.Select(mailbox, false); err != nil {
+		return fmt.Errorf("imap select %s: %w", mailbox, err)
+	}
+
+	for {
+		if err := c.fetchUnseen(cl, handle); err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- cl.Idle(stop, nil)
+		}()
+		newMail := false
+		for !newMail {
+			select {
+			case <-ctx.Done():
+				close(stop)
+				<-done
+				return ctx.Err()
+			case err := <-done:
+				if err == nil {
+					err = errors.New("imap idle ended")
+				}
+				return err
+			case update := <-updates:
+				_, newMail = update.(*imapclient.MailboxUpdate)
+			}
+		}
+		close(stop)
+		if err := <-done; err != nil {
+			return err
+		}
+	}
+}
+
+func (c *defaultEmailClient) fetchUnseen(cl *imapclient.Client, handle func(raw []byte)) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := cl.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("imap search: %w", err)
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, len(uids))
+	if err := cl.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages); err != nil {
+		return fmt.Errorf("imap fetch: %w", err)
+	}
+	for msg := range messages {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		handle(raw)
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := cl.UidStore(seqset, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+		return fmt.Errorf("imap store: %w", err)
+	}
+	return nil
+}
+
+func (c *defaultEmailClient) SendMail(ctx context.Context, from string, to []string, raw []byte) error {
+	addr := c.cfg.SMTPAddr
+	var (
+		cl  *smtp.Client
+		err error
+	)
+	switch {
+	case strings.EqualFold(c.cfg.Security, emailSecurityNone):
+		cl, err = smtp.Dial(addr)
+	case c.implicitTLS(addr):
+		cl, err = smtp.DialTLS(addr, c.tlsConfig(addr))
+	default:
+		cl, err = smtp.Dial(addr)
+		if err == nil {
+			if err = cl.StartTLS(c.tlsConfig(addr)); err != nil {
+				cl.Close()
+				err = fmt.Errorf("smtp starttls: %w", err)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		cl.CommandTimeout = time.Until(deadline)
+	}
+
+	if ok, _ := cl.Extension("AUTH"); ok && c.cfg.Username != "" {
+		if err := cl.Auth(sasl.NewPlainClient("", c.cfg.Username, c.cfg.Password)); err != nil {
+			return smtpError(err)
+		}
+	}
+	if err := cl.Mail(from, nil); err != nil {
+		return smtpError(err)
+	}
+	for _, rcpt := range to {
+		if err := cl.Rcpt(rcpt); err != nil {
+			return smtpError(err)
+		}
+	}
+	w, err := cl.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return cl.Quit()
+}
+
+// smtpError turns SMTP replies into emailSMTPError so that transient ones
+// are retried.
+func smtpError(err error) error {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return &emailSMTPError{Code: smtpErr.Code, Message: smtpErr.Message}
+	}
+	return err
+}
+
+// emailThread is what a reply to a conversation needs: the peer, the
+// subject and the References chain.
+type emailThread struct {
+	peer       string
+	subject    string
+	lastID     string
+	references []string
+}
+
+// emailSavedThread is an emailThread as saved to disk.
+type emailSavedThread struct {
+	Chat       string   `json:"chat"`
+	Peer       string   `json:"peer"`
+	Subject    string   `json:"subject,omitempty"`
+	LastID     string   `json:"lastId"`
+	References []string `json:"references,omitempty"`
+}
+
+// emailThreads remembers the threads replies go to, by chat ID. They are
+// saved to path, if set, so that replies, journal replay and announcements
+// reach a thread after a restart.
+type emailThreads struct {
+	path    string
+	mu      sync.Mutex
+	threads map[string]*emailThread
+	order   []string
+}
+
+func newEmailThreads(path string) (*emailThreads, error) {
+	t := &emailThreads{path: path, threads: make(map[string]*emailThread)}
+	if path == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var saved []emailSavedThread
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse email threads: %w", err)
+	}
+	for _, s := range saved {
+		if _, ok := t.threads[s.Chat]; !ok {
+			t.order = append(t.order, s.Chat)
+		}
+		t.threads[s.Chat] = &emailThread{peer: s.Peer, subject: s.Subject, lastID: s.LastID, references: s.References}
+	}
+	return t, nil
+}
+
+// remember records the latest mail of a chat. The peer of a known chat is
+// kept: a chat belongs to the sender who started it.
+func (t *emailThreads) remember(chatID string, thread emailThread) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.threads[chatID]; ok {
+		thread.peer = prev.peer
+	} else {
+		t.order = append(t.order, chatID)
+	}
+	t.threads[chatID] = &thread
+	for len(t.order) > emailThreadCacheEntries {
+		delete(t.threads, t.order[0])
+		t.order = t.order[1:]
+	}
+	return t.saveLocked()
+}
+
+func (t *emailThreads) get(chatID string) (emailThread, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	thread, ok := t.threads[chatID]
+	if !ok {
+		return emailThread{}, false
+	}
+	out := *thread
+	out.references = append([]string(nil), thread.references...)
+	return out, true
+}
+
+// sent appends our own reply to the thread so later replies chain to it.
+func (t *emailThreads) sent(chatID, messageID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	thread, ok := t.threads[chatID]
+	if !ok {
+		return nil
+	}
+	thread.lastID = messageID
+	thread.references = append(thread.references, messageID)
+	return t.saveLocked()
+}
+
+func (t *emailThreads) saveLocked() error {
+	if t.path == "" {
+		return nil
+	}
+	saved := make([]emailSavedThread, 0, len(t.order))
+	for _, chatID := range t.order {
+		thread := t.threads[chatID]
+		saved = append(saved, emailSavedThread{
+			Chat:       chatID,
+			Peer:       thread.peer,
+			Subject:    thread.subject,
+			LastID:     thread.lastID,
+			References: thread.references,
+		})
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0600)
+}
+
+func emailThreadsPath() string {
+	return filepath.Join(config.ConfigDir(), "data", "email", "threads.json")
+}
+
+// emailChatID is the chat of a thread. It is scoped by sender, so that a
+// mail referencing another sender's thread starts a chat of its own.
+func emailChatID(sender, root string) string {
+	return sender + ":" + root
+}
+
+// emailThreadRoot is the conversation a mail belongs to: the first entry of
+// References, else In-Reply-To, else the mail itself.
+func emailThreadRoot(messageID string, references, inReplyTo []string) string {
+	if len(references) > 0 {
+		return references[0]
+	}
+	if len(inReplyTo) > 0 {
+		return inReplyTo[0]
+	}
+	return messageID
+}
+
+// EmailChannel watches a mailbox over IMAP IDLE and replies over SMTP. Each
+// mail thread of a sender is a chat, identified by the sender and the
+// thread's root Message-ID.
+type EmailChannel struct {
+	BaseChannel
+	cfg           config.EmailConfig
+	client        EmailClient
+	clientFactory EmailClientFactory
+	cancel        context.CancelFunc
+	address       string
+	markdown      goldmark.Markdown
+	threads       *emailThreads
+}
+
+var defaultEmailClientFactory EmailClientFactory = func(cfg config.EmailConfig) EmailClient {
+	return newDefaultEmailClient(cfg)
+}
+
+func NewEmailChannel(cfg config.EmailConfig, b *bus.MessageBus, logger sdklogger.Logger) (*EmailChannel, error) {
+	return NewEmailChannelWithFactory(cfg, b, defaultEmailClientFactory, logger)
+}
+
+// NewEmailChannelWithFactory creates a EmailChannel with a custom client factory (for testing).
+func NewEmailChannelWithFactory(cfg config.EmailConfig, b *bus.MessageBus, factory EmailClientFactory, logger sdklogger.Logger) (*EmailChannel, error) {
+	if strings.TrimSpace(cfg.IMAPAddr) == "" || strings.TrimSpace(cfg.SMTPAddr) == "" {
+		return nil, fmt.Errorf("email imapAddr and smtpAddr are required")
+	}
+	if strings.TrimSpace(cfg.Username) == "" || cfg.Password == "" {
+		return nil, fmt.Errorf("email username and password are required")
+	}
+	address := strings.TrimSpace(cfg.Address)
+	if address == "" {
+		address = strings.TrimSpace(cfg.Username)
+	}
+	if !strings.Contains(address, "@") {
+		return nil, fmt.Errorf("email address is required when username is not an address")
+	}
+	// Without it any Authentication-Results header, which senders can forge,
+	// would be trusted.
+	if strings.TrimSpace(cfg.AuthServID) == "" {
+		return nil, fmt.Errorf("email authServId is required")
+	}
+	if factory == nil {
+		factory = defaultEmailClientFactory
+	}
+	// Addresses are compared case-insensitively.
+	allowFrom := make([]string, 0, len(cfg.AllowFrom))
+	for _, addr := range cfg.AllowFrom {
+		if addr = strings.ToLower(strings.TrimSpace(addr)); addr != "" {
+			allowFrom = append(allowFrom, addr)
+		}
+	}
+	// Anyone can mail the mailbox, so it is never open to everyone.
+	if len(allowFrom) == 0 {
+		return nil, fmt.Errorf("email allowFrom is required")
+	}
+	threads, err := newEmailThreads(emailThreadsPath())
+	if err != nil {
+		return nil, err
+	}
+	return &EmailChannel{
+		BaseChannel:   NewBaseChannel(emailChannelName, b, allowFrom, logger),
+		cfg:           cfg,
+		clientFactory: factory,
+		address:       strings.ToLower(address),
+		markdown:      goldmark.New(goldmark.WithExtensions(extension.GFM)),
+		threads:       threads,
+	}, nil
+}
+
+func (e *EmailChannel) Start(ctx context.Context) error {
+	ctx, e.cancel = context.WithCancel(ctx)
+	e.client = e.clientFactory(e.cfg)
+	go e.watch(ctx)
+	e.logger.Infof("[email] watching %s as %s", e.cfg.IMAPAddr, e.address)
+	return nil
+}
+
+func (e *EmailChannel) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.logger.Infof("[email] stopped")
+	return nil
+}
+
+// watch keeps an IMAP connection open, reconnecting with backoff. A watch
+// that lasted longer than the maximum backoff resets it.
+func (e *EmailChannel) watch(ctx context.Context) {
+	backoff := emailReconnectInitial
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := e.client.Watch(ctx, e.handleMail)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > emailReconnectMax {
+			backoff = emailReconnectInitial
+		}
+		e.logger.Warnf("[email] imap connection lost: %v (reconnect in %s)", err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > emailReconnectMax {
+			backoff = emailReconnectMax
+		}
+	}
+}
+
+// Capabilities reports HTML mail with attachments. Sent mail cannot be
+// edited, so turns are not streamed.
+func (e *EmailChannel) Capabilities() Capabilities {
+	return Capabilities{
+		Markdown: MarkdownFull,
+		Media:    []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+	}
+}
+
+func (e *EmailChannel) handleMail(raw []byte) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		e.logger.Warnf("[email] unreadable mail skipped: %v", err)
+		return
+	}
+	defer mr.Close()
+	header := mr.Header
+
+	from, _ := header.AddressList("From")
+	if len(from) == 0 {
+		e.logger.Debugf("[email] mail without sender skipped")
+		return
+	}
+	sender := strings.ToLower(from[0].Address)
+	if sender == e.address {
+		return
+	}
+	if isAutoGeneratedMail(header) {
+		e.logger.Debugf("[email] automatic mail from %s ignored", sender)
+		return
+	}
+	if !e.IsAllowed(sender) {
+		e.logger.Warnf("[email] message from unauthorized sender: %s", sender)
+		return
+	}
+	// From is written by the sender; only trust it when the receiving
+	// server verified it.
+	if !emailSenderVerified(header.Values("Authentication-Results"), sender[strings.LastIndex(sender, "@")+1:], e.cfg.AuthServID) {
+		e.logger.Warnf("[email] message from %s failed DKIM/DMARC verification, skipped", sender)
+		return
+	}
+
+	messageID, _ := header.MessageID()
+	if messageID == "" {
+		messageID = fmt.Sprintf("%d.%s", time.Now().UnixNano(), e.address)
+	}
+	references, _ := header.MsgIDList("References")
+	inReplyTo, _ := header.MsgIDList("In-Reply-To")
+	root := emailThreadRoot(messageID, references, inReplyTo)
+	chatID := emailChatID(sender, root)
+	subject, _ := header.Subject()
+	timestamp, err := header.Date()
+	if err != nil || timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	if len(references) == 0 && len(inReplyTo) > 0 {
+		references = inReplyTo
+	}
+	// Replies go to the verified sender, never to Reply-To.
+	if err := e.threads.remember(chatID, emailThread{
+		peer:       sender,
+		subject:    subject,
+		lastID:     messageID,
+		references: append(references, messageID),
+	}); err != nil {
+		e.logger.Warnf("[email] save threads: %v", err)
+	}
+
+	body, attachments := e.readParts(mr)
+	content := stripEmailQuote(body)
+	if root == messageID && strings.TrimSpace(subject) != "" {
+		// The subject often carries the request of a new thread.
+		content = strings.TrimSpace(subject + "\n\n" + content)
+	}
+	if content == "" && len(attachments) == 0 {
+		return
+	}
+
+	if !e.bus.PublishInbound(bus.InboundMessage{
+		Channel:     emailChannelName,
+		SenderID:    sender,
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Content:     content,
+		Timestamp:   timestamp,
+		Attachments: attachments,
+		Direct:      true,
+		Metadata:    map[string]any{"subject": subject},
+	}) {
+		e.logger.Debugf("[email] duplicate message dropped: %s", messageID)
+	}
+}
+
+// readParts returns the text body, preferring text/plain over HTML, and
+// saves attachments and inline images.
+func (e *EmailChannel) readParts(mr *mail.Reader) (string, []bus.Attachment) {
+	var plain, htmlBody string
+	var attachments []bus.Attachment
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			e.logger.Warnf("[email] read mail part: %v", err)
+			break
+		}
+		var name, contentType string
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ = h.ContentType()
+			if contentType == "text/plain" || contentType == "text/html" {
+				data, err := io.ReadAll(part.Body)
+				if err != nil {
+					e.logger.Warnf("[email] read mail body: %v", err)
+					continue
+				}
+				if contentType == "text/plain" && plain == "" {
+					plain = string(data)
+				} else if contentType == "text/html" && htmlBody == "" {
+					htmlBody = string(data)
+				}
+				continue
+			}
+			if !strings.HasPrefix(contentType, "image/") {
+				continue
+			}
+			name = "image"
+			if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+				name += exts[0]
+			}
+		case *mail.AttachmentHeader:
+			contentType, _, _ = h.ContentType()
+			name, _ = h.Filename()
+			if name == "" {
+				name = "attachment"
+			}
+		default:
+			continue
+		}
+		att, err := e.saveAttachment(part.Body, name, contentType)
+		if err != nil {
+			e.logger.Warnf("[email] save attachment %s: %v", name, err)
+			continue
+		}
+		attachments = append(attachments, att)
+	}
+	if strings.TrimSpace(plain) == "" {
+		plain = htmlToText(htmlBody)
+	}
+	return plain, attachments
+}
+
+func (e *EmailChannel) saveAttachment(r io.Reader, name, contentType string) (bus.Attachment, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return bus.Attachment{}, err
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-email-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return bus.Attachment{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(name)))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return bus.Attachment{}, fmt.Errorf("save file: %w", err)
+	}
+	return bus.Attachment{
+		Path: localPath,
+		Kind: attachmentKindOf(name, contentType),
+		MIME: contentType,
+		Size: int64(len(data)),
+	}, nil
+}
+
+func (e *EmailChannel) Send(msg bus.OutboundMessage) error {
+	if msg.Kind.Ephemeral() {
+		// Notices would each become a separate mail.
+		return nil
+	}
+	if e.client == nil {
+		return fmt.Errorf("email client not initialized")
+	}
+	thread, ok := e.threads.get(strings.TrimSpace(msg.ChatID))
+	if !ok {
+		return fmt.Errorf("email thread %q unknown, cannot address reply", msg.ChatID)
+	}
+	raw, messageID, err := e.composeReply(thread, msg)
+	if err != nil {
+		return err
+	}
+	if err := e.client.SendMail(context.Background(), e.address, []string{thread.peer}, raw); err != nil {
+		return err
+	}
+	if err := e.threads.sent(msg.ChatID, messageID); err != nil {
+		e.logger.Warnf("[email] save threads: %v", err)
+	}
+	return nil
+}
+
+// composeReply builds a threaded reply with a text/plain and text/html
+// alternative followed by the attachments.
+func (e *EmailChannel) composeReply(thread emailThread, msg bus.OutboundMessage) ([]byte, string, error) {
+	var header mail.Header
+	header.SetDate(time.Now())
+	header.SetAddressList("From", []*mail.Address{{Address: e.address}})
+	header.SetAddressList("To", []*mail.Address{{Address: thread.peer}})
+	header.SetSubject(replySubject(thread.subject))
+	if err := header.GenerateMessageIDWithHostname(e.address[strings.LastIndex(e.address, "@")+1:]); err != nil {
+		return nil, "", err
+	}
+	messageID, _ := header.MessageID()
+	inReplyTo := msg.ReplyTo
+	if inReplyTo == "" {
+		inReplyTo = thread.lastID
+	}
+	header.SetMsgIDList("In-Reply-To", []string{inReplyTo})
+	header.SetMsgIDList("References", thread.references)
+	// Tells other responders not to answer automatically (RFC 3834).
+	header.Set("Auto-Submitted", "auto-replied")
+
+	var buf bytes.Buffer
+	mw, err := mail.CreateWriter(&buf, header)
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.TrimSpace(msg.Content) != "" {
+		var htmlBody bytes.Buffer
+		if err := e.markdown.Convert([]byte(msg.Content), &htmlBody); err != nil {
+			return nil, "", fmt.Errorf("render markdown: %w", err)
+		}
+		iw, err := mw.CreateInline()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, alt := range []struct{ contentType, body string }{
+			{"text/plain", msg.Content},
+			{"text/html", htmlBody.String()},
+		} {
+			var h mail.InlineHeader
+			h.SetContentType(alt.contentType, map[string]string{"charset": "utf-8"})
+			w, err := iw.CreatePart(h)
+			if err != nil {
+				return nil, "", err
+			}
+			io.WriteString(w, alt.body)
+			w.Close()
+		}
+		if err := iw.Close(); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, att := range msg.Attachments {
+		data, err := os.ReadFile(att.Path)
+		if err != nil {
+			return nil, "", fmt.Errorf("read attachment: %w", err)
+		}
+		mimeType := att.MIME
+		if mimeType == "" {
+			mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(att.Path)))
+		}
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		var h mail.AttachmentHeader
+		h.SetContentType(mimeType, nil)
+		h.SetFilename(filepath.Base(att.Path))
+		w, err := mw.CreateAttachment(h)
+		if err != nil {
+			return nil, "", err
+		}
+		w.Write(data)
+		w.Close()
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), messageID, nil
+}
+
+func replySubject(subject string) string {
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return "Re: (no subject)"
+	}
+	if len(subject) >= 3 && strings.EqualFold(subject[:3], "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// isAutoGeneratedMail reports bounces, vacation replies and bulk mail,
+// which must not be answered to avoid mail loops.
+func isAutoGeneratedMail(h mail.Header) bool {
+	if v := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	return false
+}
+
+var (
+	emailQuoteHeader = regexp.MustCompile(`(?m)^(On .+wrote:|在.+写道[:：]|-+ ?Original Message ?-+|-+ ?原始邮件 ?-+)\s*$`)
+	htmlBreakTags    = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</h[1-6]>`)
+	htmlTags         = regexp.MustCompile(`(?s)<style.*?</style>|<script.*?</script>|<[^>]+>`)
+)
+
+// stripEmailQuote drops the quoted earlier mail that clients append below
+// a reply.
+func stripEmailQuote(body string) string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	if loc := emailQuoteHeader.FindStringIndex(body); loc != nil {
+		body = body[:loc[0]]
+	}
+	lines := strings.Split(strings.TrimRight(body, "\n "), "\n")
+	for len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), ">") {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func htmlToText(s string) string {
+	s = htmlBreakTags.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
@@ -0,0 +1,97 @@
+package channel
+
+import (
+	"strings"
+)
+
+// emailAuthResult is one method result of an Authentication-Results header
+// (RFC 8601), e.g. "dkim=pass header.d=example.org".
+type emailAuthResult struct {
+	method string
+	result string
+	props  map[string]string
+}
+
+// parseEmailAuthResults splits an Authentication-Results value into the
+// authserv-id of the server that added it and its method results.
+func parseEmailAuthResults(value string) (string, []emailAuthResult) {
+	// Comments carry nothing the check needs.
+	var b strings.Builder
+	depth := 0
+	for _, r := range value {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	parts := strings.Split(b.String(), ";")
+	id := ""
+	if fields := strings.Fields(parts[0]); len(fields) > 0 {
+		id = strings.ToLower(fields[0])
+	}
+	var results []emailAuthResult
+	for _, part := range parts[1:] {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		method, result, ok := strings.Cut(strings.ToLower(fields[0]), "=")
+		if !ok {
+			continue
+		}
+		method, _, _ = strings.Cut(method, "/")
+		res := emailAuthResult{method: method, result: result, props: make(map[string]string)}
+		for _, field := range fields[1:] {
+			if k, v, ok := strings.Cut(field, "="); ok {
+				res.props[strings.ToLower(k)] = strings.ToLower(strings.Trim(v, `"`))
+			}
+		}
+		results = append(results, res)
+	}
+	return id, results
+}
+
+// emailSenderVerified reports whether the Authentication-Results headers
+// (topmost first) show a DMARC pass for domain, or a DKIM pass by domain or
+// one of its subdomains. Only the headers of authServID are trusted: any
+// other, including the topmost, may have been written by the sender.
+func emailSenderVerified(headers []string, domain, authServID string) bool {
+	domain = strings.ToLower(domain)
+	authServID = strings.ToLower(strings.TrimSpace(authServID))
+	if authServID == "" {
+		return false
+	}
+	for _, value := range headers {
+		id, results := parseEmailAuthResults(value)
+		if id != authServID {
+			continue
+		}
+		for _, res := range results {
+			if res.result != "pass" {
+				continue
+			}
+			switch res.method {
+			case "dmarc":
+				if res.props["header.from"] == domain {
+					return true
+				}
+			case "dkim":
+				signer := res.props["header.d"]
+				if signer == "" {
+					if _, host, ok := strings.Cut(res.props["header.i"], "@"); ok {
+						signer = host
+					}
+				}
+				if signer != "" && (signer == domain || strings.HasSuffix(signer, "."+domain)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
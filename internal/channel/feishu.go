@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +44,12 @@ type feishuAdvancedClient interface {
 	UploadFile(ctx context.Context, fileName string, data []byte) (string, error)
 	UploadAudio(ctx context.Context, fileName string, data []byte, durationMillis int) (string, error)
 	DownloadResource(ctx context.Context, messageID, fileKey, resourceType string) ([]byte, string, error)
+	// GetMessage returns a message; for a merged forward, followed by the
+	// messages it contains.
+	GetMessage(ctx context.Context, messageID string) ([]feishuMessageItem, error)
+	// BotOpenID returns the open_id of the app's bot, which is how
+	// mentions of the bot are recognised.
+	BotOpenID(ctx context.Context) (string, error)
 }
 
 type feishuWSClient interface {
@@ -310,10 +317,58 @@ func (c *defaultFeishuClient) DownloadResource(ctx context.Context, messageID, f
 	return data, strings.TrimSpace(resp.Header.Get("Content-Type")), nil
 }
 
+func (c *defaultFeishuClient) GetMessage(ctx context.Context, messageID string) ([]feishuMessageItem, error) {
+	token, err := c.GetTenantAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.doJSON(ctx, token, http.MethodGet,
+		fmt.Sprintf("https://open.feishu.cn/open-apis/im/v1/messages/%s", strings.TrimSpace(messageID)),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Items []feishuMessageItem `json:"items"`
+	}
+	if err := json.Unmarshal(out.Data, &data); err != nil {
+		return nil, fmt.Errorf("decode message: %w", err)
+	}
+	return data.Items, nil
+}
+
+func (c *defaultFeishuClient) BotOpenID(ctx context.Context) (string, error) {
+	token, err := c.GetTenantAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	out, err := c.doJSON(ctx, token, http.MethodGet, "https://open.feishu.cn/open-apis/bot/v3/info", nil)
+	if err != nil {
+		return "", err
+	}
+	if out.Bot.OpenID == "" {
+		return "", fmt.Errorf("empty open_id in bot info")
+	}
+	return out.Bot.OpenID, nil
+}
+
 type feishuJSONResponse struct {
 	Code int             `json:"code"`
 	Msg  string          `json:"msg"`
 	Data json.RawMessage `json:"data"`
+	Bot  struct {
+		OpenID string `json:"open_id"`
+	} `json:"bot"` // bot info only
+}
+
+// feishuMessageItem is a message as the message API returns it.
+type feishuMessageItem struct {
+	MessageID      string `json:"message_id"`
+	MsgType        string `json:"msg_type"`
+	UpperMessageID string `json:"upper_message_id"` // the merged forward holding this message
+	Body           struct {
+		Content string `json:"content"`
+	} `json:"body"`
 }
 
 func (c *defaultFeishuClient) doJSON(ctx context.Context, token, method, endpoint string, body []byte) (*feishuJSONResponse, error) {
@@ -401,25 +456,14 @@ var defaultFeishuClientFactory FeishuClientFactory = func(appID, appSecret strin
 
 func defaultFeishuWSFactory(appID, appSecret string, onEvent func(context.Context, *larkevent.EventReq) error) (feishuWSClient, error) {
 	handler := larkdispatcher.NewEventDispatcher("", "").
-		OnCustomizedEvent("im.message.receive_v1", onEvent)
+		OnCustomizedEvent("im.message.receive_v1", onEvent).
+		OnCustomizedEvent("card.action.trigger", onEvent)
 	client := larkws.NewClient(appID, appSecret,
 		larkws.WithEventHandler(handler),
 		larkws.WithLogLevel(larkcore.LogLevelInfo))
 	return client, nil
 }
 
-type feishuPreviewState struct {
-	draftMessageID   string
-	toolMessageID    string
-	replyToMessageID string
-	lastDraftText    string
-	lastEditAt       time.Time
-	toolBlockIndex   int
-	toolEntries      []toolEntry
-	hadToolProgress  bool
-	finalized        bool
-}
-
 type FeishuChannel struct {
 	BaseChannel
 	cfg           config.FeishuConfig
@@ -428,9 +472,39 @@ type FeishuChannel struct {
 	cancel        context.CancelFunc
 	clientFactory FeishuClientFactory
 	wsFactory     FeishuWSFactory
+	stream        *streamRenderer
+	buttons       buttonRegistry
+
+	cardMu   sync.Mutex
+	lastCard map[string]feishuCard // last text card per chat, where buttons go
+	p2pChats map[string]bool       // chats seen as one-to-one, for card presses
+
+	botMu     sync.Mutex
+	botOpenID string
+}
+
+// feishuMessage is the message of an im.message.receive_v1 event.
+type feishuMessage struct {
+	MessageID   string          `json:"message_id"`
+	ChatID      string          `json:"chat_id"`
+	ChatType    string          `json:"chat_type"` // p2p or group
+	MessageType string          `json:"message_type"`
+	Content     string          `json:"content"`
+	Mentions    []feishuMention `json:"mentions"`
+}
+
+type feishuMention struct {
+	Key string `json:"key"` // placeholder in the text, e.g. @_user_1
+	ID  struct {
+		OpenID string `json:"open_id"`
+	} `json:"id"`
+	Name string `json:"name"`
+}
 
-	previewMu  sync.Mutex
-	previewMsg map[string]feishuPreviewState
+// feishuCard is a sent markdown card, kept so it can be redrawn with buttons.
+type feishuCard struct {
+	id   string
+	text string
 }
 
 func NewFeishuChannel(cfg config.FeishuConfig, b *bus.MessageBus, logger sdklogger.Logger) (*FeishuChannel, error) {
@@ -446,8 +520,14 @@ func NewFeishuChannelWithFactory(cfg config.FeishuConfig, b *bus.MessageBus, fac
 		cfg:           cfg,
 		clientFactory: factory,
 		wsFactory:     defaultFeishuWSFactory,
-		previewMsg:    make(map[string]feishuPreviewState),
-	}
+		lastCard:      make(map[string]feishuCard),
+		p2pChats:      make(map[string]bool),
+	}
+	ch.stream = newStreamingRenderer(ch, streamOptions{
+		name:            feishuChannelName,
+		editInterval:    defaultStreamEditInterval,
+		formatToolBlock: formatFeishuToolBlock,
+	}, logger)
 	return ch, nil
 }
 
@@ -491,40 +571,81 @@ func (f *FeishuChannel) processEventReq(ctx context.Context, req *larkevent.Even
 					OpenID string `json:"open_id"`
 				} `json:"sender_id"`
 			} `json:"sender"`
-			Message struct {
-				MessageID   string `json:"message_id"`
-				ChatID      string `json:"chat_id"`
-				MessageType string `json:"message_type"`
-				Content     string `json:"content"`
-			} `json:"message"`
+			Message  feishuMessage `json:"message"`
+			Operator struct {
+				OpenID string `json:"open_id"`
+			} `json:"operator"`
+			Action struct {
+				Value map[string]any `json:"value"`
+			} `json:"action"`
+			Context struct {
+				OpenMessageID string `json:"open_message_id"`
+				OpenChatID    string `json:"open_chat_id"`
+			} `json:"context"`
 		} `json:"event"`
 	}
 	if err := json.Unmarshal(req.Body, &envelope); err != nil {
 		return fmt.Errorf("parse feishu event body: %w", err)
 	}
-	if strings.TrimSpace(envelope.Header.EventType) != "im.message.receive_v1" {
+	switch strings.TrimSpace(envelope.Header.EventType) {
+	case "im.message.receive_v1":
+	case "card.action.trigger":
+		index, _ := envelope.Event.Action.Value[feishuButtonKey].(string)
+		f.processCardAction(
+			envelope.Event.Operator.OpenID,
+			envelope.Event.Context.OpenChatID,
+			envelope.Event.Context.OpenMessageID,
+			index,
+		)
+		return nil
+	default:
 		return nil
 	}
-	f.processInboundEvent(
-		envelope.Event.Sender.SenderID.OpenID,
-		envelope.Event.Message.ChatID,
-		envelope.Event.Message.MessageID,
-		envelope.Event.Message.MessageType,
-		envelope.Event.Message.Content,
-	)
+	f.processInboundEvent(envelope.Event.Sender.SenderID.OpenID, envelope.Event.Message)
 	return nil
 }
 
-func (f *FeishuChannel) processInboundEvent(senderID, chatID, messageID, messageType, contentRaw string) {
+func (f *FeishuChannel) processInboundEvent(senderID string, message feishuMessage) {
 	senderID = strings.TrimSpace(senderID)
 	if senderID == "" || !f.IsAllowed(senderID) {
 		return
 	}
-	messageType = strings.ToLower(strings.TrimSpace(messageType))
+	chatID := strings.TrimSpace(message.ChatID)
+	messageID := strings.TrimSpace(message.MessageID)
+	messageType := strings.ToLower(strings.TrimSpace(message.MessageType))
+	contentRaw := message.Content
+	names := f.mentionNames(message.Mentions)
+
+	// Group messages need an @bot mention, except commands, which only
+	// come as text.
+	group := message.ChatType == "group"
+	direct := message.ChatType == "p2p"
+	if direct {
+		f.rememberP2P(chatID)
+	}
+	var settings config.FeishuGroupConfig
+	gated := false
+	if group {
+		settings = f.groupSettings(chatID)
+		gated = (settings.RequireMention == nil || *settings.RequireMention) && !mentionsBot(names)
+		if gated && messageType != "text" {
+			return
+		}
+	}
+
 	content := ""
-	var media []string
-	mediaTypes := map[string]string{}
-	mediaMIMEs := map[string]string{}
+	var attachments []bus.Attachment
+	addMedia := func(messageType, contentRaw string) {
+		if p, kind, mime, err := f.downloadInboundMedia(messageID, messageType, contentRaw); err == nil && p != "" {
+			att := bus.Attachment{Path: p, Kind: bus.AttachmentKind(kind), MIME: mime}
+			if info, statErr := os.Stat(p); statErr == nil {
+				att.Size = info.Size()
+			}
+			attachments = append(attachments, att)
+		} else if err != nil {
+			f.logger.Warnf("[feishu] download media failed: %v", err)
+		}
+	}
 
 	switch messageType {
 	case "text":
@@ -535,43 +656,209 @@ func (f *FeishuChannel) processInboundEvent(senderID, chatID, messageID, message
 			f.logger.Errorf("[feishu] parse text content error: %v", err)
 			return
 		}
-		content = strings.TrimSpace(textContent.Text)
-	case "image", "file", "audio":
-		if p, kind, mime, err := f.downloadInboundMedia(messageID, messageType, contentRaw); err == nil && p != "" {
-			media = append(media, p)
-			mediaTypes[p] = kind
-			mediaMIMEs[p] = mime
-		} else if err != nil {
-			f.logger.Warnf("[feishu] download media failed: %v", err)
+		content = strings.TrimSpace(replaceFeishuMentions(textContent.Text, names))
+		if gated && !strings.HasPrefix(content, "/") {
+			return
 		}
+	case "post":
+		post, err := parseFeishuPost(contentRaw)
+		if err != nil {
+			f.logger.Errorf("[feishu] parse post content error: %v", err)
+			return
+		}
+		var imageKeys []string
+		content, imageKeys = renderFeishuPost(post, names)
+		for _, key := range imageKeys {
+			raw, _ := json.Marshal(map[string]string{"image_key": key})
+			addMedia("image", string(raw))
+		}
+	case "interactive":
+		content = feishuMessageText(messageType, contentRaw)
+	case "sticker":
+		// Stickers cannot be downloaded through the resource API.
+		content = "[sticker]"
+	case "merge_forward":
+		content = f.expandMergeForward(messageID)
+	case "image", "file", "audio":
+		addMedia(messageType, contentRaw)
 	default:
 		return
 	}
-	if content == "" && len(media) == 0 {
+	if content == "" && len(attachments) == 0 {
 		return
 	}
-	meta := map[string]any{
+	metadata := map[string]any{
 		"message_type": messageType,
-		"message_id":   strings.TrimSpace(messageID),
 	}
-	if len(mediaTypes) > 0 {
-		meta["media_types"] = mediaTypes
+	if message.ChatType != "" {
+		metadata["chat_type"] = message.ChatType
+	}
+	if !f.bus.PublishInbound(bus.InboundMessage{
+		Channel:     feishuChannelName,
+		SenderID:    senderID,
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Content:     content,
+		Attachments: attachments,
+		Timestamp:   time.Now(),
+		Direct:       direct,
+		Instructions: settings.SystemPrompt,
+		Metadata:     metadata,
+	}) {
+		f.logger.Debugf("[feishu] duplicate message dropped: %s", messageID)
 	}
-	if len(mediaMIMEs) > 0 {
-		meta["media_mime_types"] = mediaMIMEs
+}
+
+func (f *FeishuChannel) groupSettings(chatID string) config.FeishuGroupConfig {
+	if settings, ok := f.cfg.Groups[chatID]; ok {
+		return settings
+	}
+	return f.cfg.Groups["*"]
+}
+
+// mentionNames maps the mention keys of a message to the names they are
+// shown as. Mentions of the bot map to "", so they are dropped from the
+// text. When the bot's open_id is unknown, every mention is taken for one
+// of the bot.
+func (f *FeishuChannel) mentionNames(mentions []feishuMention) map[string]string {
+	if len(mentions) == 0 {
+		return nil
+	}
+	botID := f.selfOpenID()
+	names := make(map[string]string, len(mentions))
+	for _, m := range mentions {
+		if m.Key == "@_all" {
+			names[m.Key] = "all"
+			continue
+		}
+		if botID == "" || m.ID.OpenID == botID {
+			names[m.Key] = ""
+			continue
+		}
+		names[m.Key] = m.Name
+	}
+	return names
+}
+
+func mentionsBot(names map[string]string) bool {
+	for _, name := range names {
+		if name == "" {
+			return true
+		}
 	}
-	f.bus.Inbound <- bus.InboundMessage{
+	return false
+}
+
+// replaceFeishuMentions replaces the mention keys in text with @name.
+func replaceFeishuMentions(text string, names map[string]string) string {
+	if len(names) == 0 {
+		return text
+	}
+	keys := make([]string, 0, len(names))
+	for key := range names {
+		keys = append(keys, key)
+	}
+	// Longest first, so @_user_1 does not match the start of @_user_10.
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	pairs := make([]string, 0, 2*len(names))
+	for _, key := range keys {
+		if name := names[key]; name == "" {
+			pairs = append(pairs, key, "")
+		} else {
+			pairs = append(pairs, key, "@"+name)
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// selfOpenID returns the bot's open_id, fetched on first use. It returns
+// "" while the bot info cannot be fetched.
+func (f *FeishuChannel) selfOpenID() string {
+	f.botMu.Lock()
+	defer f.botMu.Unlock()
+	if f.botOpenID != "" {
+		return f.botOpenID
+	}
+	rc, err := f.advancedClient()
+	if err != nil {
+		return ""
+	}
+	id, err := rc.BotOpenID(context.Background())
+	if err != nil {
+		f.logger.Warnf("[feishu] get bot info failed: %v", err)
+		return ""
+	}
+	f.botOpenID = id
+	return id
+}
+
+// expandMergeForward renders the messages of a merged forward as a quote.
+func (f *FeishuChannel) expandMergeForward(messageID string) string {
+	const placeholder = "[forwarded messages]"
+	rc, err := f.advancedClient()
+	if err != nil {
+		return placeholder
+	}
+	items, err := rc.GetMessage(context.Background(), messageID)
+	if err != nil {
+		f.logger.Warnf("[feishu] get forwarded messages failed: %v", err)
+		return placeholder
+	}
+	lines := []string{"Forwarded messages:"}
+	for _, item := range items {
+		if item.UpperMessageID != messageID {
+			continue
+		}
+		text := feishuMessageText(item.MsgType, item.Body.Content)
+		lines = append(lines, "> "+strings.ReplaceAll(text, "\n", "\n> "))
+	}
+	if len(lines) == 1 {
+		return placeholder
+	}
+	return strings.Join(lines, "\n")
+}
+
+// processCardAction answers a card button press. The button's data is
+// published as the user's reply to the card, and the card is redrawn with
+// the chosen option in place of the buttons.
+func (f *FeishuChannel) processCardAction(senderID, chatID, messageID, index string) {
+	senderID = strings.TrimSpace(senderID)
+	if senderID == "" || !f.IsAllowed(senderID) {
+		return
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return
+	}
+	button, set, ok := f.buttons.take(chatID, messageID, i)
+	if !ok {
+		f.logger.Debugf("[feishu] press on expired buttons ignored: %s", messageID)
+		return
+	}
+	if rc, err := f.advancedClient(); err == nil {
+		card := buildCardWithElementsJSON(set.text, map[string]any{"tag": "markdown", "content": answeredLabel(button)})
+		if err := rc.EditCardMessage(context.Background(), messageID, card); err != nil {
+			f.logger.Warnf("[feishu] mark button answered failed msg=%s: %v", messageID, err)
+		}
+	}
+	if !f.bus.PublishInbound(bus.InboundMessage{
 		Channel:   feishuChannelName,
 		SenderID:  senderID,
-		ChatID:    strings.TrimSpace(chatID),
-		Content:   content,
-		Media:     media,
+		ChatID:    chatID,
+		MessageID: messageID,
+		Content:   button.Data,
 		Timestamp: time.Now(),
-		Metadata:  meta,
+		Direct:    f.isP2P(chatID),
+		Metadata: map[string]any{
+			"message_type": "card_action",
+			"button":       button.Label,
+		},
+	}) {
+		f.logger.Debugf("[feishu] duplicate button press dropped: %s", messageID)
 	}
 }
 
-func (f *FeishuChannel) Send(msg bus.OutboundMessage) error {
+func (f *FeishuChannel) Send(msg bus.OutboundMessage) (err error) {
 	if f.client == nil {
 		return fmt.Errorf("feishu client not initialized")
 	}
@@ -579,26 +866,31 @@ func (f *FeishuChannel) Send(msg bus.OutboundMessage) error {
 	if !ok {
 		return f.client.SendMessage(context.Background(), msg.ChatID, msg.Content)
 	}
+	if len(msg.Buttons) > 0 {
+		f.setLastCard(msg.ChatID, feishuCard{})
+		defer func() {
+			if err == nil {
+				f.attachButtons(msg.ChatID, msg.Buttons, rc)
+			}
+		}()
+	}
 
-	event := telegramEvent(msg.Metadata)
 	if msg.Content != "" {
-		switch event {
-		case telegramEventPreviewUpdate:
-			return f.sendPreview(msg.ChatID, msg.Content, "update", msg.ReplyTo, rc)
-		case telegramEventPreviewFinal:
-			return f.sendPreview(msg.ChatID, msg.Content, "final", msg.ReplyTo, rc)
-		case telegramEventToolProgress:
-			return f.sendToolProgress(msg.ChatID, msg, rc)
-		case telegramEventUsageHUD:
+		switch msg.Kind {
+		case bus.KindPreviewUpdate:
+			return f.stream.Update(msg.ChatID, msg.Content, msg.ReplyTo)
+		case bus.KindPreviewFinal:
+			return f.stream.Finalize(msg.ChatID, msg.Content, msg.ReplyTo)
+		case bus.KindToolProgress:
+			return f.stream.ToolProgress(msg.ChatID, msg)
+		case bus.KindUsageHUD:
 			return f.sendStandaloneText(msg.ChatID, msg.Content, rc)
 		}
 	}
 
-	typeMap := mapStringMeta(msg.Metadata, "media_types")
-	mimeMap := mapStringMeta(msg.Metadata, "media_mime_types")
-	for _, mediaPath := range msg.Media {
-		if err := f.sendMediaPath(msg.ChatID, mediaPath, typeMap[mediaPath], mimeMap[mediaPath], rc); err != nil {
-			f.logger.Warnf("[feishu] send media failed path=%s err=%v", mediaPath, err)
+	for _, att := range msg.Attachments {
+		if err := f.sendMediaPath(msg.ChatID, att.Path, string(att.Kind), att.MIME, rc); err != nil {
+			f.logger.Warnf("[feishu] send media failed path=%s err=%v", att.Path, err)
 		}
 	}
 	if strings.TrimSpace(msg.Content) == "" {
@@ -607,197 +899,169 @@ func (f *FeishuChannel) Send(msg bus.OutboundMessage) error {
 	return f.sendNewMessage(msg.ChatID, msg.Content, msg.ReplyTo, rc)
 }
 
-func (f *FeishuChannel) sendPreview(chatID, content, mode, replyTo string, rc feishuAdvancedClient) error {
-	if mode == "final" {
-		return f.finalizePreview(chatID, content, rc)
+// Capabilities reports card rendering. Card payloads are capped at 30KB,
+// so replies are kept well below that.
+func (f *FeishuChannel) Capabilities() Capabilities {
+	return Capabilities{
+		MaxMessageBytes: 20000,
+		Edit:            true,
+		Markdown:        MarkdownFull,
+		Media:           []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+		Voice:           true,
+		Buttons:         true,
 	}
-	text := strings.TrimSpace(renderDraftText(content))
-	if text == "" {
-		return nil
+}
+
+// feishuButtonKey names the button index in a card button's callback value.
+const feishuButtonKey = "aevitas_button"
+
+func (f *FeishuChannel) setLastCard(chatID string, card feishuCard) {
+	f.cardMu.Lock()
+	defer f.cardMu.Unlock()
+	f.lastCard[chatID] = card
+}
+
+// rememberP2P records chatID as a one-to-one chat. Card button events do
+// not carry the chat type, so presses look it up here.
+func (f *FeishuChannel) rememberP2P(chatID string) {
+	f.cardMu.Lock()
+	defer f.cardMu.Unlock()
+	f.p2pChats[chatID] = true
+}
+
+func (f *FeishuChannel) isP2P(chatID string) bool {
+	f.cardMu.Lock()
+	defer f.cardMu.Unlock()
+	return f.p2pChats[chatID]
+}
+
+// attachButtons redraws the last text card sent to chatID with buttons
+// under it, or sends a short prompt card with them when there is none.
+func (f *FeishuChannel) attachButtons(chatID string, rows [][]bus.Button, rc feishuAdvancedClient) {
+	f.cardMu.Lock()
+	card := f.lastCard[chatID]
+	f.cardMu.Unlock()
+	ctx := context.Background()
+	if card.id != "" {
+		err := rc.EditCardMessage(ctx, card.id, buildButtonCardJSON(card.text, rows))
+		if err == nil {
+			f.buttons.add(chatID, card.id, card.text, rows)
+			return
+		}
+		f.logger.Warnf("[feishu] attach buttons failed msg=%s: %v", card.id, err)
 	}
-	state, err := f.ensureTurnState(chatID, replyTo, rc)
+	const prompt = "请选择："
+	id, err := rc.SendTypedMessage(ctx, chatID, "interactive", map[string]string{"card": buildButtonCardJSON(prompt, rows)}, "")
 	if err != nil {
-		return err
-	}
-	if state.lastDraftText == text {
-		return nil
-	}
-	cardJSON := buildReplyCardJSON(text)
-	if err := rc.EditCardMessage(context.Background(), state.draftMessageID, cardJSON); err != nil {
-		newID, sendErr := rc.SendTypedMessage(context.Background(), chatID, "interactive", map[string]string{"card": cardJSON}, replyTo)
-		if sendErr != nil {
-			return fmt.Errorf("edit preview: %w; fallback send: %v", err, sendErr)
-		}
-		state.draftMessageID = newID
+		f.logger.Warnf("[feishu] send buttons failed chat=%s: %v", chatID, err)
+		return
 	}
-	state.lastDraftText = text
-	state.lastEditAt = time.Now()
-	f.previewMu.Lock()
-	f.previewMsg[chatID] = state
-	f.previewMu.Unlock()
-	return nil
+	f.buttons.add(chatID, id, prompt, rows)
 }
 
-func (f *FeishuChannel) finalizePreview(chatID, content string, rc feishuAdvancedClient) error {
-	f.previewMu.Lock()
-	state := f.previewMsg[chatID]
-	f.previewMu.Unlock()
-	if state.finalized && state.draftMessageID == "" {
-		return nil
+// StreamingRenderer implements Streamer.
+func (f *FeishuChannel) StreamingRenderer() StreamingRenderer {
+	return f.stream
+}
+
+func (f *FeishuChannel) advancedClient() (feishuAdvancedClient, error) {
+	rc, ok := f.client.(feishuAdvancedClient)
+	if !ok {
+		return nil, fmt.Errorf("feishu client does not support message editing")
 	}
-	ctx := context.Background()
-	const maxUTF16Len = 4090
-	contents, err := telegramify.Telegramify(ctx, content, maxUTF16Len, false, nil)
+	return rc, nil
+}
+
+// CreateBlock implements StreamTarget. Both blocks are markdown cards.
+func (f *FeishuChannel) CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error) {
+	rc, err := f.advancedClient()
 	if err != nil {
-		return fmt.Errorf("telegramify process: %w", err)
+		return "", err
 	}
-	if len(contents) == 0 {
-		return nil
+	card := buildReplyCardJSON(renderDraftText(text))
+	if block == StreamToolBlock {
+		card = buildToolCardJSON(text)
 	}
-	if err := f.applyFinalContents(chatID, state, contents, rc); err != nil {
+	return rc.SendTypedMessage(context.Background(), chatID, "interactive", map[string]string{"card": card}, replyTo)
+}
+
+// EditBlock implements StreamTarget.
+func (f *FeishuChannel) EditBlock(chatID, messageID string, block StreamBlock, text string) error {
+	rc, err := f.advancedClient()
+	if err != nil {
 		return err
 	}
-	f.previewMu.Lock()
-	cur := f.previewMsg[chatID]
-	if !state.hadToolProgress {
-		if state.toolMessageID != "" {
-			if err := rc.DeleteMessage(context.Background(), state.toolMessageID); err != nil {
-				f.logger.Warnf("[feishu] delete empty tool block failed: %v", err)
-			}
-		}
-		cur.toolMessageID = ""
-		cur.toolBlockIndex = 0
-		cur.toolEntries = nil
-		cur.hadToolProgress = false
-	}
-	cur.draftMessageID = ""
-	cur.lastDraftText = ""
-	cur.lastEditAt = time.Now()
-	cur.finalized = true
-	f.previewMsg[chatID] = cur
-	f.previewMu.Unlock()
-	return nil
+	card := buildReplyCardJSON(renderDraftText(text))
+	if block == StreamToolBlock {
+		card = buildToolCardJSON(text)
+	}
+	return rc.EditCardMessage(context.Background(), messageID, card)
 }
 
-func (f *FeishuChannel) applyFinalContents(chatID string, state feishuPreviewState, contents []telegramify.Content, rc feishuAdvancedClient) error {
-	usedPreview := false
-	for _, item := range contents {
-		replyTo := ""
-		if !usedPreview {
-			replyTo = state.replyToMessageID
-		}
-		switch c := item.(type) {
-		case *telegramify.Text:
-			text := strings.TrimSpace(c.Text)
-			if text == "" {
-				continue
-			}
-			cardJSON := buildReplyCardJSON(text)
-			if !usedPreview && state.draftMessageID != "" {
-				if err := rc.EditCardMessage(context.Background(), state.draftMessageID, cardJSON); err == nil {
-					usedPreview = true
-					continue
-				}
-			}
-			if _, err := rc.SendTypedMessage(context.Background(), chatID, "interactive", map[string]string{"card": cardJSON}, replyTo); err != nil {
-				return err
-			}
-			usedPreview = true
-		case *telegramify.File:
-			fileKey, err := rc.UploadFile(context.Background(), c.FileName, c.FileData)
-			if err != nil {
-				return err
-			}
-			if _, err := rc.SendTypedMessage(context.Background(), chatID, "file", map[string]string{"file_key": fileKey}, replyTo); err != nil {
-				return err
-			}
-			usedPreview = true
-		case *telegramify.Photo:
-			imageKey, err := rc.UploadImage(context.Background(), c.FileName, c.FileData)
-			if err != nil {
-				return err
-			}
-			if _, err := rc.SendTypedMessage(context.Background(), chatID, "image", map[string]string{"image_key": imageKey}, replyTo); err != nil {
-				return err
-			}
-			usedPreview = true
-		}
+// DeleteBlock implements StreamTarget.
+func (f *FeishuChannel) DeleteBlock(chatID, messageID string) error {
+	rc, err := f.advancedClient()
+	if err != nil {
+		return err
 	}
-	return nil
+	return rc.DeleteMessage(context.Background(), messageID)
 }
 
-func (f *FeishuChannel) ensureTurnState(chatID, replyTo string, rc feishuAdvancedClient) (feishuPreviewState, error) {
-	f.previewMu.Lock()
-	state, ok := f.previewMsg[chatID]
-	f.previewMu.Unlock()
-	if ok && state.draftMessageID != "" && state.toolMessageID != "" {
-		if state.replyToMessageID == "" && replyTo != "" {
-			state.replyToMessageID = replyTo
-			f.previewMu.Lock()
-			f.previewMsg[chatID] = state
-			f.previewMu.Unlock()
-		}
-		return state, nil
-	}
-	toolCard := buildToolCardJSON(formatFeishuToolBlock(1, nil))
-	toolID, err := rc.SendTypedMessage(context.Background(), chatID, "interactive", map[string]string{"card": toolCard}, "")
+// SendReply implements StreamTarget. The reply is split with telegramify;
+// only its first part replaces the draft card and replies to the user.
+func (f *FeishuChannel) SendReply(chatID, text, draftID, replyTo string) error {
+	const maxUTF16Len = 4090
+	parts, err := telegramify.Telegramify(context.Background(), text, maxUTF16Len, false, nil)
 	if err != nil {
-		return feishuPreviewState{}, fmt.Errorf("send tool block: %w", err)
+		return fmt.Errorf("telegramify process: %w", err)
 	}
-	draftCard := buildReplyCardJSON("⌛ 正在生成回复...")
-	draftID, err := rc.SendTypedMessage(context.Background(), chatID, "interactive", map[string]string{"card": draftCard}, replyTo)
-	if err != nil {
-		return feishuPreviewState{}, fmt.Errorf("send draft block: %w", err)
-	}
-	state = feishuPreviewState{
-		draftMessageID:   draftID,
-		toolMessageID:    toolID,
-		replyToMessageID: replyTo,
-		toolBlockIndex:   1,
-	}
-	f.previewMu.Lock()
-	f.previewMsg[chatID] = state
-	f.previewMu.Unlock()
-	return state, nil
+	for _, part := range parts {
+		if c, ok := part.(*telegramify.Text); ok && strings.TrimSpace(c.Text) == "" {
+			continue
+		}
+		if err := f.sendReplyPart(chatID, part, draftID, replyTo); err != nil {
+			return err
+		}
+		draftID, replyTo = "", ""
+	}
+	return nil
 }
 
-func (f *FeishuChannel) sendToolProgress(chatID string, msg bus.OutboundMessage, rc feishuAdvancedClient) error {
-	state, err := f.ensureTurnState(chatID, "", rc)
+// sendReplyPart sends one part of a reply. Text replaces the draft card in
+// place; files and photos are uploaded and sent as new messages.
+func (f *FeishuChannel) sendReplyPart(chatID string, part telegramify.Content, draftID, replyTo string) error {
+	rc, err := f.advancedClient()
 	if err != nil {
 		return err
 	}
-	entry := buildToolEntry(msg)
-	if entry.Name == "" && strings.TrimSpace(entry.Raw) == "" {
-		return nil
-	}
-	tryEntries := append(append([]toolEntry{}, state.toolEntries...), entry)
-	block := formatFeishuToolBlock(state.toolBlockIndex, tryEntries)
-	if len([]rune(block)) > maxToolBlockChars {
-		state.toolBlockIndex++
-		state.toolEntries = []toolEntry{entry}
-		newBlock := buildToolCardJSON(formatFeishuToolBlock(state.toolBlockIndex, state.toolEntries))
-		id, sendErr := rc.SendTypedMessage(context.Background(), chatID, "interactive", map[string]string{"card": newBlock}, "")
-		if sendErr != nil {
-			return fmt.Errorf("send tool block rollover: %w", sendErr)
+	ctx := context.Background()
+	switch c := part.(type) {
+	case *telegramify.Text:
+		cardJSON := buildReplyCardJSON(c.Text)
+		if draftID != "" {
+			if err := rc.EditCardMessage(ctx, draftID, cardJSON); err == nil {
+				f.setLastCard(chatID, feishuCard{id: draftID, text: c.Text})
+				return nil
+			}
 		}
-		state.toolMessageID = id
-	} else {
-		toolCard := buildToolCardJSON(block)
-		if err := rc.EditCardMessage(context.Background(), state.toolMessageID, toolCard); err != nil {
-			return fmt.Errorf("edit tool block: %w", err)
+		var id string
+		if id, err = rc.SendTypedMessage(ctx, chatID, "interactive", map[string]string{"card": cardJSON}, replyTo); err == nil {
+			f.setLastCard(chatID, feishuCard{id: id, text: c.Text})
 		}
-		state.toolEntries = tryEntries
-	}
-	state.hadToolProgress = true
-	f.previewMu.Lock()
-	cur := f.previewMsg[chatID]
-	cur.toolMessageID = state.toolMessageID
-	cur.toolBlockIndex = state.toolBlockIndex
-	cur.toolEntries = state.toolEntries
-	cur.hadToolProgress = state.hadToolProgress
-	f.previewMsg[chatID] = cur
-	f.previewMu.Unlock()
-	return nil
+	case *telegramify.File:
+		fileKey, upErr := rc.UploadFile(ctx, c.FileName, c.FileData)
+		if upErr != nil {
+			return upErr
+		}
+		_, err = rc.SendTypedMessage(ctx, chatID, "file", map[string]string{"file_key": fileKey}, replyTo)
+	case *telegramify.Photo:
+		imageKey, upErr := rc.UploadImage(ctx, c.FileName, c.FileData)
+		if upErr != nil {
+			return upErr
+		}
+		_, err = rc.SendTypedMessage(ctx, chatID, "image", map[string]string{"image_key": imageKey}, replyTo)
+	}
+	return err
 }
 
 func (f *FeishuChannel) sendStandaloneText(chatID, text string, rc feishuAdvancedClient) error {
@@ -830,9 +1094,11 @@ func (f *FeishuChannel) sendNewMessage(chatID, content, replyTo string, rc feish
 				continue
 			}
 			cardJSON := buildReplyCardJSON(text)
-			if _, err := rc.SendTypedMessage(ctx, chatID, "interactive", map[string]string{"card": cardJSON}, curReply); err != nil {
+			id, err := rc.SendTypedMessage(ctx, chatID, "interactive", map[string]string{"card": cardJSON}, curReply)
+			if err != nil {
 				return err
 			}
+			f.setLastCard(chatID, feishuCard{id: id, text: text})
 		case *telegramify.File:
 			key, err := rc.UploadFile(ctx, c.FileName, c.FileData)
 			if err != nil {
@@ -895,6 +1161,44 @@ func buildV2MarkdownCardJSON(text string) string {
 	return string(b)
 }
 
+// buildButtonCardJSON is a reply card with one action row per button row.
+// Each button's callback value carries its index.
+func buildButtonCardJSON(text string, rows [][]bus.Button) string {
+	var actions []map[string]any
+	index := 0
+	for _, row := range rows {
+		buttons := make([]map[string]any, 0, len(row))
+		for _, button := range row {
+			buttons = append(buttons, map[string]any{
+				"tag":   "button",
+				"text":  map[string]string{"tag": "plain_text", "content": button.Label},
+				"type":  "default",
+				"value": map[string]string{feishuButtonKey: strconv.Itoa(index)},
+			})
+			index++
+		}
+		actions = append(actions, map[string]any{"tag": "action", "actions": buttons})
+	}
+	return buildCardWithElementsJSON(text, actions...)
+}
+
+// buildCardWithElementsJSON is a reply card followed by extra elements.
+func buildCardWithElementsJSON(text string, extra ...map[string]any) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		text = " "
+	}
+	elements := append([]map[string]any{{"tag": "markdown", "content": text}}, extra...)
+	b, err := json.Marshal(map[string]any{
+		"config":   map[string]any{"wide_screen_mode": true},
+		"elements": elements,
+	})
+	if err != nil {
+		return buildReplyCardJSON(text)
+	}
+	return string(b)
+}
+
 func formatFeishuToolBlock(blockIndex int, entries []toolEntry) string {
 	var b strings.Builder
 	if blockIndex <= 1 {
@@ -1058,32 +1362,6 @@ func (f *FeishuChannel) downloadInboundMedia(messageID, messageType, contentRaw
 	return localPath, explicitKind, mime, nil
 }
 
-func mapStringMeta(meta map[string]any, key string) map[string]string {
-	if len(meta) == 0 {
-		return nil
-	}
-	raw, ok := meta[key]
-	if !ok || raw == nil {
-		return nil
-	}
-	if typed, ok := raw.(map[string]string); ok {
-		return typed
-	}
-	generic, ok := raw.(map[string]any)
-	if !ok {
-		return nil
-	}
-	out := make(map[string]string, len(generic))
-	for k, v := range generic {
-		s, ok := v.(string)
-		if !ok {
-			continue
-		}
-		out[k] = s
-	}
-	return out
-}
-
 func encodeFeishuContent(msgType string, content map[string]string) (string, error) {
 	msgType = strings.ToLower(strings.TrimSpace(msgType))
 	switch msgType {
@@ -0,0 +1,165 @@
+package channel
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// feishuPost is the content of a post (rich text) message: a title and
+// lines of inline elements. Posts sent through the API are wrapped in a
+// locale key, which received posts usually are not.
+type feishuPost struct {
+	Title   string                `json:"title"`
+	Content [][]feishuPostElement `json:"content"`
+}
+
+// feishuCardContent is an interactive card as it arrives in a message
+// event, reduced by Feishu to a title and lines of elements like a post.
+type feishuCardContent struct {
+	Title    string                `json:"title"`
+	Elements [][]feishuPostElement `json:"elements"`
+}
+
+type feishuPostElement struct {
+	Tag       string   `json:"tag"`
+	Text      string   `json:"text"`
+	Href      string   `json:"href"`
+	UserID    string   `json:"user_id"` // mention key, e.g. @_user_1
+	UserName  string   `json:"user_name"`
+	ImageKey  string   `json:"image_key"`
+	Language  string   `json:"language"`
+	EmojiType string   `json:"emoji_type"`
+	Style     []string `json:"style"`
+}
+
+func parseFeishuPost(raw string) (feishuPost, error) {
+	var post feishuPost
+	if err := json.Unmarshal([]byte(raw), &post); err != nil {
+		return post, err
+	}
+	if post.Title != "" || len(post.Content) > 0 {
+		return post, nil
+	}
+	var localized map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &localized); err != nil {
+		return post, nil
+	}
+	for _, locale := range []string{"zh_cn", "en_us", "ja_jp"} {
+		if v, ok := localized[locale]; ok {
+			err := json.Unmarshal(v, &post)
+			return post, err
+		}
+	}
+	for _, v := range localized {
+		if json.Unmarshal(v, &post) == nil && len(post.Content) > 0 {
+			break
+		}
+	}
+	return post, nil
+}
+
+// renderFeishuPost turns a post into markdown and returns the keys of its
+// inline images, which the caller downloads. Mentions are rendered through
+// names, keyed by mention key; a key mapped to "" (the bot) is dropped.
+func renderFeishuPost(post feishuPost, names map[string]string) (string, []string) {
+	var imageKeys []string
+	lines := make([]string, 0, len(post.Content)+1)
+	if title := strings.TrimSpace(post.Title); title != "" {
+		lines = append(lines, "**"+title+"**", "")
+	}
+	for _, line := range post.Content {
+		var b strings.Builder
+		for _, el := range line {
+			switch el.Tag {
+			case "text", "md":
+				b.WriteString(styleFeishuText(el.Text, el.Style))
+			case "a":
+				text := strings.TrimSpace(el.Text)
+				switch {
+				case el.Href == "":
+					b.WriteString(el.Text)
+				case text == "" || text == el.Href:
+					b.WriteString(el.Href)
+				default:
+					b.WriteString("[" + text + "](" + el.Href + ")")
+				}
+			case "at":
+				name, ok := names[el.UserID]
+				if !ok {
+					name = strings.TrimPrefix(el.UserName, "@")
+				}
+				if name != "" {
+					b.WriteString("@" + name)
+				}
+			case "img":
+				if el.ImageKey != "" {
+					imageKeys = append(imageKeys, el.ImageKey)
+				}
+			case "media":
+				b.WriteString("[video]")
+			case "emotion":
+				b.WriteString("[" + el.EmojiType + "]")
+			case "code_block":
+				b.WriteString("```" + strings.ToLower(el.Language) + "\n" + strings.TrimRight(el.Text, "\n") + "\n```")
+			case "hr":
+				b.WriteString("---")
+			case "button":
+				b.WriteString("[" + el.Text + "]")
+			}
+		}
+		lines = append(lines, strings.TrimRight(b.String(), " "))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), imageKeys
+}
+
+func styleFeishuText(text string, style []string) string {
+	inner := strings.TrimSpace(text)
+	if inner == "" {
+		return text
+	}
+	styled := inner
+	for _, s := range style {
+		switch s {
+		case "bold":
+			styled = "**" + styled + "**"
+		case "italic":
+			styled = "*" + styled + "*"
+		case "lineThrough":
+			styled = "~~" + styled + "~~"
+		}
+	}
+	// Keep the spacing around the text, which markers must not enclose.
+	lead := text[:strings.Index(text, inner)]
+	return lead + styled + text[len(lead)+len(inner):]
+}
+
+// feishuMessageText renders a message of any type as text, for messages
+// that are quoted rather than handled, such as the parts of a forward.
+func feishuMessageText(msgType, contentRaw string) string {
+	switch msgType {
+	case "text":
+		var c struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal([]byte(contentRaw), &c) == nil {
+			return strings.TrimSpace(c.Text)
+		}
+	case "post":
+		if post, err := parseFeishuPost(contentRaw); err == nil {
+			text, images := renderFeishuPost(post, nil)
+			for range images {
+				text = strings.TrimSpace(text + " [image]")
+			}
+			return text
+		}
+	case "interactive":
+		var card feishuCardContent
+		if json.Unmarshal([]byte(contentRaw), &card) == nil {
+			text, _ := renderFeishuPost(feishuPost{Title: card.Title, Content: card.Elements}, nil)
+			return text
+		}
+	case "merge_forward":
+		return "[forwarded messages]"
+	}
+	return "[" + msgType + "]"
+}
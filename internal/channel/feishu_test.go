@@ -39,6 +39,9 @@ type mockFeishuAdvancedClient struct {
 
 	downloadData []byte
 	downloadMIME string
+	downloads    []string // file keys
+
+	messageItems []feishuMessageItem
 }
 
 func (m *mockFeishuAdvancedClient) SendMessage(ctx context.Context, chatID, content string) error {
@@ -112,6 +115,7 @@ func (m *mockFeishuAdvancedClient) UploadAudio(ctx context.Context, fileName str
 }
 
 func (m *mockFeishuAdvancedClient) DownloadResource(ctx context.Context, messageID, fileKey, resourceType string) ([]byte, string, error) {
+	m.downloads = append(m.downloads, fileKey)
 	data := m.downloadData
 	if len(data) == 0 {
 		data = []byte{0x89, 0x50, 0x4E, 0x47}
@@ -119,6 +123,14 @@ func (m *mockFeishuAdvancedClient) DownloadResource(ctx context.Context, message
 	return data, m.downloadMIME, nil
 }
 
+func (m *mockFeishuAdvancedClient) GetMessage(ctx context.Context, messageID string) ([]feishuMessageItem, error) {
+	return m.messageItems, nil
+}
+
+func (m *mockFeishuAdvancedClient) BotOpenID(ctx context.Context) (string, error) {
+	return "ou_bot", nil
+}
+
 type mockFeishuWSClient struct {
 	started chan struct{}
 }
@@ -237,10 +249,10 @@ func TestFeishuChannel_Send_PreviewUpdateThenFinal(t *testing.T) {
 	ch, _, mockClient := newFeishuWithMocks(t)
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		ReplyTo:  "om_user_2",
-		Content:  "partial",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "oc_chat",
+		ReplyTo: "om_user_2",
+		Content: "partial",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update error: %v", err)
 	}
@@ -258,9 +270,9 @@ func TestFeishuChannel_Send_PreviewUpdateThenFinal(t *testing.T) {
 	}
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  "final answer",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "oc_chat",
+		Content: "final answer",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("preview final error: %v", err)
 	}
@@ -275,9 +287,9 @@ func TestFeishuChannel_Send_PreviewUpdateThenFinal(t *testing.T) {
 func TestFeishuChannel_Send_ToolProgressStandalone(t *testing.T) {
 	ch, _, mockClient := newFeishuWithMocks(t)
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  `{"query":"abc"}`,
-		Metadata: map[string]any{telegramEventKey: telegramEventToolProgress, "tool_name": "WebSearch"},
+		ChatID:  "oc_chat",
+		Content: `{"query":"abc"}`,
+		Kind:    bus.KindToolProgress, Tool: &bus.ToolProgress{Name: "WebSearch"},
 	}); err != nil {
 		t.Fatalf("tool progress error: %v", err)
 	}
@@ -303,16 +315,16 @@ func TestFeishuChannel_Send_ToolProgressStandalone(t *testing.T) {
 func TestFeishuChannel_Send_ToolProgressEditsCard(t *testing.T) {
 	ch, _, mockClient := newFeishuWithMocks(t)
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  `{"query":"abc"}`,
-		Metadata: map[string]any{telegramEventKey: telegramEventToolProgress, "tool_name": "WebSearch"},
+		ChatID:  "oc_chat",
+		Content: `{"query":"abc"}`,
+		Kind:    bus.KindToolProgress, Tool: &bus.ToolProgress{Name: "WebSearch"},
 	}); err != nil {
 		t.Fatalf("first tool progress error: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  `{"query":"def"}`,
-		Metadata: map[string]any{telegramEventKey: telegramEventToolProgress, "tool_name": "WebSearch"},
+		ChatID:  "oc_chat",
+		Content: `{"query":"def"}`,
+		Kind:    bus.KindToolProgress, Tool: &bus.ToolProgress{Name: "WebSearch"},
 	}); err != nil {
 		t.Fatalf("second tool progress error: %v", err)
 	}
@@ -324,23 +336,23 @@ func TestFeishuChannel_Send_ToolProgressEditsCard(t *testing.T) {
 func TestFeishuChannel_Send_PreviewFinal_WithToolProgress_KeepToolBlock(t *testing.T) {
 	ch, _, mockClient := newFeishuWithMocks(t)
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  "draft",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "oc_chat",
+		Content: "draft",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update error: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  `{"q":"x"}`,
-		Metadata: map[string]any{telegramEventKey: telegramEventToolProgress, "tool_name": "WebSearch"},
+		ChatID:  "oc_chat",
+		Content: `{"q":"x"}`,
+		Kind:    bus.KindToolProgress, Tool: &bus.ToolProgress{Name: "WebSearch"},
 	}); err != nil {
 		t.Fatalf("tool progress error: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "oc_chat",
-		Content:  "final",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "oc_chat",
+		Content: "final",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("preview final error: %v", err)
 	}
@@ -349,7 +361,7 @@ func TestFeishuChannel_Send_PreviewFinal_WithToolProgress_KeepToolBlock(t *testi
 	}
 }
 
-func TestFeishuChannel_Send_MediaPathUsesMetadata(t *testing.T) {
+func TestFeishuChannel_Send_MediaUsesAttachmentKind(t *testing.T) {
 	ch, _, mockClient := newFeishuWithMocks(t)
 	dir := t.TempDir()
 	p := filepath.Join(dir, "sample.png")
@@ -357,12 +369,8 @@ func TestFeishuChannel_Send_MediaPathUsesMetadata(t *testing.T) {
 		t.Fatalf("write sample image: %v", err)
 	}
 	err := ch.Send(bus.OutboundMessage{
-		ChatID: "oc_chat",
-		Media:  []string{p},
-		Metadata: map[string]any{
-			"media_types":      map[string]string{p: "image"},
-			"media_mime_types": map[string]string{p: "image/png"},
-		},
+		ChatID:      "oc_chat",
+		Attachments: []bus.Attachment{{Path: p, Kind: bus.AttachmentImage, MIME: "image/png"}},
 	})
 	if err != nil {
 		t.Fatalf("send media error: %v", err)
@@ -387,12 +395,8 @@ func TestFeishuChannel_Send_AudioIncludesDuration(t *testing.T) {
 		t.Fatalf("write sample audio: %v", err)
 	}
 	err := ch.Send(bus.OutboundMessage{
-		ChatID: "oc_chat",
-		Media:  []string{p},
-		Metadata: map[string]any{
-			"media_types":      map[string]string{p: "audio"},
-			"media_mime_types": map[string]string{p: "audio/mpeg"},
-		},
+		ChatID:      "oc_chat",
+		Attachments: []bus.Attachment{{Path: p, Kind: bus.AttachmentAudio, MIME: "audio/mpeg"}},
 	})
 	if err != nil {
 		t.Fatalf("send audio error: %v", err)
@@ -419,14 +423,14 @@ func TestFeishuChannel_Send_AudioIncludesDuration(t *testing.T) {
 
 func TestFeishuChannel_ProcessInboundEvent_Text(t *testing.T) {
 	ch, b, _ := newFeishuWithMocks(t)
-	ch.processInboundEvent("ou_user", "oc_chat", "om_1", "text", `{"text":"hello aevitas"}`)
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_chat", MessageID: "om_1", MessageType: "text", Content: `{"text":"hello aevitas"}`})
 	select {
 	case msg := <-b.Inbound:
 		if msg.Content != "hello aevitas" {
 			t.Fatalf("content = %q", msg.Content)
 		}
-		if msg.Metadata["message_id"] != "om_1" {
-			t.Fatalf("message_id metadata mismatch: %#v", msg.Metadata["message_id"])
+		if msg.MessageID != "om_1" {
+			t.Fatalf("message id mismatch: %q", msg.MessageID)
 		}
 	case <-time.After(time.Second):
 		t.Fatal("expected inbound message")
@@ -439,31 +443,106 @@ func TestFeishuChannel_ProcessInboundEvent_Image_MIMEFromAgentSDK(t *testing.T)
 	mockClient.downloadData = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
 	mockClient.downloadMIME = ""
 
-	ch.processInboundEvent("ou_user", "oc_chat", "om_img", "image", `{"image_key":"img_xxx"}`)
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_chat", MessageID: "om_img", MessageType: "image", Content: `{"image_key":"img_xxx"}`})
 	select {
 	case msg := <-b.Inbound:
-		if len(msg.Media) != 1 {
-			t.Fatalf("expected one media file, got %d", len(msg.Media))
+		if len(msg.Attachments) != 1 {
+			t.Fatalf("expected one attachment, got %d", len(msg.Attachments))
 		}
-		typeMap, _ := msg.Metadata["media_types"].(map[string]string)
-		mimeMap, _ := msg.Metadata["media_mime_types"].(map[string]string)
-		if len(typeMap) != 1 || len(mimeMap) != 1 {
-			t.Fatalf("missing media metadata: %#v", msg.Metadata)
+		att := msg.Attachments[0]
+		if att.Kind != bus.AttachmentImage {
+			t.Fatalf("kind = %q, want image", att.Kind)
 		}
-		for p, kind := range typeMap {
-			if kind != "image" {
-				t.Fatalf("kind = %q, want image", kind)
-			}
-			mime := mimeMap[p]
-			if !strings.HasPrefix(strings.ToLower(mime), "image/") {
-				t.Fatalf("mime = %q, want image/*", mime)
-			}
+		if !strings.HasPrefix(strings.ToLower(att.MIME), "image/") {
+			t.Fatalf("mime = %q, want image/*", att.MIME)
+		}
+		if att.Size != int64(len(mockClient.downloadData)) {
+			t.Fatalf("size = %d, want %d", att.Size, len(mockClient.downloadData))
 		}
 	case <-time.After(time.Second):
 		t.Fatal("expected inbound image")
 	}
 }
 
+func TestFeishuChannel_ProcessInboundEvent_Post(t *testing.T) {
+	ch, b, mockClient := newFeishuWithMocks(t)
+	post := `{"title":"Weekly","content":[` +
+		`[{"tag":"at","user_id":"@_user_1","user_name":"Lee"},{"tag":"text","text":" please check "},{"tag":"text","text":"this","style":["bold"]}],` +
+		`[{"tag":"a","text":"the doc","href":"https://example.com/doc"},{"tag":"img","image_key":"img_1"}],` +
+		`[{"tag":"code_block","language":"GO","text":"fmt.Println(1)\n"}]]}`
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_chat", MessageID: "om_post", MessageType: "post", Content: post,
+		Mentions: []feishuMention{{Key: "@_user_1", Name: "Lee Wang"}}})
+
+	msg := <-b.Inbound
+	want := "**Weekly**\n\n@Lee Wang please check **this**\n[the doc](https://example.com/doc)\n```go\nfmt.Println(1)\n```"
+	if msg.Content != want {
+		t.Fatalf("content = %q, want %q", msg.Content, want)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Kind != bus.AttachmentImage || len(mockClient.downloads) != 1 || mockClient.downloads[0] != "img_1" {
+		t.Fatalf("attachments %+v, downloads %v; want the inline image", msg.Attachments, mockClient.downloads)
+	}
+	os.Remove(msg.Attachments[0].Path)
+}
+
+func TestFeishuChannel_ProcessInboundEvent_GroupMention(t *testing.T) {
+	ch, b, _ := newFeishuWithMocks(t)
+	botMention := []feishuMention{{Key: "@_user_1", Name: "aevitas"}}
+	botMention[0].ID.OpenID = "ou_bot"
+	otherMention := []feishuMention{{Key: "@_user_1", Name: "Lee"}}
+	otherMention[0].ID.OpenID = "ou_lee"
+
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_group", ChatType: "group", MessageID: "om_1", MessageType: "text",
+		Content: `{"text":"@_user_1 lunch?"}`, Mentions: otherMention})
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_group", ChatType: "group", MessageID: "om_2", MessageType: "image",
+		Content: `{"image_key":"img_1"}`})
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_group", ChatType: "group", MessageID: "om_3", MessageType: "text",
+		Content: `{"text":"@_user_1 summarize this thread"}`, Mentions: botMention})
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_group", ChatType: "group", MessageID: "om_4", MessageType: "text",
+		Content: `{"text":"/status"}`})
+
+	if msg := <-b.Inbound; msg.MessageID != "om_3" || msg.Content != "summarize this thread" || msg.Metadata["chat_type"] != "group" {
+		t.Fatalf("unexpected first group message: %+v", msg)
+	}
+	if msg := <-b.Inbound; msg.MessageID != "om_4" || msg.Content != "/status" {
+		t.Fatalf("unexpected command: %+v", msg)
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("unaddressed group message published: %+v", msg)
+	default:
+	}
+
+	off := false
+	ch.cfg.Groups = map[string]config.FeishuGroupConfig{"*": {RequireMention: &off, SystemPrompt: "Be brief."}}
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_group", ChatType: "group", MessageID: "om_5", MessageType: "text",
+		Content: `{"text":"@_user_1 lunch?"}`, Mentions: otherMention})
+	if msg := <-b.Inbound; msg.Content != "@Lee lunch?" || msg.Instructions != "Be brief." {
+		t.Fatalf("unexpected message without mention requirement: %+v", msg)
+	}
+}
+
+func TestFeishuChannel_ProcessInboundEvent_MergeForwardAndSticker(t *testing.T) {
+	ch, b, mockClient := newFeishuWithMocks(t)
+	mockClient.messageItems = []feishuMessageItem{
+		{MessageID: "om_fwd", MsgType: "merge_forward"},
+		{MessageID: "om_a", MsgType: "text", UpperMessageID: "om_fwd"},
+		{MessageID: "om_b", MsgType: "image", UpperMessageID: "om_fwd"},
+	}
+	mockClient.messageItems[1].Body.Content = `{"text":"deploy failed\nsee logs"}`
+	mockClient.messageItems[2].Body.Content = `{"image_key":"img_2"}`
+
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_chat", MessageID: "om_fwd", MessageType: "merge_forward",
+		Content: `{"content":"Merged and Forwarded Message"}`})
+	if msg := <-b.Inbound; msg.Content != "Forwarded messages:\n> deploy failed\n> see logs\n> [image]" {
+		t.Fatalf("forward content = %q", msg.Content)
+	}
+
+	ch.processInboundEvent("ou_user", feishuMessage{ChatID: "oc_chat", MessageID: "om_st", MessageType: "sticker", Content: `{"file_key":"f"}`})
+	if msg := <-b.Inbound; msg.Content != "[sticker]" {
+		t.Fatalf("sticker content = %q", msg.Content)
+	}
+}
+
 func TestFeishuChannel_ProcessEventReq(t *testing.T) {
 	ch, b, _ := newFeishuWithMocks(t)
 	payload := map[string]any{
@@ -496,6 +575,50 @@ func TestFeishuChannel_ProcessEventReq(t *testing.T) {
 	}
 }
 
+func TestFeishuChannel_CardButtonPress(t *testing.T) {
+	ch, b, mockClient := newFeishuWithMocks(t)
+	err := ch.Send(bus.OutboundMessage{ChatID: "oc_chat", Content: "Which one?", Buttons: [][]bus.Button{
+		{{Label: "Red", Data: "red"}, {Label: "Blue", Data: "blue"}},
+	}})
+	if err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if len(mockClient.editedCards) != 1 || mockClient.editedCards[0].messageID != "om_1" ||
+		!strings.Contains(mockClient.editedCards[0].cardJSON, `"aevitas_button":"1"`) {
+		t.Fatalf("expected buttons added to the reply card, got %+v", mockClient.editedCards)
+	}
+
+	press := func() error {
+		body, _ := json.Marshal(map[string]any{
+			"header": map[string]any{"event_type": "card.action.trigger"},
+			"event": map[string]any{
+				"operator": map[string]any{"open_id": "ou_test"},
+				"action":   map[string]any{"value": map[string]any{"aevitas_button": "1"}},
+				"context":  map[string]any{"open_message_id": "om_1", "open_chat_id": "oc_chat"},
+			},
+		})
+		return ch.processEventReq(context.Background(), &larkevent.EventReq{Body: body})
+	}
+	if err := press(); err != nil {
+		t.Fatalf("processEventReq error: %v", err)
+	}
+	msg := <-b.Inbound
+	if msg.Content != "blue" || msg.MessageID != "om_1" || msg.ChatID != "oc_chat" || msg.Metadata["button"] != "Blue" {
+		t.Fatalf("unexpected inbound: %+v", msg)
+	}
+	answered := mockClient.editedCards[1]
+	if answered.messageID != "om_1" || !strings.Contains(answered.cardJSON, "✅ Blue") || strings.Contains(answered.cardJSON, "aevitas_button") {
+		t.Fatalf("expected card redrawn with the answer, got %+v", answered)
+	}
+
+	press()
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("second press should not publish: %+v", msg)
+	default:
+	}
+}
+
 func TestEncodeFeishuContent_InteractiveUsesRawCardJSON(t *testing.T) {
 	card := `{"config":{"wide_screen_mode":true},"elements":[{"tag":"div","text":{"tag":"lark_md","content":"ok"}}]}`
 	got, err := encodeFeishuContent("interactive", map[string]string{"card": card})
@@ -20,6 +20,7 @@ var (
 
 type ChannelManager struct {
 	channels map[string]Channel
+	debounce map[string]time.Duration // channel name -> inbound merge window
 	logger   sdklogger.Logger
 
 	mu        sync.RWMutex
@@ -40,6 +41,7 @@ type ChannelState struct {
 func NewChannelManager(cfg config.ChannelsConfig, b *bus.MessageBus, logger sdklogger.Logger) (*ChannelManager, error) {
 	m := &ChannelManager{
 		channels: make(map[string]Channel),
+		debounce: make(map[string]time.Duration),
 		logger:   logger,
 		states:   make(map[string]ChannelState),
 	}
@@ -50,13 +52,7 @@ func NewChannelManager(cfg config.ChannelsConfig, b *bus.MessageBus, logger sdkl
 		if err != nil {
 			return nil, fmt.Errorf("init telegram channel: %w", err)
 		}
-		m.channels[ch.Name()] = ch
-		m.states[ch.Name()] = ChannelState{}
-		b.SubscribeOutbound(ch.Name(), func(msg bus.OutboundMessage) {
-			if err := ch.Send(msg); err != nil {
-				logger.Errorf("[channel-mgr] send to %s failed: %v", ch.Name(), err)
-			}
-		})
+		m.add(ch, b, cfg.Telegram.DebounceMs)
 	}
 
 	if cfg.Feishu.Enabled {
@@ -64,13 +60,7 @@ func NewChannelManager(cfg config.ChannelsConfig, b *bus.MessageBus, logger sdkl
 		if err != nil {
 			return nil, fmt.Errorf("init feishu channel: %w", err)
 		}
-		m.channels[ch.Name()] = ch
-		m.states[ch.Name()] = ChannelState{}
-		b.SubscribeOutbound(ch.Name(), func(msg bus.OutboundMessage) {
-			if err := ch.Send(msg); err != nil {
-				logger.Errorf("[channel-mgr] send to %s failed: %v", ch.Name(), err)
-			}
-		})
+		m.add(ch, b, cfg.Feishu.DebounceMs)
 	}
 
 	if cfg.WeCom.Enabled {
@@ -78,18 +68,74 @@ func NewChannelManager(cfg config.ChannelsConfig, b *bus.MessageBus, logger sdkl
 		if err != nil {
 			return nil, fmt.Errorf("init wecom channel: %w", err)
 		}
-		m.channels[ch.Name()] = ch
-		m.states[ch.Name()] = ChannelState{}
-		b.SubscribeOutbound(ch.Name(), func(msg bus.OutboundMessage) {
-			if err := ch.Send(msg); err != nil {
-				logger.Errorf("[channel-mgr] send to %s failed: %v", ch.Name(), err)
-			}
-		})
+		m.add(ch, b, cfg.WeCom.DebounceMs)
+	}
+	if cfg.Slack.Enabled {
+		ch, err := NewSlackChannel(cfg.Slack, b, logger)
+		if err != nil {
+			return nil, fmt.Errorf("init slack channel: %w", err)
+		}
+		m.add(ch, b, cfg.Slack.DebounceMs)
+	}
+
+	if cfg.Discord.Enabled {
+		ch, err := NewDiscordChannel(cfg.Discord, b, logger)
+		if err != nil {
+			return nil, fmt.Errorf("init discord channel: %w", err)
+		}
+		m.add(ch, b, cfg.Discord.DebounceMs)
+	}
+
+	if cfg.Matrix.Enabled {
+		ch, err := NewMatrixChannel(cfg.Matrix, b, logger)
+		if err != nil {
+			return nil, fmt.Errorf("init matrix channel: %w", err)
+		}
+		m.add(ch, b, cfg.Matrix.DebounceMs)
+	}
+
+	if cfg.Webhook.Enabled {
+		ch, err := NewWebhookChannel(cfg.Webhook, b, logger)
+		if err != nil {
+			return nil, fmt.Errorf("init webhook channel: %w", err)
+		}
+		m.add(ch, b, cfg.Webhook.DebounceMs)
+	}
+
+	if cfg.Email.Enabled {
+		ch, err := NewEmailChannel(cfg.Email, b, logger)
+		if err != nil {
+			return nil, fmt.Errorf("init email channel: %w", err)
+		}
+		m.add(ch, b, cfg.Email.DebounceMs)
+	}
+
+	if cfg.Webchat.Enabled {
+		ch, err := NewWebchatChannel(cfg.Webchat, b, logger)
+		if err != nil {
+			return nil, fmt.Errorf("init webchat channel: %w", err)
+		}
+		m.add(ch, b, cfg.Webchat.DebounceMs)
 	}
 
 	return m, nil
 }
 
+// add registers ch with its inbound merge window and subscribes it to the
+// outbound messages addressed to it.
+func (m *ChannelManager) add(ch Channel, b *bus.MessageBus, debounceMs int) {
+	m.channels[ch.Name()] = ch
+	m.states[ch.Name()] = ChannelState{}
+	m.debounce[ch.Name()] = time.Duration(debounceMs) * time.Millisecond
+	subscribeOutbound(b, ch, m.logger)
+}
+
+// DebounceWindow returns the configured window within which consecutive
+// messages to the named channel are merged into one turn, 0 for none.
+func (m *ChannelManager) DebounceWindow(name string) time.Duration {
+	return m.debounce[strings.TrimSpace(name)]
+}
+
 func (m *ChannelManager) StartAll(ctx context.Context) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -148,6 +194,36 @@ func (m *ChannelManager) EnabledChannels() []string {
 	return names
 }
 
+// SetHistorySource gives channels that show past messages, such as the web
+// chat, access to session transcripts.
+func (m *ChannelManager) SetHistorySource(src HistorySource) {
+	for _, ch := range m.channels {
+		if v, ok := ch.(historyViewer); ok {
+			v.SetHistorySource(src)
+		}
+	}
+}
+
+// Capabilities returns what the named channel can show.
+func (m *ChannelManager) Capabilities(name string) (Capabilities, bool) {
+	ch, ok := m.channels[strings.TrimSpace(name)]
+	if !ok {
+		return Capabilities{}, false
+	}
+	return ch.Capabilities(), true
+}
+
+// SupportsPreviewStream reports whether the named channel renders streamed
+// replies: it implements Streamer and can edit sent messages.
+func (m *ChannelManager) SupportsPreviewStream(name string) bool {
+	ch, ok := m.channels[strings.TrimSpace(name)]
+	if !ok {
+		return false
+	}
+	_, ok = ch.(Streamer)
+	return ok && ch.Capabilities().Edit
+}
+
 func (m *ChannelManager) SendNow(msg bus.OutboundMessage) error {
 	channelName := strings.TrimSpace(msg.Channel)
 	if channelName == "" {
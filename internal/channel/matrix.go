@@ -0,0 +1,759 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const matrixChannelName = "matrix"
+
+const (
+	matrixSyncTimeout   = 30 * time.Second
+	matrixRetryMax      = 30 * time.Second
+	matrixTypingTimeout = 30 * time.Second
+	// Events are capped at 64 KiB, and a reply carries its text twice
+	// (plain body and HTML).
+	matrixMaxMessageBytes = 24000
+	matrixHTMLFormat      = "org.matrix.custom.html"
+)
+
+// matrixEncryptedNotice is posted once to an encrypted room, whose messages
+// the bot cannot read.
+const matrixEncryptedNotice = "🔒 机器人不支持端到端加密房间，无法读取这里的消息，请在未加密的房间中使用。"
+
+// MatrixClient is the part of the Matrix client-server API the channel uses.
+type MatrixClient interface {
+	// WhoAmI returns the MXID the access token belongs to.
+	WhoAmI(ctx context.Context) (string, error)
+	Sync(ctx context.Context, since string, timeout time.Duration) (*MatrixSyncResponse, error)
+	JoinRoom(ctx context.Context, roomID string) error
+	// SendEvent sends a room event and returns its event ID.
+	SendEvent(ctx context.Context, roomID, eventType string, content any) (string, error)
+	Redact(ctx context.Context, roomID, eventID string) error
+	SetTyping(ctx context.Context, roomID, userID string, typing bool) error
+	// Upload stores media on the homeserver and returns its mxc:// URI.
+	Upload(ctx context.Context, name, contentType string, data []byte) (string, error)
+	Download(ctx context.Context, mxcURI string) ([]byte, error)
+}
+
+type MatrixClientFactory func(cfg config.MatrixConfig) MatrixClient
+
+// MatrixSyncResponse is the subset of a /sync response the channel reads.
+type MatrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Summary  matrixRoomSummary `json:"summary"`
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+// matrixRoomSummary carries a room's member counts. Sync only sends the
+// counts that changed since the last batch.
+type matrixRoomSummary struct {
+	Joined  *int `json:"m.joined_member_count"`
+	Invited *int `json:"m.invited_member_count"`
+}
+
+type matrixEvent struct {
+	Type           string          `json:"type"`
+	EventID        string          `json:"event_id"`
+	Sender         string          `json:"sender"`
+	StateKey       *string         `json:"state_key"`
+	OriginServerTS int64           `json:"origin_server_ts"`
+	Content        json.RawMessage `json:"content"`
+}
+
+type matrixMessageContent struct {
+	MsgType  string `json:"msgtype"`
+	Body     string `json:"body"`
+	FileName string `json:"filename"`
+	URL      string `json:"url"`
+	Info     struct {
+		Mimetype string `json:"mimetype"`
+		Size     int64  `json:"size"`
+	} `json:"info"`
+	RelatesTo *struct {
+		RelType   string `json:"rel_type"`
+		InReplyTo *struct {
+			EventID string `json:"event_id"`
+		} `json:"m.in_reply_to"`
+	} `json:"m.relates_to"`
+}
+
+type matrixAPIError struct {
+	Method  string
+	Status  int
+	ErrCode string
+	Message string
+}
+
+func (e *matrixAPIError) Error() string {
+	if e.ErrCode == "" {
+		return fmt.Sprintf("matrix %s: http status %d", e.Method, e.Status)
+	}
+	return fmt.Sprintf("matrix %s: %s %s", e.Method, e.ErrCode, e.Message)
+}
+
+func (e *matrixAPIError) IsRetryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500 || e.ErrCode == "M_LIMIT_EXCEEDED"
+}
+
+type defaultMatrixClient struct {
+	homeserver string
+	token      string
+	httpClient *http.Client
+	txn        atomic.Int64
+}
+
+func newDefaultMatrixClient(cfg config.MatrixConfig) MatrixClient {
+	return &defaultMatrixClient{
+		homeserver: strings.TrimRight(strings.TrimSpace(cfg.Homeserver), "/"),
+		token:      cfg.AccessToken,
+		// Long enough for a /sync long-poll.
+		httpClient: &http.Client{Timeout: matrixSyncTimeout + 30*time.Second},
+	}
+}
+
+// do sends a request to the homeserver and decodes the JSON reply into out.
+func (c *defaultMatrixClient) do(ctx context.Context, method, path string, body io.Reader, contentType string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.homeserver+path, body)
+	if err != nil {
+		return fmt.Errorf("create matrix request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("matrix %s: %w", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		_ = json.Unmarshal(raw, &apiErr)
+		return &matrixAPIError{Method: req.URL.Path, Status: resp.StatusCode, ErrCode: apiErr.ErrCode, Message: apiErr.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if buf, ok := out.(*[]byte); ok {
+		*buf = raw
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("decode matrix %s response: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+func (c *defaultMatrixClient) doJSON(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encode matrix request: %w", err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	return c.do(ctx, method, path, reader, "application/json", out)
+}
+
+func (c *defaultMatrixClient) nextTxnID() string {
+	return fmt.Sprintf("aevitas-%d-%d", time.Now().UnixNano(), c.txn.Add(1))
+}
+
+func (c *defaultMatrixClient) WhoAmI(ctx context.Context) (string, error) {
+	var out struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &out); err != nil {
+		return "", err
+	}
+	return out.UserID, nil
+}
+
+func (c *defaultMatrixClient) Sync(ctx context.Context, since string, timeout time.Duration) (*MatrixSyncResponse, error) {
+	q := url.Values{"timeout": {fmt.Sprint(timeout.Milliseconds())}}
+	if since != "" {
+		q.Set("since", since)
+	}
+	var out MatrixSyncResponse
+	if err := c.doJSON(ctx, http.MethodGet, "/_matrix/client/v3/sync?"+q.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *defaultMatrixClient) JoinRoom(ctx context.Context, roomID string) error {
+	return c.doJSON(ctx, http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(roomID), map[string]any{}, nil)
+}
+
+func (c *defaultMatrixClient) SendEvent(ctx context.Context, roomID, eventType string, content any) (string, error) {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/%s/%s", url.PathEscape(roomID), url.PathEscape(eventType), c.nextTxnID())
+	var out struct {
+		EventID string `json:"event_id"`
+	}
+	if err := c.doJSON(ctx, http.MethodPut, path, content, &out); err != nil {
+		return "", err
+	}
+	return out.EventID, nil
+}
+
+func (c *defaultMatrixClient) Redact(ctx context.Context, roomID, eventID string) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/redact/%s/%s", url.PathEscape(roomID), url.PathEscape(eventID), c.nextTxnID())
+	return c.doJSON(ctx, http.MethodPut, path, map[string]any{}, nil)
+}
+
+func (c *defaultMatrixClient) SetTyping(ctx context.Context, roomID, userID string, typing bool) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/typing/%s", url.PathEscape(roomID), url.PathEscape(userID))
+	body := map[string]any{"typing": typing}
+	if typing {
+		body["timeout"] = matrixTypingTimeout.Milliseconds()
+	}
+	return c.doJSON(ctx, http.MethodPut, path, body, nil)
+}
+
+func (c *defaultMatrixClient) Upload(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	var out struct {
+		ContentURI string `json:"content_uri"`
+	}
+	path := "/_matrix/media/v3/upload?filename=" + url.QueryEscape(name)
+	if err := c.do(ctx, http.MethodPost, path, bytes.NewReader(data), contentType, &out); err != nil {
+		return "", err
+	}
+	return out.ContentURI, nil
+}
+
+// Download fetches mxc:// media, preferring authenticated media and falling
+// back to the legacy endpoint on older homeservers.
+func (c *defaultMatrixClient) Download(ctx context.Context, mxcURI string) ([]byte, error) {
+	serverAndID, ok := strings.CutPrefix(mxcURI, "mxc://")
+	if !ok || !strings.Contains(serverAndID, "/") {
+		return nil, fmt.Errorf("invalid mxc uri: %s", mxcURI)
+	}
+	var data []byte
+	err := c.do(ctx, http.MethodGet, "/_matrix/client/v1/media/download/"+serverAndID, nil, "", &data)
+	var apiErr *matrixAPIError
+	if err != nil && errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.ErrCode == "M_UNRECOGNIZED") {
+		err = c.do(ctx, http.MethodGet, "/_matrix/media/v3/download/"+serverAndID, nil, "", &data)
+	}
+	return data, err
+}
+
+// MatrixChannel syncs a bot account with /sync long-polling. Each room is a
+// chat. Encrypted rooms are not supported: their events cannot be decrypted
+// without an Olm/Megolm implementation, so they are skipped and the room is
+// told once that the bot cannot read it.
+type MatrixChannel struct {
+	BaseChannel
+	cfg           config.MatrixConfig
+	client        MatrixClient
+	clientFactory MatrixClientFactory
+	allowServers  map[string]bool
+	markdown      goldmark.Markdown
+	cancel        context.CancelFunc
+	stream        *streamRenderer
+
+	mu            sync.Mutex
+	userID        string
+	since         string
+	warnedRooms   map[string]bool // encrypted rooms already logged
+	members       map[string]matrixMembers
+	syncRetryBase time.Duration
+}
+
+func NewMatrixChannel(cfg config.MatrixConfig, b *bus.MessageBus, logger sdklogger.Logger) (*MatrixChannel, error) {
+	return NewMatrixChannelWithFactory(cfg, b, newDefaultMatrixClient, logger)
+}
+
+// NewMatrixChannelWithFactory creates a MatrixChannel with a custom client factory (for testing)
+func NewMatrixChannelWithFactory(cfg config.MatrixConfig, b *bus.MessageBus, factory MatrixClientFactory, logger sdklogger.Logger) (*MatrixChannel, error) {
+	if cfg.Homeserver == "" || cfg.AccessToken == "" {
+		return nil, fmt.Errorf("matrix homeserver and accessToken are required")
+	}
+	servers := make(map[string]bool)
+	for _, entry := range cfg.AllowFrom {
+		if entry = strings.TrimSpace(entry); entry != "" && !strings.HasPrefix(entry, "@") {
+			servers[strings.TrimPrefix(entry, ":")] = true
+		}
+	}
+	ch := &MatrixChannel{
+		BaseChannel:   NewBaseChannel(matrixChannelName, b, cfg.AllowFrom, logger),
+		cfg:           cfg,
+		clientFactory: factory,
+		allowServers:  servers,
+		markdown:      goldmark.New(goldmark.WithExtensions(extension.GFM)),
+		warnedRooms:   make(map[string]bool),
+		members:       make(map[string]matrixMembers),
+		syncRetryBase: time.Second,
+	}
+	ch.stream = newStreamingRenderer(ch, streamOptions{
+		name:          matrixChannelName,
+		maxDraftRunes: 8000,
+		editInterval:  defaultStreamEditInterval,
+	}, logger)
+	return ch, nil
+}
+
+// IsAllowed accepts senders listed by MXID or by homeserver.
+func (m *MatrixChannel) IsAllowed(senderID string) bool {
+	if m.BaseChannel.IsAllowed(senderID) {
+		return true
+	}
+	_, server, ok := strings.Cut(senderID, ":")
+	return ok && m.allowServers[server]
+}
+
+func (m *MatrixChannel) Start(ctx context.Context) error {
+	m.client = m.clientFactory(m.cfg)
+	userID, err := m.client.WhoAmI(ctx)
+	if err != nil {
+		return fmt.Errorf("matrix whoami: %w", err)
+	}
+	// The first sync only catches up: history from before start is not
+	// answered, but pending invites are and member counts are kept.
+	initial, err := m.client.Sync(ctx, "", 0)
+	if err != nil {
+		return fmt.Errorf("matrix initial sync: %w", err)
+	}
+	m.mu.Lock()
+	m.userID = userID
+	m.since = initial.NextBatch
+	m.mu.Unlock()
+	for roomID, room := range initial.Rooms.Join {
+		m.updateMembers(roomID, room.Summary)
+	}
+	m.handleInvites(ctx, initial)
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	go m.runSync(ctx)
+	m.logger.Infof("[matrix] sync started as %s", userID)
+	return nil
+}
+
+func (m *MatrixChannel) Stop() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.logger.Infof("[matrix] stopped")
+	return nil
+}
+
+// runSync long-polls /sync until ctx is done, backing off after errors.
+func (m *MatrixChannel) runSync(ctx context.Context) {
+	backoff := m.syncRetryBase
+	for ctx.Err() == nil {
+		m.mu.Lock()
+		since := m.since
+		m.mu.Unlock()
+		resp, err := m.client.Sync(ctx, since, matrixSyncTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.logger.Warnf("[matrix] sync failed: %v (retry in %s)", err, backoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			backoff *= 2
+			if backoff > matrixRetryMax {
+				backoff = matrixRetryMax
+			}
+			continue
+		}
+		backoff = m.syncRetryBase
+		m.handleInvites(ctx, resp)
+		for roomID, room := range resp.Rooms.Join {
+			m.updateMembers(roomID, room.Summary)
+			for _, ev := range room.Timeline.Events {
+				m.handleEvent(roomID, ev)
+			}
+		}
+		m.mu.Lock()
+		m.since = resp.NextBatch
+		m.mu.Unlock()
+	}
+}
+
+// matrixMembers is the last known member count of a room.
+type matrixMembers struct {
+	joined, invited int
+}
+
+func (m *MatrixChannel) updateMembers(roomID string, summary matrixRoomSummary) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.members[roomID]
+	if summary.Joined != nil {
+		counts.joined = *summary.Joined
+	}
+	if summary.Invited != nil {
+		counts.invited = *summary.Invited
+	}
+	m.members[roomID] = counts
+}
+
+// isDirectRoom reports whether roomID holds only the bot and one other user.
+func (m *MatrixChannel) isDirectRoom(roomID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.members[roomID]
+	return counts.joined+counts.invited == 2
+}
+
+// handleInvites joins rooms the bot was invited to by an allowed user.
+func (m *MatrixChannel) handleInvites(ctx context.Context, resp *MatrixSyncResponse) {
+	m.mu.Lock()
+	self := m.userID
+	m.mu.Unlock()
+	for roomID, room := range resp.Rooms.Invite {
+		for _, ev := range room.InviteState.Events {
+			if ev.Type != "m.room.member" || ev.StateKey == nil || *ev.StateKey != self {
+				continue
+			}
+			if !m.IsAllowed(ev.Sender) {
+				m.logger.Warnf("[matrix] ignored invite to %s from %s", roomID, ev.Sender)
+				break
+			}
+			if err := m.client.JoinRoom(ctx, roomID); err != nil {
+				m.logger.Warnf("[matrix] join %s failed: %v", roomID, err)
+			}
+			break
+		}
+	}
+}
+
+func (m *MatrixChannel) handleEvent(roomID string, ev matrixEvent) {
+	m.mu.Lock()
+	self := m.userID
+	m.mu.Unlock()
+	if ev.Sender == self {
+		return
+	}
+	if ev.Type == "m.room.encrypted" {
+		m.mu.Lock()
+		warned := m.warnedRooms[roomID]
+		m.warnedRooms[roomID] = true
+		m.mu.Unlock()
+		if !warned {
+			m.logger.Warnf("[matrix] room %s is encrypted; encrypted messages are not supported and will be ignored", roomID)
+			if m.IsAllowed(ev.Sender) {
+				content := m.textContent("m.notice", matrixEncryptedNotice, "")
+				if _, err := m.client.SendEvent(context.Background(), roomID, "m.room.message", content); err != nil {
+					m.logger.Warnf("[matrix] encrypted room notice to %s failed: %v", roomID, err)
+				}
+			}
+		}
+		return
+	}
+	if ev.Type != "m.room.message" {
+		return
+	}
+	var msg matrixMessageContent
+	if err := json.Unmarshal(ev.Content, &msg); err != nil {
+		return
+	}
+	if msg.RelatesTo != nil && msg.RelatesTo.RelType == "m.replace" {
+		return // edits of earlier messages
+	}
+	if !m.IsAllowed(ev.Sender) {
+		m.logger.Warnf("[matrix] rejected message from %s", ev.Sender)
+		return
+	}
+
+	content := ""
+	var attachments []bus.Attachment
+	addMedia := func(kind bus.AttachmentKind) {
+		localPath, err := m.downloadMedia(msg.URL, msg.FileName, msg.Body)
+		if err != nil {
+			m.logger.Warnf("failed to download %s: %v", msg.MsgType, err)
+			return
+		}
+		attachments = append(attachments, bus.Attachment{
+			Path: localPath,
+			Kind: kind,
+			MIME: strings.TrimSpace(msg.Info.Mimetype),
+			Size: msg.Info.Size,
+		})
+		m.logger.Debugf("downloaded %s to %s", msg.MsgType, localPath)
+		// A body that differs from the file name is a caption.
+		if msg.FileName != "" && msg.Body != msg.FileName {
+			content = msg.Body
+		}
+	}
+	switch msg.MsgType {
+	case "m.text", "m.notice", "m.emote":
+		content = msg.Body
+		if msg.RelatesTo != nil && msg.RelatesTo.InReplyTo != nil {
+			content = stripMatrixReplyFallback(content)
+		}
+	case "m.image":
+		addMedia(bus.AttachmentImage)
+	case "m.audio":
+		addMedia(bus.AttachmentAudio)
+	case "m.file":
+		addMedia(attachmentKindOf(msg.Body, strings.ToLower(msg.Info.Mimetype)))
+	}
+	content = strings.TrimSpace(content)
+
+	// Skip messages with no content and no media
+	if content == "" && len(attachments) == 0 {
+		return
+	}
+
+	// Typing notices expire, so refresh them until the reply is under way.
+	stopTyping := make(chan struct{})
+	go func() {
+		ctx := context.Background()
+		ticker := time.NewTicker(matrixTypingTimeout * 2 / 3)
+		defer ticker.Stop()
+		m.client.SetTyping(ctx, roomID, self, true)
+		for {
+			select {
+			case <-stopTyping:
+				m.client.SetTyping(ctx, roomID, self, false)
+				return
+			case <-ticker.C:
+				m.client.SetTyping(ctx, roomID, self, true)
+			}
+		}
+	}()
+	typing := bus.NewTyping(func() { close(stopTyping) })
+
+	if !m.bus.PublishInbound(bus.InboundMessage{
+		Channel:     matrixChannelName,
+		SenderID:    ev.Sender,
+		ChatID:      roomID,
+		MessageID:   ev.EventID,
+		Content:     content,
+		Attachments: attachments,
+		Timestamp:   time.UnixMilli(ev.OriginServerTS),
+		Typing:      typing,
+		Direct:      m.isDirectRoom(roomID),
+	}) {
+		m.logger.Debugf("[matrix] duplicate message dropped: %s", ev.EventID)
+		typing.Stop()
+	}
+}
+
+// stripMatrixReplyFallback drops the quoted original that clients put in
+// front of a reply's body.
+func stripMatrixReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i == 0 {
+		return body
+	}
+	if i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+func (m *MatrixChannel) downloadMedia(mxcURI, fileName, body string) (string, error) {
+	data, err := m.client.Download(context.Background(), mxcURI)
+	if err != nil {
+		return "", err
+	}
+	name := fileName
+	if name == "" {
+		name = body
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-matrix-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return "", fmt.Errorf("create temp dir: %w", err)
+	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(name)))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return "", fmt.Errorf("save file: %w", err)
+	}
+	return localPath, nil
+}
+
+func (m *MatrixChannel) Capabilities() Capabilities {
+	return Capabilities{
+		MaxMessageBytes: matrixMaxMessageBytes,
+		Edit:            true,
+		Markdown:        MarkdownFull,
+		Media:           []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+	}
+}
+
+func (m *MatrixChannel) Send(msg bus.OutboundMessage) error {
+	if m.client == nil {
+		return fmt.Errorf("matrix client not initialized")
+	}
+	roomID := strings.TrimSpace(msg.ChatID)
+	if roomID == "" {
+		return fmt.Errorf("matrix room id is required")
+	}
+	switch msg.Kind {
+	case bus.KindPreviewUpdate:
+		return m.stream.Update(roomID, msg.Content, msg.ReplyTo)
+	case bus.KindPreviewFinal:
+		return m.stream.Finalize(roomID, msg.Content, msg.ReplyTo)
+	case bus.KindToolProgress:
+		return m.stream.ToolProgress(roomID, msg)
+	}
+
+	replyTo := msg.ReplyTo
+	for _, att := range msg.Attachments {
+		data, err := os.ReadFile(att.Path)
+		if err == nil {
+			err = m.sendMedia(roomID, att, filepath.Base(att.Path), data, replyTo)
+		}
+		if err != nil {
+			m.logger.Warnf("[matrix] send media %s failed: %v", att.Path, err)
+			continue
+		}
+		replyTo = ""
+	}
+	if strings.TrimSpace(msg.Content) == "" {
+		return nil
+	}
+	_, err := m.client.SendEvent(context.Background(), roomID, "m.room.message", m.textContent("m.text", msg.Content, replyTo))
+	return err
+}
+
+func (m *MatrixChannel) sendMedia(roomID string, att bus.Attachment, name string, data []byte, replyTo string) error {
+	mimeType := att.MIME
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	if att.Kind == "" {
+		att.Kind = attachmentKindOf(name, mimeType)
+	}
+	uri, err := m.client.Upload(context.Background(), name, mimeType, data)
+	if err != nil {
+		return err
+	}
+	msgType := "m.file"
+	switch att.Kind {
+	case bus.AttachmentImage:
+		msgType = "m.image"
+	case bus.AttachmentAudio:
+		msgType = "m.audio"
+	}
+	content := map[string]any{
+		"msgtype":  msgType,
+		"body":     name,
+		"filename": name,
+		"url":      uri,
+		"info":     map[string]any{"mimetype": mimeType, "size": len(data)},
+	}
+	if replyTo != "" {
+		content["m.relates_to"] = map[string]any{"m.in_reply_to": map[string]string{"event_id": replyTo}}
+	}
+	_, err = m.client.SendEvent(context.Background(), roomID, "m.room.message", content)
+	return err
+}
+
+// textContent builds a message with the Markdown rendered as HTML next to
+// the plain body.
+func (m *MatrixChannel) textContent(msgType, markdown, replyTo string) map[string]any {
+	content := map[string]any{"msgtype": msgType, "body": markdown}
+	var html bytes.Buffer
+	if err := m.markdown.Convert([]byte(markdown), &html); err == nil {
+		content["format"] = matrixHTMLFormat
+		content["formatted_body"] = strings.TrimSpace(html.String())
+	}
+	if replyTo != "" {
+		content["m.relates_to"] = map[string]any{"m.in_reply_to": map[string]string{"event_id": replyTo}}
+	}
+	return content
+}
+
+// StreamingRenderer implements Streamer.
+func (m *MatrixChannel) StreamingRenderer() StreamingRenderer {
+	return m.stream
+}
+
+// CreateBlock implements StreamTarget. The tool block is a notice so clients
+// and bridges treat it as bot chatter.
+func (m *MatrixChannel) CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error) {
+	msgType := "m.text"
+	if block == StreamToolBlock {
+		msgType = "m.notice"
+	}
+	return m.client.SendEvent(context.Background(), chatID, "m.room.message", m.textContent(msgType, text, replyTo))
+}
+
+// EditBlock implements StreamTarget with an m.replace edit.
+func (m *MatrixChannel) EditBlock(chatID, messageID string, block StreamBlock, text string) error {
+	msgType := "m.text"
+	if block == StreamToolBlock {
+		msgType = "m.notice"
+	}
+	return m.replace(chatID, messageID, m.textContent(msgType, text, ""))
+}
+
+func (m *MatrixChannel) replace(roomID, eventID string, newContent map[string]any) error {
+	content := map[string]any{
+		"msgtype":       newContent["msgtype"],
+		"body":          "* " + fmt.Sprint(newContent["body"]),
+		"m.new_content": newContent,
+		"m.relates_to":  map[string]string{"rel_type": "m.replace", "event_id": eventID},
+	}
+	_, err := m.client.SendEvent(context.Background(), roomID, "m.room.message", content)
+	return err
+}
+
+// DeleteBlock implements StreamTarget.
+func (m *MatrixChannel) DeleteBlock(chatID, messageID string) error {
+	return m.client.Redact(context.Background(), chatID, messageID)
+}
+
+// SendReply implements StreamTarget. The reply is sent with its HTML
+// rendering and replaces the draft with an edit.
+func (m *MatrixChannel) SendReply(chatID, text, draftID, replyTo string) error {
+	if draftID != "" {
+		if err := m.replace(chatID, draftID, m.textContent("m.text", text, "")); err == nil {
+			return nil
+		}
+	}
+	_, err := m.client.SendEvent(context.Background(), chatID, "m.room.message", m.textContent("m.text", text, replyTo))
+	return err
+}
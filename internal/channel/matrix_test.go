@@ -0,0 +1,302 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+type matrixCall struct {
+	method string
+	path   string
+	body   map[string]any
+}
+
+// matrixStub is a minimal homeserver. The first /sync returns the initial
+// batch; later ones return batches queued by the test, or nothing after a
+// short long-poll.
+type matrixStub struct {
+	srv     *httptest.Server
+	mu      sync.Mutex
+	calls   []matrixCall
+	nextID  int
+	initial string
+	batches chan string
+}
+
+func newMatrixStub(t *testing.T) *matrixStub {
+	s := &matrixStub{batches: make(chan string, 8), initial: `{"next_batch": "s1"}`}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+func (s *matrixStub) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer syt-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "bad token"}`))
+		return
+	}
+	path := r.URL.EscapedPath()
+	var body map[string]any
+	if raw, _ := io.ReadAll(r.Body); len(raw) > 0 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		json.Unmarshal(raw, &body)
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, matrixCall{method: r.Method, path: path, body: body})
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+
+	switch {
+	case path == "/_matrix/client/v3/account/whoami":
+		w.Write([]byte(`{"user_id": "@bot:example.org"}`))
+	case path == "/_matrix/client/v3/sync":
+		if r.URL.Query().Get("since") == "" {
+			w.Write([]byte(s.initial))
+			return
+		}
+		select {
+		case batch := <-s.batches:
+			w.Write([]byte(batch))
+		case <-time.After(20 * time.Millisecond):
+			fmt.Fprintf(w, `{"next_batch": %q}`, r.URL.Query().Get("since"))
+		case <-r.Context().Done():
+		}
+	case strings.Contains(path, "/send/") || strings.Contains(path, "/redact/"):
+		fmt.Fprintf(w, `{"event_id": "$e%d"}`, id)
+	case path == "/_matrix/media/v3/upload":
+		w.Write([]byte(`{"content_uri": "mxc://example.org/up1"}`))
+	case path == "/_matrix/client/v1/media/download/example.org/img1":
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode": "M_UNRECOGNIZED"}`))
+	case path == "/_matrix/media/v3/download/example.org/img1":
+		w.Write([]byte("jpeg-bytes"))
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+func (s *matrixStub) callsMatching(method, pathPart string) []matrixCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []matrixCall
+	for _, c := range s.calls {
+		if c.method == method && strings.Contains(c.path, pathPart) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func startTestMatrixChannel(t *testing.T, s *matrixStub, allowFrom []string) (*MatrixChannel, *bus.MessageBus) {
+	t.Helper()
+	b := bus.NewMessageBus(10)
+	ch, err := NewMatrixChannel(config.MatrixConfig{
+		Enabled:     true,
+		Homeserver:  s.srv.URL,
+		AccessToken: "syt-test",
+		AllowFrom:   allowFrom,
+	}, b, sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewMatrixChannel: %v", err)
+	}
+	if err := ch.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { ch.Stop() })
+	return ch, b
+}
+
+func matrixBatch(next, roomID string, events ...string) string {
+	return fmt.Sprintf(`{"next_batch": %q, "rooms": {"join": {%q: {"timeline": {"events": [%s]}}}}}`, next, roomID, strings.Join(events, ","))
+}
+
+func TestMatrixChannel_SyncInbound(t *testing.T) {
+	s := newMatrixStub(t)
+	// History in the initial batch is not answered; the invite is accepted.
+	s.initial = `{"next_batch": "s1", "rooms": {
+		"join": {"!old:example.org": {"timeline": {"events": [{"type": "m.room.message", "event_id": "$old", "sender": "@alice:example.org", "content": {"msgtype": "m.text", "body": "old"}}]}}},
+		"invite": {"!new:example.org": {"invite_state": {"events": [{"type": "m.room.member", "state_key": "@bot:example.org", "sender": "@alice:example.org", "content": {"membership": "invite"}}]}}}
+	}}`
+	_, b := startTestMatrixChannel(t, s, []string{"example.org", "@carol:other.org"})
+
+	if joins := s.callsMatching(http.MethodPost, "/join/%21new:example.org"); len(joins) != 1 {
+		t.Fatalf("invite from an allowed user should be accepted: %+v", s.calls)
+	}
+
+	room := "!r:example.org"
+	s.batches <- matrixBatch("s2", room,
+		`{"type": "m.room.message", "event_id": "$self", "sender": "@bot:example.org", "content": {"msgtype": "m.text", "body": "echo"}}`,
+		`{"type": "m.room.message", "event_id": "$stranger", "sender": "@mallory:evil.org", "content": {"msgtype": "m.text", "body": "hi"}}`,
+		`{"type": "m.room.encrypted", "event_id": "$enc", "sender": "@alice:example.org", "content": {}}`,
+		`{"type": "m.room.encrypted", "event_id": "$enc2", "sender": "@alice:example.org", "content": {}}`,
+		`{"type": "m.room.message", "event_id": "$1", "sender": "@alice:example.org", "origin_server_ts": 1700000000000,
+			"content": {"msgtype": "m.text", "body": "> <@bot:example.org> earlier\n\nreply text", "m.relates_to": {"m.in_reply_to": {"event_id": "$0"}}}}`,
+		`{"type": "m.room.message", "event_id": "$2", "sender": "@carol:other.org",
+			"content": {"msgtype": "m.image", "body": "look", "filename": "cat.jpg", "url": "mxc://example.org/img1", "info": {"mimetype": "image/jpeg", "size": 10}}}`,
+		`{"type": "m.room.message", "event_id": "$3", "sender": "@alice:example.org",
+			"content": {"msgtype": "m.text", "body": "* edited", "m.relates_to": {"rel_type": "m.replace", "event_id": "$1"}}}`,
+	)
+
+	var got []bus.InboundMessage
+	for len(got) < 2 {
+		select {
+		case msg := <-b.Inbound:
+			msg.Typing.Stop()
+			got = append(got, msg)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected 2 messages, got %+v", got)
+		}
+	}
+	if got[0].ChatID != room || got[0].MessageID != "$1" || got[0].Content != "reply text" || got[0].Timestamp.UnixMilli() != 1700000000000 {
+		t.Fatalf("unexpected text message: %+v", got[0])
+	}
+	img := got[1]
+	if img.SenderID != "@carol:other.org" || img.Content != "look" || len(img.Attachments) != 1 || img.Attachments[0].Kind != bus.AttachmentImage {
+		t.Fatalf("unexpected image message: %+v", img)
+	}
+	data, _ := os.ReadFile(img.Attachments[0].Path)
+	os.Remove(img.Attachments[0].Path)
+	if string(data) != "jpeg-bytes" {
+		t.Fatalf("media should fall back to the legacy download endpoint, got %q", data)
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("filtered event was published: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if typing := s.callsMatching(http.MethodPut, "/typing/"); len(typing) == 0 {
+		t.Fatal("typing notice should be sent while the turn runs")
+	}
+	notices := s.callsMatching(http.MethodPut, "/rooms/%21r:example.org/send/m.room.message/")
+	if len(notices) != 1 || notices[0].body["msgtype"] != "m.notice" || notices[0].body["body"] != matrixEncryptedNotice {
+		t.Fatalf("an encrypted room should be told once that it cannot be read: %+v", notices)
+	}
+}
+
+func TestMatrixChannel_DirectRoomFromMemberCounts(t *testing.T) {
+	s := newMatrixStub(t)
+	s.initial = `{"next_batch": "s1", "rooms": {"join": {
+		"!dm:example.org": {"summary": {"m.joined_member_count": 2}},
+		"!group:example.org": {"summary": {"m.joined_member_count": 5}}
+	}}}`
+	_, b := startTestMatrixChannel(t, s, nil)
+
+	text := `{"type": "m.room.message", "event_id": "$%d", "sender": "@alice:example.org", "content": {"msgtype": "m.text", "body": "hi"}}`
+	s.batches <- matrixBatch("s2", "!dm:example.org", fmt.Sprintf(text, 1))
+	s.batches <- matrixBatch("s3", "!group:example.org", fmt.Sprintf(text, 2))
+	// Later batches only carry the counts that changed.
+	s.batches <- `{"next_batch": "s4", "rooms": {"join": {"!group:example.org": {"summary": {"m.joined_member_count": 2},
+		"timeline": {"events": [` + fmt.Sprintf(text, 3) + `]}}}}}`
+
+	for _, want := range []bool{true, false, true} {
+		select {
+		case msg := <-b.Inbound:
+			msg.Typing.Stop()
+			if msg.Direct != want {
+				t.Fatalf("message %s in %s: direct = %v, want %v", msg.MessageID, msg.ChatID, msg.Direct, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+}
+
+func TestMatrixChannel_AllowFromByMXIDOrServer(t *testing.T) {
+	ch, err := NewMatrixChannel(config.MatrixConfig{
+		Homeserver:  "https://example.org",
+		AccessToken: "syt-test",
+		AllowFrom:   []string{"@alice:one.org", ":two.org"},
+	}, bus.NewMessageBus(1), sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewMatrixChannel: %v", err)
+	}
+	for sender, want := range map[string]bool{
+		"@alice:one.org": true,
+		"@bob:one.org":   false,
+		"@bob:two.org":   true,
+		"@bob:three.org": false,
+	} {
+		if got := ch.IsAllowed(sender); got != want {
+			t.Errorf("IsAllowed(%s) = %v, want %v", sender, got, want)
+		}
+	}
+}
+
+func TestMatrixChannel_SendRepliesWithHTMLAndMedia(t *testing.T) {
+	s := newMatrixStub(t)
+	ch, _ := startTestMatrixChannel(t, s, nil)
+
+	path := t.TempDir() + "/chart.png"
+	os.WriteFile(path, []byte("png-data"), 0644)
+	err := ch.Send(bus.OutboundMessage{ChatID: "!r:example.org", ReplyTo: "$1", Content: "**done**", Attachments: bus.PathAttachments(path)})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if uploads := s.callsMatching(http.MethodPost, "/_matrix/media/v3/upload"); len(uploads) != 1 {
+		t.Fatalf("expected one upload, got %d", len(uploads))
+	}
+	sends := s.callsMatching(http.MethodPut, "/send/m.room.message/")
+	if len(sends) != 2 {
+		t.Fatalf("expected media and text events, got %d", len(sends))
+	}
+	media, text := sends[0].body, sends[1].body
+	if media["msgtype"] != "m.image" || media["url"] != "mxc://example.org/up1" || media["m.relates_to"] == nil {
+		t.Fatalf("unexpected media event: %v", media)
+	}
+	if text["body"] != "**done**" || text["formatted_body"] != "<p><strong>done</strong></p>" || text["m.relates_to"] != nil {
+		t.Fatalf("unexpected text event: %v", text)
+	}
+}
+
+func TestMatrixChannel_PreviewStreamUsesReplaceEdits(t *testing.T) {
+	s := newMatrixStub(t)
+	ch, _ := startTestMatrixChannel(t, s, nil)
+	ch.stream.opts.editInterval = 0
+	room := "!r:example.org"
+
+	if err := ch.Send(bus.OutboundMessage{Kind: bus.KindPreviewUpdate, ChatID: room, ReplyTo: "$1", Content: "partial"}); err != nil {
+		t.Fatalf("preview update: %v", err)
+	}
+	if err := ch.Send(bus.OutboundMessage{Kind: bus.KindPreviewFinal, ChatID: room, ReplyTo: "$1", Content: "final [answer](https://x.io)\n\n```\nx := 1\n```"}); err != nil {
+		t.Fatalf("preview final: %v", err)
+	}
+
+	sends := s.callsMatching(http.MethodPut, "/send/m.room.message/")
+	if len(sends) != 4 {
+		t.Fatalf("expected tool block, draft and two edits, got %d", len(sends))
+	}
+	if sends[0].body["msgtype"] != "m.notice" || sends[1].body["m.relates_to"] == nil {
+		t.Fatalf("tool block should be a notice and the draft a reply: %v / %v", sends[0].body, sends[1].body)
+	}
+	final := sends[3].body
+	rel, _ := final["m.relates_to"].(map[string]any)
+	newContent, _ := final["m.new_content"].(map[string]any)
+	if rel["rel_type"] != "m.replace" || rel["event_id"] != sends[2].body["m.relates_to"].(map[string]any)["event_id"] {
+		t.Fatalf("final should replace the draft: %v", final)
+	}
+	if !strings.HasPrefix(fmt.Sprint(newContent["body"]), "final [answer](https://x.io)") || newContent["format"] != matrixHTMLFormat {
+		t.Fatalf("unexpected replacement content: %v", final)
+	}
+	html := fmt.Sprint(newContent["formatted_body"])
+	if !strings.Contains(html, `<a href="https://x.io">answer</a>`) || !strings.Contains(html, "<pre><code>x := 1") {
+		t.Fatalf("final should keep links and code blocks in formatted_body: %q", html)
+	}
+	if redacts := s.callsMatching(http.MethodPut, "/redact/"); len(redacts) != 1 {
+		t.Fatalf("unused tool block should be redacted, got %d", len(redacts))
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
 )
 
 const audioDurationFallbackMillis = 1000
@@ -89,9 +91,23 @@ func transcodeToFeishuOpus(srcPath string) (string, error) {
 }
 
 func detectAudioDurationMillis(mediaPath string) int {
+	seconds := probeDurationSeconds(mediaPath)
+	if seconds <= 0 {
+		return audioDurationFallbackMillis
+	}
+	ms := int(seconds * 1000)
+	if ms < audioDurationFallbackMillis {
+		return audioDurationFallbackMillis
+	}
+	return ms
+}
+
+// probeDurationSeconds returns the duration of a media file, or 0 when it
+// cannot be determined.
+func probeDurationSeconds(mediaPath string) float64 {
 	ffprobePath, err := resolveLocalOrSystemBinary("ffprobe")
 	if err != nil {
-		return audioDurationFallbackMillis
+		return 0
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -103,15 +119,98 @@ func detectAudioDurationMillis(mediaPath string) int {
 	)
 	out, err := cmd.Output()
 	if err != nil {
-		return audioDurationFallbackMillis
+		return 0
 	}
 	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
 	if err != nil || seconds <= 0 {
-		return audioDurationFallbackMillis
+		return 0
 	}
-	ms := int(seconds * 1000)
-	if ms < audioDurationFallbackMillis {
-		return audioDurationFallbackMillis
+	return seconds
+}
+
+// extractVideoKeyframes saves up to maxFrames JPEG frames spread evenly over
+// the video, scaled down to at most 1280 pixels wide.
+func extractVideoKeyframes(srcPath, tempDir string, maxFrames int) ([]string, error) {
+	ffmpegPath, err := resolveLocalOrSystemBinary("ffmpeg")
+	if err != nil {
+		return nil, err
 	}
-	return ms
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	fps := 1.0
+	if seconds := probeDurationSeconds(srcPath); seconds > float64(maxFrames) {
+		fps = float64(maxFrames) / seconds
+	}
+	pattern := filepath.Join(tempDir, fmt.Sprintf("frame-%d-%%02d.jpg", time.Now().UnixNano()))
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-y",
+		"-i", srcPath,
+		"-vf", fmt.Sprintf("fps=%.6f,scale='min(1280,iw)':-2", fps),
+		"-frames:v", strconv.Itoa(maxFrames),
+		"-q:v", "3",
+		pattern,
+	)
+	out, err := cmd.CombinedOutput()
+	frames, _ := filepath.Glob(strings.Replace(pattern, "%02d", "*", 1))
+	if err != nil {
+		for _, f := range frames {
+			_ = os.Remove(f)
+		}
+		return nil, fmt.Errorf("ffmpeg keyframes failed: %v output=%s", err, strings.TrimSpace(string(out)))
+	}
+	return frames, nil
+}
+
+// extractVideoAudio saves the audio track of a video as Opus. Videos without
+// sound return an error.
+func extractVideoAudio(srcPath, tempDir string) (string, error) {
+	ffmpegPath, err := resolveLocalOrSystemBinary("ffmpeg")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return "", fmt.Errorf("create temp dir: %w", err)
+	}
+	dstPath := filepath.Join(tempDir, fmt.Sprintf("video-audio-%d.ogg", time.Now().UnixNano()))
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-y",
+		"-i", srcPath,
+		"-vn",
+		"-map", "0:a:0",
+		"-c:a", "libopus",
+		"-b:a", "48k",
+		"-application", "voip",
+		dstPath,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(dstPath)
+		return "", fmt.Errorf("ffmpeg audio extract failed: %v output=%s", err, strings.TrimSpace(string(out)))
+	}
+	return dstPath, nil
+}
+
+// maxVideoKeyframes is how many frames of an inbound video reach the model.
+const maxVideoKeyframes = 4
+
+// videoAttachments turns a video into what a model can take in: keyframes
+// as images and the soundtrack as audio, which is transcribed like a voice
+// message. A video without sound yields only frames.
+func videoAttachments(srcPath, tempDir string) ([]bus.Attachment, error) {
+	frames, err := extractVideoKeyframes(srcPath, tempDir, maxVideoKeyframes)
+	if err != nil {
+		return nil, err
+	}
+	attachments := make([]bus.Attachment, 0, len(frames)+1)
+	for _, frame := range frames {
+		attachments = append(attachments, bus.Attachment{Path: frame, Kind: bus.AttachmentImage, MIME: "image/jpeg"})
+	}
+	if audio, err := extractVideoAudio(srcPath, tempDir); err == nil {
+		attachments = append(attachments, bus.Attachment{Path: audio, Kind: bus.AttachmentAudio, MIME: "audio/ogg"})
+	}
+	return attachments, nil
 }
@@ -0,0 +1,652 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+const slackChannelName = "slack"
+
+const (
+	slackDefaultAPIURL      = "https://slack.com/api/"
+	slackReconnectInitial   = time.Second
+	slackReconnectMax       = 30 * time.Second
+	slackThreadCacheEntries = 2048
+)
+
+// SlackClient is the part of the Slack Web API the channel uses.
+type SlackClient interface {
+	// AuthTest returns the bot's own user ID.
+	AuthTest(ctx context.Context) (string, error)
+	// OpenConnection returns a Socket Mode WebSocket URL.
+	OpenConnection(ctx context.Context) (string, error)
+	PostMessage(ctx context.Context, channelID, text, threadTS string) (string, error)
+	UpdateMessage(ctx context.Context, channelID, ts, text string) error
+	DeleteMessage(ctx context.Context, channelID, ts string) error
+	UploadFile(ctx context.Context, channelID, threadTS, name string, data []byte) error
+	DownloadFile(ctx context.Context, fileURL string) ([]byte, error)
+}
+
+type SlackClientFactory func(cfg config.SlackConfig) SlackClient
+
+type slackAPIError struct {
+	Method string
+	Status int
+	Code   string
+}
+
+func (e *slackAPIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("slack %s: http status %d", e.Method, e.Status)
+	}
+	return fmt.Sprintf("slack %s: %s", e.Method, e.Code)
+}
+
+func (e *slackAPIError) IsRetryable() bool {
+	if e.Status == http.StatusTooManyRequests || e.Status >= 500 {
+		return true
+	}
+	switch e.Code {
+	case "ratelimited", "internal_error", "fatal_error", "service_unavailable", "request_timeout":
+		return true
+	}
+	return false
+}
+
+type defaultSlackClient struct {
+	botToken   string
+	appToken   string
+	apiURL     string
+	httpClient *http.Client
+}
+
+func newDefaultSlackClient(cfg config.SlackConfig) SlackClient {
+	apiURL := strings.TrimSpace(cfg.APIURL)
+	if apiURL == "" {
+		apiURL = slackDefaultAPIURL
+	}
+	return &defaultSlackClient{
+		botToken:   cfg.BotToken,
+		appToken:   cfg.AppToken,
+		apiURL:     strings.TrimRight(apiURL, "/") + "/",
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call posts a form-encoded Web API request and decodes the reply into out.
+func (c *defaultSlackClient) call(ctx context.Context, method, token string, form url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("create slack %s request: %w", method, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &slackAPIError{Method: method, Status: resp.StatusCode}
+	}
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("decode slack %s response: %w", method, err)
+	}
+	if !result.OK {
+		return &slackAPIError{Method: method, Status: resp.StatusCode, Code: result.Error}
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return fmt.Errorf("decode slack %s response: %w", method, err)
+		}
+	}
+	return nil
+}
+
+func (c *defaultSlackClient) AuthTest(ctx context.Context) (string, error) {
+	var out struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.call(ctx, "auth.test", c.botToken, url.Values{}, &out); err != nil {
+		return "", err
+	}
+	return out.UserID, nil
+}
+
+func (c *defaultSlackClient) OpenConnection(ctx context.Context) (string, error) {
+	var out struct {
+		URL string `json:"url"`
+	}
+	if err := c.call(ctx, "apps.connections.open", c.appToken, url.Values{}, &out); err != nil {
+		return "", err
+	}
+	return out.URL, nil
+}
+
+func (c *defaultSlackClient) PostMessage(ctx context.Context, channelID, text, threadTS string) (string, error) {
+	form := url.Values{"channel": {channelID}, "text": {text}}
+	if threadTS != "" {
+		form.Set("thread_ts", threadTS)
+	}
+	var out struct {
+		TS string `json:"ts"`
+	}
+	if err := c.call(ctx, "chat.postMessage", c.botToken, form, &out); err != nil {
+		return "", err
+	}
+	return out.TS, nil
+}
+
+func (c *defaultSlackClient) UpdateMessage(ctx context.Context, channelID, ts, text string) error {
+	return c.call(ctx, "chat.update", c.botToken, url.Values{"channel": {channelID}, "ts": {ts}, "text": {text}}, nil)
+}
+
+func (c *defaultSlackClient) DeleteMessage(ctx context.Context, channelID, ts string) error {
+	return c.call(ctx, "chat.delete", c.botToken, url.Values{"channel": {channelID}, "ts": {ts}}, nil)
+}
+
+// UploadFile uses the external upload flow: reserve an upload URL, send the
+// bytes there, then share the file into the conversation.
+func (c *defaultSlackClient) UploadFile(ctx context.Context, channelID, threadTS, name string, data []byte) error {
+	var reserved struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	form := url.Values{"filename": {name}, "length": {fmt.Sprint(len(data))}}
+	if err := c.call(ctx, "files.getUploadURLExternal", c.botToken, form, &reserved); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reserved.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create slack upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack upload: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &slackAPIError{Method: "upload", Status: resp.StatusCode}
+	}
+
+	files, _ := json.Marshal([]map[string]string{{"id": reserved.FileID, "title": name}})
+	form = url.Values{"files": {string(files)}, "channel_id": {channelID}}
+	if threadTS != "" {
+		form.Set("thread_ts", threadTS)
+	}
+	return c.call(ctx, "files.completeUploadExternal", c.botToken, form, nil)
+}
+
+func (c *defaultSlackClient) DownloadFile(ctx context.Context, fileURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create slack download request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.botToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("slack download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &slackAPIError{Method: "download", Status: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// slackThreads remembers the thread of each inbound message, so replies to
+// it land in the same thread. The oldest entries are dropped first.
+type slackThreads struct {
+	mu     sync.Mutex
+	roots  map[string]string // channel/ts -> thread root, "" for top level
+	order  []string
+	active map[string]string // channel -> thread of its latest message
+}
+
+func newSlackThreads() *slackThreads {
+	return &slackThreads{roots: make(map[string]string), active: make(map[string]string)}
+}
+
+func (t *slackThreads) remember(channelID, ts, root string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := channelID + "/" + ts
+	if _, ok := t.roots[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.roots[key] = root
+	t.active[channelID] = root
+	for len(t.order) > slackThreadCacheEntries {
+		delete(t.roots, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// rootOf returns the thread a reply to ts belongs in. Unknown messages, e.g.
+// after a restart, are threaded under themselves except in DMs.
+func (t *slackThreads) rootOf(channelID, ts string) string {
+	if ts == "" {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if root, ok := t.roots[channelID+"/"+ts]; ok {
+		return root
+	}
+	if strings.HasPrefix(channelID, "D") {
+		return ""
+	}
+	return ts
+}
+
+func (t *slackThreads) activeThread(channelID string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active[channelID]
+}
+
+type slackEnvelope struct {
+	EnvelopeID string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type slackEvent struct {
+	Type        string      `json:"type"`
+	Subtype     string      `json:"subtype"`
+	User        string      `json:"user"`
+	BotID       string      `json:"bot_id"`
+	Channel     string      `json:"channel"`
+	ChannelType string      `json:"channel_type"`
+	Text        string      `json:"text"`
+	TS          string      `json:"ts"`
+	ThreadTS    string      `json:"thread_ts"`
+	Files       []slackFile `json:"files"`
+}
+
+type slackFile struct {
+	Name        string `json:"name"`
+	Mimetype    string `json:"mimetype"`
+	Size        int64  `json:"size"`
+	DownloadURL string `json:"url_private_download"`
+}
+
+type SlackChannel struct {
+	BaseChannel
+	cfg           config.SlackConfig
+	client        SlackClient
+	clientFactory SlackClientFactory
+	dialer        *websocket.Dialer
+	botUserID     string
+	cancel        context.CancelFunc
+	stream        *streamRenderer
+	threads       *slackThreads
+}
+
+func NewSlackChannel(cfg config.SlackConfig, b *bus.MessageBus, logger sdklogger.Logger) (*SlackChannel, error) {
+	return NewSlackChannelWithFactory(cfg, b, newDefaultSlackClient, logger)
+}
+
+// NewSlackChannelWithFactory creates a SlackChannel with a custom client factory (for testing)
+func NewSlackChannelWithFactory(cfg config.SlackConfig, b *bus.MessageBus, factory SlackClientFactory, logger sdklogger.Logger) (*SlackChannel, error) {
+	if cfg.BotToken == "" || cfg.AppToken == "" {
+		return nil, fmt.Errorf("slack botToken and appToken are required")
+	}
+	ch := &SlackChannel{
+		BaseChannel:   NewBaseChannel(slackChannelName, b, cfg.AllowFrom, logger),
+		cfg:           cfg,
+		clientFactory: factory,
+		dialer:        websocket.DefaultDialer,
+		threads:       newSlackThreads(),
+	}
+	ch.stream = newStreamingRenderer(ch, streamOptions{
+		name:          slackChannelName,
+		maxDraftRunes: 4000,
+		editInterval:  defaultStreamEditInterval,
+	}, logger)
+	return ch, nil
+}
+
+func (s *SlackChannel) Start(ctx context.Context) error {
+	s.client = s.clientFactory(s.cfg)
+	botUserID, err := s.client.AuthTest(ctx)
+	if err != nil {
+		return fmt.Errorf("slack auth.test: %w", err)
+	}
+	s.botUserID = botUserID
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.runSocketMode(ctx)
+	s.logger.Infof("[slack] socket mode started as %s", botUserID)
+	return nil
+}
+
+func (s *SlackChannel) Stop() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.logger.Infof("[slack] stopped")
+	return nil
+}
+
+// runSocketMode keeps a Socket Mode connection open until ctx is done,
+// reconnecting with backoff when it drops.
+func (s *SlackChannel) runSocketMode(ctx context.Context) {
+	backoff := slackReconnectInitial
+	for ctx.Err() == nil {
+		connected, err := s.serveConnection(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = slackReconnectInitial
+		}
+		if err == nil {
+			continue
+		}
+		s.logger.Warnf("[slack] socket mode connection lost: %v (reconnect in %s)", err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > slackReconnectMax {
+			backoff = slackReconnectMax
+		}
+	}
+}
+
+// serveConnection reads envelopes from one connection, acknowledging each
+// before handling it. It returns nil when Slack asks for a reconnect.
+func (s *SlackChannel) serveConnection(ctx context.Context) (bool, error) {
+	wsURL, err := s.client.OpenConnection(ctx)
+	if err != nil {
+		return false, err
+	}
+	conn, _, err := s.dialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("dial socket mode: %w", err)
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	connected := false
+	for {
+		var env slackEnvelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return connected, err
+		}
+		if env.EnvelopeID != "" {
+			if err := conn.WriteJSON(map[string]string{"envelope_id": env.EnvelopeID}); err != nil {
+				return connected, fmt.Errorf("ack envelope: %w", err)
+			}
+		}
+		switch env.Type {
+		case "hello":
+			connected = true
+			s.logger.Debugf("[slack] socket mode connected")
+		case "disconnect":
+			return connected, nil
+		case "events_api":
+			var payload struct {
+				Event slackEvent `json:"event"`
+			}
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				s.logger.Warnf("[slack] parse event payload: %v", err)
+				continue
+			}
+			s.handleEvent(payload.Event)
+		}
+	}
+}
+
+// handleEvent publishes DMs and channel mentions. A top-level mention starts
+// a thread; messages inside a thread are answered there.
+func (s *SlackChannel) handleEvent(ev slackEvent) {
+	if ev.BotID != "" || ev.User == "" || ev.User == s.botUserID {
+		return
+	}
+	if ev.Subtype != "" && ev.Subtype != "file_share" {
+		return
+	}
+	isDM := ev.ChannelType == "im"
+	if !(ev.Type == "app_mention" || (ev.Type == "message" && isDM)) {
+		return
+	}
+	if !s.IsAllowed(ev.User) {
+		return
+	}
+
+	content := ev.Text
+	if s.botUserID != "" {
+		content = strings.ReplaceAll(content, "<@"+s.botUserID+">", "")
+	}
+	content = strings.TrimSpace(slackUnescape(content))
+
+	var attachments []bus.Attachment
+	for _, f := range ev.Files {
+		att, err := s.downloadFile(f)
+		if err != nil {
+			s.logger.Warnf("[slack] download file %s failed: %v", f.Name, err)
+			continue
+		}
+		attachments = append(attachments, att)
+	}
+	if content == "" && len(attachments) == 0 {
+		return
+	}
+
+	root := ev.ThreadTS
+	if root == "" && !isDM {
+		root = ev.TS
+	}
+	s.threads.remember(ev.Channel, ev.TS, root)
+
+	if !s.bus.PublishInbound(bus.InboundMessage{
+		Channel:     slackChannelName,
+		SenderID:    ev.User,
+		ChatID:      ev.Channel,
+		MessageID:   ev.TS,
+		Content:     content,
+		Attachments: attachments,
+		Timestamp:   time.Now(),
+		Direct:      isDM,
+		Metadata: map[string]any{
+			"channel_type": ev.ChannelType,
+		},
+	}) {
+		s.logger.Debugf("[slack] duplicate message dropped: %s", ev.TS)
+	}
+}
+
+func (s *SlackChannel) downloadFile(f slackFile) (bus.Attachment, error) {
+	if f.DownloadURL == "" {
+		return bus.Attachment{}, fmt.Errorf("no download url")
+	}
+	data, err := s.client.DownloadFile(context.Background(), f.DownloadURL)
+	if err != nil {
+		return bus.Attachment{}, err
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-slack-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return bus.Attachment{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(f.Name)))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return bus.Attachment{}, fmt.Errorf("save file: %w", err)
+	}
+	return bus.Attachment{
+		Path: localPath,
+		Kind: attachmentKindOf(f.Name, f.Mimetype),
+		MIME: f.Mimetype,
+		Size: int64(len(data)),
+	}, nil
+}
+
+func (s *SlackChannel) Capabilities() Capabilities {
+	return Capabilities{
+		MaxMessageLen: 4000,
+		Edit:          true,
+		Markdown:      MarkdownFull,
+		Media:         []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+		Threads:       true,
+	}
+}
+
+func (s *SlackChannel) Send(msg bus.OutboundMessage) error {
+	if s.client == nil {
+		return fmt.Errorf("slack client not initialized")
+	}
+	channelID := strings.TrimSpace(msg.ChatID)
+	if channelID == "" {
+		return fmt.Errorf("slack channel id is required")
+	}
+	thread := s.threads.rootOf(channelID, msg.ReplyTo)
+
+	for _, att := range msg.Attachments {
+		data, err := os.ReadFile(att.Path)
+		if err == nil {
+			err = s.client.UploadFile(context.Background(), channelID, thread, filepath.Base(att.Path), data)
+		}
+		if err != nil {
+			s.logger.Warnf("[slack] send media %s failed: %v", att.Path, err)
+		}
+	}
+
+	if strings.TrimSpace(msg.Content) == "" {
+		return nil
+	}
+	switch msg.Kind {
+	case bus.KindPreviewUpdate:
+		return s.stream.Update(channelID, msg.Content, msg.ReplyTo)
+	case bus.KindPreviewFinal:
+		return s.stream.Finalize(channelID, msg.Content, msg.ReplyTo)
+	case bus.KindToolProgress:
+		return s.stream.ToolProgress(channelID, msg)
+	}
+	_, err := s.client.PostMessage(context.Background(), channelID, toSlackMrkdwn(msg.Content), thread)
+	return err
+}
+
+// StreamingRenderer implements Streamer.
+func (s *SlackChannel) StreamingRenderer() StreamingRenderer {
+	return s.stream
+}
+
+// streamThread is the thread for stream blocks: the reply target's thread,
+// or that of the chat's latest message for blocks sent without one.
+func (s *SlackChannel) streamThread(chatID, replyTo string) string {
+	if replyTo != "" {
+		return s.threads.rootOf(chatID, replyTo)
+	}
+	return s.threads.activeThread(chatID)
+}
+
+// CreateBlock implements StreamTarget.
+func (s *SlackChannel) CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error) {
+	return s.client.PostMessage(context.Background(), chatID, toSlackMrkdwn(text), s.streamThread(chatID, replyTo))
+}
+
+// EditBlock implements StreamTarget.
+func (s *SlackChannel) EditBlock(chatID, messageID string, block StreamBlock, text string) error {
+	return s.client.UpdateMessage(context.Background(), chatID, messageID, toSlackMrkdwn(text))
+}
+
+// DeleteBlock implements StreamTarget.
+func (s *SlackChannel) DeleteBlock(chatID, messageID string) error {
+	return s.client.DeleteMessage(context.Background(), chatID, messageID)
+}
+
+// SendReply implements StreamTarget. The reply replaces the draft via
+// chat.update, or is posted into the thread.
+func (s *SlackChannel) SendReply(chatID, text, draftID, replyTo string) error {
+	ctx := context.Background()
+	text = toSlackMrkdwn(text)
+	if draftID != "" {
+		if err := s.client.UpdateMessage(ctx, chatID, draftID, text); err == nil {
+			return nil
+		}
+	}
+	_, err := s.client.PostMessage(ctx, chatID, text, s.streamThread(chatID, replyTo))
+	return err
+}
+
+var (
+	slackMDBold   = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	slackMDItalic = regexp.MustCompile(`(^|[^*\w])\*([^*\n]+)\*`)
+	slackMDStrike = regexp.MustCompile(`~~([^~\n]+)~~`)
+	slackMDImage  = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	slackMDLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	slackMDHead   = regexp.MustCompile(`^#{1,6}\s+(.+)$`)
+)
+
+// toSlackMrkdwn converts CommonMark to Slack mrkdwn. Code blocks are kept;
+// &, < and > are escaped as Slack requires.
+func toSlackMrkdwn(md string) string {
+	lines := strings.Split(md, "\n")
+	inFence := false
+	for i, line := range lines {
+		if mdFenceHeader.MatchString(line) {
+			inFence = !inFence
+			lines[i] = "```"
+			continue
+		}
+		quote := ""
+		if !inFence && strings.HasPrefix(line, ">") {
+			quote, line = ">", line[1:]
+		}
+		line = slackEscape(line)
+		if !inFence {
+			line = slackMDHead.ReplaceAllString(line, "**$1**")
+			line = slackMDBold.ReplaceAllString(line, "\x00$1\x00")
+			line = slackMDItalic.ReplaceAllString(line, "${1}_${2}_")
+			line = strings.ReplaceAll(line, "\x00", "*")
+			line = slackMDStrike.ReplaceAllString(line, "~$1~")
+			line = slackMDImage.ReplaceAllString(line, "<$2|$1>")
+			line = slackMDLink.ReplaceAllString(line, "<$2|$1>")
+		}
+		lines[i] = quote + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func slackUnescape(s string) string {
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
@@ -0,0 +1,312 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+type slackCall struct {
+	method string
+	form   url.Values
+}
+
+// fakeSlack is a local Slack server: the Web API under /api/, a Socket Mode
+// endpoint at /socket, and file upload and download URLs.
+type fakeSlack struct {
+	srv     *httptest.Server
+	mu      sync.Mutex
+	calls   []slackCall
+	uploads [][]byte
+	nextTS  int
+	sockets chan *websocket.Conn
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{sockets: make(chan *websocket.Conn, 4)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", f.handleAPI)
+	mux.HandleFunc("/socket", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		f.sockets <- conn
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.uploads = append(f.uploads, data)
+		f.mu.Unlock()
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("file-bytes"))
+	})
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeSlack) handleAPI(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+	f.mu.Lock()
+	f.calls = append(f.calls, slackCall{method: method, form: r.PostForm})
+	if method == "chat.postMessage" {
+		f.nextTS++
+	}
+	ts := fmt.Sprintf("1700000000.%06d", f.nextTS)
+	f.mu.Unlock()
+
+	resp := map[string]any{"ok": true}
+	switch method {
+	case "auth.test":
+		resp["user_id"] = "UBOT"
+	case "apps.connections.open":
+		resp["url"] = "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/socket"
+	case "chat.postMessage":
+		resp["ts"] = ts
+	case "files.getUploadURLExternal":
+		resp["upload_url"] = f.srv.URL + "/upload"
+		resp["file_id"] = "F1"
+	case "chat.update", "chat.delete", "files.completeUploadExternal":
+	default:
+		resp = map[string]any{"ok": false, "error": "unknown_method"}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeSlack) callsTo(method string) []slackCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []slackCall
+	for _, c := range f.calls {
+		if c.method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func newTestSlackChannel(t *testing.T, f *fakeSlack, allowFrom []string) (*SlackChannel, *bus.MessageBus) {
+	b := bus.NewMessageBus(10)
+	ch, err := NewSlackChannel(config.SlackConfig{
+		Enabled:   true,
+		BotToken:  "xoxb-test",
+		AppToken:  "xapp-test",
+		APIURL:    f.srv.URL + "/api",
+		AllowFrom: allowFrom,
+	}, b, sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewSlackChannel: %v", err)
+	}
+	return ch, b
+}
+
+func sendEnvelope(t *testing.T, conn *websocket.Conn, id string, event map[string]any) {
+	t.Helper()
+	env := map[string]any{"envelope_id": id, "type": "events_api", "payload": map[string]any{"event": event}}
+	if err := conn.WriteJSON(env); err != nil {
+		t.Fatalf("write envelope: %v", err)
+	}
+	var ack map[string]string
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&ack); err != nil || ack["envelope_id"] != id {
+		t.Fatalf("envelope %s not acked: %v %v", id, ack, err)
+	}
+}
+
+func TestNewSlackChannel_RequiresTokens(t *testing.T) {
+	_, err := NewSlackChannel(config.SlackConfig{BotToken: "xoxb"}, bus.NewMessageBus(1), sdklogger.NewDefault())
+	if err == nil {
+		t.Fatal("expected error without an app token")
+	}
+}
+
+func TestSlackChannel_SocketModeInbound(t *testing.T) {
+	f := newFakeSlack(t)
+	ch, b := newTestSlackChannel(t, f, []string{"U1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ch.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ch.Stop()
+
+	var conn *websocket.Conn
+	select {
+	case conn = <-f.sockets:
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel did not open a socket mode connection")
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]any{"type": "hello"})
+
+	sendEnvelope(t, conn, "e1", map[string]any{"type": "message", "channel_type": "channel", "user": "U1", "channel": "C1", "text": "no mention", "ts": "1.0"})
+	sendEnvelope(t, conn, "e2", map[string]any{"type": "app_mention", "user": "U2", "channel": "C1", "text": "<@UBOT> stranger", "ts": "1.1"})
+	sendEnvelope(t, conn, "e3", map[string]any{"type": "message", "channel_type": "im", "bot_id": "B1", "user": "UBOT", "channel": "D1", "text": "echo", "ts": "1.2"})
+	sendEnvelope(t, conn, "e4", map[string]any{"type": "app_mention", "user": "U1", "channel": "C1", "text": "<@UBOT> hi &amp; bye", "ts": "1.3"})
+	sendEnvelope(t, conn, "e5", map[string]any{
+		"type": "message", "channel_type": "im", "subtype": "file_share", "user": "U1", "channel": "D1", "text": "", "ts": "1.4",
+		"files": []map[string]any{{"name": "notes.txt", "mimetype": "text/plain", "url_private_download": f.srv.URL + "/files/notes.txt"}},
+	})
+
+	select {
+	case msg := <-b.Inbound:
+		if msg.Channel != "slack" || msg.ChatID != "C1" || msg.MessageID != "1.3" || msg.Content != "hi & bye" {
+			t.Fatalf("unexpected mention message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mention was not published")
+	}
+	select {
+	case msg := <-b.Inbound:
+		if msg.ChatID != "D1" || len(msg.Attachments) != 1 {
+			t.Fatalf("unexpected DM message: %+v", msg)
+		}
+		data, err := os.ReadFile(msg.Attachments[0].Path)
+		if err != nil || string(data) != "file-bytes" {
+			t.Fatalf("attachment not downloaded: %q %v", data, err)
+		}
+		os.Remove(msg.Attachments[0].Path)
+	case <-time.After(2 * time.Second):
+		t.Fatal("DM was not published")
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("filtered event was published: %+v", msg)
+	default:
+	}
+}
+
+func TestSlackChannel_SendRepliesInThread(t *testing.T) {
+	f := newFakeSlack(t)
+	ch, _ := newTestSlackChannel(t, f, nil)
+	if err := ch.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ch.Stop()
+
+	ch.handleEvent(slackEvent{Type: "app_mention", User: "U1", Channel: "C1", Text: "<@UBOT> top", TS: "2.0"})
+	ch.handleEvent(slackEvent{Type: "app_mention", User: "U1", Channel: "C1", Text: "<@UBOT> in thread", TS: "2.5", ThreadTS: "2.0"})
+	ch.handleEvent(slackEvent{Type: "message", ChannelType: "im", User: "U1", Channel: "D1", Text: "dm", TS: "3.0"})
+
+	for _, msg := range []bus.OutboundMessage{
+		{ChatID: "C1", ReplyTo: "2.0", Content: "**one**"},
+		{ChatID: "C1", ReplyTo: "2.5", Content: "two"},
+		{ChatID: "D1", ReplyTo: "3.0", Content: "three"},
+	} {
+		if err := ch.Send(msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	posts := f.callsTo("chat.postMessage")
+	if len(posts) != 3 {
+		t.Fatalf("expected 3 posts, got %d", len(posts))
+	}
+	want := []struct{ text, thread string }{{"*one*", "2.0"}, {"two", "2.0"}, {"three", ""}}
+	for i, w := range want {
+		if got := posts[i].form.Get("text"); got != w.text {
+			t.Errorf("post %d text = %q, want %q", i, got, w.text)
+		}
+		if got := posts[i].form.Get("thread_ts"); got != w.thread {
+			t.Errorf("post %d thread_ts = %q, want %q", i, got, w.thread)
+		}
+	}
+}
+
+func TestSlackChannel_SendUploadsAttachments(t *testing.T) {
+	f := newFakeSlack(t)
+	ch, _ := newTestSlackChannel(t, f, nil)
+	if err := ch.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ch.Stop()
+
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	os.WriteFile(path, []byte("pdf-data"), 0644)
+	err := ch.Send(bus.OutboundMessage{ChatID: "C1", ReplyTo: "4.0", Attachments: bus.PathAttachments(path)})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	reserve := f.callsTo("files.getUploadURLExternal")
+	complete := f.callsTo("files.completeUploadExternal")
+	if len(reserve) != 1 || reserve[0].form.Get("filename") != "report.pdf" || reserve[0].form.Get("length") != "8" {
+		t.Fatalf("unexpected upload reservation: %+v", reserve)
+	}
+	if len(f.uploads) != 1 || string(f.uploads[0]) != "pdf-data" {
+		t.Fatalf("file bytes not uploaded: %q", f.uploads)
+	}
+	if len(complete) != 1 || complete[0].form.Get("channel_id") != "C1" || complete[0].form.Get("thread_ts") != "4.0" {
+		t.Fatalf("upload not shared into the thread: %+v", complete)
+	}
+	if len(f.callsTo("chat.postMessage")) != 0 {
+		t.Fatal("attachment-only message should not post text")
+	}
+}
+
+func TestSlackChannel_PreviewStreamUsesChatUpdate(t *testing.T) {
+	f := newFakeSlack(t)
+	ch, _ := newTestSlackChannel(t, f, nil)
+	if err := ch.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ch.Stop()
+	ch.stream.opts.editInterval = 0
+	ch.handleEvent(slackEvent{Type: "app_mention", User: "U1", Channel: "C1", Text: "<@UBOT> go", TS: "5.0"})
+
+	if err := ch.Send(bus.OutboundMessage{Kind: bus.KindPreviewUpdate, ChatID: "C1", ReplyTo: "5.0", Content: "partial"}); err != nil {
+		t.Fatalf("preview update: %v", err)
+	}
+	if err := ch.Send(bus.OutboundMessage{Kind: bus.KindPreviewFinal, ChatID: "C1", ReplyTo: "5.0", Content: "see [docs](https://x.io)\n\n```go\nx := 1\n```"}); err != nil {
+		t.Fatalf("preview final: %v", err)
+	}
+
+	posts := f.callsTo("chat.postMessage")
+	if len(posts) != 2 {
+		t.Fatalf("expected tool block and draft posts, got %d", len(posts))
+	}
+	for _, p := range posts {
+		if p.form.Get("thread_ts") != "5.0" {
+			t.Fatalf("stream blocks should go to the thread: %v", p.form)
+		}
+	}
+	draftTS := "1700000000.000002"
+	updates := f.callsTo("chat.update")
+	if len(updates) != 2 || updates[1].form.Get("ts") != draftTS || updates[1].form.Get("text") != "see <https://x.io|docs>\n\n```\nx := 1\n```" {
+		t.Fatalf("final should replace the draft via chat.update: %+v", updates)
+	}
+	deletes := f.callsTo("chat.delete")
+	if len(deletes) != 1 || deletes[0].form.Get("ts") != "1700000000.000001" {
+		t.Fatalf("unused tool block should be deleted: %+v", deletes)
+	}
+}
+
+func TestToSlackMrkdwn(t *testing.T) {
+	md := "# Title\n**bold** and *it* ~~gone~~ [docs](https://x.io) a<b\n> quote\n```go\nif a && b {}\n```"
+	want := "*Title*\n*bold* and _it_ ~gone~ <https://x.io|docs> a&lt;b\n> quote\n```\nif a &amp;&amp; b {}\n```"
+	if got := toSlackMrkdwn(md); got != want {
+		t.Fatalf("toSlackMrkdwn:\n got %q\nwant %q", got, want)
+	}
+}
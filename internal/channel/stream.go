@@ -0,0 +1,353 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+// StreamBlock is one of the two live messages of a streamed turn.
+type StreamBlock int
+
+const (
+	StreamToolBlock  StreamBlock = iota // tool call log, edited as tools run
+	StreamDraftBlock                    // reply draft, replaced by the final reply
+)
+
+// StreamTarget is the set of message primitives a channel implements so the
+// shared renderer can stream replies into it. Message IDs are opaque. All
+// text is Markdown, which each channel renders as its platform allows.
+type StreamTarget interface {
+	// CreateBlock posts a new block and returns its message ID.
+	CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error)
+	// EditBlock replaces the text of a posted block. Edits that change
+	// nothing are not errors.
+	EditBlock(chatID, messageID string, block StreamBlock, text string) error
+	DeleteBlock(chatID, messageID string) error
+	// SendReply delivers the final reply, split as the platform needs. When
+	// draftID is set the first message should replace the draft in place if
+	// it can.
+	SendReply(chatID, text, draftID, replyTo string) error
+}
+
+// StreamingRenderer renders a streamed turn as a tool block plus a draft
+// that is edited as text arrives and replaced by the final reply.
+type StreamingRenderer interface {
+	Update(chatID, content, replyTo string) error
+	ToolProgress(chatID string, msg bus.OutboundMessage) error
+	Finalize(chatID, content, replyTo string) error
+}
+
+// Streamer is implemented by channels that render KindPreviewUpdate,
+// KindPreviewFinal and KindToolProgress messages.
+type Streamer interface {
+	StreamingRenderer() StreamingRenderer
+}
+
+const (
+	maxToolBlockChars = 3800
+	// Draft edits closer together than this are skipped; the final reply
+	// always goes out.
+	defaultStreamEditInterval = 500 * time.Millisecond
+	streamDraftPlaceholder    = "⌛ 正在生成回复..."
+)
+
+type toolEntry struct {
+	Name      string
+	ParamsRaw string
+	When      string
+	Raw       string
+}
+
+type streamOptions struct {
+	name            string // log prefix
+	maxDraftRunes   int    // 0 keeps the whole draft
+	maxToolRunes    int    // tool block size before rolling over; 0 = maxToolBlockChars
+	editInterval    time.Duration
+	formatToolBlock func(blockIndex int, entries []toolEntry) string
+}
+
+type streamState struct {
+	draftID     string
+	toolID      string
+	replyTo     string
+	lastDraft   string
+	lastEditAt  time.Time
+	toolIndex   int
+	toolEntries []toolEntry
+	hadTools    bool
+	finalized   bool
+}
+
+type streamRenderer struct {
+	target StreamTarget
+	opts   streamOptions
+	logger sdklogger.Logger
+	now    func() time.Time
+
+	mu    sync.Mutex
+	chats map[string]streamState
+}
+
+func newStreamingRenderer(target StreamTarget, opts streamOptions, logger sdklogger.Logger) *streamRenderer {
+	if opts.formatToolBlock == nil {
+		opts.formatToolBlock = formatToolBlock
+	}
+	if opts.maxToolRunes <= 0 {
+		opts.maxToolRunes = maxToolBlockChars
+	}
+	return &streamRenderer{
+		target: target,
+		opts:   opts,
+		logger: logger,
+		now:    time.Now,
+		chats:  make(map[string]streamState),
+	}
+}
+
+func (r *streamRenderer) state(chatID string) (streamState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.chats[chatID]
+	return s, ok
+}
+
+func (r *streamRenderer) setState(chatID string, s streamState) {
+	r.mu.Lock()
+	r.chats[chatID] = s
+	r.mu.Unlock()
+}
+
+// Update edits the draft with the partial reply so far. Markup left open
+// by the cut is closed.
+func (r *streamRenderer) Update(chatID, content, replyTo string) error {
+	text := strings.TrimSpace(content)
+	if text == "" {
+		return nil
+	}
+	if r.opts.maxDraftRunes > 0 {
+		text = truncateTelegramText(text, r.opts.maxDraftRunes)
+	}
+	text = closeOpenMarkdown(text)
+
+	state, err := r.ensureTurn(chatID, replyTo)
+	if err != nil {
+		return err
+	}
+	if state.lastDraft == text {
+		return nil
+	}
+	now := r.now()
+	if r.opts.editInterval > 0 && !state.lastEditAt.IsZero() && now.Sub(state.lastEditAt) < r.opts.editInterval {
+		return nil
+	}
+
+	if err := r.target.EditBlock(chatID, state.draftID, StreamDraftBlock, text); err != nil {
+		newID, sendErr := r.target.CreateBlock(chatID, StreamDraftBlock, text, replyTo)
+		if sendErr != nil {
+			return fmt.Errorf("edit preview: %w; fallback send: %v", err, sendErr)
+		}
+		state.draftID = newID
+	}
+	state.lastDraft = text
+	state.lastEditAt = now
+	r.setState(chatID, state)
+	return nil
+}
+
+// ToolProgress appends a tool call to the tool block, starting a new block
+// once the current one is full.
+func (r *streamRenderer) ToolProgress(chatID string, msg bus.OutboundMessage) error {
+	state, err := r.ensureTurn(chatID, "")
+	if err != nil {
+		return err
+	}
+	entry := buildToolEntry(msg)
+	if entry.Name == "" && strings.TrimSpace(entry.Raw) == "" {
+		return nil
+	}
+
+	tryEntries := append(append([]toolEntry{}, state.toolEntries...), entry)
+	block := r.opts.formatToolBlock(state.toolIndex, tryEntries)
+	if len([]rune(block)) > r.opts.maxToolRunes {
+		// Start a new tool block without dropping old logs.
+		state.toolIndex++
+		state.toolEntries = []toolEntry{entry}
+		id, sendErr := r.target.CreateBlock(chatID, StreamToolBlock, r.opts.formatToolBlock(state.toolIndex, state.toolEntries), "")
+		if sendErr != nil {
+			return fmt.Errorf("send tool block rollover: %w", sendErr)
+		}
+		state.toolID = id
+	} else {
+		if err := r.target.EditBlock(chatID, state.toolID, StreamToolBlock, block); err != nil {
+			return fmt.Errorf("edit tool block: %w", err)
+		}
+		state.toolEntries = tryEntries
+	}
+	state.hadTools = true
+
+	r.mu.Lock()
+	cur := r.chats[chatID]
+	cur.toolID = state.toolID
+	cur.toolIndex = state.toolIndex
+	cur.toolEntries = state.toolEntries
+	cur.hadTools = true
+	r.chats[chatID] = cur
+	r.mu.Unlock()
+	return nil
+}
+
+// Finalize replaces the draft with the final reply and drops the tool block
+// if no tool ran. Repeated finals for the same turn are ignored.
+func (r *streamRenderer) Finalize(chatID, content, replyTo string) error {
+	state, _ := r.state(chatID)
+	if state.finalized && state.draftID == "" {
+		return nil
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	if state.replyTo != "" {
+		replyTo = state.replyTo
+	}
+	if err := r.target.SendReply(chatID, content, state.draftID, replyTo); err != nil {
+		return err
+	}
+
+	// Keep the tool block of a turn that used tools, so later notices can
+	// still refer to it.
+	if !state.hadTools && state.toolID != "" {
+		if err := r.target.DeleteBlock(chatID, state.toolID); err != nil {
+			r.logger.Warnf("[%s] delete empty tool block failed: %v", r.opts.name, err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur := r.chats[chatID]
+	if !state.hadTools {
+		cur.toolID = ""
+		cur.toolIndex = 0
+		cur.toolEntries = nil
+		cur.hadTools = false
+	}
+	cur.draftID = ""
+	cur.lastDraft = ""
+	cur.lastEditAt = r.now()
+	cur.finalized = true
+	r.chats[chatID] = cur
+	return nil
+}
+
+// ensureTurn returns the live blocks of chatID, posting an empty tool block
+// and a draft placeholder when the turn has none yet.
+func (r *streamRenderer) ensureTurn(chatID, replyTo string) (streamState, error) {
+	state, ok := r.state(chatID)
+	if ok && state.draftID != "" && state.toolID != "" {
+		if state.replyTo == "" && replyTo != "" {
+			state.replyTo = replyTo
+			r.setState(chatID, state)
+		}
+		return state, nil
+	}
+
+	toolID, err := r.target.CreateBlock(chatID, StreamToolBlock, r.opts.formatToolBlock(1, nil), "")
+	if err != nil {
+		return streamState{}, fmt.Errorf("send tool block: %w", err)
+	}
+	draftID, err := r.target.CreateBlock(chatID, StreamDraftBlock, streamDraftPlaceholder, replyTo)
+	if err != nil {
+		return streamState{}, fmt.Errorf("send draft block: %w", err)
+	}
+	state = streamState{
+		draftID:   draftID,
+		toolID:    toolID,
+		replyTo:   replyTo,
+		toolIndex: 1,
+	}
+	r.setState(chatID, state)
+	return state, nil
+}
+
+func formatToolBlock(blockIndex int, entries []toolEntry) string {
+	var b strings.Builder
+	if blockIndex <= 1 {
+		b.WriteString("🧰 Tool Calls")
+	} else {
+		b.WriteString(fmt.Sprintf("🧰 Tool Calls (续 %d)", blockIndex))
+	}
+	if len(entries) == 0 {
+		b.WriteString("\n（等待工具调用）")
+		return b.String()
+	}
+	for _, e := range entries {
+		name := strings.TrimSpace(e.Name)
+		if name == "" {
+			name = "Tool"
+		}
+		payload := normalizeToolPayload(e)
+		if payload == "" {
+			continue
+		}
+		b.WriteString("\n\n⏳ ")
+		b.WriteString(name)
+		b.WriteString("\n```text\n")
+		b.WriteString(payload)
+		b.WriteString("\n```")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func buildToolEntry(msg bus.OutboundMessage) toolEntry {
+	entry := toolEntry{Raw: strings.TrimSpace(msg.Content)}
+	if msg.Tool == nil {
+		return entry
+	}
+	entry.Name = strings.TrimSpace(msg.Tool.Name)
+	entry.ParamsRaw = strings.TrimSpace(msg.Tool.Params)
+	if !msg.Tool.At.IsZero() {
+		entry.When = msg.Tool.At.Format(time.RFC3339)
+	}
+	return entry
+}
+
+func normalizeToolPayload(e toolEntry) string {
+	raw := strings.TrimSpace(e.ParamsRaw)
+	if raw == "" || raw == "{}" {
+		raw = strings.TrimSpace(e.Raw)
+	}
+	if raw == "" {
+		return "{}"
+	}
+	if json.Valid([]byte(raw)) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(raw)); err == nil {
+			raw = buf.String()
+		}
+	}
+	raw = strings.ReplaceAll(raw, "```", "'''")
+	return truncateTelegramText(raw, 3400)
+}
+
+func closeOpenMarkdown(s string) string {
+	if s == "" {
+		return s
+	}
+	closed := s
+	if strings.Count(closed, "```")%2 == 1 {
+		closed += "\n```"
+	}
+	if strings.Count(closed, "`")%2 == 1 {
+		closed += "`"
+	}
+	if strings.Count(closed, "**")%2 == 1 {
+		closed += "**"
+	}
+	return closed
+}
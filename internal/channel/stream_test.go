@@ -0,0 +1,174 @@
+package channel
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+// recordingTarget is a StreamTarget that logs every primitive call.
+type recordingTarget struct {
+	calls   []string
+	nextID  int
+	editErr error
+}
+
+func (r *recordingTarget) CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error) {
+	r.nextID++
+	id := fmt.Sprintf("m%d", r.nextID)
+	r.calls = append(r.calls, fmt.Sprintf("create %d %s reply=%s", block, id, replyTo))
+	return id, nil
+}
+
+func (r *recordingTarget) EditBlock(chatID, messageID string, block StreamBlock, text string) error {
+	r.calls = append(r.calls, fmt.Sprintf("edit %d %s %s", block, messageID, text))
+	return r.editErr
+}
+
+func (r *recordingTarget) DeleteBlock(chatID, messageID string) error {
+	r.calls = append(r.calls, "delete "+messageID)
+	return nil
+}
+
+func (r *recordingTarget) SendReply(chatID, text, draftID, replyTo string) error {
+	r.calls = append(r.calls, fmt.Sprintf("reply draft=%s reply=%s %s", draftID, replyTo, text))
+	return nil
+}
+
+func newTestRenderer(target StreamTarget, interval time.Duration) (*streamRenderer, *time.Time) {
+	r := newStreamingRenderer(target, streamOptions{name: "test", editInterval: interval}, sdklogger.NewDefault())
+	clock := time.Unix(1000, 0)
+	r.now = func() time.Time { return clock }
+	return r, &clock
+}
+
+func TestStreamRenderer_ThrottlesDraftEdits(t *testing.T) {
+	target := &recordingTarget{}
+	r, clock := newTestRenderer(target, time.Second)
+
+	for _, content := range []string{"a", "a b", "a b c"} {
+		if err := r.Update("1", content, "u1"); err != nil {
+			t.Fatalf("Update(%q): %v", content, err)
+		}
+	}
+	*clock = clock.Add(time.Second)
+	if err := r.Update("1", "a b c d", "u1"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	want := []string{
+		"create 0 m1 reply=",
+		"create 1 m2 reply=u1",
+		"edit 1 m2 a",
+		"edit 1 m2 a b c d",
+	}
+	if strings.Join(target.calls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("calls = %q, want %q", target.calls, want)
+	}
+}
+
+func TestStreamRenderer_FailedEditPostsNewDraft(t *testing.T) {
+	target := &recordingTarget{editErr: fmt.Errorf("message deleted")}
+	r, _ := newTestRenderer(target, 0)
+
+	if err := r.Update("1", "partial", "u1"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	target.editErr = nil
+	if err := r.Finalize("1", "done", ""); err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+	last := target.calls[len(target.calls)-2]
+	if last != "reply draft=m3 reply=u1 done" {
+		t.Fatalf("final should replace the fallback draft, calls = %q", target.calls)
+	}
+}
+
+func TestStreamRenderer_FinalizeDropsUnusedToolBlockOnce(t *testing.T) {
+	target := &recordingTarget{}
+	r, _ := newTestRenderer(target, 0)
+
+	if err := r.Update("1", "partial", "u1"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := r.Finalize("1", "done", ""); err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+	n := len(target.calls)
+	if target.calls[n-1] != "delete m1" {
+		t.Fatalf("empty tool block should be deleted, calls = %q", target.calls)
+	}
+	if err := r.Finalize("1", "done", ""); err != nil {
+		t.Fatalf("second Finalize: %v", err)
+	}
+	if len(target.calls) != n {
+		t.Fatalf("duplicate final should be a no-op, calls = %q", target.calls[n:])
+	}
+}
+
+func TestStreamRenderer_PassesMarkdown(t *testing.T) {
+	const md = "see [docs](https://x.io)\n\n```go\nx := 1\n```"
+
+	target := &recordingTarget{}
+	r, _ := newTestRenderer(target, 0)
+	if err := r.Update("1", "see [docs](https://x.io)\n\n```go\nx", "u1"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := target.calls[2]; got != "edit 1 m2 see [docs](https://x.io)\n\n```go\nx\n```" {
+		t.Fatalf("draft should be Markdown with the fence closed, got %q", got)
+	}
+	if err := r.Finalize("1", md, ""); err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+	if got := target.calls[3]; got != "reply draft=m2 reply=u1 "+md {
+		t.Fatalf("final should be the Markdown reply replacing the draft, got %q", got)
+	}
+}
+
+func TestStreamRenderer_ToolProgressUsesChannelFormat(t *testing.T) {
+	target := &recordingTarget{}
+	r := newStreamingRenderer(target, streamOptions{
+		formatToolBlock: func(i int, entries []toolEntry) string {
+			return fmt.Sprintf("block%d:%d", i, len(entries))
+		},
+	}, sdklogger.NewDefault())
+
+	err := r.ToolProgress("1", bus.OutboundMessage{Kind: bus.KindToolProgress, Tool: &bus.ToolProgress{Name: "Read"}})
+	if err != nil {
+		t.Fatalf("ToolProgress: %v", err)
+	}
+	if got := target.calls[len(target.calls)-1]; got != "edit 0 m1 block1:1" {
+		t.Fatalf("tool block should use the channel format, got %q", got)
+	}
+	if err := r.Finalize("1", "done", ""); err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+	for _, call := range target.calls {
+		if strings.HasPrefix(call, "delete") {
+			t.Fatalf("tool block of a turn that used tools must be kept, calls = %q", target.calls)
+		}
+	}
+}
+
+func TestChannelManager_SupportsPreviewStream(t *testing.T) {
+	b := bus.NewMessageBus(10)
+	m, err := NewChannelManager(config.ChannelsConfig{
+		Telegram: config.TelegramConfig{Enabled: true, Token: "fake-token"},
+	}, b, sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewChannelManager: %v", err)
+	}
+	m.channels["mock"] = &mockChannel{name: "mock"}
+
+	if !m.SupportsPreviewStream("telegram") {
+		t.Error("telegram should declare preview streaming")
+	}
+	if m.SupportsPreviewStream("mock") || m.SupportsPreviewStream("missing") {
+		t.Error("channels without a renderer should not stream")
+	}
+}
@@ -1,11 +1,15 @@
 package channel
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -22,17 +26,29 @@ import (
 	"github.com/riverfjs/aevitas/internal/config"
 )
 
-const telegramChannelName = "telegram"
+const (
+	telegramChannelName        = "telegram"
+	telegramWebhookPath        = "/telegram/webhook"
+	telegramDefaultWebhookPort = 9888
+	telegramSecretHeader       = "X-Telegram-Bot-Api-Secret-Token"
+	telegramWebhookQueue       = 100
+	telegramWebhookShutdown    = 5 * time.Second
+)
+
+// telegramAllowedUpdates are the update types the channel handles.
+var telegramAllowedUpdates = []string{"message", "callback_query"}
 
 // TelegramBot interface for mocking telegram bot API
 type TelegramBot interface {
-	GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel
-	StopReceivingUpdates()
+	GetUpdates(config tgbotapi.UpdateConfig) ([]TelegramUpdate, error)
 	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
 	EditMessageText(chatID int64, messageID int, text string) (tgbotapi.Message, error)
 	DeleteMessage(chatID int64, messageID int) error
 	GetSelf() tgbotapi.User
 	GetFileDirectURL(fileID string) (string, error)
+	SetWebhook(url, secret string) error
+	DeleteWebhook() error
 }
 
 // tgBotWrapper wraps tgbotapi.BotAPI to implement TelegramBot interface
@@ -40,18 +56,44 @@ type tgBotWrapper struct {
 	bot *tgbotapi.BotAPI
 }
 
-func (w *tgBotWrapper) GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel {
-	return w.bot.GetUpdatesChan(config)
+func (w *tgBotWrapper) GetUpdates(config tgbotapi.UpdateConfig) ([]TelegramUpdate, error) {
+	resp, err := w.bot.Request(config)
+	if err != nil {
+		return nil, err
+	}
+	var updates []TelegramUpdate
+	if err := json.Unmarshal(resp.Result, &updates); err != nil {
+		return nil, fmt.Errorf("decode updates: %w", err)
+	}
+	return updates, nil
+}
+
+// SetWebhook registers url for updates. tgbotapi v5 predates secret_token,
+// so the request is built by hand.
+func (w *tgBotWrapper) SetWebhook(url, secret string) error {
+	params := tgbotapi.Params{"url": url}
+	params.AddNonEmpty("secret_token", secret)
+	if err := params.AddInterface("allowed_updates", telegramAllowedUpdates); err != nil {
+		return err
+	}
+	_, err := w.bot.MakeRequest("setWebhook", params)
+	return err
 }
 
-func (w *tgBotWrapper) StopReceivingUpdates() {
-	w.bot.StopReceivingUpdates()
+// DeleteWebhook switches the bot back to getUpdates, keeping pending updates.
+func (w *tgBotWrapper) DeleteWebhook() error {
+	_, err := w.bot.MakeRequest("deleteWebhook", nil)
+	return err
 }
 
 func (w *tgBotWrapper) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
 	return w.bot.Send(c)
 }
 
+func (w *tgBotWrapper) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return w.bot.Request(c)
+}
+
 func (w *tgBotWrapper) EditMessageText(chatID int64, messageID int, text string) (tgbotapi.Message, error) {
 	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
 	return w.bot.Send(edit)
@@ -71,6 +113,44 @@ func (w *tgBotWrapper) GetFileDirectURL(fileID string) (string, error) {
 	return w.bot.GetFileDirectURL(fileID)
 }
 
+// TelegramUpdate is an update together with the forum topic of its message,
+// which tgbotapi v5 predates and does not decode.
+type TelegramUpdate struct {
+	tgbotapi.Update
+	// ThreadID is the topic of Message, or of the message a callback query
+	// came from, in a forum supergroup; 0 elsewhere.
+	ThreadID int
+}
+
+func (u *TelegramUpdate) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return err
+	}
+	type topic struct {
+		MessageThreadID int  `json:"message_thread_id"`
+		IsTopicMessage  bool `json:"is_topic_message"`
+	}
+	var raw struct {
+		Message       *topic `json:"message"`
+		CallbackQuery *struct {
+			Message *topic `json:"message"`
+		} `json:"callback_query"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	msg := raw.Message
+	if raw.CallbackQuery != nil {
+		msg = raw.CallbackQuery.Message
+	}
+	// Replies in ordinary supergroups carry a thread ID too; only forum
+	// topics get their own session.
+	if msg != nil && msg.IsTopicMessage {
+		u.ThreadID = msg.MessageThreadID
+	}
+	return nil
+}
+
 // BotFactory creates TelegramBot instances (allows mocking)
 type BotFactory func(token, apiEndpoint string, client *http.Client) (TelegramBot, error)
 
@@ -90,38 +170,24 @@ type TelegramChannel struct {
 	proxy      string
 	cancel     context.CancelFunc
 	botFactory BotFactory
-	previewMu  sync.Mutex
-	previewMsg map[int64]previewState
-}
-
-type previewState struct {
-	draftMessageID int
-	toolMessageID  int
-	replyToMessageID int
-	lastDraftText  string
-	lastEditAt     time.Time
-	toolBlockIndex int
-	toolEntries    []toolEntry
-	hadToolProgress bool
-	finalized      bool
+	stream     *streamRenderer
+	buttons    buttonRegistry
+	groupAllow map[string]bool
+	groups     map[string]config.TelegramGroupConfig
+
+	// Webhook mode; polling when webhookURL is empty.
+	webhookURL    string
+	webhookPort   int
+	webhookSecret string
+	webhookSlots  chan struct{}   // updates admitted and not yet answered
+	webhookMu     sync.Mutex      // handles updates one at a time
+	webhookDone   <-chan struct{} // closed once the channel stops
+	server        *http.Server
+
+	textMu   sync.Mutex
+	lastText map[telegramChat]int // last text message per chat, where buttons go
 }
 
-type toolEntry struct {
-	Name      string
-	ParamsRaw string
-	When      string
-	Raw       string
-}
-
-const (
-	telegramEventKey           = "telegram_event"
-	telegramEventPreviewUpdate = "preview_update"
-	telegramEventPreviewFinal  = "preview_final"
-	telegramEventToolProgress  = "tool_progress"
-	telegramEventUsageHUD      = "usage_hud"
-	maxToolBlockChars          = 3800
-)
-
 func NewTelegramChannel(cfg config.TelegramConfig, b *bus.MessageBus, logger sdklogger.Logger) (*TelegramChannel, error) {
 	return NewTelegramChannelWithFactory(cfg, b, defaultBotFactory, logger)
 }
@@ -136,9 +202,24 @@ func NewTelegramChannelWithFactory(cfg config.TelegramConfig, b *bus.MessageBus,
 		BaseChannel: NewBaseChannel(telegramChannelName, b, cfg.AllowFrom, logger),
 		token:       cfg.Token,
 		proxy:       cfg.Proxy,
+		webhookURL:    strings.TrimSpace(cfg.WebhookURL),
+		webhookPort:   cfg.WebhookPort,
+		webhookSecret: cfg.WebhookSecret,
 		botFactory:  factory,
-		previewMsg:  make(map[int64]previewState),
+		groupAllow:  make(map[string]bool),
+		groups:      cfg.Groups,
+		lastText:    make(map[telegramChat]int),
 	}
+	for _, id := range cfg.GroupAllowFrom {
+		if id = strings.TrimSpace(id); id != "" {
+			ch.groupAllow[id] = true
+		}
+	}
+	ch.stream = newStreamingRenderer(ch, streamOptions{
+		name:          telegramChannelName,
+		maxDraftRunes: 4000,
+		editInterval:  defaultStreamEditInterval,
+	}, logger)
 	return ch, nil
 }
 
@@ -171,34 +252,157 @@ func (t *TelegramChannel) Start(ctx context.Context) error {
 	}
 
 	ctx, t.cancel = context.WithCancel(ctx)
+	if t.webhookURL != "" {
+		return t.startWebhook(ctx)
+	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 30
-	updates := t.bot.GetUpdatesChan(u)
+	// A webhook left behind by an earlier run makes getUpdates fail.
+	if err := t.bot.DeleteWebhook(); err != nil {
+		t.logger.Warnf("[telegram] delete webhook failed: %v", err)
+	}
+	go t.poll(ctx)
+
+	t.logger.Infof("[telegram] polling started")
+	return nil
+}
+
+// startWebhook serves webhook updates on a local listener, usually behind a
+// reverse proxy, and points the bot at the public URL.
+func (t *TelegramChannel) startWebhook(ctx context.Context) error {
+	port := t.webhookPort
+	if port == 0 {
+		port = telegramDefaultWebhookPort
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("telegram webhook listen :%d: %w", port, err)
+	}
+
+	if t.webhookSecret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			ln.Close()
+			return fmt.Errorf("generate webhook secret: %w", err)
+		}
+		t.webhookSecret = hex.EncodeToString(buf)
+	}
+	t.webhookSlots = make(chan struct{}, telegramWebhookQueue)
+	t.webhookDone = ctx.Done()
 
+	mux := http.NewServeMux()
+	mux.HandleFunc(telegramWebhookPath, t.handleWebhook)
+	t.server = &http.Server{Handler: mux}
 	go func() {
-		for {
+		if err := t.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.logger.Errorf("[telegram] webhook server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		t.shutdownWebhook()
+	}()
+
+	if err := t.bot.SetWebhook(t.webhookURL, t.webhookSecret); err != nil {
+		t.cancel()
+		return fmt.Errorf("set telegram webhook: %w", err)
+	}
+	t.logger.Infof("[telegram] webhook listening on :%d%s for %s", port, telegramWebhookPath, t.webhookURL)
+	return nil
+}
+
+// handleWebhook handles one update posted by Telegram and answers 200 only
+// once it has been handled, so an update is never lost on the way. Updates
+// are handled one at a time, as when polling. Too many waiting updates, or a
+// stopped channel, answer 503, which Telegram retries later.
+func (t *TelegramChannel) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(telegramSecretHeader)), []byte(t.webhookSecret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var update TelegramUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&update); err != nil {
+		http.Error(w, "invalid update", http.StatusBadRequest)
+		return
+	}
+	select {
+	case t.webhookSlots <- struct{}{}:
+		defer func() { <-t.webhookSlots }()
+	default:
+		t.logger.Warnf("[telegram] webhook queue full, update %d deferred", update.UpdateID)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	t.webhookMu.Lock()
+	defer t.webhookMu.Unlock()
+	select {
+	case <-t.webhookDone:
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	t.handleUpdate(update)
+	w.WriteHeader(http.StatusOK)
+}
+
+// shutdownWebhook stops the webhook server, letting updates already being
+// handled finish so that Telegram gets their answers.
+func (t *TelegramChannel) shutdownWebhook() {
+	ctx, cancel := context.WithTimeout(context.Background(), telegramWebhookShutdown)
+	defer cancel()
+	if err := t.server.Shutdown(ctx); err != nil {
+		_ = t.server.Close()
+	}
+}
+
+// poll long-polls getUpdates until ctx is done.
+func (t *TelegramChannel) poll(ctx context.Context) {
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 30
+	for ctx.Err() == nil {
+		updates, err := t.bot.GetUpdates(u)
+		if err != nil {
+			t.logger.Warnf("[telegram] get updates failed, retrying in 3s: %v", err)
 			select {
-			case update := <-updates:
-				if update.Message == nil {
-					continue
-				}
-				t.handleMessage(update.Message)
 			case <-ctx.Done():
 				return
+			case <-time.After(3 * time.Second):
+			}
+			continue
+		}
+		for _, update := range updates {
+			if update.UpdateID < u.Offset {
+				continue
 			}
+			u.Offset = update.UpdateID + 1
+			t.handleUpdate(update)
 		}
-	}()
+	}
+}
 
-	t.logger.Infof("[telegram] polling started")
-	return nil
+func (t *TelegramChannel) handleUpdate(update TelegramUpdate) {
+	switch {
+	case update.Message != nil:
+		t.handleMessage(update.Message, update.ThreadID)
+	case update.CallbackQuery != nil:
+		t.handleCallback(update.CallbackQuery, update.ThreadID)
+	}
 }
 
-func (t *TelegramChannel) handleMessage(msg *tgbotapi.Message) {
+func (t *TelegramChannel) handleMessage(msg *tgbotapi.Message, threadID int) {
+	if msg.From == nil {
+		return
+	}
 	senderID := strconv.FormatInt(msg.From.ID, 10)
+	group := msg.Chat.IsGroup() || msg.Chat.IsSuperGroup()
 
-	if !t.IsAllowed(senderID) {
-		t.logger.Warnf("[telegram] rejected message from %s (%s)", senderID, msg.From.UserName)
+	if !t.chatAllowed(msg.Chat, senderID) {
+		t.logger.Warnf("[telegram] rejected message from %s (%s) in %d", senderID, msg.From.UserName, msg.Chat.ID)
 		return
 	}
 
@@ -206,112 +410,294 @@ func (t *TelegramChannel) handleMessage(msg *tgbotapi.Message) {
 	if content == "" && msg.Caption != "" {
 		content = msg.Caption
 	}
+	var settings config.TelegramGroupConfig
+	if group {
+		settings = t.groupSettings(msg.Chat.ID)
+		var addressed bool
+		content, addressed = t.addressedContent(msg, content, threadID)
+		if !addressed && (settings.RequireMention == nil || *settings.RequireMention) {
+			return
+		}
+	}
 
 	// Download media if present
-	var media []string
-	mediaTypes := map[string]string{}
-	mediaMIMEs := map[string]string{}
-	if msg.Photo != nil && len(msg.Photo) > 0 {
-		// Get largest photo
-		photo := msg.Photo[len(msg.Photo)-1]
-		localPath, err := t.downloadFile(photo.FileID, "photo")
+	var attachments []bus.Attachment
+	addMedia := func(fileID, prefix, name string, kind bus.AttachmentKind, mime string, size int) string {
+		if size > telegramMaxFileBytes {
+			t.logger.Warnf("[telegram] %s too large to download: %d bytes", name, size)
+			content = strings.TrimSpace(content + "\n\n" + fmt.Sprintf("[%s not downloaded: %.1f MB is over the %d MB limit]",
+				name, float64(size)/(1<<20), telegramMaxFileBytes>>20))
+			return ""
+		}
+		localPath, err := t.downloadFile(fileID, prefix)
 		if err != nil {
-			t.logger.Warnf("failed to download photo: %v", err)
-		} else {
-			media = append(media, localPath)
-			mediaTypes[localPath] = "image"
-			mediaMIMEs[localPath] = "image/jpeg"
-			t.logger.Debugf("downloaded photo to %s", localPath)
+			t.logger.Warnf("failed to download %s: %v", prefix, err)
+			return ""
 		}
+		attachments = append(attachments, bus.Attachment{
+			Path: localPath,
+			Kind: kind,
+			MIME: strings.TrimSpace(mime),
+			Size: int64(size),
+		})
+		t.logger.Debugf("downloaded %s to %s", prefix, localPath)
+		return localPath
 	}
-	if msg.Voice != nil && strings.TrimSpace(msg.Voice.FileID) != "" {
-		localPath, err := t.downloadFile(msg.Voice.FileID, "voice")
+	addVideo := func(fileID, name, mime string, size int) {
+		localPath := addMedia(fileID, "video", name, bus.AttachmentFile, mime, size)
+		if localPath == "" {
+			return
+		}
+		parts, err := videoAttachments(localPath, telegramMediaDir())
 		if err != nil {
-			t.logger.Warnf("failed to download voice: %v", err)
-		} else {
-			media = append(media, localPath)
-			mediaTypes[localPath] = "audio"
-			mediaMIMEs[localPath] = strings.TrimSpace(msg.Voice.MimeType)
-			t.logger.Debugf("downloaded voice to %s", localPath)
+			t.logger.Warnf("[telegram] extract video %s: %v", name, err)
 		}
+		attachments = append(attachments, parts...)
+		content = appendDocument(content, name, localPath, "")
+	}
+	if msg.Photo != nil && len(msg.Photo) > 0 {
+		// Get largest photo
+		photo := msg.Photo[len(msg.Photo)-1]
+		addMedia(photo.FileID, "photo", "photo", bus.AttachmentImage, "image/jpeg", photo.FileSize)
+	}
+	if msg.Voice != nil && strings.TrimSpace(msg.Voice.FileID) != "" {
+		addMedia(msg.Voice.FileID, "voice", "voice", bus.AttachmentAudio, msg.Voice.MimeType, msg.Voice.FileSize)
 	}
 	if msg.Audio != nil && strings.TrimSpace(msg.Audio.FileID) != "" {
-		localPath, err := t.downloadFile(msg.Audio.FileID, "audio")
-		if err != nil {
-			t.logger.Warnf("failed to download audio: %v", err)
-		} else {
-			media = append(media, localPath)
-			mediaTypes[localPath] = "audio"
-			mediaMIMEs[localPath] = strings.TrimSpace(msg.Audio.MimeType)
-			t.logger.Debugf("downloaded audio to %s", localPath)
-		}
+		addMedia(msg.Audio.FileID, "audio", "audio", bus.AttachmentAudio, msg.Audio.MimeType, msg.Audio.FileSize)
 	}
-	if msg.Document != nil && strings.TrimSpace(msg.Document.FileID) != "" {
-		mime := strings.ToLower(strings.TrimSpace(msg.Document.MimeType))
-		kind := ""
+	if msg.Video != nil && strings.TrimSpace(msg.Video.FileID) != "" {
+		addVideo(msg.Video.FileID, nameOr(msg.Video.FileName, "video.mp4"), msg.Video.MimeType, msg.Video.FileSize)
+	}
+	if msg.VideoNote != nil && strings.TrimSpace(msg.VideoNote.FileID) != "" {
+		addVideo(msg.VideoNote.FileID, "video_note.mp4", "video/mp4", msg.VideoNote.FileSize)
+	}
+	if doc := msg.Document; doc != nil && strings.TrimSpace(doc.FileID) != "" {
+		mime := strings.ToLower(strings.TrimSpace(doc.MimeType))
+		name := nameOr(doc.FileName, "document")
 		switch {
 		case strings.HasPrefix(mime, "audio/"):
-			kind = "audio"
+			addMedia(doc.FileID, "audio", name, bus.AttachmentAudio, mime, doc.FileSize)
 		case strings.HasPrefix(mime, "image/"):
-			kind = "image"
-		}
-		if kind != "" {
-			localPath, err := t.downloadFile(msg.Document.FileID, kind)
-			if err != nil {
-				t.logger.Warnf("failed to download %s document: %v", kind, err)
-			} else {
-				media = append(media, localPath)
-				mediaTypes[localPath] = kind
-				mediaMIMEs[localPath] = mime
-				t.logger.Debugf("downloaded %s document to %s", kind, localPath)
+			addMedia(doc.FileID, "image", name, bus.AttachmentImage, mime, doc.FileSize)
+		case strings.HasPrefix(mime, "video/"):
+			addVideo(doc.FileID, name, mime, doc.FileSize)
+		default:
+			if localPath := addMedia(doc.FileID, "document", name, bus.AttachmentFile, mime, doc.FileSize); localPath != "" {
+				text, err := documentText(localPath, name, mime)
+				if err != nil {
+					t.logger.Warnf("[telegram] extract text from %s: %v", name, err)
+				}
+				content = appendDocument(content, name, localPath, text)
 			}
 		}
 	}
 
 	// Skip messages with no content and no media
-	if content == "" && len(media) == 0 {
+	if content == "" && len(attachments) == 0 {
 		return
 	}
 
-	chatID := strconv.FormatInt(msg.Chat.ID, 10)
+	chat := telegramChat{id: msg.Chat.ID, thread: threadID}
+	typing := t.startTyping(msg.Chat.ID)
+
+	metadata := map[string]any{
+		"username":   msg.From.UserName,
+		"first_name": msg.From.FirstName,
+	}
+	if group {
+		metadata["chat_type"] = msg.Chat.Type
+		metadata["chat_title"] = msg.Chat.Title
+	}
+	if !t.bus.PublishInbound(bus.InboundMessage{
+		Channel:     telegramChannelName,
+		SenderID:    senderID,
+		ChatID:      chat.String(),
+		MessageID:   strconv.Itoa(msg.MessageID),
+		Content:     content,
+		Attachments: attachments,
+		Timestamp:   time.Unix(int64(msg.Date), 0),
+		Typing:      typing, // Gateway stops typing once the reply is under way
+		Direct:       msg.Chat.IsPrivate(),
+		Instructions: settings.SystemPrompt,
+		Metadata:     metadata,
+	}) {
+		t.logger.Debugf("[telegram] duplicate message dropped: %d", msg.MessageID)
+		typing.Stop()
+	}
+}
+
+// chatAllowed reports whether senderID may talk to the bot in chat. Groups
+// listed in groupAllowFrom are open to all their members; other chats are
+// checked by sender.
+func (t *TelegramChannel) chatAllowed(chat *tgbotapi.Chat, senderID string) bool {
+	if chat != nil && (chat.IsGroup() || chat.IsSuperGroup()) && len(t.groupAllow) > 0 {
+		return t.groupAllow[strconv.FormatInt(chat.ID, 10)]
+	}
+	return t.IsAllowed(senderID)
+}
+
+// groupSettings returns the settings of a group chat, falling back to "*".
+func (t *TelegramChannel) groupSettings(chatID int64) config.TelegramGroupConfig {
+	if settings, ok := t.groups[strconv.FormatInt(chatID, 10)]; ok {
+		return settings
+	}
+	return t.groups["*"]
+}
+
+// addressedContent reports whether a group message is meant for the bot:
+// it mentions the bot, replies to one of its messages or is a command not
+// aimed at another bot. The mention and a command's @bot suffix are removed
+// from the returned content.
+func (t *TelegramChannel) addressedContent(msg *tgbotapi.Message, content string, threadID int) (string, bool) {
+	self := t.bot.GetSelf()
+	mention := "@" + self.UserName
+	addressed := false
+
+	if strings.HasPrefix(content, "/") {
+		command, rest, _ := strings.Cut(content, " ")
+		if name, target, ok := strings.Cut(command, "@"); ok {
+			if !strings.EqualFold(target, self.UserName) {
+				return content, false
+			}
+			content = strings.TrimSpace(name + " " + rest)
+		}
+		addressed = true
+	}
+
+	// A plain message in a forum topic replies to the topic's first message.
+	if reply := msg.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == self.ID && reply.MessageID != threadID {
+		addressed = true
+	}
 
-	// Start continuous typing indicator (stops when message is received in Inbound channel)
+	entities := msg.Entities
+	if msg.Text == "" {
+		entities = msg.CaptionEntities
+	}
+	mentioned := false
+	for _, ent := range entities {
+		switch ent.Type {
+		case "text_mention":
+			mentioned = mentioned || (ent.User != nil && ent.User.ID == self.ID)
+		case "mention":
+			mentioned = mentioned || (self.UserName != "" && strings.Contains(strings.ToLower(content), strings.ToLower(mention)))
+		}
+	}
+	if mentioned && self.UserName != "" {
+		content = removeFold(content, mention)
+	}
+	return strings.TrimSpace(content), addressed || mentioned
+}
+
+// removeFold removes every case-insensitive occurrence of sub from s.
+func removeFold(s, sub string) string {
+	lower, lowerSub := strings.ToLower(s), strings.ToLower(sub)
+	var b strings.Builder
+	for {
+		i := strings.Index(lower, lowerSub)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s, lower = s[i+len(sub):], lower[i+len(sub):]
+	}
+}
+
+// startTyping shows the typing indicator in chatID until the returned
+// handle is stopped.
+func (t *TelegramChannel) startTyping(chatID int64) *bus.Typing {
 	// Telegram typing indicator lasts 5 seconds, so we resend every 4 seconds
 	stopTyping := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(4 * time.Second)
 		defer ticker.Stop()
-		
+
 		// Send first typing immediately
-		typing := tgbotapi.NewChatAction(msg.Chat.ID, tgbotapi.ChatTyping)
+		typing := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
 		t.bot.Send(typing)
-		
+
 		for {
 			select {
 			case <-stopTyping:
 				return
 			case <-ticker.C:
-				typing := tgbotapi.NewChatAction(msg.Chat.ID, tgbotapi.ChatTyping)
+				typing := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
 				t.bot.Send(typing)
 			}
 		}
 	}()
+	return bus.NewTyping(func() { close(stopTyping) })
+}
+
+// handleCallback answers an inline keyboard press. The button's data is
+// published as the user's reply to the message that carried the keyboard,
+// and the keyboard collapses to the chosen option.
+func (t *TelegramChannel) handleCallback(query *tgbotapi.CallbackQuery, threadID int) {
+	senderID := strconv.FormatInt(query.From.ID, 10)
+	var queryChat *tgbotapi.Chat
+	if query.Message != nil {
+		queryChat = query.Message.Chat
+	}
+	if !t.chatAllowed(queryChat, senderID) {
+		t.logger.Warnf("[telegram] rejected button press from %s (%s)", senderID, query.From.UserName)
+		t.answerCallback(query.ID, "")
+		return
+	}
+	if query.Data == telegramButtonAnswered {
+		t.answerCallback(query.ID, "")
+		return
+	}
+	if query.Message == nil {
+		t.answerCallback(query.ID, telegramButtonExpired)
+		return
+	}
 
-	t.bus.Inbound <- bus.InboundMessage{
+	msg := query.Message
+	chatID := telegramChat{id: msg.Chat.ID, thread: threadID}.String()
+	messageID := strconv.Itoa(msg.MessageID)
+	index, err := strconv.Atoi(strings.TrimPrefix(query.Data, telegramButtonPrefix))
+	if err != nil || !strings.HasPrefix(query.Data, telegramButtonPrefix) {
+		index = -1
+	}
+	button, _, ok := t.buttons.take(chatID, messageID, index)
+	if !ok {
+		t.answerCallback(query.ID, telegramButtonExpired)
+		return
+	}
+	t.answerCallback(query.ID, "")
+
+	answered := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(answeredLabel(button), telegramButtonAnswered),
+	))
+	if _, err := t.bot.Request(tgbotapi.NewEditMessageReplyMarkup(msg.Chat.ID, msg.MessageID, answered)); err != nil && !isIgnorableEditError(err) {
+		t.logger.Warnf("[telegram] mark button answered failed chat=%s msg=%s: %v", chatID, messageID, err)
+	}
+
+	typing := t.startTyping(msg.Chat.ID)
+	if !t.bus.PublishInbound(bus.InboundMessage{
 		Channel:   telegramChannelName,
 		SenderID:  senderID,
 		ChatID:    chatID,
-		Content:   content,
-		Media:     media,
-		Timestamp: time.Unix(int64(msg.Date), 0),
+		MessageID: messageID,
+		Content:   button.Data,
+		Timestamp: time.Now(),
+		Typing:    typing,
+		Direct:    msg.Chat.IsPrivate(),
 		Metadata: map[string]any{
-			"username":         msg.From.UserName,
-			"first_name":       msg.From.FirstName,
-			"message_id":       msg.MessageID,
-			"stop_typing":      stopTyping, // Pass channel to gateway to stop typing
-			"media_types":      mediaTypes,
-			"media_mime_types": mediaMIMEs,
+			"username":   query.From.UserName,
+			"first_name": query.From.FirstName,
+			"button":     button.Label,
 		},
+	}) {
+		t.logger.Debugf("[telegram] duplicate button press dropped: %s", messageID)
+		typing.Stop()
+	}
+}
+
+func (t *TelegramChannel) answerCallback(queryID, text string) {
+	if _, err := t.bot.Request(tgbotapi.NewCallback(queryID, text)); err != nil {
+		t.logger.Warnf("[telegram] answer callback failed: %v", err)
 	}
 }
 
@@ -319,8 +705,11 @@ func (t *TelegramChannel) Stop() error {
 	if t.cancel != nil {
 		t.cancel()
 	}
-	if t.bot != nil {
-		t.bot.StopReceivingUpdates()
+	if t.server != nil {
+		t.shutdownWebhook()
+		if err := t.bot.DeleteWebhook(); err != nil {
+			t.logger.Warnf("[telegram] delete webhook failed: %v", err)
+		}
 	}
 	return nil
 }
@@ -333,7 +722,7 @@ func (t *TelegramChannel) downloadFile(fileID, prefix string) (string, error) {
 	}
 
 	// Create temp directory
-	tempDir := filepath.Join(os.TempDir(), "aevitas-telegram-media")
+	tempDir := telegramMediaDir()
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		return "", fmt.Errorf("create temp dir: %w", err)
 	}
@@ -356,62 +745,134 @@ func (t *TelegramChannel) downloadFile(fileID, prefix string) (string, error) {
 	}
 	defer outFile.Close()
 
-	if _, err := io.Copy(outFile, resp.Body); err != nil {
+	// The size in the message is optional, so enforce the limit here too.
+	written, err := io.Copy(outFile, io.LimitReader(resp.Body, telegramMaxFileBytes+1))
+	if err == nil && written > telegramMaxFileBytes {
+		err = fmt.Errorf("larger than %d bytes", telegramMaxFileBytes)
+	}
+	if err != nil {
+		os.Remove(localPath)
 		return "", fmt.Errorf("save file: %w", err)
 	}
 
 	return localPath, nil
 }
 
+// telegramMaxFileBytes is the largest file the Bot API lets bots download.
+const telegramMaxFileBytes = 20 << 20
+
+func telegramMediaDir() string {
+	return filepath.Join(os.TempDir(), "aevitas-telegram-media")
+}
+
+func nameOr(name, fallback string) string {
+	if name = strings.TrimSpace(name); name != "" {
+		return name
+	}
+	return fallback
+}
+
 // SetBot sets the bot (for testing)
 func (t *TelegramChannel) SetBot(bot TelegramBot) {
 	t.bot = bot
 }
 
-func (t *TelegramChannel) Send(msg bus.OutboundMessage) error {
+func (t *TelegramChannel) Send(msg bus.OutboundMessage) (err error) {
 	if t.bot == nil {
 		return fmt.Errorf("telegram bot not initialized")
 	}
 
-	chatID, err := strconv.ParseInt(msg.ChatID, 10, 64)
+	chat, err := parseTelegramChat(msg.ChatID)
 	if err != nil {
-		return fmt.Errorf("invalid chat id %q: %w", msg.ChatID, err)
+		return err
+	}
+	if msg.Kind == bus.KindToolProgress && !t.showToolProgress(chat) {
+		return nil
 	}
-	event := telegramEvent(msg.Metadata)
 	replyToMessageID := parseReplyToMessageID(msg.ReplyTo)
+	if len(msg.Buttons) > 0 {
+		t.setLastText(chat, 0)
+		defer func() {
+			if err == nil {
+				t.attachButtons(chat, msg.Buttons)
+			}
+		}()
+	}
 
 	// Send media files first (if any)
-	for _, mediaPath := range msg.Media {
-		if err := t.sendMediaFile(chatID, mediaPath); err != nil {
-			t.logger.Warnf("failed to send media file %s: %v", mediaPath, err)
+	for _, att := range msg.Attachments {
+		if err := t.sendMediaFile(chat, att.Path); err != nil {
+			t.logger.Warnf("failed to send media file %s: %v", att.Path, err)
 			// Continue with other files
 		}
 	}
 
 	// Send text content if present
 	if msg.Content != "" {
-		switch event {
-		case telegramEventPreviewUpdate:
-			return t.sendPreview(chatID, msg.Content, "update", replyToMessageID)
-		case telegramEventPreviewFinal:
-			return t.sendPreview(chatID, msg.Content, "final", replyToMessageID)
-		case telegramEventUsageHUD:
-			return t.sendUsageHUD(chatID, msg.Content)
-		case telegramEventToolProgress:
-			return t.sendToolProgress(chatID, msg)
+		switch msg.Kind {
+		case bus.KindPreviewUpdate:
+			return t.stream.Update(msg.ChatID, msg.Content, msg.ReplyTo)
+		case bus.KindPreviewFinal:
+			return t.stream.Finalize(msg.ChatID, msg.Content, msg.ReplyTo)
+		case bus.KindUsageHUD:
+			return t.sendUsageHUD(chat, msg.Content)
+		case bus.KindToolProgress:
+			return t.stream.ToolProgress(msg.ChatID, msg)
 		}
-		return t.sendNewMessage(chatID, msg.Content, replyToMessageID)
+		return t.sendNewMessage(chat, msg.Content, replyToMessageID)
 	}
 
 	return nil
 }
 
-func telegramEvent(meta map[string]any) string {
-	if len(meta) == 0 {
-		return ""
+// showToolProgress reports whether tool progress is shown in chat; groups
+// can turn it off.
+func (t *TelegramChannel) showToolProgress(chat telegramChat) bool {
+	if chat.id >= 0 {
+		return true
+	}
+	settings := t.groupSettings(chat.id)
+	return settings.ToolProgress == nil || *settings.ToolProgress
+}
+
+// telegramChat is where a message goes: a chat and, in forum supergroups,
+// a topic. Topics are written "<chat>:<thread>" in bus chat IDs so each
+// gets its own session.
+type telegramChat struct {
+	id     int64
+	thread int
+}
+
+func parseTelegramChat(raw string) (telegramChat, error) {
+	idPart, threadPart, hasThread := strings.Cut(raw, ":")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return telegramChat{}, fmt.Errorf("invalid chat id %q: %w", raw, err)
 	}
-	mode, _ := meta[telegramEventKey].(string)
-	return strings.ToLower(strings.TrimSpace(mode))
+	chat := telegramChat{id: id}
+	if hasThread {
+		if chat.thread, err = strconv.Atoi(threadPart); err != nil || chat.thread <= 0 {
+			return telegramChat{}, fmt.Errorf("invalid chat id %q: bad topic", raw)
+		}
+	}
+	return chat, nil
+}
+
+func (c telegramChat) String() string {
+	if c.thread == 0 {
+		return strconv.FormatInt(c.id, 10)
+	}
+	return strconv.FormatInt(c.id, 10) + ":" + strconv.Itoa(c.thread)
+}
+
+// replyTo returns the message a new message should reply to. tgbotapi v5
+// cannot set message_thread_id, so messages reach a topic by replying to
+// its first message, which clients do not show as a reply.
+func (c telegramChat) replyTo(messageID int) int {
+	if messageID > 0 {
+		return messageID
+	}
+	return c.thread
 }
 
 func parseReplyToMessageID(raw string) int {
@@ -426,342 +887,207 @@ func parseReplyToMessageID(raw string) int {
 	return id
 }
 
-func (t *TelegramChannel) sendPreview(chatID int64, content, mode string, replyToMessageID int) error {
-	isFinal := mode == "final"
-	if isFinal {
-		return t.finalizePreview(chatID, content)
+func (t *TelegramChannel) Capabilities() Capabilities {
+	return Capabilities{
+		MaxMessageLen: 4096,
+		Edit:          true,
+		Markdown:      MarkdownFull,
+		Media:         []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+		Voice:         true,
+		Buttons:       true,
+		Threads:       true,
 	}
+}
 
-	text := renderDraftText(content)
-	if text == "" {
-		return nil
-	}
-	text = truncateTelegramText(text, 4000)
+const (
+	telegramButtonPrefix   = "btn:"
+	telegramButtonAnswered = "btn:answered"
+	telegramButtonExpired  = "选项已失效，请直接回复文字"
+)
 
-	state, err := t.ensureTurnState(chatID, replyToMessageID)
-	if err != nil {
-		return err
-	}
-	if state.lastDraftText == text {
-		return nil
-	}
+func (t *TelegramChannel) setLastText(chat telegramChat, messageID int) {
+	t.textMu.Lock()
+	defer t.textMu.Unlock()
+	t.lastText[chat] = messageID
+}
 
-	edited, err := t.editPreviewText(chatID, state.draftMessageID, text)
-	if err != nil {
-		fallback := tgbotapi.NewMessage(chatID, text)
-		if replyToMessageID > 0 {
-			fallback.ReplyToMessageID = replyToMessageID
-		}
-		m, sendErr := t.bot.Send(fallback)
-		if sendErr != nil {
-			return fmt.Errorf("edit preview: %w; fallback send: %v", err, sendErr)
+// attachButtons puts an inline keyboard under the last text message sent
+// to chat, or under a short prompt when there is none. Callback data holds
+// the button's index; the data itself may exceed Telegram's 64 bytes.
+func (t *TelegramChannel) attachButtons(chat telegramChat, rows [][]bus.Button) {
+	keyboard := make([][]tgbotapi.InlineKeyboardButton, 0, len(rows))
+	index := 0
+	for _, row := range rows {
+		kbRow := make([]tgbotapi.InlineKeyboardButton, 0, len(row))
+		for _, button := range row {
+			kbRow = append(kbRow, tgbotapi.NewInlineKeyboardButtonData(button.Label, telegramButtonPrefix+strconv.Itoa(index)))
+			index++
 		}
-		t.previewMu.Lock()
-		t.previewMsg[chatID] = previewState{
-			draftMessageID: m.MessageID,
-			toolMessageID:  state.toolMessageID,
-			replyToMessageID: state.replyToMessageID,
-			lastDraftText:  text,
-			lastEditAt:     time.Now(),
-			toolBlockIndex: state.toolBlockIndex,
-			toolEntries:    state.toolEntries,
-			hadToolProgress: state.hadToolProgress,
-			finalized:      state.finalized,
+		keyboard = append(keyboard, kbRow)
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+
+	t.textMu.Lock()
+	messageID := t.lastText[chat]
+	t.textMu.Unlock()
+	if messageID != 0 {
+		_, err := t.bot.Request(tgbotapi.NewEditMessageReplyMarkup(chat.id, messageID, markup))
+		if err == nil {
+			t.buttons.add(chat.String(), strconv.Itoa(messageID), "", rows)
+			return
 		}
-		t.previewMu.Unlock()
-		return nil
+		t.logger.Warnf("[telegram] attach buttons failed chat=%s msg=%d: %v", chat, messageID, err)
 	}
-	if !edited {
-		return nil
+	prompt := tgbotapi.NewMessage(chat.id, "请选择：")
+	prompt.ReplyToMessageID = chat.replyTo(0)
+	prompt.ReplyMarkup = markup
+	sent, err := t.bot.Send(prompt)
+	if err != nil {
+		t.logger.Warnf("[telegram] send buttons failed chat=%s: %v", chat, err)
+		return
 	}
+	t.buttons.add(chat.String(), strconv.Itoa(sent.MessageID), "", rows)
+}
 
-	t.previewMu.Lock()
-	t.previewMsg[chatID] = previewState{
-		draftMessageID: state.draftMessageID,
-		toolMessageID:  state.toolMessageID,
-		replyToMessageID: state.replyToMessageID,
-		lastDraftText:  text,
-		lastEditAt:     time.Now(),
-		toolBlockIndex: state.toolBlockIndex,
-		toolEntries:    state.toolEntries,
-		hadToolProgress: state.hadToolProgress,
-		finalized:      state.finalized,
-	}
-	t.previewMu.Unlock()
-	return nil
+// StreamingRenderer implements Streamer.
+func (t *TelegramChannel) StreamingRenderer() StreamingRenderer {
+	return t.stream
 }
 
-func (t *TelegramChannel) finalizePreview(chatID int64, content string) error {
-	t.previewMu.Lock()
-	state := t.previewMsg[chatID]
-	t.previewMu.Unlock()
-	if state.finalized && state.draftMessageID == 0 {
-		// Idempotent finalization: ignore duplicated final events.
-		return nil
+// CreateBlock implements StreamTarget. The tool block is rendered from
+// markdown, the draft is plain text.
+func (t *TelegramChannel) CreateBlock(chatID string, block StreamBlock, text, replyTo string) (string, error) {
+	chat, err := parseTelegramChat(chatID)
+	if err != nil {
+		return "", err
+	}
+	if block == StreamToolBlock {
+		msgID, err := t.sendMarkdownText(chat, text, parseReplyToMessageID(replyTo))
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(msgID), nil
+	}
+	msg := tgbotapi.NewMessage(chat.id, renderDraftText(text))
+	msg.ReplyToMessageID = chat.replyTo(parseReplyToMessageID(replyTo))
+	sent, err := t.bot.Send(msg)
+	if err != nil {
+		return "", err
 	}
+	return strconv.Itoa(sent.MessageID), nil
+}
 
-	ctx := context.Background()
-	const maxUTF16Len = 4090
-	contents, err := telegramify.Telegramify(ctx, content, maxUTF16Len, false, nil)
+// EditBlock implements StreamTarget.
+func (t *TelegramChannel) EditBlock(chatID, messageID string, block StreamBlock, text string) error {
+	chat, err := parseTelegramChat(chatID)
 	if err != nil {
-		return fmt.Errorf("telegramify process: %w", err)
+		return err
+	}
+	msgID := parseReplyToMessageID(messageID)
+	if block == StreamToolBlock {
+		err = t.editMarkdownMessage(chat.id, msgID, text)
+	} else {
+		_, err = t.editPreviewText(chat.id, msgID, renderDraftText(text))
 	}
-	if len(contents) == 0 {
+	if isIgnorableEditError(err) {
 		return nil
 	}
+	return err
+}
 
-	if err := t.applyFinalContents(chatID, state, contents); err != nil {
+// DeleteBlock implements StreamTarget.
+func (t *TelegramChannel) DeleteBlock(chatID, messageID string) error {
+	chat, err := parseTelegramChat(chatID)
+	if err != nil {
 		return err
 	}
-
-	// Keep the tool block state after finalization so post-final metadata
-	// (e.g. usage HUD) can still append to the active turn summary.
-	t.previewMu.Lock()
-	cur := t.previewMsg[chatID]
-	if !state.hadToolProgress && state.toolMessageID != 0 {
-		if err := t.bot.DeleteMessage(chatID, state.toolMessageID); err != nil {
-			t.logger.Warnf("[telegram] delete empty tool block failed: %v", err)
-		}
-		cur.toolMessageID = 0
-		cur.toolBlockIndex = 0
-		cur.toolEntries = nil
-		cur.hadToolProgress = false
-	}
-	cur.draftMessageID = 0
-	cur.lastDraftText = ""
-	cur.lastEditAt = time.Now()
-	cur.finalized = true
-	if cur.toolMessageID == 0 && state.toolMessageID != 0 && state.hadToolProgress {
-		cur.toolMessageID = state.toolMessageID
-		cur.toolBlockIndex = state.toolBlockIndex
-		cur.toolEntries = state.toolEntries
-		cur.hadToolProgress = state.hadToolProgress
-	}
-	t.previewMsg[chatID] = cur
-	t.previewMu.Unlock()
-	return nil
+	return t.bot.DeleteMessage(chat.id, parseReplyToMessageID(messageID))
 }
 
-func (t *TelegramChannel) applyFinalContents(chatID int64, state previewState, contents []telegramify.Content) error {
-	usedPreview := false
-	for _, item := range contents {
-		replyToMessageID := 0
-		if !usedPreview {
-			replyToMessageID = state.replyToMessageID
+// SendReply implements StreamTarget. The reply is split with telegramify;
+// only its first part replaces the draft and replies to the user.
+func (t *TelegramChannel) SendReply(chatID, text, draftID, replyTo string) error {
+	const maxUTF16Len = 4090
+	parts, err := telegramify.Telegramify(context.Background(), text, maxUTF16Len, false, nil)
+	if err != nil {
+		return fmt.Errorf("telegramify process: %w", err)
+	}
+	for _, part := range parts {
+		if c, ok := part.(*telegramify.Text); ok && strings.TrimSpace(c.Text) == "" {
+			continue
 		}
-		switch c := item.(type) {
-		case *telegramify.Text:
-			if !usedPreview && state.draftMessageID != 0 {
-				_, err := t.editPreviewWithTextContent(chatID, state.draftMessageID, c)
-				if err == nil {
-					usedPreview = true
-					continue
-				}
-				t.logger.Warnf("[telegram] preview final edit failed chat=%d err=%v", chatID, err)
-			}
-			if err := t.sendTextContent(chatID, c, replyToMessageID); err != nil {
-				return err
-			}
-			usedPreview = true
-		case *telegramify.File:
-			if !usedPreview && state.draftMessageID != 0 {
-				_, _ = t.bot.EditMessageText(chatID, state.draftMessageID, "已生成附件，正在发送...")
-				usedPreview = true
-			}
-			if err := t.sendFileContent(chatID, c, replyToMessageID); err != nil {
-				return err
-			}
-			usedPreview = true
-		case *telegramify.Photo:
-			if !usedPreview && state.draftMessageID != 0 {
-				_, _ = t.bot.EditMessageText(chatID, state.draftMessageID, "已生成图片，正在发送...")
-				usedPreview = true
-			}
-			if err := t.sendPhotoContent(chatID, c, replyToMessageID); err != nil {
-				return err
-			}
-			usedPreview = true
-		default:
-			t.logger.Warnf("[telegram] unknown content type: %T", item)
+		if err := t.sendReplyPart(chatID, part, draftID, replyTo); err != nil {
+			return err
 		}
+		draftID, replyTo = "", ""
 	}
 	return nil
 }
 
-func (t *TelegramChannel) ensureTurnState(chatID int64, replyToMessageID int) (previewState, error) {
-	t.previewMu.Lock()
-	state, ok := t.previewMsg[chatID]
-	t.previewMu.Unlock()
-	if ok && state.draftMessageID != 0 && state.toolMessageID != 0 {
-		if state.replyToMessageID == 0 && replyToMessageID > 0 {
-			state.replyToMessageID = replyToMessageID
-			t.previewMu.Lock()
-			t.previewMsg[chatID] = state
-			t.previewMu.Unlock()
-		}
-		return state, nil
-	}
-
-	toolMsgID, err := t.sendMarkdownText(chatID, formatToolBlock(1, nil), 0)
-	if err != nil {
-		return previewState{}, fmt.Errorf("send tool block: %w", err)
-	}
-	draft := tgbotapi.NewMessage(chatID, "⌛ 正在生成回复...")
-	if replyToMessageID > 0 {
-		draft.ReplyToMessageID = replyToMessageID
-	}
-	draftMsg, err := t.bot.Send(draft)
-	if err != nil {
-		return previewState{}, fmt.Errorf("send draft block: %w", err)
-	}
-
-	state = previewState{
-		draftMessageID: draftMsg.MessageID,
-		toolMessageID:  toolMsgID,
-		replyToMessageID: replyToMessageID,
-		toolBlockIndex: 1,
-		hadToolProgress: false,
-		finalized:      false,
-	}
-	t.previewMu.Lock()
-	t.previewMsg[chatID] = state
-	t.previewMu.Unlock()
-	return state, nil
-}
-
-func (t *TelegramChannel) sendToolProgress(chatID int64, msg bus.OutboundMessage) error {
-	state, err := t.ensureTurnState(chatID, 0)
+// sendReplyPart sends one part of a reply. Text replaces the draft in
+// place; for files and photos the draft becomes a short notice.
+func (t *TelegramChannel) sendReplyPart(chatID string, part telegramify.Content, draftID, replyTo string) error {
+	chat, err := parseTelegramChat(chatID)
 	if err != nil {
 		return err
 	}
-	entry := buildToolEntry(msg)
-	if entry.Name == "" && strings.TrimSpace(entry.Raw) == "" {
-		return nil
-	}
-
-	tryEntries := append(append([]toolEntry{}, state.toolEntries...), entry)
-	block := formatToolBlock(state.toolBlockIndex, tryEntries)
-	if len([]rune(block)) > maxToolBlockChars {
-		// Start a new tool block without dropping old logs.
-		state.toolBlockIndex++
-		state.toolEntries = []toolEntry{entry}
-		newBlock := formatToolBlock(state.toolBlockIndex, state.toolEntries)
-		mID, sendErr := t.sendMarkdownText(chatID, newBlock, 0)
-		if sendErr != nil {
-			return fmt.Errorf("send tool block rollover: %w", sendErr)
-		}
-		state.toolMessageID = mID
-	} else {
-		if err := t.editMarkdownMessage(chatID, state.toolMessageID, block); err != nil {
-			msg := strings.ToLower(err.Error())
-			if !strings.Contains(msg, "message is not modified") {
-				return fmt.Errorf("edit tool block: %w", err)
+	draftMsgID := parseReplyToMessageID(draftID)
+	replyToMessageID := parseReplyToMessageID(replyTo)
+	switch c := part.(type) {
+	case *telegramify.Text:
+		if draftMsgID != 0 {
+			_, err := t.editPreviewWithTextContent(chat.id, draftMsgID, c)
+			if err == nil {
+				t.setLastText(chat, draftMsgID)
+				return nil
 			}
+			t.logger.Warnf("[telegram] preview final edit failed chat=%s err=%v", chat, err)
+		}
+		return t.sendTextContent(chat, c, replyToMessageID)
+	case *telegramify.File:
+		if draftMsgID != 0 {
+			_, _ = t.bot.EditMessageText(chat.id, draftMsgID, "已生成附件，正在发送...")
+		}
+		return t.sendFileContent(chat, c, replyToMessageID)
+	case *telegramify.Photo:
+		if draftMsgID != 0 {
+			_, _ = t.bot.EditMessageText(chat.id, draftMsgID, "已生成图片，正在发送...")
 		}
-		state.toolEntries = tryEntries
-	}
-	state.hadToolProgress = true
-
-	t.previewMu.Lock()
-	cur := t.previewMsg[chatID]
-	cur.toolMessageID = state.toolMessageID
-	cur.toolBlockIndex = state.toolBlockIndex
-	cur.toolEntries = state.toolEntries
-	cur.hadToolProgress = state.hadToolProgress
-	t.previewMsg[chatID] = cur
-	t.previewMu.Unlock()
+		return t.sendPhotoContent(chat, c, replyToMessageID)
+	default:
+		t.logger.Warnf("[telegram] unknown content type: %T", part)
+	}
 	return nil
 }
 
-func (t *TelegramChannel) sendUsageHUD(chatID int64, content string) error {
+func (t *TelegramChannel) sendUsageHUD(chat telegramChat, content string) error {
 	content = strings.TrimSpace(content)
 	if content == "" {
 		return nil
 	}
 	// Usage HUD is always sent as standalone message.
-	return t.sendPlainText(chatID, content)
+	return t.sendPlainText(chat, content)
 }
 
-func (t *TelegramChannel) sendPlainText(chatID int64, content string) error {
+func (t *TelegramChannel) sendPlainText(chat telegramChat, content string) error {
 	text := truncateTelegramText(content, 4000)
 	if text == "" {
 		return nil
 	}
-	_, err := t.bot.Send(tgbotapi.NewMessage(chatID, text))
+	msg := tgbotapi.NewMessage(chat.id, text)
+	msg.ReplyToMessageID = chat.replyTo(0)
+	_, err := t.bot.Send(msg)
 	return err
 }
 
-func formatToolBlock(blockIndex int, entries []toolEntry) string {
-	var b strings.Builder
-	if blockIndex <= 1 {
-		b.WriteString("🧰 Tool Calls")
-	} else {
-		b.WriteString(fmt.Sprintf("🧰 Tool Calls (续 %d)", blockIndex))
-	}
-	if len(entries) == 0 {
-		b.WriteString("\n（等待工具调用）")
-		return b.String()
-	}
-	for _, e := range entries {
-		name := strings.TrimSpace(e.Name)
-		if name == "" {
-			name = "Tool"
-		}
-		payload := normalizeToolPayload(e)
-		if payload == "" {
-			continue
-		}
-		b.WriteString("\n\n⏳ ")
-		b.WriteString(name)
-		b.WriteString("\n```text\n")
-		b.WriteString(payload)
-		b.WriteString("\n```")
-	}
-	return strings.TrimSpace(b.String())
-}
-
-func buildToolEntry(msg bus.OutboundMessage) toolEntry {
-	entry := toolEntry{Raw: strings.TrimSpace(msg.Content)}
-	if msg.Metadata == nil {
-		return entry
-	}
-	if name, ok := msg.Metadata["tool_name"].(string); ok {
-		entry.Name = strings.TrimSpace(name)
-	}
-	if params, ok := msg.Metadata["tool_params"].(string); ok {
-		entry.ParamsRaw = strings.TrimSpace(params)
-	}
-	if when, ok := msg.Metadata["tool_time"].(string); ok {
-		entry.When = strings.TrimSpace(when)
-	}
-	return entry
-}
-
-func normalizeToolPayload(e toolEntry) string {
-	raw := strings.TrimSpace(e.ParamsRaw)
-	if raw == "" || raw == "{}" {
-		raw = strings.TrimSpace(e.Raw)
-	}
-	if raw == "" {
-		return "{}"
-	}
-	if json.Valid([]byte(raw)) {
-		var buf bytes.Buffer
-		if err := json.Compact(&buf, []byte(raw)); err == nil {
-			raw = buf.String()
-		}
-	}
-	raw = strings.ReplaceAll(raw, "```", "'''")
-	return truncateTelegramText(raw, 3400)
-}
-
+// renderDraftText converts a Markdown draft to the plain text shown while
+// the reply streams.
 func renderDraftText(content string) string {
 	text := strings.TrimSpace(content)
 	if text == "" {
 		return ""
 	}
-	closed := closeOpenMarkdown(text)
-	rendered, _ := telegramify.Convert(closed, false, nil)
+	rendered, _ := telegramify.Convert(closeOpenMarkdown(text), false, nil)
 	rendered = strings.TrimSpace(rendered)
 	if rendered == "" {
 		return text
@@ -769,23 +1095,6 @@ func renderDraftText(content string) string {
 	return rendered
 }
 
-func closeOpenMarkdown(s string) string {
-	if s == "" {
-		return s
-	}
-	closed := s
-	if strings.Count(closed, "```")%2 == 1 {
-		closed += "\n```"
-	}
-	if strings.Count(closed, "`")%2 == 1 {
-		closed += "`"
-	}
-	if strings.Count(closed, "**")%2 == 1 {
-		closed += "**"
-	}
-	return closed
-}
-
 func truncateTelegramText(text string, maxRunes int) string {
 	if maxRunes <= 0 {
 		return ""
@@ -815,7 +1124,7 @@ func (t *TelegramChannel) sendPhoto(chatID int64, imagePath string) error {
 }
 
 // sendMediaFile sends a file (document, image, etc.) to Telegram
-func (t *TelegramChannel) sendMediaFile(chatID int64, filePath string) error {
+func (t *TelegramChannel) sendMediaFile(chat telegramChat, filePath string) error {
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return fmt.Errorf("media file not found: %s", filePath)
@@ -830,18 +1139,20 @@ func (t *TelegramChannel) sendMediaFile(chatID int64, filePath string) error {
 	if isImage {
 		// Send as photo; fall back to document when Telegram rejects the image
 		// (e.g. PHOTO_INVALID_DIMENSIONS for very tall/wide screenshots).
-		photo := tgbotapi.NewPhoto(chatID, tgbotapi.FilePath(filePath))
+		photo := tgbotapi.NewPhoto(chat.id, tgbotapi.FilePath(filePath))
+		photo.ReplyToMessageID = chat.replyTo(0)
 		photo.Caption = filepath.Base(filePath)
 		if _, err := t.bot.Send(photo); err != nil {
 			t.logger.Warnf("photo upload failed (%v), retrying as document: %s", err, filePath)
-			doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(filePath))
+			doc := tgbotapi.NewDocument(chat.id, tgbotapi.FilePath(filePath))
+			doc.ReplyToMessageID = chat.replyTo(0)
 			doc.Caption = filepath.Base(filePath)
 			if _, docErr := t.bot.Send(doc); docErr != nil {
 				return fmt.Errorf("send telegram document (photo fallback): %w", docErr)
 			}
-			t.logger.Infof("sent file as document (photo fallback) chat_id=%d path=%s", chatID, filePath)
+			t.logger.Infof("sent file as document (photo fallback) chat=%s path=%s", chat, filePath)
 		} else {
-			t.logger.Infof("sent photo to telegram chat_id=%d path=%s", chatID, filePath)
+			t.logger.Infof("sent photo to telegram chat=%s path=%s", chat, filePath)
 		}
 	} else if isAudio {
 		voicePath := filePath
@@ -856,28 +1167,31 @@ func (t *TelegramChannel) sendMediaFile(chatID int64, filePath string) error {
 				t.logger.Infof("[telegram] audio transcoded for voice path=%s converted=%s", filePath, convertedPath)
 			}
 		}
-		voice := tgbotapi.NewVoice(chatID, tgbotapi.FilePath(voicePath))
+		voice := tgbotapi.NewVoice(chat.id, tgbotapi.FilePath(voicePath))
+		voice.ReplyToMessageID = chat.replyTo(0)
 		voice.Caption = filepath.Base(filePath)
 		if _, err := t.bot.Send(voice); err == nil {
 			cleanupVoicePath()
-			t.logger.Infof("sent voice to telegram chat_id=%d path=%s", chatID, filePath)
+			t.logger.Infof("sent voice to telegram chat=%s path=%s", chat, filePath)
 			return nil
 		}
 		cleanupVoicePath()
 		t.logger.Warnf("[telegram] send voice failed, fallback to audio path=%s", filePath)
-		audio := tgbotapi.NewAudio(chatID, tgbotapi.FilePath(filePath))
+		audio := tgbotapi.NewAudio(chat.id, tgbotapi.FilePath(filePath))
+		audio.ReplyToMessageID = chat.replyTo(0)
 		audio.Caption = filepath.Base(filePath)
 		if _, err := t.bot.Send(audio); err == nil {
-			t.logger.Infof("sent audio to telegram chat_id=%d path=%s", chatID, filePath)
+			t.logger.Infof("sent audio to telegram chat=%s path=%s", chat, filePath)
 			return nil
 		}
 		// Fallback to document
-		doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(filePath))
+		doc := tgbotapi.NewDocument(chat.id, tgbotapi.FilePath(filePath))
+		doc.ReplyToMessageID = chat.replyTo(0)
 		doc.Caption = filepath.Base(filePath)
 		if _, err := t.bot.Send(doc); err != nil {
 			return fmt.Errorf("send telegram audio/document fallback: %w", err)
 		}
-		t.logger.Infof("sent audio as document to telegram chat_id=%d path=%s", chatID, filePath)
+		t.logger.Infof("sent audio as document to telegram chat=%s path=%s", chat, filePath)
 	} else {
 		// Send as document using FileBytes so the display name is always the
 		// symlink name (e.g. "aevitas.log") rather than the symlink target
@@ -886,14 +1200,15 @@ func (t *TelegramChannel) sendMediaFile(chatID int64, filePath string) error {
 		if err != nil {
 			return fmt.Errorf("read file for telegram: %w", err)
 		}
-		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		doc := tgbotapi.NewDocument(chat.id, tgbotapi.FileBytes{
 			Name:  filepath.Base(filePath),
 			Bytes: data,
 		})
+		doc.ReplyToMessageID = chat.replyTo(0)
 		if _, err := t.bot.Send(doc); err != nil {
 			return fmt.Errorf("send telegram document: %w", err)
 		}
-		t.logger.Infof("sent document to telegram chat_id=%d path=%s", chatID, filePath)
+		t.logger.Infof("sent document to telegram chat=%s path=%s", chat, filePath)
 	}
 
 	return nil
@@ -901,7 +1216,7 @@ func (t *TelegramChannel) sendMediaFile(chatID int64, filePath string) error {
 
 // sendNewMessage sends a new message using full Telegramify pipeline
 // Supports text, code files, and Mermaid diagram images
-func (t *TelegramChannel) sendNewMessage(chatID int64, content string, replyToMessageID int) error {
+func (t *TelegramChannel) sendNewMessage(chat telegramChat, content string, replyToMessageID int) error {
 	ctx := context.Background()
 	
 	// Process markdown with full pipeline (split, code extraction, mermaid rendering)
@@ -921,15 +1236,15 @@ func (t *TelegramChannel) sendNewMessage(chatID int64, content string, replyToMe
 		}
 		switch c := item.(type) {
 		case *telegramify.Text:
-			if err := t.sendTextContent(chatID, c, currentReplyTo); err != nil {
+			if err := t.sendTextContent(chat, c, currentReplyTo); err != nil {
 				return err
 			}
 		case *telegramify.File:
-			if err := t.sendFileContent(chatID, c, currentReplyTo); err != nil {
+			if err := t.sendFileContent(chat, c, currentReplyTo); err != nil {
 				return err
 			}
 		case *telegramify.Photo:
-			if err := t.sendPhotoContent(chatID, c, currentReplyTo); err != nil {
+			if err := t.sendPhotoContent(chat, c, currentReplyTo); err != nil {
 				return err
 			}
 		default:
@@ -941,37 +1256,33 @@ func (t *TelegramChannel) sendNewMessage(chatID int64, content string, replyToMe
 }
 
 // sendTextContent sends a text message with entities
-func (t *TelegramChannel) sendTextContent(chatID int64, text *telegramify.Text, replyToMessageID int) error {
-	tgMsg := tgbotapi.NewMessage(chatID, text.Text)
-	if replyToMessageID > 0 {
-		tgMsg.ReplyToMessageID = replyToMessageID
-	}
+func (t *TelegramChannel) sendTextContent(chat telegramChat, text *telegramify.Text, replyToMessageID int) error {
+	tgMsg := tgbotapi.NewMessage(chat.id, text.Text)
+	tgMsg.ReplyToMessageID = chat.replyTo(replyToMessageID)
 	
 	// Convert MessageEntity to Telegram's format
 	tgMsg.Entities = toTelegramEntities(text.Entities)
 	
 	// Send the message
-	if _, err := t.bot.Send(tgMsg); err != nil {
+	sent, err := t.bot.Send(tgMsg)
+	if err != nil {
 		// Fallback to plain text if entity parsing fails
 		t.logger.Warnf("[telegram] failed to send with entities, falling back to plain text: %v", err)
-		fallbackMsg := tgbotapi.NewMessage(chatID, text.Text)
-		if replyToMessageID > 0 {
-			fallbackMsg.ReplyToMessageID = replyToMessageID
-		}
-		if _, err2 := t.bot.Send(fallbackMsg); err2 != nil {
-			return fmt.Errorf("send telegram message: %w", err2)
+		fallbackMsg := tgbotapi.NewMessage(chat.id, text.Text)
+		fallbackMsg.ReplyToMessageID = chat.replyTo(replyToMessageID)
+		if sent, err = t.bot.Send(fallbackMsg); err != nil {
+			return fmt.Errorf("send telegram message: %w", err)
 		}
 	}
+	t.setLastText(chat, sent.MessageID)
 	
 	return nil
 }
 
-func (t *TelegramChannel) sendMarkdownText(chatID int64, markdown string, replyToMessageID int) (int, error) {
+func (t *TelegramChannel) sendMarkdownText(chat telegramChat, markdown string, replyToMessageID int) (int, error) {
 	text, entities := telegramify.Convert(markdown, false, nil)
-	msg := tgbotapi.NewMessage(chatID, text)
-	if replyToMessageID > 0 {
-		msg.ReplyToMessageID = replyToMessageID
-	}
+	msg := tgbotapi.NewMessage(chat.id, text)
+	msg.ReplyToMessageID = chat.replyTo(replyToMessageID)
 	msg.Entities = toTelegramEntities(entities)
 	sent, err := t.bot.Send(msg)
 	if err != nil {
@@ -1059,17 +1370,15 @@ func isIgnorableEditError(err error) bool {
 }
 
 // sendFileContent sends a file (e.g., code block)
-func (t *TelegramChannel) sendFileContent(chatID int64, file *telegramify.File, replyToMessageID int) error {
+func (t *TelegramChannel) sendFileContent(chat telegramChat, file *telegramify.File, replyToMessageID int) error {
 	// Create FileBytes from data
 	fileBytes := tgbotapi.FileBytes{
 		Name:  file.FileName,
 		Bytes: file.FileData,
 	}
 	
-	doc := tgbotapi.NewDocument(chatID, fileBytes)
-	if replyToMessageID > 0 {
-		doc.ReplyToMessageID = replyToMessageID
-	}
+	doc := tgbotapi.NewDocument(chat.id, fileBytes)
+	doc.ReplyToMessageID = chat.replyTo(replyToMessageID)
 	
 	// Add caption if present
 	if file.CaptionText != "" {
@@ -1100,17 +1409,15 @@ func (t *TelegramChannel) sendFileContent(chatID int64, file *telegramify.File,
 }
 
 // sendPhotoContent sends a photo (e.g., Mermaid diagram)
-func (t *TelegramChannel) sendPhotoContent(chatID int64, photo *telegramify.Photo, replyToMessageID int) error {
+func (t *TelegramChannel) sendPhotoContent(chat telegramChat, photo *telegramify.Photo, replyToMessageID int) error {
 	// Create FileBytes from image data
 	fileBytes := tgbotapi.FileBytes{
 		Name:  photo.FileName,
 		Bytes: photo.FileData,
 	}
 	
-	photoMsg := tgbotapi.NewPhoto(chatID, fileBytes)
-	if replyToMessageID > 0 {
-		photoMsg.ReplyToMessageID = replyToMessageID
-	}
+	photoMsg := tgbotapi.NewPhoto(chat.id, fileBytes)
+	photoMsg.ReplyToMessageID = chat.replyTo(replyToMessageID)
 	
 	// Add caption if present
 	if photo.CaptionText != "" {
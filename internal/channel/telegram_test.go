@@ -2,9 +2,14 @@ package channel
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -225,7 +230,7 @@ func TestTelegramChannel_HandleMessage_Allowed(t *testing.T) {
 		Date: 1234567890,
 	}
 
-	ch.handleMessage(msg)
+	ch.handleMessage(msg, 0)
 
 	select {
 	case inbound := <-b.Inbound:
@@ -253,7 +258,7 @@ func TestTelegramChannel_HandleMessage_EmptyText(t *testing.T) {
 		Text: "",
 	}
 
-	ch.handleMessage(msg)
+	ch.handleMessage(msg, 0)
 
 	select {
 	case <-b.Inbound:
@@ -277,7 +282,7 @@ func TestTelegramChannel_HandleMessage_Caption(t *testing.T) {
 		Caption: "image caption",
 	}
 
-	ch.handleMessage(msg)
+	ch.handleMessage(msg, 0)
 
 	select {
 	case inbound := <-b.Inbound:
@@ -292,34 +297,43 @@ func TestTelegramChannel_HandleMessage_Caption(t *testing.T) {
 // ===== Mock Bot for Testing =====
 
 type mockTelegramBot struct {
-	updatesChan chan tgbotapi.Update
-	stopped     bool
+	mu          sync.Mutex // typing indicators are sent from their own goroutines
+	updatesChan chan TelegramUpdate
 	sentMsgs    []tgbotapi.Chattable
 	edited      []tgbotapi.EditMessageTextConfig
 	deleted     []tgbotapi.DeleteMessageConfig
+	requests    []tgbotapi.Chattable
 	sendErr     error
 	sendEditErr error
 	editErr     error
 	deleteErr   error
 	self        tgbotapi.User
+	fileURL     string
+
+	webhookURL     string
+	webhookSecret  string
+	webhookDeletes int
 }
 
 func newMockBot() *mockTelegramBot {
 	return &mockTelegramBot{
-		updatesChan: make(chan tgbotapi.Update, 10),
+		updatesChan: make(chan TelegramUpdate, 10),
 		self:        tgbotapi.User{UserName: "testbot"},
 	}
 }
 
-func (m *mockTelegramBot) GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel {
-	return m.updatesChan
-}
-
-func (m *mockTelegramBot) StopReceivingUpdates() {
-	m.stopped = true
+func (m *mockTelegramBot) GetUpdates(config tgbotapi.UpdateConfig) ([]TelegramUpdate, error) {
+	select {
+	case update := <-m.updatesChan:
+		return []TelegramUpdate{update}, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, nil
+	}
 }
 
 func (m *mockTelegramBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if edit, ok := c.(tgbotapi.EditMessageTextConfig); ok {
 		if m.sendEditErr != nil {
 			return tgbotapi.Message{}, m.sendEditErr
@@ -333,6 +347,11 @@ func (m *mockTelegramBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
 	return tgbotapi.Message{MessageID: 1}, nil
 }
 
+func (m *mockTelegramBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	m.requests = append(m.requests, c)
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
 func (m *mockTelegramBot) EditMessageText(chatID int64, messageID int, text string) (tgbotapi.Message, error) {
 	if m.editErr != nil {
 		return tgbotapi.Message{}, m.editErr
@@ -352,11 +371,37 @@ func (m *mockTelegramBot) DeleteMessage(chatID int64, messageID int) error {
 	return nil
 }
 
+func (m *mockTelegramBot) SetWebhook(url, secret string) error {
+	m.webhookURL, m.webhookSecret = url, secret
+	return nil
+}
+
+func (m *mockTelegramBot) DeleteWebhook() error {
+	m.webhookDeletes++
+	return nil
+}
+
+// messages returns the text messages sent so far.
+func (m *mockTelegramBot) messages() []tgbotapi.MessageConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var msgs []tgbotapi.MessageConfig
+	for _, c := range m.sentMsgs {
+		if msg, ok := c.(tgbotapi.MessageConfig); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
 func (m *mockTelegramBot) GetSelf() tgbotapi.User {
 	return m.self
 }
 
 func (m *mockTelegramBot) GetFileDirectURL(fileID string) (string, error) {
+	if m.fileURL != "" {
+		return m.fileURL + "/" + fileID, nil
+	}
 	return "https://api.telegram.org/file/bot/test.jpg", nil
 }
 
@@ -497,9 +542,9 @@ func TestTelegramChannel_Send_PreviewUpdateThenFinal(t *testing.T) {
 	ch.SetBot(mockBot)
 
 	err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "partial",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "partial",
+		Kind:    bus.KindPreviewUpdate,
 	})
 	if err != nil {
 		t.Fatalf("update preview error: %v", err)
@@ -509,9 +554,9 @@ func TestTelegramChannel_Send_PreviewUpdateThenFinal(t *testing.T) {
 	}
 
 	err = ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "final text",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: "final text",
+		Kind:    bus.KindPreviewFinal,
 	})
 	if err != nil {
 		t.Fatalf("final preview error: %v", err)
@@ -532,10 +577,10 @@ func TestTelegramChannel_Send_PreviewUpdate_RepliesToUserMessage(t *testing.T) {
 	ch.SetBot(mockBot)
 
 	err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		ReplyTo:  "99",
-		Content:  "partial",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		ReplyTo: "99",
+		Content: "partial",
+		Kind:    bus.KindPreviewUpdate,
 	})
 	if err != nil {
 		t.Fatalf("preview update error: %v", err)
@@ -567,23 +612,23 @@ func TestTelegramChannel_Send_PreviewFinal_WithToolProgress_DoesNotDeleteToolBlo
 	ch.SetBot(mockBot)
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "draft",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "draft",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update failed: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  `{"query":"abc"}`,
-		Metadata: map[string]any{telegramEventKey: telegramEventToolProgress, "tool_name": "WebSearch"},
+		ChatID:  "123",
+		Content: `{"query":"abc"}`,
+		Kind:    bus.KindToolProgress, Tool: &bus.ToolProgress{Name: "WebSearch"},
 	}); err != nil {
 		t.Fatalf("tool progress failed: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "final",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: "final",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("preview final failed: %v", err)
 	}
@@ -600,9 +645,9 @@ func TestTelegramChannel_Send_PreviewFinal_NotModified_DoesNotFallbackSend(t *te
 	ch.SetBot(mockBot)
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "same final text",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "same final text",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update failed: %v", err)
 	}
@@ -610,9 +655,9 @@ func TestTelegramChannel_Send_PreviewFinal_NotModified_DoesNotFallbackSend(t *te
 	beforeSends := len(mockBot.sentMsgs)
 	mockBot.sendEditErr = fmt.Errorf("Bad Request: message is not modified")
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "same final text",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: "same final text",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("preview final failed: %v", err)
 	}
@@ -629,16 +674,16 @@ func TestTelegramChannel_Send_DuplicatePreviewFinal_IsIdempotent(t *testing.T) {
 	ch.SetBot(mockBot)
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "draft",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "draft",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update failed: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "final once",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: "final once",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("first preview final failed: %v", err)
 	}
@@ -648,9 +693,9 @@ func TestTelegramChannel_Send_DuplicatePreviewFinal_IsIdempotent(t *testing.T) {
 	deletedCount := len(mockBot.deleted)
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "final once",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: "final once",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("duplicate preview final failed: %v", err)
 	}
@@ -669,14 +714,14 @@ func TestTelegramChannel_Send_PreviewUpdateEditsExisting(t *testing.T) {
 	ch.SetBot(mockBot)
 
 	first := bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "chunk-1",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "chunk-1",
+		Kind:    bus.KindPreviewUpdate,
 	}
 	second := bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "chunk-1 chunk-2",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "chunk-1 chunk-2",
+		Kind:    bus.KindPreviewUpdate,
 	}
 	if err := ch.Send(first); err != nil {
 		t.Fatalf("first preview send: %v", err)
@@ -707,18 +752,18 @@ func TestTelegramChannel_Send_PreviewFinalCodeBlockUsesFinalizePipeline(t *testi
 	ch.SetBot(mockBot)
 
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "draft text",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "draft text",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update failed: %v", err)
 	}
 
 	finalContent := "最终代码如下：\n```go\npackage main\nfunc main(){}\n```"
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  finalContent,
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: finalContent,
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("preview final failed: %v", err)
 	}
@@ -754,10 +799,10 @@ func TestTelegramChannel_Send_ToolProgressCreatesAndKeepsToolBlocks(t *testing.T
 		if err := ch.Send(bus.OutboundMessage{
 			ChatID:  "123",
 			Content: long,
-			Metadata: map[string]any{
-				telegramEventKey: telegramEventToolProgress,
-				"tool_name":      "WebFetch",
-				"tool_params":    fmt.Sprintf(`{"url":"https://example.com/%d","prompt":"%s"}`, i, strings.Repeat("x", 120)),
+			Kind:    bus.KindToolProgress,
+			Tool: &bus.ToolProgress{
+				Name:   "WebFetch",
+				Params: fmt.Sprintf(`{"url":"https://example.com/%d","prompt":"%s"}`, i, strings.Repeat("x", 120)),
 			},
 		}); err != nil {
 			t.Fatalf("tool progress #%d failed: %v", i, err)
@@ -780,10 +825,10 @@ func TestTelegramChannel_Send_ToolProgressRendersStructuredSummary(t *testing.T)
 	msg := bus.OutboundMessage{
 		ChatID:  "123",
 		Content: "⏳ WebSearch",
-		Metadata: map[string]any{
-			telegramEventKey: telegramEventToolProgress,
-			"tool_name":      "WebSearch",
-			"tool_params":    `{"query":"Iran situation March 2026 latest news","url":"https://example.com"}`,
+		Kind:    bus.KindToolProgress,
+		Tool: &bus.ToolProgress{
+			Name:   "WebSearch",
+			Params: `{"query":"Iran situation March 2026 latest news","url":"https://example.com"}`,
 		},
 	}
 	if err := ch.Send(msg); err != nil {
@@ -813,27 +858,27 @@ func TestTelegramChannel_Send_UsageHUDAfterToolProgress_SendsStandalone(t *testi
 
 	// Prepare a turn with preview + tool progress.
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "draft text",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewUpdate},
+		ChatID:  "123",
+		Content: "draft text",
+		Kind:    bus.KindPreviewUpdate,
 	}); err != nil {
 		t.Fatalf("preview update failed: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
 		ChatID:  "123",
 		Content: "⏳ WebSearch",
-		Metadata: map[string]any{
-			telegramEventKey: telegramEventToolProgress,
-			"tool_name":      "WebSearch",
-			"tool_params":    `{"query":"abc"}`,
+		Kind:    bus.KindToolProgress,
+		Tool: &bus.ToolProgress{
+			Name:   "WebSearch",
+			Params: `{"query":"abc"}`,
 		},
 	}); err != nil {
 		t.Fatalf("tool progress failed: %v", err)
 	}
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "final answer",
-		Metadata: map[string]any{telegramEventKey: telegramEventPreviewFinal},
+		ChatID:  "123",
+		Content: "final answer",
+		Kind:    bus.KindPreviewFinal,
 	}); err != nil {
 		t.Fatalf("preview final failed: %v", err)
 	}
@@ -841,9 +886,9 @@ func TestTelegramChannel_Send_UsageHUDAfterToolProgress_SendsStandalone(t *testi
 	beforeEdits := len(mockBot.edited)
 	beforeSent := len(mockBot.sentMsgs)
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "📊 Usage\nTotal billed tokens: 123",
-		Metadata: map[string]any{telegramEventKey: telegramEventUsageHUD},
+		ChatID:  "123",
+		Content: "📊 Usage\nTotal billed tokens: 123",
+		Kind:    bus.KindUsageHUD,
 	}); err != nil {
 		t.Fatalf("usage hud send failed: %v", err)
 	}
@@ -864,9 +909,9 @@ func TestTelegramChannel_Send_UsageHUDWithoutToolProgress_SendsStandalone(t *tes
 
 	beforeSent := len(mockBot.sentMsgs)
 	if err := ch.Send(bus.OutboundMessage{
-		ChatID:   "123",
-		Content:  "📊 Usage\nTotal billed tokens: 456",
-		Metadata: map[string]any{telegramEventKey: telegramEventUsageHUD},
+		ChatID:  "123",
+		Content: "📊 Usage\nTotal billed tokens: 456",
+		Kind:    bus.KindUsageHUD,
 	}); err != nil {
 		t.Fatalf("usage hud send failed: %v", err)
 	}
@@ -885,10 +930,10 @@ func TestTelegramChannel_Send_UsageHUD_WithToolProgress_NoToolBlockEdit(t *testi
 	if err := ch.Send(bus.OutboundMessage{
 		ChatID:  "123",
 		Content: "⏳ WebSearch",
-		Metadata: map[string]any{
-			telegramEventKey: telegramEventToolProgress,
-			"tool_name":      "WebSearch",
-			"tool_params":    `{"query":"abc"}`,
+		Kind:    bus.KindToolProgress,
+		Tool: &bus.ToolProgress{
+			Name:   "WebSearch",
+			Params: `{"query":"abc"}`,
 		},
 	}); err != nil {
 		t.Fatalf("tool progress failed: %v", err)
@@ -899,9 +944,7 @@ func TestTelegramChannel_Send_UsageHUD_WithToolProgress_NoToolBlockEdit(t *testi
 	if err := ch.Send(bus.OutboundMessage{
 		ChatID:  "123",
 		Content: "📊 Usage\nTotal billed tokens: 789",
-		Metadata: map[string]any{
-			telegramEventKey: telegramEventUsageHUD,
-		},
+		Kind:    bus.KindUsageHUD,
 	}); err != nil {
 		t.Fatalf("usage hud html send failed: %v", err)
 	}
@@ -913,6 +956,220 @@ func TestTelegramChannel_Send_UsageHUD_WithToolProgress_NoToolBlockEdit(t *testi
 	}
 }
 
+// ===== Telegram inline keyboard 测试 =====
+
+func TestTelegramChannel_Send_ButtonsAttachToLastText(t *testing.T) {
+	mockBot := newMockBot()
+	ch, _ := NewTelegramChannel(config.TelegramConfig{Token: "fake-token"}, bus.NewMessageBus(10), sdklogger.NewDefault())
+	ch.SetBot(mockBot)
+
+	err := ch.Send(bus.OutboundMessage{ChatID: "123", Content: "Which one?", Buttons: [][]bus.Button{
+		{{Label: "Red", Data: "red"}},
+		{{Label: "Blue", Data: "blue"}},
+	}})
+	if err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if len(mockBot.requests) != 1 {
+		t.Fatalf("expected one keyboard request, got %d", len(mockBot.requests))
+	}
+	edit, ok := mockBot.requests[0].(tgbotapi.EditMessageReplyMarkupConfig)
+	if !ok || edit.MessageID != 1 || edit.ChatID != 123 {
+		t.Fatalf("expected keyboard on the sent message, got %#v", mockBot.requests[0])
+	}
+	rows := edit.ReplyMarkup.InlineKeyboard
+	if len(rows) != 2 || *rows[1][0].CallbackData != "btn:1" || rows[1][0].Text != "Blue" {
+		t.Fatalf("unexpected keyboard: %+v", rows)
+	}
+}
+
+func TestTelegramChannel_HandleCallback_AnswersOnce(t *testing.T) {
+	b := bus.NewMessageBus(10)
+	mockBot := newMockBot()
+	ch, _ := NewTelegramChannel(config.TelegramConfig{Token: "fake-token"}, b, sdklogger.NewDefault())
+	ch.SetBot(mockBot)
+	ch.Send(bus.OutboundMessage{ChatID: "123", Content: "Delete?", Buttons: [][]bus.Button{
+		{{Label: "Yes", Data: "/cleanup confirm"}, {Label: "No", Data: "/cleanup cancel"}},
+	}})
+
+	press := &tgbotapi.CallbackQuery{
+		ID:      "cb1",
+		From:    &tgbotapi.User{ID: 7, UserName: "alice"},
+		Message: &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 123}},
+		Data:    "btn:1",
+	}
+	ch.handleCallback(press, 0)
+
+	inbound := <-b.Inbound
+	inbound.Typing.Stop()
+	if inbound.Content != "/cleanup cancel" || inbound.MessageID != "1" || inbound.SenderID != "7" || inbound.Metadata["button"] != "No" {
+		t.Fatalf("unexpected inbound: %+v", inbound)
+	}
+	if answer, ok := mockBot.requests[1].(tgbotapi.CallbackConfig); !ok || answer.CallbackQueryID != "cb1" || answer.Text != "" {
+		t.Fatalf("expected silent callback answer, got %#v", mockBot.requests[1])
+	}
+	edit, ok := mockBot.requests[2].(tgbotapi.EditMessageReplyMarkupConfig)
+	if !ok || edit.ReplyMarkup.InlineKeyboard[0][0].Text != "✅ No" {
+		t.Fatalf("expected keyboard collapsed to the answer, got %#v", mockBot.requests[2])
+	}
+
+	press.ID = "cb2"
+	ch.handleCallback(press, 0)
+	if answer, ok := mockBot.requests[3].(tgbotapi.CallbackConfig); !ok || answer.Text != telegramButtonExpired {
+		t.Fatalf("second press should be told the options expired, got %#v", mockBot.requests[3])
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("second press should not publish: %+v", msg)
+	default:
+	}
+}
+
+func TestTelegramChannel_HandleMessage_Documents(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("package main\n\nfunc main() {}\n"))
+	}))
+	defer files.Close()
+	b := bus.NewMessageBus(10)
+	mockBot := newMockBot()
+	mockBot.fileURL = files.URL
+	ch, _ := NewTelegramChannel(config.TelegramConfig{Token: "fake-token"}, b, sdklogger.NewDefault())
+	ch.SetBot(mockBot)
+
+	ch.handleMessage(&tgbotapi.Message{
+		From:     &tgbotapi.User{ID: 123},
+		Chat:     &tgbotapi.Chat{ID: 456},
+		Caption:  "review this",
+		Document: &tgbotapi.Document{FileID: "main.go", FileName: "main.go", MimeType: "application/octet-stream", FileSize: 30},
+	}, 0)
+	inbound := <-b.Inbound
+	inbound.Typing.Stop()
+	if len(inbound.Attachments) != 1 || inbound.Attachments[0].Kind != bus.AttachmentFile {
+		t.Fatalf("expected one file attachment, got %+v", inbound.Attachments)
+	}
+	defer os.Remove(inbound.Attachments[0].Path)
+	want := fmt.Sprintf("review this\n\n<document name=\"main.go\" path=%q>\npackage main\n\nfunc main() {}\n</document>", inbound.Attachments[0].Path)
+	if inbound.Content != want {
+		t.Fatalf("content = %q, want %q", inbound.Content, want)
+	}
+
+	ch.handleMessage(&tgbotapi.Message{
+		From:     &tgbotapi.User{ID: 123},
+		Chat:     &tgbotapi.Chat{ID: 456},
+		Document: &tgbotapi.Document{FileID: "big", FileName: "dump.bin", FileSize: 30 << 20},
+	}, 0)
+	inbound = <-b.Inbound
+	inbound.Typing.Stop()
+	if len(inbound.Attachments) != 0 || inbound.Content != "[dump.bin not downloaded: 30.0 MB is over the 20 MB limit]" {
+		t.Fatalf("unexpected inbound for oversized file: %+v", inbound)
+	}
+}
+
+// ===== Telegram Group 测试 =====
+
+func TestTelegramChannel_Group_RequiresMention(t *testing.T) {
+	b := bus.NewMessageBus(10)
+	mockBot := newMockBot()
+	mockBot.self.ID = 99
+	ch, _ := NewTelegramChannel(config.TelegramConfig{
+		Token:          "fake-token",
+		GroupAllowFrom: []string{"-100"},
+		Groups:         map[string]config.TelegramGroupConfig{"*": {SystemPrompt: "Keep it short."}},
+	}, b, sdklogger.NewDefault())
+	ch.SetBot(mockBot)
+	group := &tgbotapi.Chat{ID: -100, Type: "supergroup"}
+
+	for _, msg := range []*tgbotapi.Message{
+		{MessageID: 1, From: &tgbotapi.User{ID: 7}, Chat: group, Text: "just chatting"},
+		{MessageID: 2, From: &tgbotapi.User{ID: 7}, Chat: group, Text: "/status@otherbot"},
+		{MessageID: 3, From: &tgbotapi.User{ID: 7}, Chat: &tgbotapi.Chat{ID: -200, Type: "group"}, Text: "@testbot hi",
+			Entities: []tgbotapi.MessageEntity{{Type: "mention", Offset: 0, Length: 8}}},
+	} {
+		ch.handleMessage(msg, 0)
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("unaddressed or unlisted group message published: %+v", msg)
+	default:
+	}
+
+	ch.handleMessage(&tgbotapi.Message{MessageID: 4, From: &tgbotapi.User{ID: 7}, Chat: group, Text: "@TestBot what time is it?",
+		Entities: []tgbotapi.MessageEntity{{Type: "mention", Offset: 0, Length: 8}}}, 0)
+	ch.handleMessage(&tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{ID: 8}, Chat: group, Text: "/status@testbot"}, 0)
+	ch.handleMessage(&tgbotapi.Message{MessageID: 6, From: &tgbotapi.User{ID: 8}, Chat: group, Text: "and tomorrow?",
+		ReplyToMessage: &tgbotapi.Message{MessageID: 4, From: &tgbotapi.User{ID: 99}}}, 0)
+
+	for _, want := range []string{"what time is it?", "/status", "and tomorrow?"} {
+		inbound := <-b.Inbound
+		inbound.Typing.Stop()
+		if inbound.Content != want || inbound.ChatID != "-100" || inbound.Instructions != "Keep it short." {
+			t.Fatalf("got %+v, want content %q", inbound, want)
+		}
+	}
+}
+
+func TestTelegramChannel_Group_TopicSession(t *testing.T) {
+	b := bus.NewMessageBus(10)
+	mockBot := newMockBot()
+	mockBot.self.ID = 99
+	quiet := false
+	ch, _ := NewTelegramChannel(config.TelegramConfig{
+		Token:     "fake-token",
+		AllowFrom: []string{"7"},
+		Groups:    map[string]config.TelegramGroupConfig{"-100": {RequireMention: &quiet, ToolProgress: &quiet}},
+	}, b, sdklogger.NewDefault())
+	ch.SetBot(mockBot)
+	group := &tgbotapi.Chat{ID: -100, Type: "supergroup"}
+
+	// Messages in a topic reply to its first message, which is not the bot's.
+	ch.handleMessage(&tgbotapi.Message{MessageID: 50, From: &tgbotapi.User{ID: 7}, Chat: group, Text: "hello",
+		ReplyToMessage: &tgbotapi.Message{MessageID: 42, From: &tgbotapi.User{ID: 7}}}, 42)
+	ch.handleMessage(&tgbotapi.Message{MessageID: 51, From: &tgbotapi.User{ID: 8}, Chat: group, Text: "not allowed"}, 42)
+
+	inbound := <-b.Inbound
+	inbound.Typing.Stop()
+	if inbound.ChatID != "-100:42" || inbound.Content != "hello" {
+		t.Fatalf("unexpected inbound: %+v", inbound)
+	}
+	select {
+	case msg := <-b.Inbound:
+		t.Fatalf("sender outside allowFrom published: %+v", msg)
+	default:
+	}
+
+	if err := ch.Send(bus.OutboundMessage{ChatID: "-100:42", Kind: bus.KindToolProgress, Content: "⏳ Read",
+		Tool: &bus.ToolProgress{Name: "Read"}}); err != nil || len(mockBot.messages()) != 0 {
+		t.Fatalf("tool progress should be hidden: err=%v sent=%+v", err, mockBot.messages())
+	}
+	if err := ch.Send(bus.OutboundMessage{ChatID: "-100:42", Content: "hi there"}); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if msgs := mockBot.messages(); len(msgs) != 1 || msgs[0].ChatID != -100 || msgs[0].ReplyToMessageID != 42 {
+		t.Fatalf("expected a message into topic 42, got %+v", msgs)
+	}
+}
+
+func TestTelegramUpdate_UnmarshalThread(t *testing.T) {
+	var updates []TelegramUpdate
+	data := `[
+		{"update_id": 1, "message": {"message_id": 5, "chat": {"id": -100}, "message_thread_id": 42, "is_topic_message": true, "text": "hi"}},
+		{"update_id": 2, "message": {"message_id": 6, "chat": {"id": -100}, "message_thread_id": 5, "text": "a reply"}},
+		{"update_id": 3, "callback_query": {"id": "cb", "data": "btn:0", "message": {"message_id": 7, "chat": {"id": -100}, "message_thread_id": 42, "is_topic_message": true}}}
+	]`
+	if err := json.Unmarshal([]byte(data), &updates); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if updates[0].ThreadID != 42 || updates[0].Message.Text != "hi" {
+		t.Fatalf("topic message: %+v", updates[0])
+	}
+	if updates[1].ThreadID != 0 {
+		t.Fatalf("reply thread outside a forum should be ignored, got %d", updates[1].ThreadID)
+	}
+	if updates[2].ThreadID != 42 || updates[2].CallbackQuery.Data != "btn:0" {
+		t.Fatalf("callback query: %+v", updates[2])
+	}
+}
+
 // ===== Telegram Start/Stop 测试 =====
 
 func TestTelegramChannel_Start_NilMessage(t *testing.T) {
@@ -930,7 +1187,7 @@ func TestTelegramChannel_Start_NilMessage(t *testing.T) {
 
 	ch.Start(ctx)
 
-	mockBot.updatesChan <- tgbotapi.Update{Message: nil}
+	mockBot.updatesChan <- TelegramUpdate{}
 	time.Sleep(50 * time.Millisecond)
 
 	select {
@@ -941,3 +1198,77 @@ func TestTelegramChannel_Start_NilMessage(t *testing.T) {
 	}
 }
 
+func TestTelegramChannel_Webhook(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	b := bus.NewMessageBus(10)
+	mockBot := newMockBot()
+	factory := func(token, apiEndpoint string, client *http.Client) (TelegramBot, error) {
+		return mockBot, nil
+	}
+	ch, _ := NewTelegramChannelWithFactory(config.TelegramConfig{
+		Token:       "fake-token",
+		WebhookURL:  "https://bot.example.com/tg",
+		WebhookPort: port,
+	}, b, factory, sdklogger.NewDefault())
+	if err := ch.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ch.Stop()
+	if mockBot.webhookURL != "https://bot.example.com/tg" || len(mockBot.webhookSecret) < 32 {
+		t.Fatalf("webhook registered as %q with secret %q", mockBot.webhookURL, mockBot.webhookSecret)
+	}
+
+	post := func(secret string) int {
+		body := `{"update_id": 9, "message": {"message_id": 3, "from": {"id": 7}, "chat": {"id": 7, "type": "private"}, "date": 1, "text": "hi"}}`
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", port, telegramWebhookPath), strings.NewReader(body))
+		req.Header.Set(telegramSecretHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post update: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: status %d", code)
+	}
+	if code := post(mockBot.webhookSecret); code != http.StatusOK {
+		t.Fatalf("update: status %d", code)
+	}
+	// The update is answered only once it has been handled.
+	select {
+	case inbound := <-b.Inbound:
+		inbound.Typing.Stop()
+		if inbound.Content != "hi" || inbound.ChatID != "7" || inbound.MessageID != "3" {
+			t.Fatalf("unexpected inbound: %+v", inbound)
+		}
+	default:
+		t.Fatal("webhook update answered before it was published")
+	}
+
+	// Updates arriving while the channel stops are left to Telegram to retry.
+	ch.cancel()
+	req := httptest.NewRequest(http.MethodPost, telegramWebhookPath, strings.NewReader(`{"update_id": 10, "message": {"message_id": 4, "from": {"id": 7}, "chat": {"id": 7, "type": "private"}, "date": 1, "text": "late"}}`))
+	req.Header.Set(telegramSecretHeader, mockBot.webhookSecret)
+	rec := httptest.NewRecorder()
+	ch.handleWebhook(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("update after stop: status %d, want 503", rec.Code)
+	}
+	select {
+	case inbound := <-b.Inbound:
+		t.Fatalf("update after stop published: %+v", inbound)
+	default:
+	}
+
+	ch.Stop()
+	if mockBot.webhookDeletes != 1 {
+		t.Fatalf("webhook deleted %d times on stop, want 1", mockBot.webhookDeletes)
+	}
+}
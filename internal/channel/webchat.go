@@ -0,0 +1,597 @@
+package channel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+const webchatChannelName = "webchat"
+
+const (
+	webchatDefaultHost    = "127.0.0.1"
+	webchatDefaultPort    = 18791
+	webchatDefaultChat    = "main"
+	webchatSenderID       = "local"
+	webchatMaxMediaBytes  = 20 << 20
+	webchatMaxFrameBytes  = 64 << 20 // base64 attachments of one message
+	webchatWriteTimeout   = 10 * time.Second
+	webchatMaxServedFiles = 512
+	webchatCookie         = "aevitas_webchat"
+	webchatCookieMaxAge   = 30 * 24 * time.Hour
+)
+
+//go:embed webchat/index.html
+var webchatIndexHTML []byte
+
+// HistoryEntry is one message of a session transcript as shown to a user.
+type HistoryEntry struct {
+	Role    string   `json:"role"` // user or assistant
+	Content string   `json:"content"`
+	Tools   []string `json:"tools,omitempty"` // tools the assistant called before this reply
+}
+
+// HistorySource returns the transcript of the session a message from msg's
+// sender in msg's chat would join.
+type HistorySource interface {
+	SessionHistory(msg bus.InboundMessage) ([]HistoryEntry, error)
+}
+
+// historyViewer is implemented by channels that show past messages.
+type historyViewer interface {
+	SetHistorySource(src HistorySource)
+}
+
+// webchatMedia is an attachment: inline base64 Data from the browser, or a
+// URL under /media/ for files sent to it.
+type webchatMedia struct {
+	Name string             `json:"name,omitempty"`
+	MIME string             `json:"mime,omitempty"`
+	Kind bus.AttachmentKind `json:"kind,omitempty"`
+	Data string             `json:"data,omitempty"`
+	URL  string             `json:"url,omitempty"`
+}
+
+// webchatInbound is a frame from the browser.
+type webchatInbound struct {
+	Type        string         `json:"type"` // message
+	Text        string         `json:"text,omitempty"`
+	Attachments []webchatMedia `json:"attachments,omitempty"`
+}
+
+// webchatFrame is a frame to the browser.
+type webchatFrame struct {
+	// Type is history, accepted, message, draft, tools, final, hud or error.
+	Type    string         `json:"type"`
+	ID      string         `json:"id,omitempty"`
+	ReplyTo string         `json:"replyTo,omitempty"`
+	Text    string         `json:"text,omitempty"`
+	Media   []webchatMedia `json:"media,omitempty"`
+	History []HistoryEntry `json:"history,omitempty"`
+}
+
+// webchatConn is one browser tab, bound to a chat.
+type webchatConn struct {
+	ws     *websocket.Conn
+	chatID string
+	mu     sync.Mutex // serializes writes
+}
+
+func (c *webchatConn) write(frame webchatFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(webchatWriteTimeout))
+	return c.ws.WriteJSON(frame)
+}
+
+// WebchatChannel serves a small browser chat UI and talks to it over a
+// WebSocket. Every tab open on a chat sees the same stream.
+type WebchatChannel struct {
+	BaseChannel
+	cfg      config.WebchatConfig
+	server   *http.Server
+	cancel   context.CancelFunc
+	upgrader websocket.Upgrader
+	stream   *webchatStream
+	history  HistorySource
+
+	mu    sync.Mutex
+	conns map[string]map[*webchatConn]struct{} // by chat ID
+	files map[string]string                    // served media path by ID
+	order []string                             // media IDs, oldest first
+}
+
+// NewWebchatChannel creates the web chat channel. Without a configured
+// token it loads, or creates, the one kept in the data dir.
+func NewWebchatChannel(cfg config.WebchatConfig, b *bus.MessageBus, logger sdklogger.Logger) (*WebchatChannel, error) {
+	if strings.TrimSpace(cfg.Token) == "" {
+		token, err := loadWebchatToken(webchatTokenPath())
+		if err != nil {
+			return nil, fmt.Errorf("webchat token: %w", err)
+		}
+		cfg.Token = token
+	}
+	ch := &WebchatChannel{
+		BaseChannel: NewBaseChannel(webchatChannelName, b, nil, logger),
+		cfg:         cfg,
+		conns:       make(map[string]map[*webchatConn]struct{}),
+		files:       make(map[string]string),
+	}
+	ch.stream = &webchatStream{ch: ch, tools: make(map[string][]toolEntry)}
+	return ch, nil
+}
+
+func webchatTokenPath() string {
+	return filepath.Join(config.ConfigDir(), "data", "webchat", "token")
+}
+
+// loadWebchatToken reads the token at path, generating it on first use.
+func loadWebchatToken(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SetHistorySource implements historyViewer.
+func (w *WebchatChannel) SetHistorySource(src HistorySource) {
+	w.mu.Lock()
+	w.history = src
+	w.mu.Unlock()
+}
+
+func (w *WebchatChannel) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", w.handleIndex)
+	mux.HandleFunc("/session", w.handleSession)
+	mux.HandleFunc("/ws", w.handleWS)
+	mux.HandleFunc("/media/", w.handleMedia)
+	return mux
+}
+
+func (w *WebchatChannel) Start(ctx context.Context) error {
+	ctx, w.cancel = context.WithCancel(ctx)
+
+	host := strings.TrimSpace(w.cfg.Host)
+	if host == "" {
+		host = webchatDefaultHost
+	}
+	port := w.cfg.Port
+	if port == 0 {
+		port = webchatDefaultPort
+	}
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("webchat listen %s: %w", addr, err)
+	}
+	w.server = &http.Server{Handler: w.handler()}
+
+	// The token is not logged: log files can be sent to chats with /logs.
+	w.logger.Infof("[webchat] listening on http://%s (open it with #token=<token>)", addr)
+	go func() {
+		if err := w.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w.logger.Errorf("[webchat] server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = w.server.Close()
+	}()
+
+	return nil
+}
+
+func (w *WebchatChannel) Stop() error {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	if w.server != nil {
+		_ = w.server.Close()
+	}
+	w.logger.Infof("[webchat] stopped")
+	return nil
+}
+
+// Capabilities reports a Markdown channel that renders streamed replies and
+// shows media inline.
+func (w *WebchatChannel) Capabilities() Capabilities {
+	return Capabilities{
+		Edit:     true,
+		Markdown: MarkdownFull,
+		Media:    []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+	}
+}
+
+// StreamingRenderer implements Streamer.
+func (w *WebchatChannel) StreamingRenderer() StreamingRenderer {
+	return w.stream
+}
+
+func (w *WebchatChannel) Send(msg bus.OutboundMessage) error {
+	chatID := strings.TrimSpace(msg.ChatID)
+	if chatID == "" {
+		return fmt.Errorf("webchat chat id is required")
+	}
+	switch msg.Kind {
+	case bus.KindPreviewUpdate:
+		return w.stream.Update(chatID, msg.Content, msg.ReplyTo)
+	case bus.KindPreviewFinal:
+		return w.stream.Finalize(chatID, msg.Content, msg.ReplyTo)
+	case bus.KindToolProgress:
+		return w.stream.ToolProgress(chatID, msg)
+	case bus.KindUsageHUD:
+		w.broadcast(chatID, webchatFrame{Type: "hud", Text: msg.Content})
+		return nil
+	}
+
+	frame := webchatFrame{
+		Type:    "message",
+		ID:      fmt.Sprintf("wc-out-%d", time.Now().UnixNano()),
+		ReplyTo: msg.ReplyTo,
+		Text:    msg.Content,
+	}
+	for _, att := range msg.Attachments {
+		if _, err := os.Stat(att.Path); err != nil {
+			w.logger.Warnf("[webchat] attachment %s: %v", att.Path, err)
+			continue
+		}
+		name := filepath.Base(att.Path)
+		mimeType := att.MIME
+		if mimeType == "" {
+			mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+		}
+		kind := att.Kind
+		if kind == "" {
+			kind = attachmentKindOf(name, mimeType)
+		}
+		frame.Media = append(frame.Media, webchatMedia{
+			Name: name,
+			MIME: mimeType,
+			Kind: kind,
+			URL:  "/media/" + w.serveFile(att.Path),
+		})
+	}
+	if msg.ReplyTo != "" {
+		// A plain reply ends the turn like a final preview does.
+		w.stream.reset(chatID)
+	}
+	w.broadcast(chatID, frame)
+	return nil
+}
+
+// broadcast writes frame to every tab open on chatID. Nothing is queued for
+// closed tabs: replies are part of the session history they load on return.
+func (w *WebchatChannel) broadcast(chatID string, frame webchatFrame) {
+	w.mu.Lock()
+	conns := make([]*webchatConn, 0, len(w.conns[chatID]))
+	for c := range w.conns[chatID] {
+		conns = append(conns, c)
+	}
+	w.mu.Unlock()
+	if len(conns) == 0 {
+		w.logger.Debugf("[webchat] no open tab for %s, %s frame dropped", chatID, frame.Type)
+		return
+	}
+	for _, c := range conns {
+		if err := c.write(frame); err != nil {
+			w.logger.Warnf("[webchat] write to %s failed: %v", chatID, err)
+			_ = c.ws.Close()
+		}
+	}
+}
+
+// serveFile registers path for download and returns its media ID. Only the
+// most recent files stay available.
+func (w *WebchatChannel) serveFile(path string) string {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files[id] = path
+	w.order = append(w.order, id)
+	if len(w.order) > webchatMaxServedFiles {
+		delete(w.files, w.order[0])
+		w.order = w.order[1:]
+	}
+	return id
+}
+
+// authorized accepts the token as a bearer header or in the session
+// cookie. URLs end up in logs and browser history, so it is never read
+// from the query.
+func (w *WebchatChannel) authorized(req *http.Request) bool {
+	if w.bearerValid(req) {
+		return true
+	}
+	cookie, err := req.Cookie(webchatCookie)
+	return err == nil && w.tokenValid(cookie.Value)
+}
+
+func (w *WebchatChannel) bearerValid(req *http.Request) bool {
+	got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && w.tokenValid(got)
+}
+
+func (w *WebchatChannel) tokenValid(got string) bool {
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(strings.TrimSpace(w.cfg.Token))) == 1
+}
+
+// handleSession trades the token, sent as a bearer header, for the session
+// cookie the page's WebSocket and media requests carry (POST), and reports
+// whether a request is still authorized (GET).
+func (w *WebchatChannel) handleSession(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		if !w.authorized(req) {
+			http.Error(resp, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	case http.MethodPost:
+		if !w.bearerValid(req) {
+			http.Error(resp, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(resp, &http.Cookie{
+			Name:     webchatCookie,
+			Value:    strings.TrimSpace(w.cfg.Token),
+			Path:     "/",
+			MaxAge:   int(webchatCookieMaxAge.Seconds()),
+			HttpOnly: true,
+			Secure:   req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteStrictMode,
+		})
+	default:
+		resp.Header().Set("Allow", "GET, POST")
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (w *WebchatChannel) handleIndex(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-cache")
+	_, _ = resp.Write(webchatIndexHTML)
+}
+
+func (w *WebchatChannel) handleMedia(resp http.ResponseWriter, req *http.Request) {
+	if !w.authorized(req) {
+		http.Error(resp, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/media/")
+	w.mu.Lock()
+	path, ok := w.files[id]
+	w.mu.Unlock()
+	if !ok {
+		http.NotFound(resp, req)
+		return
+	}
+	http.ServeFile(resp, req, path)
+}
+
+func (w *WebchatChannel) handleWS(resp http.ResponseWriter, req *http.Request) {
+	if !w.authorized(req) {
+		http.Error(resp, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	chatID := strings.TrimSpace(req.URL.Query().Get("chat"))
+	if chatID == "" {
+		chatID = webchatDefaultChat
+	}
+	ws, err := w.upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		w.logger.Warnf("[webchat] upgrade: %v", err)
+		return
+	}
+	ws.SetReadLimit(webchatMaxFrameBytes)
+	conn := &webchatConn{ws: ws, chatID: chatID}
+
+	w.mu.Lock()
+	if w.conns[chatID] == nil {
+		w.conns[chatID] = make(map[*webchatConn]struct{})
+	}
+	w.conns[chatID][conn] = struct{}{}
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.conns[chatID], conn)
+		if len(w.conns[chatID]) == 0 {
+			delete(w.conns, chatID)
+		}
+		w.mu.Unlock()
+		_ = ws.Close()
+	}()
+
+	w.sendHistory(conn)
+	for {
+		var in webchatInbound
+		if err := ws.ReadJSON(&in); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				w.logger.Debugf("[webchat] read: %v", err)
+			}
+			return
+		}
+		if in.Type != "message" {
+			_ = conn.write(webchatFrame{Type: "error", Text: fmt.Sprintf("unknown frame type %q", in.Type)})
+			continue
+		}
+		w.handleMessage(conn, in)
+	}
+}
+
+func (w *WebchatChannel) sendHistory(conn *webchatConn) {
+	w.mu.Lock()
+	src := w.history
+	w.mu.Unlock()
+	if src == nil {
+		return
+	}
+	entries, err := src.SessionHistory(bus.InboundMessage{
+		Channel:  webchatChannelName,
+		SenderID: webchatSenderID,
+		ChatID:   conn.chatID,
+		Direct:   true,
+	})
+	if err != nil {
+		w.logger.Warnf("[webchat] load history for %s: %v", conn.chatID, err)
+		return
+	}
+	_ = conn.write(webchatFrame{Type: "history", History: entries})
+}
+
+func (w *WebchatChannel) handleMessage(conn *webchatConn, in webchatInbound) {
+	if strings.TrimSpace(in.Text) == "" && len(in.Attachments) == 0 {
+		_ = conn.write(webchatFrame{Type: "error", Text: "text or attachments are required"})
+		return
+	}
+	var attachments []bus.Attachment
+	for _, media := range in.Attachments {
+		att, err := saveWebchatMedia(media)
+		if err != nil {
+			for _, saved := range attachments {
+				os.Remove(saved.Path)
+			}
+			_ = conn.write(webchatFrame{Type: "error", Text: "attachment: " + err.Error()})
+			return
+		}
+		attachments = append(attachments, att)
+	}
+
+	messageID := fmt.Sprintf("wc-%d", time.Now().UnixNano())
+	published := w.bus.PublishInbound(bus.InboundMessage{
+		Channel:     webchatChannelName,
+		SenderID:    webchatSenderID,
+		ChatID:      conn.chatID,
+		MessageID:   messageID,
+		Content:     in.Text,
+		Timestamp:   time.Now(),
+		Attachments: attachments,
+		Direct:      true,
+	})
+	if !published {
+		w.logger.Debugf("[webchat] duplicate message dropped: %s", messageID)
+		return
+	}
+	_ = conn.write(webchatFrame{Type: "accepted", ID: messageID})
+}
+
+// saveWebchatMedia writes an uploaded attachment to the temp media dir.
+func saveWebchatMedia(media webchatMedia) (bus.Attachment, error) {
+	data, err := base64.StdEncoding.DecodeString(media.Data)
+	if err != nil {
+		return bus.Attachment{}, fmt.Errorf("decode base64: %w", err)
+	}
+	if len(data) == 0 {
+		return bus.Attachment{}, fmt.Errorf("empty file")
+	}
+	if len(data) > webchatMaxMediaBytes {
+		return bus.Attachment{}, fmt.Errorf("larger than %d bytes", webchatMaxMediaBytes)
+	}
+	name := filepath.Base(strings.TrimSpace(media.Name))
+	if name == "." || name == "/" {
+		name = "file"
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-webchat-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return bus.Attachment{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), name))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return bus.Attachment{}, fmt.Errorf("save file: %w", err)
+	}
+	return bus.Attachment{
+		Path: localPath,
+		Kind: attachmentKindOf(name, media.MIME),
+		MIME: media.MIME,
+		Size: int64(len(data)),
+	}, nil
+}
+
+// webchatStream renders streamed turns for the browser. Unlike the shared
+// renderer it sends the Markdown source, which the page renders itself, and
+// the tool block text as formatted for Telegram.
+type webchatStream struct {
+	ch *WebchatChannel
+
+	mu    sync.Mutex
+	tools map[string][]toolEntry // tool calls of the running turn, by chat ID
+}
+
+func (s *webchatStream) Update(chatID, content, replyTo string) error {
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	s.ch.broadcast(chatID, webchatFrame{Type: "draft", ReplyTo: replyTo, Text: closeOpenMarkdown(content)})
+	return nil
+}
+
+func (s *webchatStream) ToolProgress(chatID string, msg bus.OutboundMessage) error {
+	entry := buildToolEntry(msg)
+	if entry.Name == "" && strings.TrimSpace(entry.Raw) == "" {
+		return nil
+	}
+	s.mu.Lock()
+	s.tools[chatID] = append(s.tools[chatID], entry)
+	text := formatToolBlock(1, s.tools[chatID])
+	s.mu.Unlock()
+	s.ch.broadcast(chatID, webchatFrame{Type: "tools", Text: text})
+	return nil
+}
+
+func (s *webchatStream) Finalize(chatID, content, replyTo string) error {
+	s.reset(chatID)
+	s.ch.broadcast(chatID, webchatFrame{
+		Type:    "final",
+		ID:      fmt.Sprintf("wc-out-%d", time.Now().UnixNano()),
+		ReplyTo: replyTo,
+		Text:    content,
+	})
+	return nil
+}
+
+func (s *webchatStream) reset(chatID string) {
+	s.mu.Lock()
+	delete(s.tools, chatID)
+	s.mu.Unlock()
+}
@@ -0,0 +1,259 @@
+package channel
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+type fakeHistorySource struct {
+	keys    chan string
+	entries []HistoryEntry
+}
+
+func (f *fakeHistorySource) SessionHistory(msg bus.InboundMessage) ([]HistoryEntry, error) {
+	f.keys <- msg.SessionKey()
+	return f.entries, nil
+}
+
+// newTestWebchatChannel serves the channel's handler on a test server
+// instead of binding the configured port.
+func newTestWebchatChannel(t *testing.T) (*WebchatChannel, *bus.MessageBus, *httptest.Server) {
+	t.Helper()
+	b := bus.NewMessageBus(10)
+	ch, err := NewWebchatChannel(config.WebchatConfig{Enabled: true, Token: "chat-token"}, b, sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewWebchatChannel: %v", err)
+	}
+	srv := httptest.NewServer(ch.handler())
+	t.Cleanup(srv.Close)
+	return ch, b, srv
+}
+
+func dialWebchat(t *testing.T, srv *httptest.Server, token string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?chat=main"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func readWebchatFrame(t *testing.T, conn *websocket.Conn) webchatFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var frame webchatFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	return frame
+}
+
+// waitWebchatTab waits until the server has registered a tab on chatID.
+func waitWebchatTab(t *testing.T, ch *WebchatChannel, chatID string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ch.mu.Lock()
+		n := len(ch.conns[chatID])
+		ch.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no tab registered on %s", chatID)
+}
+
+func TestNewWebchatChannel_GeneratesToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	first, err := NewWebchatChannel(config.WebchatConfig{}, bus.NewMessageBus(1), sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewWebchatChannel: %v", err)
+	}
+	second, _ := NewWebchatChannel(config.WebchatConfig{}, bus.NewMessageBus(1), sdklogger.NewDefault())
+	if len(first.cfg.Token) < 32 || first.cfg.Token != second.cfg.Token {
+		t.Fatalf("tokens %q and %q, want one persisted token", first.cfg.Token, second.cfg.Token)
+	}
+	info, err := os.Stat(webchatTokenPath())
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("token file: %v, mode %v", err, info.Mode())
+	}
+}
+
+func TestWebchatChannel_RequiresToken(t *testing.T) {
+	_, _, srv := newTestWebchatChannel(t)
+
+	if _, resp, err := dialWebchat(t, srv, "wrong"); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial with bad token: err=%v resp=%v", err, resp)
+	}
+	// The token is never accepted in the URL.
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?chat=main&token=chat-token"
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial with query token: err=%v resp=%v", err, resp)
+	}
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /: %v %v", err, resp)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "/ws?chat=") {
+		t.Fatal("index page does not look like the chat UI")
+	}
+	if strings.Contains(string(body), "?token=") || strings.Contains(string(body), "&token=") {
+		t.Fatal("index page still puts the token in URLs")
+	}
+}
+
+func TestWebchatChannel_SessionCookie(t *testing.T) {
+	_, _, srv := newTestWebchatChannel(t)
+
+	login := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/session", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /session: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 0 {
+		t.Fatalf("login with bad token: status %d, cookies %v", resp.StatusCode, resp.Cookies())
+	}
+	resp := login("chat-token")
+	cookies := resp.Cookies()
+	if resp.StatusCode != http.StatusNoContent || len(cookies) != 1 {
+		t.Fatalf("login: status %d, cookies %v", resp.StatusCode, cookies)
+	}
+	if c := cookies[0]; c.Name != webchatCookie || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("unexpected cookie: %+v", c)
+	}
+
+	check := func(cookie *http.Cookie) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/session", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /session: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := check(nil); status != http.StatusUnauthorized {
+		t.Fatalf("check without cookie: status %d", status)
+	}
+	if status := check(cookies[0]); status != http.StatusNoContent {
+		t.Fatalf("check with cookie: status %d", status)
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?chat=main"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Cookie": {cookies[0].String()}})
+	if err != nil {
+		t.Fatalf("dial with cookie: %v", err)
+	}
+	conn.Close()
+}
+
+func TestWebchatChannel_MessageHistoryAndStream(t *testing.T) {
+	ch, b, srv := newTestWebchatChannel(t)
+	history := &fakeHistorySource{keys: make(chan string, 1), entries: []HistoryEntry{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "Hello!", Tools: []string{"Read"}},
+	}}
+	ch.SetHistorySource(history)
+
+	conn, _, err := dialWebchat(t, srv, "chat-token")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if frame := readWebchatFrame(t, conn); frame.Type != "history" || len(frame.History) != 2 || frame.History[1].Tools[0] != "Read" {
+		t.Fatalf("unexpected history frame: %+v", frame)
+	}
+	if key := <-history.keys; key != "webchat:main" {
+		t.Fatalf("history session key = %q", key)
+	}
+
+	conn.WriteJSON(webchatInbound{Type: "message", Text: "what is this?", Attachments: []webchatMedia{
+		{Name: "shot.png", MIME: "image/png", Data: base64.StdEncoding.EncodeToString([]byte("png-bytes"))},
+	}})
+	msg := <-b.Inbound
+	if msg.Channel != "webchat" || msg.ChatID != "main" || msg.SenderID != webchatSenderID || msg.Content != "what is this?" ||
+		len(msg.Attachments) != 1 || msg.Attachments[0].Kind != bus.AttachmentImage {
+		t.Fatalf("unexpected inbound: %+v", msg)
+	}
+	os.Remove(msg.Attachments[0].Path)
+	if frame := readWebchatFrame(t, conn); frame.Type != "accepted" || frame.ID != msg.MessageID {
+		t.Fatalf("unexpected ack: %+v", frame)
+	}
+
+	ch.Send(bus.OutboundMessage{ChatID: "main", Kind: bus.KindToolProgress, Content: "⏳ WebSearch",
+		Tool: &bus.ToolProgress{Name: "WebSearch", Params: `{"query": "x"}`}})
+	ch.Send(bus.OutboundMessage{ChatID: "main", Kind: bus.KindPreviewUpdate, ReplyTo: msg.MessageID, Content: "It is ```go\nfmt"})
+	ch.Send(bus.OutboundMessage{ChatID: "main", Kind: bus.KindPreviewFinal, ReplyTo: msg.MessageID, Content: "It is **a screenshot**."})
+	ch.Send(bus.OutboundMessage{ChatID: "main", Kind: bus.KindUsageHUD, Content: "ctx 12%"})
+
+	if frame := readWebchatFrame(t, conn); frame.Type != "tools" || !strings.Contains(frame.Text, "⏳ WebSearch") || !strings.Contains(frame.Text, `{"query":"x"}`) {
+		t.Fatalf("unexpected tools frame: %+v", frame)
+	}
+	if frame := readWebchatFrame(t, conn); frame.Type != "draft" || frame.Text != "It is ```go\nfmt\n```" {
+		t.Fatalf("unexpected draft frame: %+v", frame)
+	}
+	if frame := readWebchatFrame(t, conn); frame.Type != "final" || frame.Text != "It is **a screenshot**." || frame.ReplyTo != msg.MessageID {
+		t.Fatalf("unexpected final frame: %+v", frame)
+	}
+	if frame := readWebchatFrame(t, conn); frame.Type != "hud" || frame.Text != "ctx 12%" {
+		t.Fatalf("unexpected hud frame: %+v", frame)
+	}
+	if len(ch.stream.tools) != 0 {
+		t.Fatalf("tool state not reset after final: %+v", ch.stream.tools)
+	}
+}
+
+func TestWebchatChannel_ServesReplyMedia(t *testing.T) {
+	ch, _, srv := newTestWebchatChannel(t)
+	conn, _, err := dialWebchat(t, srv, "chat-token")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	waitWebchatTab(t, ch, "main")
+
+	path := filepath.Join(t.TempDir(), "report.txt")
+	os.WriteFile(path, []byte("ok"), 0644)
+	ch.Send(bus.OutboundMessage{ChatID: "main", Content: "📊 Status", Attachments: bus.PathAttachments(path)})
+
+	frame := readWebchatFrame(t, conn)
+	if frame.Type != "message" || frame.Text != "📊 Status" || len(frame.Media) != 1 || frame.Media[0].Kind != bus.AttachmentFile {
+		t.Fatalf("unexpected message frame: %+v", frame)
+	}
+	if resp, _ := http.Get(srv.URL + frame.Media[0].URL); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("media without token: status %d", resp.StatusCode)
+	}
+	if resp, _ := http.Get(srv.URL + frame.Media[0].URL + "?token=chat-token"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("media with query token: status %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+frame.Media[0].URL, nil)
+	req.AddCookie(&http.Cookie{Name: webchatCookie, Value: "chat-token"})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET media: %v", err)
+	}
+	defer resp.Body.Close()
+	if data, _ := io.ReadAll(resp.Body); string(data) != "ok" {
+		t.Fatalf("media body = %q", data)
+	}
+}
@@ -0,0 +1,635 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+)
+
+const webhookChannelName = "webhook"
+
+const (
+	webhookDefaultPort         = 9887
+	webhookDefaultReplyTimeout = 120 * time.Second
+	webhookMaxBodyBytes        = 32 << 20
+	webhookMaxMediaBytes       = 20 << 20
+	webhookSignatureHeader     = "X-Aevitas-Signature"
+)
+
+const (
+	webhookModeSync  = "sync"
+	webhookModeAsync = "async"
+)
+
+// WebhookClient makes the channel's outgoing HTTP requests.
+type WebhookClient interface {
+	// PostCallback delivers a reply body to the configured callback URL.
+	// signature is the X-Aevitas-Signature value, empty when unsigned.
+	PostCallback(ctx context.Context, body []byte, signature string) error
+	DownloadMedia(ctx context.Context, mediaURL string) ([]byte, error)
+}
+
+type WebhookClientFactory func(cfg config.WebhookConfig) WebhookClient
+
+type webhookCallbackError struct {
+	Status int
+}
+
+func (e *webhookCallbackError) Error() string {
+	return fmt.Sprintf("webhook callback: http status %d", e.Status)
+}
+
+func (e *webhookCallbackError) IsRetryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+type defaultWebhookClient struct {
+	cfg  config.WebhookConfig
+	http *http.Client
+	// media fetches caller-supplied URLs and only reaches public addresses.
+	media *http.Client
+}
+
+func newDefaultWebhookClient(cfg config.WebhookConfig) WebhookClient {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: webhookPublicAddrOnly}
+	return &defaultWebhookClient{
+		cfg:  cfg,
+		http: &http.Client{Timeout: 30 * time.Second},
+		media: &http.Client{
+			Timeout: 30 * time.Second,
+			// No proxy: the address check must see the real target.
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}
+}
+
+// webhookBlockedPrefixes are ranges not covered by the netip predicates
+// that still reach internal hosts: shared address space (RFC 6598).
+var webhookBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// webhookPublicAddrOnly refuses connections to loopback, private,
+// link-local and other non-public addresses, so a media URL cannot reach
+// the gateway's host or network. It checks the resolved address of every
+// connection, redirects included.
+func webhookPublicAddrOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	blocked := !ip.IsGlobalUnicast() || ip.IsPrivate()
+	for _, prefix := range webhookBlockedPrefixes {
+		blocked = blocked || prefix.Contains(ip)
+	}
+	if blocked {
+		return fmt.Errorf("address %s is not public", ip)
+	}
+	return nil
+}
+
+func (c *defaultWebhookClient) PostCallback(ctx context.Context, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(webhookSignatureHeader, signature)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookCallbackError{Status: resp.StatusCode}
+	}
+	return nil
+}
+
+func (c *defaultWebhookClient) DownloadMedia(ctx context.Context, mediaURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("download %s: unsupported scheme", mediaURL)
+	}
+	resp, err := c.media.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: http status %d", mediaURL, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, webhookMaxMediaBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > webhookMaxMediaBytes {
+		return nil, fmt.Errorf("download %s: larger than %d bytes", mediaURL, webhookMaxMediaBytes)
+	}
+	return data, nil
+}
+
+// webhookMetaKey is the inbound metadata key holding the metadata a caller
+// sent with a message.
+const webhookMetaKey = "webhook"
+
+// webhookRequest is the body of POST /v1/messages.
+type webhookRequest struct {
+	ID       string         `json:"id,omitempty"`     // caller's message ID, for dedupe; generated when empty
+	Sender   string         `json:"sender,omitempty"` // must match the sender of the token when set
+	Chat     string         `json:"chat,omitempty"` // conversation ID; defaults to the sender
+	Text     string         `json:"text,omitempty"`
+	Media    []webhookMedia `json:"media,omitempty"`
+	Mode     string         `json:"mode,omitempty"` // sync or async; async when a callback URL is configured
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// webhookMedia is an attachment, inline as base64 Data or fetched from URL.
+type webhookMedia struct {
+	Name string `json:"name,omitempty"`
+	MIME string `json:"mime,omitempty"`
+	Data string `json:"data,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// webhookReply is one reply, in a sync response or a callback body.
+type webhookReply struct {
+	Chat      string         `json:"chat"`
+	ReplyTo   string         `json:"replyTo,omitempty"`
+	Text      string         `json:"text,omitempty"`
+	Media     []webhookMedia `json:"media,omitempty"`
+	Timestamp int64          `json:"timestamp"` // unix seconds, covered by the signature
+}
+
+type webhookResponse struct {
+	ID      string         `json:"id"`
+	Status  string         `json:"status"` // replied, accepted, timeout or duplicate
+	Replies []webhookReply `json:"replies,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// webhookWaiter collects the reply to one sync request. messageID is the
+// message the reply must target: the request's own, or the one it was
+// merged into by debouncing.
+type webhookWaiter struct {
+	messageID string
+	replies   []webhookReply
+	done      chan struct{}
+}
+
+// WebhookChannel accepts messages from internal tools over HTTP. Replies are
+// returned in the HTTP response (sync) or posted to a callback URL (async).
+type WebhookChannel struct {
+	BaseChannel
+	cfg           config.WebhookConfig
+	server        *http.Server
+	cancel        context.CancelFunc
+	client        WebhookClient
+	clientFactory WebhookClientFactory
+
+	mu      sync.Mutex
+	waiters map[string][]*webhookWaiter // by chat ID, oldest first
+}
+
+var defaultWebhookClientFactory WebhookClientFactory = func(cfg config.WebhookConfig) WebhookClient {
+	return newDefaultWebhookClient(cfg)
+}
+
+func NewWebhookChannel(cfg config.WebhookConfig, b *bus.MessageBus, logger sdklogger.Logger) (*WebhookChannel, error) {
+	return NewWebhookChannelWithFactory(cfg, b, defaultWebhookClientFactory, logger)
+}
+
+// NewWebhookChannelWithFactory creates a WebhookChannel with a custom client factory (for testing).
+func NewWebhookChannelWithFactory(cfg config.WebhookConfig, b *bus.MessageBus, factory WebhookClientFactory, logger sdklogger.Logger) (*WebhookChannel, error) {
+	if len(cfg.Tokens) == 0 {
+		return nil, fmt.Errorf("webhook tokens are required")
+	}
+	seen := make(map[string]bool, len(cfg.Tokens))
+	for sender, token := range cfg.Tokens {
+		token = strings.TrimSpace(token)
+		if strings.TrimSpace(sender) == "" || token == "" {
+			return nil, fmt.Errorf("webhook tokens need a sender and a token")
+		}
+		// A shared token could not tell its senders apart.
+		if seen[token] {
+			return nil, fmt.Errorf("webhook token of %s is used by another sender", sender)
+		}
+		seen[token] = true
+	}
+	if factory == nil {
+		factory = defaultWebhookClientFactory
+	}
+	return &WebhookChannel{
+		BaseChannel:   NewBaseChannel(webhookChannelName, b, cfg.AllowFrom, logger),
+		cfg:           cfg,
+		clientFactory: factory,
+		waiters:       make(map[string][]*webhookWaiter),
+	}, nil
+}
+
+func (w *WebhookChannel) Start(ctx context.Context) error {
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.client = w.clientFactory(w.cfg)
+
+	port := w.cfg.Port
+	if port == 0 {
+		port = webhookDefaultPort
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/messages", w.handleMessages)
+
+	w.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+
+	go func() {
+		w.logger.Infof("[webhook] listening on :%d", port)
+		if err := w.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w.logger.Errorf("[webhook] server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = w.server.Close()
+	}()
+
+	return nil
+}
+
+func (w *WebhookChannel) Stop() error {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	if w.server != nil {
+		_ = w.server.Close()
+	}
+	w.logger.Infof("[webhook] stopped")
+	return nil
+}
+
+// Capabilities reports a Markdown text channel that returns media inline.
+// Replies cannot be edited, so turns are not streamed.
+func (w *WebhookChannel) Capabilities() Capabilities {
+	return Capabilities{
+		Markdown: MarkdownFull,
+		Media:    []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile},
+	}
+}
+
+func (w *WebhookChannel) Send(msg bus.OutboundMessage) error {
+	if msg.Kind == bus.KindPreviewUpdate || msg.Kind == bus.KindToolProgress {
+		return nil
+	}
+	chatID := strings.TrimSpace(msg.ChatID)
+	if chatID == "" {
+		return fmt.Errorf("webhook chat id is required")
+	}
+
+	reply := webhookReply{
+		Chat:      chatID,
+		ReplyTo:   msg.ReplyTo,
+		Text:      msg.Content,
+		Timestamp: time.Now().Unix(),
+	}
+	for _, att := range msg.Attachments {
+		data, err := os.ReadFile(att.Path)
+		if err != nil {
+			return fmt.Errorf("read attachment: %w", err)
+		}
+		mimeType := att.MIME
+		if mimeType == "" {
+			mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(att.Path)))
+		}
+		reply.Media = append(reply.Media, webhookMedia{
+			Name: filepath.Base(att.Path),
+			MIME: mimeType,
+			Data: base64.StdEncoding.EncodeToString(data),
+		})
+	}
+
+	if w.deliverSync(msg, reply) {
+		return nil
+	}
+	if strings.TrimSpace(w.cfg.CallbackURL) == "" {
+		w.logger.Warnf("[webhook] no pending request for %s and no callback URL, reply dropped", chatID)
+		return nil
+	}
+	if w.client == nil {
+		return fmt.Errorf("webhook client not initialized")
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return w.client.PostCallback(context.Background(), body, webhookSignature(w.cfg.Secret, body))
+}
+
+// deliverSync completes the sync requests waiting for the message reply
+// targets, if any. Messages without a target, such as notices, never
+// complete a request.
+func (w *WebhookChannel) deliverSync(msg bus.OutboundMessage, reply webhookReply) bool {
+	if msg.ReplyTo == "" {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delivered := false
+	for _, waiter := range append([]*webhookWaiter(nil), w.waiters[reply.Chat]...) {
+		if waiter.messageID != msg.ReplyTo {
+			continue
+		}
+		waiter.replies = append(waiter.replies, reply)
+		w.removeWaiterLocked(reply.Chat, waiter)
+		close(waiter.done)
+		delivered = true
+	}
+	return delivered
+}
+
+func (w *WebhookChannel) addWaiter(chatID string, waiter *webhookWaiter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.waiters[chatID] = append(w.waiters[chatID], waiter)
+}
+
+// retargetWaiter makes waiter wait for the reply to messageID, the message
+// its own was merged into.
+func (w *WebhookChannel) retargetWaiter(waiter *webhookWaiter, messageID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiter.messageID = messageID
+}
+
+// removeWaiter drops waiter and returns the replies it collected so far.
+func (w *WebhookChannel) removeWaiter(chatID string, waiter *webhookWaiter) []webhookReply {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.removeWaiterLocked(chatID, waiter)
+	return waiter.replies
+}
+
+func (w *WebhookChannel) removeWaiterLocked(chatID string, waiter *webhookWaiter) {
+	waiters := w.waiters[chatID]
+	for i, x := range waiters {
+		if x == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(w.waiters, chatID)
+	} else {
+		w.waiters[chatID] = waiters
+	}
+}
+
+func (w *WebhookChannel) handleMessages(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		writeWebhookJSON(resp, http.StatusMethodNotAllowed, webhookResponse{Error: "method not allowed"})
+		return
+	}
+	sender, ok := w.tokenSender(req)
+	if !ok {
+		writeWebhookJSON(resp, http.StatusUnauthorized, webhookResponse{Error: "invalid token"})
+		return
+	}
+
+	var in webhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, webhookMaxBodyBytes)).Decode(&in); err != nil {
+		writeWebhookJSON(resp, http.StatusBadRequest, webhookResponse{Error: "invalid JSON body: " + err.Error()})
+		return
+	}
+	if claimed := strings.TrimSpace(in.Sender); claimed != "" && claimed != sender {
+		w.logger.Warnf("[webhook] token of %s used to send as %s", sender, claimed)
+		writeWebhookJSON(resp, http.StatusForbidden, webhookResponse{Error: "sender does not match token"})
+		return
+	}
+	if !w.IsAllowed(sender) {
+		w.logger.Warnf("[webhook] message from unauthorized sender: %s", sender)
+		writeWebhookJSON(resp, http.StatusForbidden, webhookResponse{Error: "sender not allowed"})
+		return
+	}
+	if strings.TrimSpace(in.Text) == "" && len(in.Media) == 0 {
+		writeWebhookJSON(resp, http.StatusBadRequest, webhookResponse{Error: "text or media is required"})
+		return
+	}
+	mode := strings.ToLower(strings.TrimSpace(in.Mode))
+	hasCallback := strings.TrimSpace(w.cfg.CallbackURL) != ""
+	switch mode {
+	case "":
+		mode = webhookModeSync
+		if hasCallback {
+			mode = webhookModeAsync
+		}
+	case webhookModeSync:
+	case webhookModeAsync:
+		if !hasCallback {
+			writeWebhookJSON(resp, http.StatusBadRequest, webhookResponse{Error: "async mode needs a configured callbackUrl"})
+			return
+		}
+	default:
+		writeWebhookJSON(resp, http.StatusBadRequest, webhookResponse{Error: fmt.Sprintf("unknown mode %q", in.Mode)})
+		return
+	}
+
+	chatID := strings.TrimSpace(in.Chat)
+	if chatID == "" {
+		chatID = sender
+	}
+	messageID := strings.TrimSpace(in.ID)
+	if messageID == "" {
+		messageID = fmt.Sprintf("wh-%d", time.Now().UnixNano())
+	}
+
+	var attachments []bus.Attachment
+	for _, media := range in.Media {
+		att, err := w.saveMedia(req.Context(), media)
+		if err != nil {
+			for _, saved := range attachments {
+				os.Remove(saved.Path)
+			}
+			writeWebhookJSON(resp, http.StatusBadRequest, webhookResponse{ID: messageID, Error: "media: " + err.Error()})
+			return
+		}
+		attachments = append(attachments, att)
+	}
+
+	var waiter *webhookWaiter
+	if mode == webhookModeSync {
+		// Registered before publishing so a fast reply is not missed.
+		waiter = &webhookWaiter{messageID: messageID, done: make(chan struct{})}
+		w.addWaiter(chatID, waiter)
+	}
+	var merged func(string)
+	if waiter != nil {
+		merged = func(into string) { w.retargetWaiter(waiter, into) }
+	}
+
+	// The caller's metadata is kept under its own key, apart from the
+	// channel's own extras.
+	var metadata map[string]any
+	if len(in.Metadata) > 0 {
+		metadata = map[string]any{webhookMetaKey: in.Metadata}
+	}
+	published := w.bus.PublishInbound(bus.InboundMessage{
+		Channel:     webhookChannelName,
+		SenderID:    sender,
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Content:     in.Text,
+		Timestamp:   time.Now(),
+		Attachments: attachments,
+		Direct:      chatID == sender, // a chat of its own unless the caller names a shared one
+		Metadata:    metadata,
+		Merged:      merged,
+	})
+	if !published {
+		w.logger.Debugf("[webhook] duplicate message dropped: %s", messageID)
+		if waiter != nil {
+			w.removeWaiter(chatID, waiter)
+		}
+		writeWebhookJSON(resp, http.StatusOK, webhookResponse{ID: messageID, Status: "duplicate"})
+		return
+	}
+	if waiter == nil {
+		writeWebhookJSON(resp, http.StatusAccepted, webhookResponse{ID: messageID, Status: "accepted"})
+		return
+	}
+
+	timeout := webhookDefaultReplyTimeout
+	if w.cfg.ReplyTimeoutSec > 0 {
+		timeout = time.Duration(w.cfg.ReplyTimeoutSec) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.done:
+		writeWebhookJSON(resp, http.StatusOK, webhookResponse{ID: messageID, Status: "replied", Replies: waiter.replies})
+	case <-timer.C:
+		// Later replies go to the callback URL, if there is one.
+		replies := w.removeWaiter(chatID, waiter)
+		status := http.StatusGatewayTimeout
+		if hasCallback {
+			status = http.StatusAccepted
+		}
+		writeWebhookJSON(resp, status, webhookResponse{ID: messageID, Status: "timeout", Replies: replies})
+	case <-req.Context().Done():
+		w.removeWaiter(chatID, waiter)
+	}
+}
+
+// tokenSender returns the sender whose bearer token req carries.
+func (w *WebhookChannel) tokenSender(req *http.Request) (string, bool) {
+	got := strings.TrimSpace(req.Header.Get("Authorization"))
+	for sender, token := range w.cfg.Tokens {
+		want := "Bearer " + strings.TrimSpace(token)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+			return strings.TrimSpace(sender), true
+		}
+	}
+	return "", false
+}
+
+// saveMedia writes an inbound attachment to the temp media dir.
+func (w *WebhookChannel) saveMedia(ctx context.Context, media webhookMedia) (bus.Attachment, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case media.Data != "":
+		data, err = base64.StdEncoding.DecodeString(media.Data)
+		if err != nil {
+			return bus.Attachment{}, fmt.Errorf("decode base64: %w", err)
+		}
+		if len(data) > webhookMaxMediaBytes {
+			return bus.Attachment{}, fmt.Errorf("larger than %d bytes", webhookMaxMediaBytes)
+		}
+	case media.URL != "":
+		if w.client == nil {
+			return bus.Attachment{}, fmt.Errorf("webhook client not initialized")
+		}
+		data, err = w.client.DownloadMedia(ctx, media.URL)
+		if err != nil {
+			return bus.Attachment{}, err
+		}
+	default:
+		return bus.Attachment{}, fmt.Errorf("data or url is required")
+	}
+
+	name := filepath.Base(strings.TrimSpace(media.Name))
+	if name == "." || name == "/" {
+		name = "file"
+		if media.URL != "" {
+			name = filepath.Base(strings.SplitN(media.URL, "?", 2)[0])
+		}
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-webhook-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return bus.Attachment{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), name))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return bus.Attachment{}, fmt.Errorf("save file: %w", err)
+	}
+	return bus.Attachment{
+		Path: localPath,
+		Kind: attachmentKindOf(name, media.MIME),
+		MIME: media.MIME,
+		Size: int64(len(data)),
+	}, nil
+}
+
+// webhookSignature is the X-Aevitas-Signature value for body: the hex
+// HMAC-SHA256 under secret. It is empty when no secret is configured.
+func webhookSignature(secret string, body []byte) string {
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func writeWebhookJSON(resp http.ResponseWriter, status int, body webhookResponse) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	_ = json.NewEncoder(resp).Encode(body)
+}
@@ -13,7 +13,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -33,11 +38,21 @@ const (
 	wecomDefaultMsgCacheScan  = 1 * time.Minute
 	wecomDefaultReplyCacheTTL = 1 * time.Hour
 	wecomMarkdownMaxBytes     = 20480
-	wecomSendMaxRetries       = 3
+	wecomPushMaxBytes         = 2048 // app message markdown limit
+	wecomDefaultAPIURL        = "https://qyapi.weixin.qq.com"
+	wecomTokenRefreshMargin   = 5 * time.Minute
+	wecomMaxMediaBytes        = 20 << 20 // app file upload limit
+	wecomMaxImageBytes        = 10 << 20 // app image upload limit
 )
 
 type WeComClient interface {
 	SendMessage(ctx context.Context, responseURL string, msg bus.OutboundMessage) error
+	// PushMessage sends msg to a user through the app message API, for
+	// chats without a live response_url.
+	PushMessage(ctx context.Context, userID string, msg bus.OutboundMessage) error
+	// DownloadMedia fetches an inbound image or file and its file name.
+	// The data is still encrypted with the callback EncodingAESKey.
+	DownloadMedia(ctx context.Context, mediaURL string) ([]byte, string, error)
 	Close()
 }
 
@@ -45,6 +60,27 @@ type WeComClientFactory func(cfg config.WeComConfig) WeComClient
 
 type defaultWeComClient struct {
 	httpClient *http.Client
+
+	// App credentials for PushMessage.
+	apiURL     string
+	corpID     string
+	corpSecret string
+	agentID    int
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type weComTokenResponse struct {
+	weComSendResponse
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type weComUploadResponse struct {
+	weComSendResponse
+	MediaID string `json:"media_id"`
 }
 
 type weComSendResponse struct {
@@ -65,18 +101,35 @@ func (e *weComAPIError) IsRetryable() bool {
 	return e.Code == -1 || e.Code == 6000
 }
 
+// tokenExpired reports an invalid or expired access_token.
+func (e *weComAPIError) tokenExpired() bool {
+	return e.Code == 40014 || e.Code == 42001
+}
+
 type weComHTTPStatusError struct {
 	Code int
 	Body string
 }
 
 func (e *weComHTTPStatusError) Error() string {
-	return fmt.Sprintf("wecom response_url status %d: %s", e.Code, e.Body)
+	return fmt.Sprintf("wecom http status %d: %s", e.Code, e.Body)
+}
+
+func (e *weComHTTPStatusError) IsRetryable() bool {
+	return e.Code >= 500
 }
 
 func newDefaultWeComClient(cfg config.WeComConfig) WeComClient {
+	apiURL := strings.TrimRight(strings.TrimSpace(cfg.APIURL), "/")
+	if apiURL == "" {
+		apiURL = wecomDefaultAPIURL
+	}
 	return &defaultWeComClient{
 		httpClient: &http.Client{Timeout: 10 * time.Second},
+		apiURL:     apiURL,
+		corpID:     strings.TrimSpace(cfg.CorpID),
+		corpSecret: strings.TrimSpace(cfg.CorpSecret),
+		agentID:    cfg.AgentID,
 	}
 }
 
@@ -88,76 +141,262 @@ func (c *defaultWeComClient) SendMessage(ctx context.Context, responseURL string
 	}
 
 	content := truncateUTF8ByByteLimit(msg.Content, wecomMarkdownMaxBytes)
-	return c.sendTextWithRetry(ctx, responseURL, content)
+	return c.postJSON(ctx, responseURL, map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"content": content,
+		},
+	})
 }
 
-func (c *defaultWeComClient) sendTextWithRetry(ctx context.Context, responseURL, content string) error {
-	var lastErr error
-	for attempt := 1; attempt <= wecomSendMaxRetries; attempt++ {
-		err := c.sendTextOnce(ctx, responseURL, content)
-		if err == nil {
-			return nil
-		}
-
-		lastErr = err
-		if !c.shouldRetry(err) || attempt == wecomSendMaxRetries {
+// PushMessage sends msg's attachments as app image or file messages, then
+// its text as markdown messages split at the app message size limit. An
+// expired access token is refreshed once. A failure after the first message
+// is a *PartialSendError holding what was not sent.
+func (c *defaultWeComClient) PushMessage(ctx context.Context, userID string, msg bus.OutboundMessage) error {
+	if c.corpID == "" || c.corpSecret == "" || c.agentID == 0 {
+		return fmt.Errorf("wecom proactive send requires corpId, corpSecret and agentId")
+	}
+	sent := false
+	fail := func(rest bus.OutboundMessage, err error) error {
+		if !sent {
 			return err
 		}
+		return &PartialSendError{Rest: rest, Err: err}
+	}
+	for i, att := range msg.Attachments {
+		if err := c.pushMedia(ctx, userID, att); err != nil {
+			rest := msg
+			rest.Attachments = msg.Attachments[i:]
+			return fail(rest, fmt.Errorf("send %s: %w", filepath.Base(att.Path), err))
+		}
+		sent = true
+	}
+	for content := strings.TrimSpace(msg.Content); content != ""; {
+		chunk := truncateUTF8ByByteLimit(content, wecomPushMaxBytes)
+		if len(chunk) < len(content) {
+			if i := strings.LastIndex(chunk, "\n"); i > len(chunk)/2 {
+				chunk = chunk[:i+1]
+			}
+		}
+		payload := map[string]any{
+			"touser":  userID,
+			"msgtype": "markdown",
+			"agentid": c.agentID,
+			"markdown": map[string]string{
+				"content": chunk,
+			},
+		}
+		if err := c.pushOnce(ctx, payload); err != nil {
+			rest := msg
+			rest.Attachments = nil
+			rest.Content = content
+			return fail(rest, err)
+		}
+		sent = true
+		content = content[len(chunk):]
+	}
+	return nil
+}
 
-		backoff := time.Duration(attempt*attempt) * 100 * time.Millisecond
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(backoff):
+// pushMedia uploads att as temporary media and sends it as an image
+// message, or as a file message when WeCom would not take it as an image.
+func (c *defaultWeComClient) pushMedia(ctx context.Context, userID string, att bus.Attachment) error {
+	info, err := os.Stat(att.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > wecomMaxMediaBytes {
+		return fmt.Errorf("%.1f MB is over the %d MB limit", float64(info.Size())/(1<<20), wecomMaxMediaBytes>>20)
+	}
+	mediaType := "file"
+	switch strings.ToLower(filepath.Ext(att.Path)) {
+	case ".jpg", ".jpeg", ".png":
+		if info.Size() <= wecomMaxImageBytes {
+			mediaType = "image"
 		}
 	}
 
-	return lastErr
+	var mediaID string
+	err = c.withToken(ctx, func(token string) error {
+		var err error
+		mediaID, err = c.uploadMedia(ctx, token, mediaType, att.Path)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.pushOnce(ctx, map[string]any{
+		"touser":  userID,
+		"msgtype": mediaType,
+		"agentid": c.agentID,
+		mediaType: map[string]string{
+			"media_id": mediaID,
+		},
+	})
 }
 
-func (c *defaultWeComClient) shouldRetry(err error) bool {
-	if err == nil {
-		return false
+func (c *defaultWeComClient) uploadMedia(ctx context.Context, token, mediaType, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
-	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-		return false
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("media", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return "", err
 	}
 
+	uploadURL := c.apiURL + "/cgi-bin/media/upload?access_token=" + url.QueryEscape(token) + "&type=" + mediaType
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, &body)
+	if err != nil {
+		return "", fmt.Errorf("create wecom upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("upload wecom media: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &weComHTTPStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(raw))}
+	}
+	var result weComUploadResponse
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", fmt.Errorf("decode wecom upload response: %w", err)
+	}
+	if result.ErrCode != 0 || result.MediaID == "" {
+		return "", &weComAPIError{Code: result.ErrCode, Msg: result.ErrMsg}
+	}
+	return result.MediaID, nil
+}
+
+func (c *defaultWeComClient) pushOnce(ctx context.Context, payload any) error {
+	return c.withToken(ctx, func(token string) error {
+		return c.postJSON(ctx, c.apiURL+"/cgi-bin/message/send?access_token="+url.QueryEscape(token), payload)
+	})
+}
+
+// withToken runs call with the app access token, fetching a new token and
+// running it again once if WeCom reports the token expired.
+func (c *defaultWeComClient) withToken(ctx context.Context, call func(token string) error) error {
+	send := func() error {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = call(token)
+		var apiErr *weComAPIError
+		if errors.As(err, &apiErr) && apiErr.tokenExpired() {
+			c.resetToken(token)
+		}
+		return err
+	}
+	err := send()
 	var apiErr *weComAPIError
-	if errors.As(err, &apiErr) {
-		return apiErr.IsRetryable()
+	if errors.As(err, &apiErr) && apiErr.tokenExpired() {
+		err = send()
 	}
+	return err
+}
 
-	var statusErr *weComHTTPStatusError
-	if errors.As(err, &statusErr) {
-		return statusErr.Code >= 500
+// accessToken returns the cached app access token, fetching a new one
+// shortly before it expires.
+func (c *defaultWeComClient) accessToken(ctx context.Context) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	tokenURL := c.apiURL + "/cgi-bin/gettoken?corpid=" + url.QueryEscape(c.corpID) + "&corpsecret=" + url.QueryEscape(c.corpSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("create wecom gettoken request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("wecom gettoken: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &weComHTTPStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(raw))}
+	}
+	var result weComTokenResponse
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", fmt.Errorf("decode wecom gettoken response: %w", err)
+	}
+	if result.ErrCode != 0 || result.AccessToken == "" {
+		return "", &weComAPIError{Code: result.ErrCode, Msg: result.ErrMsg}
 	}
 
-	return true
+	c.token = result.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - wecomTokenRefreshMargin)
+	return c.token, nil
 }
 
-func (c *defaultWeComClient) sendTextOnce(ctx context.Context, responseURL, content string) error {
-	payload := map[string]any{
-		"msgtype": "markdown",
-		"markdown": map[string]string{
-			"content": content,
-		},
+// resetToken forgets token unless another send already replaced it.
+func (c *defaultWeComClient) resetToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.token == token {
+		c.token = ""
 	}
+}
 
+// DownloadMedia fetches an inbound media URL. The file name comes from the
+// Content-Disposition header, when there is one.
+func (c *defaultWeComClient) DownloadMedia(ctx context.Context, mediaURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("create wecom download request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("wecom download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, "", &weComHTTPStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(raw))}
+	}
+	// One extra byte tells whether the file is over the limit.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, wecomMaxMediaBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("wecom download: %w", err)
+	}
+	if len(data) > wecomMaxMediaBytes {
+		return nil, "", fmt.Errorf("wecom media is over the %d MB limit", wecomMaxMediaBytes>>20)
+	}
+	name := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	return data, name, nil
+}
+
+func (c *defaultWeComClient) postJSON(ctx context.Context, targetURL string, payload any) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("marshal wecom response_url payload: %w", err)
+		return fmt.Errorf("marshal wecom payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("create wecom response_url request: %w", err)
+		return fmt.Errorf("create wecom request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("send wecom response_url message: %w", err)
+		return fmt.Errorf("send wecom message: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -326,6 +565,77 @@ func (c *weComReplyCache) gcLocked(now time.Time) {
 	}
 }
 
+// errWeComGroupPush is returned for sends to a group chat without a live
+// response_url. The app message API only reaches users, and appchat/send
+// only the group chats the app created itself, not those the bot is in.
+var errWeComGroupPush = errors.New("wecom proactive send is not supported for group chats")
+
+// weComGroups is the set of group chat IDs seen in callbacks, saved so
+// proactive sends can tell them from user IDs after a restart.
+type weComGroups struct {
+	mu   sync.Mutex
+	path string
+	ids  map[string]bool
+}
+
+func newWeComGroups(path string) (*weComGroups, error) {
+	g := &weComGroups{path: path, ids: make(map[string]bool)}
+	if path == "" {
+		return g, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return g, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("parse wecom groups: %w", err)
+	}
+	for _, id := range ids {
+		g.ids[id] = true
+	}
+	return g, nil
+}
+
+func (g *weComGroups) has(chatID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ids[chatID]
+}
+
+// add records chatID as a group chat and saves the set if it is new.
+func (g *weComGroups) add(chatID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ids[chatID] {
+		return nil
+	}
+	g.ids[chatID] = true
+	if g.path == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(g.ids))
+	for id := range g.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(g.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(g.path, data, 0600)
+}
+
+func weComGroupsPath() string {
+	return filepath.Join(config.ConfigDir(), "data", "wecom", "groups.json")
+}
+
 type WeComChannel struct {
 	BaseChannel
 	cfg              config.WeComConfig
@@ -336,6 +646,7 @@ type WeComChannel struct {
 	allowlistEnabled bool
 	msgCache         *weComMsgCache
 	replyCache       *weComReplyCache
+	groups           *weComGroups
 	receiveID        string
 }
 
@@ -360,6 +671,10 @@ func NewWeComChannelWithFactory(cfg config.WeComConfig, b *bus.MessageBus, facto
 	}
 
 	receiveID := strings.TrimSpace(cfg.ReceiveID)
+	groups, err := newWeComGroups(weComGroupsPath())
+	if err != nil {
+		return nil, err
+	}
 
 	ch := &WeComChannel{
 		BaseChannel:      NewBaseChannel(wecomChannelName, b, cfg.AllowFrom, logger),
@@ -368,6 +683,7 @@ func NewWeComChannelWithFactory(cfg config.WeComConfig, b *bus.MessageBus, facto
 		allowlistEnabled: len(cfg.AllowFrom) > 0,
 		msgCache:         newWeComMsgCache(wecomDefaultMsgCacheTTL),
 		replyCache:       newWeComReplyCache(wecomDefaultReplyCacheTTL),
+		groups:           groups,
 		receiveID:        receiveID,
 	}
 
@@ -420,6 +736,25 @@ func (w *WeComChannel) Stop() error {
 	return nil
 }
 
+// Capabilities reports what a response_url reply can carry: WeCom markdown
+// text only. Images and files go through the app message API, so they are
+// only sent when app credentials are set.
+func (w *WeComChannel) Capabilities() Capabilities {
+	caps := Capabilities{
+		MaxMessageBytes: wecomMarkdownMaxBytes,
+		Markdown:        MarkdownBasic,
+	}
+	if w.pushEnabled() {
+		caps.Media = []bus.AttachmentKind{bus.AttachmentImage, bus.AttachmentFile}
+	}
+	return caps
+}
+
+// pushEnabled reports whether app credentials for proactive sends are set.
+func (w *WeComChannel) pushEnabled() bool {
+	return strings.TrimSpace(w.cfg.CorpID) != "" && strings.TrimSpace(w.cfg.CorpSecret) != "" && w.cfg.AgentID != 0
+}
+
 func (w *WeComChannel) Send(msg bus.OutboundMessage) error {
 	if w.client == nil {
 		return fmt.Errorf("wecom client not initialized")
@@ -432,12 +767,47 @@ func (w *WeComChannel) Send(msg bus.OutboundMessage) error {
 
 	responseURL, ok := w.replyCache.Get(chatID)
 	if !ok {
-		return fmt.Errorf("wecom response_url not found or expired for chat id %q", chatID)
+		// Cron announcements, heartbeats and notifications arrive long
+		// after the last message, if there was one.
+		if !w.pushEnabled() {
+			return fmt.Errorf("wecom response_url not found or expired for chat id %q", chatID)
+		}
+		return w.push(chatID, msg)
+	}
+
+	if len(msg.Attachments) > 0 {
+		// A response_url reply carries markdown only.
+		media := bus.OutboundMessage{ChatID: chatID, Attachments: msg.Attachments}
+		if err := w.push(chatID, media); err != nil {
+			w.logger.Warnf("[wecom] send media to %s failed: %v", chatID, err)
+			links := make([]string, 0, len(msg.Attachments))
+			for _, att := range msg.Attachments {
+				links = append(links, attachmentLink(att, MarkdownBasic))
+			}
+			msg.Content = strings.TrimSpace(msg.Content + "\n\n" + strings.Join(links, "\n"))
+		}
+		msg.Attachments = nil
+		if strings.TrimSpace(msg.Content) == "" {
+			return nil
+		}
+		// The media is sent or linked; a retry only needs the text.
+		if err := w.client.SendMessage(context.Background(), responseURL, msg); err != nil {
+			return &PartialSendError{Rest: msg, Err: err}
+		}
+		return nil
 	}
 
 	return w.client.SendMessage(context.Background(), responseURL, msg)
 }
 
+// push sends msg through the app message API, which only reaches users.
+func (w *WeComChannel) push(chatID string, msg bus.OutboundMessage) error {
+	if w.groups.has(chatID) {
+		return fmt.Errorf("%w: %s", errWeComGroupPush, chatID)
+	}
+	return w.client.PushMessage(context.Background(), chatID, msg)
+}
+
 type weComEncryptedEnvelope struct {
 	Encrypt string `json:"-"`
 }
@@ -467,9 +837,16 @@ type weComText struct {
 	Content string `json:"content"`
 }
 
+// weComMedia is an inbound image or file. The URL is valid for a few
+// minutes and serves the content encrypted with the EncodingAESKey.
+type weComMedia struct {
+	URL string `json:"url"`
+}
+
 type weComMixedItem struct {
-	MsgType string    `json:"msgtype"`
-	Text    weComText `json:"text"`
+	MsgType string     `json:"msgtype"`
+	Text    weComText  `json:"text"`
+	Image   weComMedia `json:"image"`
 }
 
 type weComMixed struct {
@@ -492,6 +869,8 @@ type weComInboundMessage struct {
 	Text        weComText  `json:"text"`
 	Mixed       weComMixed `json:"mixed"`
 	Voice       weComVoice `json:"voice"`
+	Image       weComMedia `json:"image"`
+	File        weComMedia `json:"file"`
 }
 
 type weComReplyEnvelope struct {
@@ -648,30 +1027,40 @@ func (w *WeComChannel) processDecryptedMessage(plaintext string) {
 		return
 	}
 
+	// resolveChatID only returns a chat other than the sender for groups.
+	if chatID != senderID {
+		if err := w.groups.add(chatID); err != nil {
+			w.logger.Warnf("[wecom] save group chat %s failed: %v", chatID, err)
+		}
+	}
+
 	responseURL := strings.TrimSpace(message.ResponseURL)
 	if responseURL != "" {
 		w.replyCache.Set(chatID, responseURL)
 	}
 
-	content := w.extractWeComContent(message)
-	if content == "" {
+	content, attachments := w.extractWeComContent(message)
+	if content == "" && len(attachments) == 0 {
 		return
 	}
 
-	w.bus.Inbound <- bus.InboundMessage{
-		Channel:   wecomChannelName,
-		SenderID:  senderID,
-		ChatID:    chatID,
-		Content:   content,
-		Timestamp: time.Now(),
+	if !w.bus.PublishInbound(bus.InboundMessage{
+		Channel:     wecomChannelName,
+		SenderID:    senderID,
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Content:     content,
+		Attachments: attachments,
+		Timestamp:   time.Now(),
+		Direct:      strings.TrimSpace(message.ChatType) == "single",
 		Metadata: map[string]any{
-			"msg_id":       messageID,
-			"aibot_id":     strings.TrimSpace(message.AIBotID),
-			"chat_id":      strings.TrimSpace(message.ChatID),
-			"chat_type":    strings.TrimSpace(message.ChatType),
-			"msg_type":     strings.TrimSpace(message.MsgType),
-			"response_url": responseURL,
+			"aibot_id":  strings.TrimSpace(message.AIBotID),
+			"chat_id":   strings.TrimSpace(message.ChatID),
+			"chat_type": strings.TrimSpace(message.ChatType),
+			"msg_type":  strings.TrimSpace(message.MsgType),
 		},
+	}) {
+		w.logger.Debugf("[wecom] duplicate message dropped: %s", messageID)
 	}
 }
 
@@ -692,27 +1081,91 @@ func (w *WeComChannel) resolveChatID(message weComInboundMessage, senderID strin
 	return senderID
 }
 
-func (w *WeComChannel) extractWeComContent(message weComInboundMessage) string {
+func (w *WeComChannel) extractWeComContent(message weComInboundMessage) (string, []bus.Attachment) {
+	var attachments []bus.Attachment
+	addImage := func(image weComMedia) {
+		if att, _, err := w.downloadMedia(image.URL, "image"); err != nil {
+			w.logger.Warnf("[wecom] download image failed: %v", err)
+		} else {
+			attachments = append(attachments, att)
+		}
+	}
+
 	switch strings.ToLower(strings.TrimSpace(message.MsgType)) {
 	case "text":
-		return strings.TrimSpace(message.Text.Content)
+		return strings.TrimSpace(message.Text.Content), nil
 	case "voice":
-		return strings.TrimSpace(message.Voice.Content)
+		return strings.TrimSpace(message.Voice.Content), nil
+	case "image":
+		addImage(message.Image)
+		return "", attachments
+	case "file":
+		att, name, err := w.downloadMedia(message.File.URL, "file")
+		if err != nil {
+			w.logger.Warnf("[wecom] download file failed: %v", err)
+			return "", nil
+		}
+		text, err := documentText(att.Path, name, att.MIME)
+		if err != nil {
+			w.logger.Warnf("[wecom] extract text from %s: %v", name, err)
+		}
+		return appendDocument("", name, att.Path, text), []bus.Attachment{att}
 	case "mixed":
 		parts := make([]string, 0, len(message.Mixed.MsgItem))
 		for _, item := range message.Mixed.MsgItem {
-			if !strings.EqualFold(strings.TrimSpace(item.MsgType), "text") {
-				continue
-			}
-			if text := strings.TrimSpace(item.Text.Content); text != "" {
-				parts = append(parts, text)
+			switch strings.ToLower(strings.TrimSpace(item.MsgType)) {
+			case "text":
+				if text := strings.TrimSpace(item.Text.Content); text != "" {
+					parts = append(parts, text)
+				}
+			case "image":
+				addImage(item.Image)
 			}
 		}
-		return strings.TrimSpace(strings.Join(parts, "\n"))
+		return strings.TrimSpace(strings.Join(parts, "\n")), attachments
 	default:
 		w.logger.Debugf("[wecom] unsupported message type: %s", strings.TrimSpace(message.MsgType))
-		return ""
+		return "", nil
+	}
+}
+
+// downloadMedia fetches and decrypts an inbound image or file into the temp
+// dir. It returns the attachment and the file name, fallbackName when WeCom
+// does not send one.
+func (w *WeComChannel) downloadMedia(mediaURL, fallbackName string) (bus.Attachment, string, error) {
+	mediaURL = strings.TrimSpace(mediaURL)
+	if mediaURL == "" {
+		return bus.Attachment{}, "", fmt.Errorf("empty media url")
+	}
+	data, name, err := w.client.DownloadMedia(context.Background(), mediaURL)
+	if err != nil {
+		return bus.Attachment{}, "", err
+	}
+	if data, err = w.decryptMedia(data); err != nil {
+		return bus.Attachment{}, "", fmt.Errorf("decrypt media: %w", err)
+	}
+
+	if name = filepath.Base(strings.TrimSpace(name)); name == "." || name == string(filepath.Separator) {
+		name = fallbackName
+	}
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	tempDir := filepath.Join(os.TempDir(), "aevitas-wecom-media")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return bus.Attachment{}, "", fmt.Errorf("create temp dir: %w", err)
 	}
+	localPath := filepath.Join(tempDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), name))
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return bus.Attachment{}, "", fmt.Errorf("save media: %w", err)
+	}
+	return bus.Attachment{
+		Path: localPath,
+		Kind: attachmentKindOf(name, mimeType),
+		MIME: mimeType,
+		Size: int64(len(data)),
+	}, name, nil
 }
 
 func (w *WeComChannel) allowMessageFrom(senderID string) bool {
@@ -778,6 +1231,27 @@ func (w *WeComChannel) decrypt(encrypted string) (string, string, error) {
 	return string(msg), receiveID, nil
 }
 
+// decryptMedia decrypts downloaded media: AES-256-CBC with the
+// EncodingAESKey, like callbacks, but without the length and receive ID
+// framing.
+func (w *WeComChannel) decryptMedia(data []byte) ([]byte, error) {
+	aesKey, err := decodeWeComAESKey(w.cfg.EncodingAESKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode aes key: %w", err)
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted block size")
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("new aes cipher: %w", err)
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, aesKey[:aes.BlockSize]).CryptBlocks(plain, data)
+	return pkcs7Unpad(plain, 32)
+}
+
 func (w *WeComChannel) encrypt(plaintext, receiveID string) (string, error) {
 	aesKey, err := decodeWeComAESKey(w.cfg.EncodingAESKey)
 	if err != nil {
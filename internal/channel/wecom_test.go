@@ -9,10 +9,13 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
@@ -28,9 +31,16 @@ type mockWeComSend struct {
 	Message     bus.OutboundMessage
 }
 
+type mockWeComMedia struct {
+	data []byte
+	name string
+}
+
 type mockWeComClient struct {
-	sent []mockWeComSend
-	err  error
+	sent   []mockWeComSend
+	pushed []mockWeComSend
+	media  map[string]mockWeComMedia
+	err    error
 }
 
 func (m *mockWeComClient) SendMessage(ctx context.Context, responseURL string, msg bus.OutboundMessage) error {
@@ -38,6 +48,19 @@ func (m *mockWeComClient) SendMessage(ctx context.Context, responseURL string, m
 	return m.err
 }
 
+func (m *mockWeComClient) PushMessage(ctx context.Context, userID string, msg bus.OutboundMessage) error {
+	m.pushed = append(m.pushed, mockWeComSend{Message: msg})
+	return m.err
+}
+
+func (m *mockWeComClient) DownloadMedia(ctx context.Context, mediaURL string) ([]byte, string, error) {
+	media, ok := m.media[mediaURL]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown media url %s", mediaURL)
+	}
+	return media.data, media.name, nil
+}
+
 func (m *mockWeComClient) Close() {}
 
 func mockWeComClientFactory(client *mockWeComClient) WeComClientFactory {
@@ -193,8 +216,11 @@ func TestWeComCallback_ReceiveTextMessage_OK(t *testing.T) {
 		if msg.Content != "你好，aevitas" {
 			t.Errorf("content = %q, want 你好，aevitas", msg.Content)
 		}
-		if msg.Metadata["response_url"] != "https://example.com/resp" {
-			t.Errorf("response_url = %v, want https://example.com/resp", msg.Metadata["response_url"])
+		if msg.MessageID != "10001" {
+			t.Errorf("messageID = %q, want 10001", msg.MessageID)
+		}
+		if url, _ := ch.replyCache.Get("zhangsan"); url != "https://example.com/resp" {
+			t.Errorf("response_url = %q, want https://example.com/resp", url)
 		}
 	case <-time.After(time.Second):
 		t.Fatal("expected inbound message")
@@ -347,6 +373,185 @@ func TestWeComChannel_Send_ResponseURLMissing(t *testing.T) {
 	}
 }
 
+func TestWeComChannel_Send_PushesWithoutResponseURL(t *testing.T) {
+	b := bus.NewMessageBus(10)
+	mock := &mockWeComClient{}
+
+	ch, err := NewWeComChannelWithFactory(config.WeComConfig{
+		Token:          "verify-token",
+		EncodingAESKey: "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG",
+		CorpID:         "corp",
+		CorpSecret:     "secret",
+		AgentID:        1000002,
+	}, b, mockWeComClientFactory(mock), sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("new channel error: %v", err)
+	}
+	ch.client = mock
+
+	if err := ch.Send(bus.OutboundMessage{ChatID: "zhangsan", Content: "daily report"}); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	if len(mock.sent) != 0 || len(mock.pushed) != 1 || mock.pushed[0].Message.Content != "daily report" {
+		t.Fatalf("sent %+v, pushed %+v; want one push", mock.sent, mock.pushed)
+	}
+}
+
+func TestWeComChannel_Send_RefusesGroupPush(t *testing.T) {
+	cfg := config.WeComConfig{
+		Token:          "verify-token",
+		EncodingAESKey: "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG",
+		CorpID:         "corp",
+		CorpSecret:     "secret",
+		AgentID:        1000002,
+	}
+	ch, b := newTestWeComChannel(t, cfg)
+	ch.processDecryptedMessage(`{"msgid":"20001","chattype":"group","chatid":"wrkGROUP","from":{"userid":"zhangsan"},"msgtype":"text","text":{"content":"hi"}}`)
+	<-b.Inbound
+
+	err := ch.Send(bus.OutboundMessage{ChatID: "wrkGROUP", Content: "daily report"})
+	if !errors.Is(err, errWeComGroupPush) {
+		t.Fatalf("send to group = %v, want %v", err, errWeComGroupPush)
+	}
+	mock := ch.client.(*mockWeComClient)
+	if len(mock.pushed) != 0 {
+		t.Fatalf("group chat id must not be pushed as a user: %+v", mock.pushed)
+	}
+
+	// The group is remembered across restarts; users are still pushed to.
+	reopened, err := NewWeComChannelWithFactory(cfg, b, mockWeComClientFactory(mock), sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	reopened.client = mock
+	if err := reopened.Send(bus.OutboundMessage{ChatID: "wrkGROUP", Content: "daily report"}); !errors.Is(err, errWeComGroupPush) {
+		t.Fatalf("send to group after restart = %v, want %v", err, errWeComGroupPush)
+	}
+	if err := reopened.Send(bus.OutboundMessage{ChatID: "zhangsan", Content: "daily report"}); err != nil {
+		t.Fatalf("send to user: %v", err)
+	}
+	if len(mock.pushed) != 1 || mock.pushed[0].Message.ChatID != "zhangsan" {
+		t.Fatalf("pushed %+v, want one push to zhangsan", mock.pushed)
+	}
+}
+
+func TestWeComChannel_ReceiveMedia(t *testing.T) {
+	ch, b := newTestWeComChannel(t, config.WeComConfig{
+		Token:          "verify-token",
+		EncodingAESKey: "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG",
+	})
+	png := []byte("\x89PNG\r\n\x1a\nimage-bytes")
+	ch.client.(*mockWeComClient).media = map[string]mockWeComMedia{
+		"https://example.com/img": {data: testWeComEncryptMedia(t, ch.cfg.EncodingAESKey, png)},
+		"https://example.com/doc": {data: testWeComEncryptMedia(t, ch.cfg.EncodingAESKey, []byte("quarterly numbers")), name: "notes.txt"},
+	}
+
+	ch.processDecryptedMessage(`{"msgid":"m1","chattype":"single","from":{"userid":"zhangsan"},"msgtype":"mixed","mixed":{"msg_item":[` +
+		`{"msgtype":"text","text":{"content":"what is this?"}},{"msgtype":"image","image":{"url":"https://example.com/img"}}]}}`)
+	msg := <-b.Inbound
+	if msg.Content != "what is this?" || len(msg.Attachments) != 1 || msg.Attachments[0].Kind != bus.AttachmentImage || msg.Attachments[0].MIME != "image/png" {
+		t.Fatalf("unexpected mixed message: %+v", msg)
+	}
+	defer os.Remove(msg.Attachments[0].Path)
+	if data, _ := os.ReadFile(msg.Attachments[0].Path); !bytes.Equal(data, png) {
+		t.Fatalf("saved image = %q, want decrypted bytes", data)
+	}
+
+	ch.processDecryptedMessage(`{"msgid":"m2","chattype":"single","from":{"userid":"zhangsan"},"msgtype":"file","file":{"url":"https://example.com/doc"}}`)
+	msg = <-b.Inbound
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Kind != bus.AttachmentFile {
+		t.Fatalf("unexpected file message: %+v", msg)
+	}
+	defer os.Remove(msg.Attachments[0].Path)
+	want := fmt.Sprintf("<document name=%q path=%q>\nquarterly numbers\n</document>", "notes.txt", msg.Attachments[0].Path)
+	if msg.Content != want {
+		t.Fatalf("content = %q, want %q", msg.Content, want)
+	}
+}
+
+func TestWeComChannel_Send_MediaWithResponseURL(t *testing.T) {
+	ch, _ := newTestWeComChannel(t, config.WeComConfig{
+		Token:          "verify-token",
+		EncodingAESKey: "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG",
+		CorpID:         "corp",
+		CorpSecret:     "secret",
+		AgentID:        1000002,
+	})
+	mock := ch.client.(*mockWeComClient)
+	ch.replyCache.Set("zhangsan", "https://example.com/response-url")
+	if !ch.Capabilities().SupportsMedia(bus.AttachmentImage) {
+		t.Fatal("images should be supported with app credentials")
+	}
+
+	att := bus.Attachment{Path: "/tmp/chart.png", Kind: bus.AttachmentImage}
+	if err := ch.Send(bus.OutboundMessage{ChatID: "zhangsan", Content: "here", Attachments: []bus.Attachment{att}}); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	if len(mock.pushed) != 1 || len(mock.pushed[0].Message.Attachments) != 1 || mock.pushed[0].Message.Content != "" {
+		t.Fatalf("pushed %+v, want the attachment only", mock.pushed)
+	}
+	if len(mock.sent) != 1 || mock.sent[0].Message.Content != "here" {
+		t.Fatalf("sent %+v, want the text through response_url", mock.sent)
+	}
+}
+
+func TestWeComChannel_Send_GroupMediaAgainstAPI(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var calls []string
+	var replies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		switch r.URL.Path {
+		case "/response":
+			var payload struct {
+				Markdown struct {
+					Content string `json:"content"`
+				} `json:"markdown"`
+			}
+			json.NewDecoder(r.Body).Decode(&payload)
+			replies = append(replies, payload.Markdown.Content)
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		case "/cgi-bin/gettoken":
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok","access_token":"token","expires_in":7200}`)
+		case "/cgi-bin/media/upload":
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok","type":"image","media_id":"id-1"}`)
+		default:
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		}
+	}))
+	defer ts.Close()
+
+	cfg := config.WeComConfig{
+		Token:          "verify-token",
+		EncodingAESKey: "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG",
+		APIURL:         ts.URL,
+		CorpID:         "corp",
+		CorpSecret:     "secret",
+		AgentID:        1000002,
+	}
+	b := bus.NewMessageBus(10)
+	ch, err := NewWeComChannelWithFactory(cfg, b, nil, sdklogger.NewDefault())
+	if err != nil {
+		t.Fatalf("new channel: %v", err)
+	}
+	ch.client = newDefaultWeComClient(cfg)
+	ch.processDecryptedMessage(`{"msgid":"20002","chattype":"group","chatid":"wrkGROUP","from":{"userid":"zhangsan"},"response_url":"` + ts.URL + `/response","msgtype":"text","text":{"content":"chart?"}}`)
+	<-b.Inbound
+
+	chart := filepath.Join(t.TempDir(), "chart.png")
+	os.WriteFile(chart, []byte("png-bytes"), 0644)
+	msg := bus.OutboundMessage{ChatID: "wrkGROUP", Content: "here", Attachments: bus.PathAttachments(chart)}
+	if err := ch.Send(msg); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if strings.Join(calls, ",") != "/response" {
+		t.Fatalf("group reply should only use response_url, calls = %v", calls)
+	}
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], "here\n\n") || !strings.Contains(replies[0], "chart.png") {
+		t.Fatalf("reply should list the file it could not send: %q", replies)
+	}
+}
+
 func TestChannelManager_WeComEnabled_MissingConfig(t *testing.T) {
 	b := bus.NewMessageBus(10)
 	_, err := NewChannelManager(config.ChannelsConfig{
@@ -385,6 +590,7 @@ func TestChannelManager_WeComEnabled(t *testing.T) {
 
 func newTestWeComChannel(t *testing.T, cfg config.WeComConfig) (*WeComChannel, *bus.MessageBus) {
 	t.Helper()
+	t.Setenv("HOME", t.TempDir())
 	b := bus.NewMessageBus(10)
 	mock := &mockWeComClient{}
 	ch, err := NewWeComChannelWithFactory(cfg, b, mockWeComClientFactory(mock), sdklogger.NewDefault())
@@ -435,6 +641,23 @@ func testWeComEncrypt(t *testing.T, encodingAESKey, receiveID, plaintext string)
 	return base64.StdEncoding.EncodeToString(cipherData)
 }
 
+// testWeComEncryptMedia encrypts data the way WeCom serves inbound media.
+func testWeComEncryptMedia(t *testing.T, encodingAESKey string, data []byte) []byte {
+	t.Helper()
+	aesKey, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		t.Fatalf("decode aes key: %v", err)
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	padded := testPKCS7Pad(append([]byte(nil), data...), 32)
+	cipherData := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, aesKey[:16]).CryptBlocks(cipherData, padded)
+	return cipherData
+}
+
 func testWeComDecrypt(t *testing.T, encodingAESKey, expectedReceiveID, encrypted string) string {
 	t.Helper()
 	aesKey, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
@@ -571,16 +794,12 @@ func TestWeComClient_Send_TruncateLongContent(t *testing.T) {
 	}
 }
 
-func TestWeComClient_Send_RetryTransientErrcode(t *testing.T) {
+func TestWeComClient_Send_TransientErrcodeIsLeftToDelivery(t *testing.T) {
 	sendCalls := 0
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sendCalls++
-		if sendCalls == 1 {
-			io.WriteString(w, `{"errcode":-1,"errmsg":"system busy"}`)
-			return
-		}
-		io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		io.WriteString(w, `{"errcode":-1,"errmsg":"system busy"}`)
 	}))
 	defer ts.Close()
 
@@ -589,11 +808,11 @@ func TestWeComClient_Send_RetryTransientErrcode(t *testing.T) {
 	}
 
 	err := client.SendMessage(context.Background(), ts.URL, bus.OutboundMessage{ChatID: "zhangsan", Content: "retry me"})
-	if err != nil {
-		t.Fatalf("send message: %v", err)
+	if !IsRetryableSendError(err) {
+		t.Fatalf("system busy should be retryable, got %v", err)
 	}
-	if sendCalls != 2 {
-		t.Fatalf("send calls = %d, want 2", sendCalls)
+	if sendCalls != 1 {
+		t.Fatalf("send calls = %d, want 1 (only the delivery layer retries)", sendCalls)
 	}
 }
 
@@ -621,3 +840,132 @@ func TestWeComClient_Send_NoRetryOnPayloadErrcode(t *testing.T) {
 		t.Fatalf("send calls = %d, want 1", sendCalls)
 	}
 }
+
+func TestWeComClient_PushMessage_TokenCacheAndRefresh(t *testing.T) {
+	var tokenCalls int
+	var sends []map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/gettoken":
+			if r.URL.Query().Get("corpid") != "corp" || r.URL.Query().Get("corpsecret") != "secret" {
+				t.Errorf("unexpected gettoken query: %s", r.URL.RawQuery)
+			}
+			tokenCalls++
+			fmt.Fprintf(w, `{"errcode":0,"errmsg":"ok","access_token":"token-%d","expires_in":7200}`, tokenCalls)
+		case "/cgi-bin/message/send":
+			if r.URL.Query().Get("access_token") == "token-1" {
+				io.WriteString(w, `{"errcode":42001,"errmsg":"access_token expired"}`)
+				return
+			}
+			var payload map[string]any
+			json.NewDecoder(r.Body).Decode(&payload)
+			sends = append(sends, payload)
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	client := newDefaultWeComClient(config.WeComConfig{APIURL: ts.URL + "/", CorpID: "corp", CorpSecret: "secret", AgentID: 1000002})
+	long := strings.Repeat("line of the report\n", 150) // ~2.8 KB, two app messages
+	if err := client.PushMessage(context.Background(), "zhangsan", bus.OutboundMessage{Content: long}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := client.PushMessage(context.Background(), "zhangsan", bus.OutboundMessage{Content: "again"}); err != nil {
+		t.Fatalf("second push: %v", err)
+	}
+
+	if tokenCalls != 2 {
+		t.Fatalf("gettoken calls = %d, want 2 (initial + one refresh)", tokenCalls)
+	}
+	if len(sends) != 3 {
+		t.Fatalf("sends = %d, want 3", len(sends))
+	}
+	first := sends[0]["markdown"].(map[string]any)["content"].(string)
+	if sends[0]["touser"] != "zhangsan" || sends[0]["agentid"] != float64(1000002) || len(first) > wecomPushMaxBytes || !strings.HasSuffix(first, "\n") {
+		t.Fatalf("unexpected first send: %+v", sends[0])
+	}
+}
+
+func TestWeComClient_PushMessage_UploadsMedia(t *testing.T) {
+	var uploads []string
+	var sends []map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/gettoken":
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok","access_token":"token","expires_in":7200}`)
+		case "/cgi-bin/media/upload":
+			file, header, err := r.FormFile("media")
+			if err != nil {
+				t.Errorf("read upload: %v", err)
+				return
+			}
+			file.Close()
+			mediaType := r.URL.Query().Get("type")
+			uploads = append(uploads, mediaType+":"+header.Filename)
+			fmt.Fprintf(w, `{"errcode":0,"errmsg":"ok","type":%q,"media_id":"id-%d"}`, mediaType, len(uploads))
+		case "/cgi-bin/message/send":
+			var payload map[string]any
+			json.NewDecoder(r.Body).Decode(&payload)
+			sends = append(sends, payload)
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	chart := filepath.Join(dir, "chart.png")
+	report := filepath.Join(dir, "report.pdf")
+	os.WriteFile(chart, []byte("png-bytes"), 0644)
+	os.WriteFile(report, []byte("pdf-bytes"), 0644)
+
+	client := newDefaultWeComClient(config.WeComConfig{APIURL: ts.URL, CorpID: "corp", CorpSecret: "secret", AgentID: 1000002})
+	msg := bus.OutboundMessage{Content: "done", Attachments: bus.PathAttachments(chart, report)}
+	if err := client.PushMessage(context.Background(), "zhangsan", msg); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	if strings.Join(uploads, ",") != "image:chart.png,file:report.pdf" {
+		t.Fatalf("uploads = %v", uploads)
+	}
+	if len(sends) != 3 || sends[0]["msgtype"] != "image" || sends[1]["msgtype"] != "file" || sends[2]["msgtype"] != "markdown" {
+		t.Fatalf("unexpected sends: %+v", sends)
+	}
+	if id := sends[1]["file"].(map[string]any)["media_id"]; id != "id-2" {
+		t.Fatalf("file media_id = %v, want id-2", id)
+	}
+}
+
+func TestWeComClient_PushMessage_ReportsUnsentRest(t *testing.T) {
+	var sends []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/gettoken":
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok","access_token":"token","expires_in":7200}`)
+		case "/cgi-bin/message/send":
+			var payload map[string]any
+			json.NewDecoder(r.Body).Decode(&payload)
+			sends = append(sends, payload["markdown"].(map[string]any)["content"].(string))
+			if len(sends) == 2 {
+				io.WriteString(w, `{"errcode":-1,"errmsg":"system busy"}`)
+				return
+			}
+			io.WriteString(w, `{"errcode":0,"errmsg":"ok"}`)
+		}
+	}))
+	defer ts.Close()
+
+	client := newDefaultWeComClient(config.WeComConfig{APIURL: ts.URL, CorpID: "corp", CorpSecret: "secret", AgentID: 1000002})
+	long := strings.Repeat("line of the report\n", 150)
+	err := client.PushMessage(context.Background(), "zhangsan", bus.OutboundMessage{Content: long})
+	var partial *PartialSendError
+	if !errors.As(err, &partial) || !IsRetryableSendError(err) {
+		t.Fatalf("a failure after the first chunk should be partial and retryable: %v", err)
+	}
+	if len(sends) != 2 || sends[0]+partial.Rest.Content != strings.TrimSpace(long) {
+		t.Fatalf("the rest should start at the failed chunk: sent %d, rest %d bytes", len(sends), len(partial.Rest.Content))
+	}
+}
@@ -16,6 +16,9 @@ const (
 	DefaultHost              = "0.0.0.0"
 	DefaultPort              = 18790
 	DefaultBufSize           = 100
+
+	DefaultMaxConcurrentTurns  = 4
+	DefaultMaxQueuedPerSession = 5
 )
 
 type Config struct {
@@ -25,10 +28,15 @@ type Config struct {
 	Voice    VoiceConfig    `json:"voice,omitempty"`
 	Tools    ToolsConfig    `json:"tools"`
 	Gateway  GatewayConfig  `json:"gateway"`
+	// Identities links the accounts one person uses on different channels.
+	Identities IdentitiesConfig `json:"identities,omitempty"`
 }
 
 type AgentConfig struct {
 	Workspace         string  `json:"workspace"`
+	// SettingsPath is an extra settings file layered over the workspace's
+	// .claude/settings.json.
+	SettingsPath      string      `json:"settingsPath,omitempty"`
 	Model             ModelConfig `json:"model"`
 	MaxTokens         int     `json:"maxTokens"`
 	Temperature       float64 `json:"temperature"`
@@ -219,20 +227,56 @@ type ChannelsConfig struct {
 	Telegram TelegramConfig `json:"telegram"`
 	Feishu   FeishuConfig   `json:"feishu"`
 	WeCom    WeComConfig    `json:"wecom"`
+	Slack    SlackConfig    `json:"slack"`
+	Discord  DiscordConfig  `json:"discord"`
+	Matrix   MatrixConfig   `json:"matrix"`
+	Webhook  WebhookConfig  `json:"webhook"`
+	Email    EmailConfig    `json:"email"`
+	Webchat  WebchatConfig  `json:"webchat"`
 }
 
 type TelegramConfig struct {
-	Enabled   bool     `json:"enabled"`
-	Token     string   `json:"token"`
-	AllowFrom []string `json:"allowFrom"`
-	Proxy     string   `json:"proxy,omitempty"`
+	Enabled    bool     `json:"enabled"`
+	Token      string   `json:"token"`
+	AllowFrom  []string `json:"allowFrom"`
+	Proxy      string   `json:"proxy,omitempty"`
+	DebounceMs int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+	// GroupAllowFrom lists group chat IDs whose members may all talk to the
+	// bot. When empty, group messages are allowed by sender like private ones.
+	GroupAllowFrom []string `json:"groupAllowFrom,omitempty"`
+	// Groups holds per-group settings keyed by chat ID; "*" applies to
+	// groups without an entry of their own.
+	Groups map[string]TelegramGroupConfig `json:"groups,omitempty"`
+	// WebhookURL is the public HTTPS URL Telegram posts updates to. When set,
+	// the bot receives updates on a local listener instead of long polling.
+	WebhookURL    string `json:"webhookUrl,omitempty"`
+	WebhookPort   int    `json:"webhookPort,omitempty"`   // local listener port; defaults to 9888
+	WebhookSecret string `json:"webhookSecret,omitempty"` // secret_token Telegram sends back; random per start when empty
+}
+
+// TelegramGroupConfig holds the settings of one Telegram group chat. Forum
+// topics share the settings of their group.
+type TelegramGroupConfig struct {
+	RequireMention *bool  `json:"requireMention,omitempty"` // answer only when mentioned, replied to or sent a command; default true
+	SystemPrompt   string `json:"systemPrompt,omitempty"`   // extra instructions for every turn in the group
+	ToolProgress   *bool  `json:"toolProgress,omitempty"`   // show tool progress blocks; default true
 }
 
 type FeishuConfig struct {
-	Enabled   bool     `json:"enabled"`
-	AppID     string   `json:"appId"`
-	AppSecret string   `json:"appSecret"`
-	AllowFrom []string `json:"allowFrom"`
+	Enabled    bool     `json:"enabled"`
+	AppID      string   `json:"appId"`
+	AppSecret  string   `json:"appSecret"`
+	AllowFrom  []string `json:"allowFrom"`
+	DebounceMs int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+	// Groups holds per-group settings keyed by chat ID (oc_...); "*"
+	// applies to groups without their own entry.
+	Groups map[string]FeishuGroupConfig `json:"groups,omitempty"`
+}
+
+// FeishuGroupConfig holds the settings of one Feishu group chat.
+type FeishuGroupConfig struct {
+	RequireMention *bool  `json:"requireMention,omitempty"` // answer only when @mentioned or sent a command; default true
+	SystemPrompt   string `json:"systemPrompt,omitempty"`   // extra instructions for every turn in the group
 }
 
 type WeComConfig struct {
@@ -242,6 +286,85 @@ type WeComConfig struct {
 	ReceiveID      string   `json:"receiveId,omitempty"`
 	Port           int      `json:"port,omitempty"`
 	AllowFrom      []string `json:"allowFrom"`
+	DebounceMs     int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+	// CorpID, CorpSecret and AgentID identify a self-built app used to
+	// message users when no response_url is cached, e.g. for cron jobs.
+	CorpID     string `json:"corpId,omitempty"`
+	CorpSecret string `json:"corpSecret,omitempty"`
+	AgentID    int    `json:"agentId,omitempty"`
+	APIURL     string `json:"apiUrl,omitempty"` // app API base URL; defaults to https://qyapi.weixin.qq.com
+}
+
+type SlackConfig struct {
+	Enabled    bool     `json:"enabled"`
+	BotToken   string   `json:"botToken"`         // xoxb- token for the Web API
+	AppToken   string   `json:"appToken"`         // xapp- token with connections:write, for Socket Mode
+	APIURL     string   `json:"apiUrl,omitempty"` // Web API base URL; defaults to https://slack.com/api/
+	AllowFrom  []string `json:"allowFrom"`
+	DebounceMs int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+}
+
+type DiscordConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Token      string   `json:"token"`             // bot token
+	GuildID    string   `json:"guildId,omitempty"` // register slash commands on this guild only (instant); empty = global
+	APIURL     string   `json:"apiUrl,omitempty"`  // REST base URL; defaults to https://discord.com/api/v10/
+	AllowFrom  []string `json:"allowFrom"`
+	DebounceMs int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+}
+
+type MatrixConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Homeserver  string `json:"homeserver"`  // client-server API base URL, e.g. https://matrix.example.org
+	AccessToken string `json:"accessToken"` // bot account access token
+	// AllowFrom takes MXIDs (@alice:example.org) or homeserver names
+	// (example.org) to allow every user of that server.
+	AllowFrom  []string `json:"allowFrom"`
+	DebounceMs int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+}
+
+type WebhookConfig struct {
+	Enabled bool   `json:"enabled"`
+	Port    int    `json:"port,omitempty"`
+	// Tokens maps each sender to the bearer token it must present on
+	// POST /v1/messages. The token decides who the sender is.
+	Tokens map[string]string `json:"tokens"`
+	// CallbackURL receives replies that are not returned synchronously,
+	// signed with Secret as X-Aevitas-Signature: sha256=<hex hmac>.
+	CallbackURL     string   `json:"callbackUrl,omitempty"`
+	Secret          string   `json:"secret,omitempty"`
+	ReplyTimeoutSec int      `json:"replyTimeoutSec,omitempty"` // how long a sync request waits for the reply; defaults to 120
+	AllowFrom       []string `json:"allowFrom"`
+	DebounceMs      int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+}
+
+type EmailConfig struct {
+	Enabled  bool   `json:"enabled"`
+	IMAPAddr string `json:"imapAddr"` // host:port, e.g. imap.example.com:993
+	SMTPAddr string `json:"smtpAddr"` // host:port, e.g. smtp.example.com:587
+	Username string `json:"username"` // login for both servers
+	Password string `json:"password"`
+	Address  string `json:"address,omitempty"` // From address of replies; defaults to username
+	Mailbox  string `json:"mailbox,omitempty"` // watched folder; defaults to INBOX
+	// Security is "" for implicit TLS on ports 993/465 and STARTTLS
+	// elsewhere, or "none" for plain connections to a trusted local relay.
+	Security   string   `json:"security,omitempty"`
+	AllowFrom  []string `json:"allowFrom"`            // sender addresses; required
+	DebounceMs int      `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
+	// AuthServID is the authserv-id of the receiving server's
+	// Authentication-Results header, e.g. "mx.example.com". Only that header
+	// is trusted; required.
+	AuthServID string `json:"authServId"`
+}
+
+type WebchatConfig struct {
+	Enabled bool   `json:"enabled"`
+	Host    string `json:"host,omitempty"` // listen address; defaults to 127.0.0.1
+	Port    int    `json:"port,omitempty"` // defaults to 18791
+	// Token authenticates the browser. When empty one is generated and kept
+	// in ~/.aevitas/data/webchat/token.
+	Token      string `json:"token,omitempty"`
+	DebounceMs int    `json:"debounceMs,omitempty"` // merge messages arriving within this window into one turn; 0 = off
 }
 
 type ToolsConfig struct {
@@ -250,9 +373,51 @@ type ToolsConfig struct {
 	RestrictToWorkspace bool   `json:"restrictToWorkspace"`
 }
 
+// IdentitiesConfig maps channel accounts to users. Accounts are written
+// "channel:senderID", e.g. "telegram:123456", "feishu:ou_xxx" or
+// "wecom:zhangsan". Users can also link accounts themselves with /link;
+// those links are kept in ~/.aevitas/data/identities.json.
+type IdentitiesConfig struct {
+	Users map[string]UserIdentity `json:"users,omitempty"` // keyed by user name
+	// SharedSession routes the direct chats of a user's accounts to one
+	// session, so history carries over between channels. Group chats keep
+	// their own sessions.
+	SharedSession bool `json:"sharedSession,omitempty"`
+	// DefaultRole is the role of senders whose user has none: "owner",
+	// "member" or "guest". Default: "owner", i.e. no restrictions.
+	DefaultRole string `json:"defaultRole,omitempty"`
+}
+
+// UserIdentity is one user's profile.
+type UserIdentity struct {
+	Accounts []string `json:"accounts"`
+	// Role limits the commands the user may run and selects the tool
+	// permissions of their turns (.claude/settings.<role>.json).
+	Role string `json:"role,omitempty"`
+}
+
 type GatewayConfig struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Host    string          `json:"host"`
+	Port    int             `json:"port"`
+	Queue   TurnQueueConfig `json:"queue,omitempty"`
+	Journal JournalConfig   `json:"journal,omitempty"`
+}
+
+// JournalConfig controls the message journal under ~/.aevitas/data/journal.
+// When enabled, unfinished turns and undelivered replies are replayed on start.
+type JournalConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// TurnQueueConfig controls how agent turns are scheduled.
+// Turns in one session always run in order; different sessions run in parallel.
+type TurnQueueConfig struct {
+	// MaxConcurrent caps agent turns running at once across all sessions. Default: 4.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// MaxPerSession caps turns waiting behind the running one in a session.
+	// Further messages are answered with a busy notice. Unset means 5; 0 lets
+	// no turn wait, so messages sent while one runs are all turned away.
+	MaxPerSession *int `json:"maxPerSession,omitempty"`
 }
 
 func DefaultConfig() *Config {
@@ -301,6 +466,10 @@ func DefaultConfig() *Config {
 		Gateway: GatewayConfig{
 			Host: DefaultHost,
 			Port: DefaultPort,
+			Queue: TurnQueueConfig{
+				MaxConcurrent: DefaultMaxConcurrentTurns,
+			},
+			Journal: JournalConfig{Enabled: true},
 		},
 	}
 }
@@ -353,6 +522,9 @@ func LoadConfig() (*Config, error) {
 	if token := os.Getenv("AEVITAS_TELEGRAM_TOKEN"); token != "" {
 		cfg.Channels.Telegram.Token = token
 	}
+	if secret := os.Getenv("AEVITAS_TELEGRAM_WEBHOOK_SECRET"); secret != "" {
+		cfg.Channels.Telegram.WebhookSecret = secret
+	}
 	if appID := os.Getenv("AEVITAS_FEISHU_APP_ID"); appID != "" {
 		cfg.Channels.Feishu.AppID = appID
 	}
@@ -368,6 +540,39 @@ func LoadConfig() (*Config, error) {
 	if receiveID := os.Getenv("AEVITAS_WECOM_RECEIVE_ID"); receiveID != "" {
 		cfg.Channels.WeCom.ReceiveID = receiveID
 	}
+	if corpID := os.Getenv("AEVITAS_WECOM_CORP_ID"); corpID != "" {
+		cfg.Channels.WeCom.CorpID = corpID
+	}
+	if secret := os.Getenv("AEVITAS_WECOM_CORP_SECRET"); secret != "" {
+		cfg.Channels.WeCom.CorpSecret = secret
+	}
+	if token := os.Getenv("AEVITAS_SLACK_BOT_TOKEN"); token != "" {
+		cfg.Channels.Slack.BotToken = token
+	}
+	if token := os.Getenv("AEVITAS_SLACK_APP_TOKEN"); token != "" {
+		cfg.Channels.Slack.AppToken = token
+	}
+	if token := os.Getenv("AEVITAS_DISCORD_TOKEN"); token != "" {
+		cfg.Channels.Discord.Token = token
+	}
+	if hs := os.Getenv("AEVITAS_MATRIX_HOMESERVER"); hs != "" {
+		cfg.Channels.Matrix.Homeserver = hs
+	}
+	if token := os.Getenv("AEVITAS_MATRIX_ACCESS_TOKEN"); token != "" {
+		cfg.Channels.Matrix.AccessToken = token
+	}
+	if secret := os.Getenv("AEVITAS_WEBHOOK_SECRET"); secret != "" {
+		cfg.Channels.Webhook.Secret = secret
+	}
+	if user := os.Getenv("AEVITAS_EMAIL_USERNAME"); user != "" {
+		cfg.Channels.Email.Username = user
+	}
+	if password := os.Getenv("AEVITAS_EMAIL_PASSWORD"); password != "" {
+		cfg.Channels.Email.Password = password
+	}
+	if token := os.Getenv("AEVITAS_WEBCHAT_TOKEN"); token != "" {
+		cfg.Channels.Webchat.Token = token
+	}
 	if key := os.Getenv("AEVITAS_VOICE_ASR_API_KEY"); key != "" {
 		cfg.Voice.ASR.APIKey = key
 	}
@@ -126,6 +126,25 @@ func TestLoadConfig_FromFile(t *testing.T) {
 	}
 }
 
+func TestLoadConfig_QueueMaxPerSessionZero(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	cfgDir := filepath.Join(tmpDir, ".aevitas")
+	os.MkdirAll(cfgDir, 0755)
+	os.WriteFile(filepath.Join(cfgDir, "config.json"), []byte(`{"gateway":{"queue":{"maxPerSession":0}}}`), 0644)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if q := cfg.Gateway.Queue; q.MaxPerSession == nil || *q.MaxPerSession != 0 {
+		t.Fatalf("maxPerSession = %v, want explicit 0", q.MaxPerSession)
+	}
+	if q := cfg.Gateway.Queue; q.MaxConcurrent != DefaultMaxConcurrentTurns {
+		t.Errorf("maxConcurrent = %d, want default %d", q.MaxConcurrent, DefaultMaxConcurrentTurns)
+	}
+}
+
 func TestLoadConfig_ModelObjectWithFallbacks(t *testing.T) {
 	tmpDir := t.TempDir()
 	origHome := os.Getenv("HOME")
@@ -363,3 +382,42 @@ func TestLoadConfig_WeComEnvOverrides(t *testing.T) {
 		t.Errorf("wecom receiveId = %q, want wecom-receive-id", cfg.Channels.WeCom.ReceiveID)
 	}
 }
+
+func TestLoadConfig_ChatChannelEnvOverrides(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("AEVITAS_SLACK_BOT_TOKEN", "xoxb-test")
+	t.Setenv("AEVITAS_SLACK_APP_TOKEN", "xapp-test")
+	t.Setenv("AEVITAS_DISCORD_TOKEN", "discord-test")
+	t.Setenv("AEVITAS_MATRIX_ACCESS_TOKEN", "syt-test")
+	t.Setenv("AEVITAS_WEBHOOK_SECRET", "webhook-secret")
+	t.Setenv("AEVITAS_EMAIL_USERNAME", "bot@example.com")
+	t.Setenv("AEVITAS_EMAIL_PASSWORD", "mail-pass")
+	t.Setenv("AEVITAS_WEBCHAT_TOKEN", "webchat-test")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Channels.Slack.BotToken != "xoxb-test" {
+		t.Errorf("slack bot token = %q, want xoxb-test", cfg.Channels.Slack.BotToken)
+	}
+	if cfg.Channels.Slack.AppToken != "xapp-test" {
+		t.Errorf("slack app token = %q, want xapp-test", cfg.Channels.Slack.AppToken)
+	}
+	if cfg.Channels.Discord.Token != "discord-test" {
+		t.Errorf("discord token = %q, want discord-test", cfg.Channels.Discord.Token)
+	}
+	if cfg.Channels.Matrix.AccessToken != "syt-test" {
+		t.Errorf("matrix access token = %q, want syt-test", cfg.Channels.Matrix.AccessToken)
+	}
+	if cfg.Channels.Webhook.Secret != "webhook-secret" {
+		t.Errorf("webhook secret = %q, want webhook-secret", cfg.Channels.Webhook.Secret)
+	}
+	if cfg.Channels.Email.Username != "bot@example.com" || cfg.Channels.Email.Password != "mail-pass" {
+		t.Errorf("email username/password = %q/%q, want configured values", cfg.Channels.Email.Username, cfg.Channels.Email.Password)
+	}
+	if cfg.Channels.Webchat.Token != "webchat-test" {
+		t.Errorf("webchat token = %q, want webchat-test", cfg.Channels.Webchat.Token)
+	}
+}
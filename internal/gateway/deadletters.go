@@ -0,0 +1,31 @@
+package gateway
+
+import (
+	"github.com/riverfjs/aevitas/internal/journal"
+)
+
+// ListDeadLetters returns outbound messages that could not be delivered.
+func (g *Gateway) ListDeadLetters() []journal.DeadLetter {
+	return g.deadLetters.List()
+}
+
+// RetryDeadLetters re-queues the dead letter with the given ID, or all of
+// them for "all", and reports how many were re-queued.
+func (g *Gateway) RetryDeadLetters(id string) (int, error) {
+	letters, err := g.deadLetters.Take(id)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range letters {
+		g.logger.Infof("[gateway] retrying dead letter %s to %s/%s", l.ID, l.Channel, l.ChatID)
+		g.bus.PublishOutbound(l.Message())
+	}
+	return len(letters), nil
+}
+
+// DropDeadLetters discards the dead letter with the given ID, or all of
+// them for "all", and reports how many were dropped.
+func (g *Gateway) DropDeadLetters(id string) (int, error) {
+	letters, err := g.deadLetters.Take(id)
+	return len(letters), err
+}
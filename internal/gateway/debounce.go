@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/identity"
+	"github.com/riverfjs/aevitas/internal/journal"
+)
+
+// inboundDebouncer collects messages from one sender in a session that
+// arrive in quick succession and hands them on as a single merged message
+// once the sender has been quiet for the debounce window. The zero value is
+// ready to use.
+type inboundDebouncer struct {
+	mu      sync.Mutex
+	pending map[string]*debounceBatch
+}
+
+type debounceBatch struct {
+	msgs  []bus.InboundMessage
+	timer *time.Timer
+}
+
+// add buffers msg and calls flush with the merged batch after window passes
+// without another message from the same sender in the session. A
+// non-positive window flushes msg immediately.
+func (d *inboundDebouncer) add(msg bus.InboundMessage, window time.Duration, flush func(bus.InboundMessage)) {
+	if window <= 0 {
+		flush(msg)
+		return
+	}
+	// Keyed by session and sender account: group members each get their
+	// own turn, and a user sharing a session across channels is answered in
+	// each chat.
+	key := msg.SessionKey() + "|" + identity.Account(msg.Channel, msg.SenderID)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string]*debounceBatch)
+	}
+	batch, ok := d.pending[key]
+	if !ok {
+		batch = &debounceBatch{}
+		d.pending[key] = batch
+	}
+	batch.msgs = append(batch.msgs, msg)
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	batch.timer = time.AfterFunc(window, func() {
+		d.mu.Lock()
+		if d.pending[key] != batch {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.pending, key)
+		msgs := batch.msgs
+		d.mu.Unlock()
+		flush(mergeInbound(msgs))
+	})
+}
+
+// clear discards the batches still waiting in sessionKey and returns their
+// messages.
+func (d *inboundDebouncer) clear(sessionKey string) []bus.InboundMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var msgs []bus.InboundMessage
+	for key, batch := range d.pending {
+		if !strings.HasPrefix(key, sessionKey+"|") {
+			continue
+		}
+		batch.timer.Stop()
+		delete(d.pending, key)
+		msgs = append(msgs, batch.msgs...)
+	}
+	return msgs
+}
+
+// debounceWindow returns the configured merge window for a channel.
+func (g *Gateway) debounceWindow(channel string) time.Duration {
+	if g.channels == nil {
+		return 0
+	}
+	return g.channels.DebounceWindow(channel)
+}
+
+// mergeInbound folds msgs into one message. Content is joined line by line,
+// attachments and metadata are combined, and the remaining fields come from
+// the last message so the reply threads to it.
+func mergeInbound(msgs []bus.InboundMessage) bus.InboundMessage {
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	merged := msgs[len(msgs)-1]
+	var contents []string
+	var attachments []bus.Attachment
+	meta := map[string]any{}
+	var journalIDs []string
+	for i, msg := range msgs {
+		journalIDs = append(journalIDs, journal.IDs(msg)...)
+		if text := strings.TrimSpace(msg.Content); text != "" {
+			contents = append(contents, text)
+		}
+		attachments = append(attachments, msg.Attachments...)
+		for k, v := range msg.Metadata {
+			meta[k] = v
+		}
+		// Only the last message keeps its typing indicator running and
+		// gets the reply.
+		if i < len(msgs)-1 {
+			msg.Typing.Stop()
+			if msg.Merged != nil {
+				msg.Merged(merged.MessageID)
+			}
+		}
+	}
+	merged.Content = strings.Join(contents, "\n")
+	merged.Attachments = attachments
+	merged.Metadata = meta
+	merged.JournalIDs = journalIDs
+	return merged
+}
@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/channel"
+	"github.com/riverfjs/aevitas/internal/config"
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+)
+
+// recordingRuntime reports every request it receives.
+type recordingRuntime struct {
+	mockRuntime
+	requests chan api.Request
+}
+
+func (r *recordingRuntime) Run(ctx context.Context, req api.Request) (*api.Response, error) {
+	r.requests <- req
+	return &api.Response{Result: &api.Result{Output: "ok"}}, nil
+}
+
+func (r *recordingRuntime) RunStream(ctx context.Context, req api.Request) (<-chan api.StreamEvent, error) {
+	resp, _ := r.Run(ctx, req)
+	events := make(chan api.StreamEvent, 1)
+	events <- api.StreamEvent{Type: api.EventFinalResponse, Output: resp}
+	close(events)
+	return events, nil
+}
+
+func TestMergeInbound_CombinesContentAndMedia(t *testing.T) {
+	firstTyping := make(chan struct{})
+	lastTyping := make(chan struct{})
+	last := bus.NewTyping(func() { close(lastTyping) })
+	var mergedInto string
+	merged := mergeInbound([]bus.InboundMessage{
+		{
+			Channel: "telegram", ChatID: "1", MessageID: "10", Content: "look at this",
+			Typing: bus.NewTyping(func() { close(firstTyping) }),
+			Merged: func(into string) { mergedInto = into },
+		},
+		{
+			Channel: "telegram", ChatID: "1", MessageID: "11",
+			Attachments: []bus.Attachment{{Path: "/tmp/a.jpg", Kind: bus.AttachmentImage}},
+		},
+		{
+			Channel: "telegram", ChatID: "1", MessageID: "12", Content: "what is it?",
+			Typing: last,
+		},
+	})
+
+	if merged.Content != "look at this\nwhat is it?" {
+		t.Fatalf("content = %q", merged.Content)
+	}
+	if len(merged.Attachments) != 1 || merged.Attachments[0].Path != "/tmp/a.jpg" ||
+		merged.Attachments[0].Kind != bus.AttachmentImage {
+		t.Fatalf("attachments = %+v", merged.Attachments)
+	}
+	if merged.MessageID != "12" {
+		t.Fatalf("reply to %q, want last message 12", merged.MessageID)
+	}
+	if mergedInto != "12" {
+		t.Fatalf("merged-away message told it went into %q, want 12", mergedInto)
+	}
+	select {
+	case <-firstTyping:
+	default:
+		t.Fatal("typing indicator of merged-away message should be stopped")
+	}
+	if merged.Typing != last {
+		t.Fatal("last message should keep its typing indicator")
+	}
+	select {
+	case <-lastTyping:
+		t.Fatal("typing indicator of the merged turn should keep running")
+	default:
+	}
+}
+
+func TestGateway_ProcessLoop_DebouncesRapidMessages(t *testing.T) {
+	msgBus := bus.NewMessageBus(10)
+	channels, err := channel.NewChannelManager(config.ChannelsConfig{
+		Webchat: config.WebchatConfig{Enabled: true, Token: "t", DebounceMs: 100},
+	}, msgBus, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewChannelManager: %v", err)
+	}
+	rt := &recordingRuntime{requests: make(chan api.Request, 4)}
+	g := &Gateway{
+		bus:      msgBus,
+		channels: channels,
+		runtime:  rt,
+		logger:   newTestLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.processLoop(ctx)
+
+	for _, text := range []string{"one", "two", "three"} {
+		msgBus.Inbound <- bus.InboundMessage{Channel: "webchat", ChatID: "c1", SenderID: "u1", Content: text}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Another sender in the same chat, and a different chat, are debounced
+	// independently.
+	msgBus.Inbound <- bus.InboundMessage{Channel: "webchat", ChatID: "c1", SenderID: "u2", Content: "mine"}
+	msgBus.Inbound <- bus.InboundMessage{Channel: "webchat", ChatID: "c2", SenderID: "u1", Content: "other"}
+
+	var prompts []string
+	for i := 0; i < 3; i++ {
+		select {
+		case req := <-rt.requests:
+			prompts = append(prompts, req.SessionID+" "+req.Prompt)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting request %d", i)
+		}
+	}
+	sort.Strings(prompts)
+	want := []string{"webchat:c1 mine", "webchat:c1 one\ntwo\nthree", "webchat:c2 other"}
+	if strings.Join(prompts, "|") != strings.Join(want, "|") {
+		t.Fatalf("turns = %q, want %q", prompts, want)
+	}
+	select {
+	case req := <-rt.requests:
+		t.Fatalf("unexpected extra turn: %+v", req)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
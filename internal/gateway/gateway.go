@@ -2,12 +2,12 @@ package gateway
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -18,6 +18,8 @@ import (
 	"github.com/riverfjs/aevitas/internal/config"
 	"github.com/riverfjs/aevitas/internal/cron"
 	"github.com/riverfjs/aevitas/internal/heartbeat"
+	"github.com/riverfjs/aevitas/internal/identity"
+	"github.com/riverfjs/aevitas/internal/journal"
 	"github.com/riverfjs/aevitas/internal/logger"
 	"github.com/riverfjs/aevitas/internal/rpc"
 	"github.com/riverfjs/aevitas/internal/runtimeopts"
@@ -25,6 +27,7 @@ import (
 	"github.com/riverfjs/agentsdk-go/pkg/api"
 	"github.com/riverfjs/agentsdk-go/pkg/core/events"
 	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+	"github.com/riverfjs/agentsdk-go/pkg/message"
 )
 
 // Runtime interface for agent runtime (allows mocking in tests)
@@ -34,6 +37,7 @@ type Runtime interface {
 	ClearSession(sessionID string) error
 	GetSessionStats(sessionID string) *api.SessionTokenStats
 	GetTotalStats() *api.SessionTokenStats
+	GetHistory(sessionID string) ([]message.Message, error)
 	Close()
 }
 
@@ -62,6 +66,10 @@ func (r *runtimeAdapter) GetTotalStats() *api.SessionTokenStats {
 	return r.rt.GetTotalStats()
 }
 
+func (r *runtimeAdapter) GetHistory(sessionID string) ([]message.Message, error) {
+	return r.rt.GetHistory(sessionID)
+}
+
 func (r *runtimeAdapter) Close() {
 	r.rt.Close()
 }
@@ -105,18 +113,23 @@ type Gateway struct {
 	signalChan     chan os.Signal // for testing
 	logger         sdklogger.Logger
 
-	// Current execution context (for realtime callbacks)
-	currentChannelID string
-	currentChatID    string
-	currentReplyTo   string
-	usageMu          sync.Mutex
-	usageNotified    map[string]uint8
+	// Active turns, used to route realtime callbacks back to the originating chat.
+	turns         turnRegistry
+	schedOnce     sync.Once
+	sched         *sessionScheduler
+	debounce      inboundDebouncer
+	journal       *journal.Journal
+	deadLetters   *journal.DeadLetters
+	identities    *identity.Registry
+	usageMu       sync.Mutex
+	usageNotified map[string]uint8
 
 	// Optional test hooks for channel state/event observation.
 	waitReadyFn    func(context.Context, string) bool
 	channelStatesFn func() map[string]channel.ChannelState
 	sendNowFn      func(bus.OutboundMessage) error
 	restartFn      func() error
+	previewStreamFn func(string) bool
 }
 
 // New creates a Gateway with default options
@@ -145,90 +158,46 @@ func NewWithOptions(cfg *config.Config, opts Options) (*Gateway, error) {
 	// Build system prompt
 	sysPrompt := g.buildSystemPrompt()
 
-	// Build real-time event callback.
-	// Progress updates require toolLog.enabled; context window warnings always fire.
-	realtimeCallback := func(event api.RealtimeEvent) {
-		g.logger.Infof("[gateway] Realtime event: type=%s, count=%d, tool=%s", event.Type, event.Count, event.LastTool)
-		if g.currentChannelID == "" || g.currentChatID == "" {
-			return
-		}
-
-		var msg string
-		switch event.Type {
-		case api.RealtimeEventContextWindowWarn:
-			// Always forward context window warnings — the user must know.
-			msg = event.Message
-
-		case api.RealtimeEventProgressUpdate:
-			// Only forward progress updates when toolLog is enabled.
-			if !cfg.Agent.ToolLog.Enabled {
-				return
-			}
-			msg = fmt.Sprintf("⏳ %s", event.LastTool)
-			if len(event.RecentCalls) > 0 {
-				params := event.RecentCalls[0].Params
-				if params != "" && params != "{}" {
-					if rendered := formatProgressParams(params); rendered != "" {
-						msg += "\n" + rendered
-					}
-				}
-			}
-
-		case api.RealtimeEventModelSwitch:
-			msg = strings.TrimSpace(event.Message)
-			if msg == "" {
-				msg = "Model switched to fallback."
-			}
-			msg = "⚠️ " + msg
-
-		default:
-			return
-		}
-
-		if msg == "" {
-			return
-		}
-		meta := map[string]any{}
-		replyTo := g.currentReplyTo
-		if event.Type == api.RealtimeEventProgressUpdate {
-			meta[telegramEventKey] = telegramEventToolProgress
-			meta["tool_name"] = event.LastTool
-			if len(event.RecentCalls) > 0 {
-				meta["tool_params"] = event.RecentCalls[0].Params
-			}
-			meta["tool_time"] = time.Now().Format(time.RFC3339)
-			// Tool progress should stay as independent tool blocks.
-			replyTo = ""
-		}
-		if event.Type == api.RealtimeEventModelSwitch {
-			// Model switch notice should be a standalone alert.
-			replyTo = ""
-		}
-		g.bus.Outbound <- bus.OutboundMessage{
-			Channel:  g.currentChannelID,
-			ChatID:   g.currentChatID,
-			ReplyTo:  replyTo,
-			Content:  msg,
-			Metadata: meta,
-		}
-		g.logger.Debugf("[gateway] Sent %s event to %s/%s", event.Type, g.currentChannelID, g.currentChatID)
-	}
-
 	// Create runtime using factory (allows injection for testing)
 	factory := opts.RuntimeFactory
 	if factory == nil {
 		factory = DefaultRuntimeFactory
 	}
 	g.runtimeFactory = factory // Save factory for restart
-	rt, err := factory(cfg, sysPrompt, realtimeCallback)
+	rt, err := factory(cfg, sysPrompt, g.handleRealtimeEvent)
 	if err != nil {
 		return nil, err
 	}
-	g.runtime = rt
+	// Roles with their own .claude/settings.<role>.json get their own runtime.
+	g.runtime, err = newRoleRouter(cfg, rt, func(roleCfg *config.Config) (Runtime, error) {
+		return factory(roleCfg, sysPrompt, g.handleRealtimeEvent)
+	})
+	if err != nil {
+		rt.Close()
+		return nil, err
+	}
 
 	// Signal channel for testing
 	g.signalChan = opts.SignalChan
 
+	// Message journal: replay unfinished turns and undelivered replies,
+	// and keep messages that still fail after retries as dead letters.
+	if cfg.Gateway.Journal.Enabled {
+		journalDir := filepath.Join(config.ConfigDir(), "data", "journal")
+		if j, err := journal.Open(filepath.Join(journalDir, "messages.jsonl")); err != nil {
+			g.logger.Warnf("[gateway] message journal disabled: %v", err)
+		} else {
+			g.journal = j
+			g.bus.SetJournal(j)
+		}
+		if d, err := journal.OpenDeadLetters(filepath.Join(journalDir, "deadletters.json")); err != nil {
+			g.logger.Warnf("[gateway] dead-letter store disabled: %v", err)
+		} else {
+			g.deadLetters = d
+			g.bus.SetDeadLetterSink(d)
+		}
+	}
+
 	// Cron
 	cronStorePath := filepath.Join(config.ConfigDir(), "data", "cron", "jobs.json")
 	g.cron = cron.NewService(cronStorePath, g.logger)
@@ -269,11 +238,11 @@ func NewWithOptions(cfg *config.Config, opts Options) (*Gateway, error) {
 
 		// Deliver result via Delivery config (new style)
 		if d := job.Delivery; d != nil && d.Mode == "announce" && d.Channel != "" {
-			g.bus.Outbound <- bus.OutboundMessage{
+			g.bus.PublishOutbound(bus.OutboundMessage{
 				Channel: d.Channel,
 				ChatID:  d.To,
 				Content: result,
-			}
+			})
 		}
 		return result, nil
 	}
@@ -285,6 +254,22 @@ func NewWithOptions(cfg *config.Config, opts Options) (*Gateway, error) {
 
 	// Command handler
 	g.cmdHandler = channel.NewCommandHandler(g.runtime, cfg.Agent.Workspace, cfg.Agent.ContextWindow.Tokens)
+	g.cmdHandler.SetQueueReporter(g.scheduler())
+	g.cmdHandler.SetTurnStopper(g)
+	g.cmdHandler.SetDeadLetterAdmin(g)
+
+	// Identities: accounts linked across channels in config or with /link.
+	// Roles must apply even when the saved links cannot be read.
+	reg, err := identity.Open(cfg.Identities, filepath.Join(config.ConfigDir(), "data", "identities.json"))
+	if err != nil {
+		g.logger.Warnf("[gateway] links made with /link are disabled: %v", err)
+		if reg, err = identity.Open(cfg.Identities, ""); err != nil {
+			g.runtime.Close()
+			return nil, fmt.Errorf("identities: %w", err)
+		}
+	}
+	g.identities = reg
+	g.cmdHandler.SetIdentityLinker(reg)
 
 	// Channels
 	chMgr, err := channel.NewChannelManager(cfg.Channels, g.bus, g.logger)
@@ -292,10 +277,78 @@ func NewWithOptions(cfg *config.Config, opts Options) (*Gateway, error) {
 		return nil, fmt.Errorf("create channel manager: %w", err)
 	}
 	g.channels = chMgr
+	g.channels.SetHistorySource(g)
 
 	return g, nil
 }
 
+// handleRealtimeEvent forwards runtime realtime events to the chat of the turn
+// that produced them. Context window warnings always fire. Tool progress is
+// read from each turn's own event stream instead (see emitToolProgress): the
+// SDK sends progress updates without a session, so they cannot be routed.
+func (g *Gateway) handleRealtimeEvent(event api.RealtimeEvent) {
+	g.logger.Infof("[gateway] Realtime event: type=%s, session=%s, count=%d, tool=%s", event.Type, event.SessionID, event.Count, event.LastTool)
+	turn := g.turns.lookup(event.SessionID)
+	if turn == nil {
+		g.logger.Debugf("[gateway] no active turn for %s event (session=%q), dropping", event.Type, event.SessionID)
+		return
+	}
+
+	var msg string
+	switch event.Type {
+	case api.RealtimeEventContextWindowWarn:
+		// Always forward context window warnings — the user must know.
+		msg = event.Message
+
+	case api.RealtimeEventModelSwitch:
+		msg = strings.TrimSpace(event.Message)
+		if msg == "" {
+			msg = "Model switched to fallback."
+		}
+		msg = "⚠️ " + msg
+
+	default:
+		return
+	}
+
+	if msg == "" {
+		return
+	}
+	out := bus.OutboundMessage{
+		Channel: turn.Channel,
+		ChatID:  turn.ChatID,
+		ReplyTo: turn.ReplyTo,
+		Content: msg,
+	}
+	if event.Type == api.RealtimeEventModelSwitch {
+		// Model switch notice should be a standalone alert.
+		out.ReplyTo = ""
+	}
+	g.bus.PublishOutbound(out)
+	g.logger.Debugf("[gateway] Sent %s event to %s/%s", event.Type, turn.Channel, turn.ChatID)
+}
+
+// toolLogEnabled reports whether tool calls are reported to the chat.
+func (g *Gateway) toolLogEnabled() bool {
+	return g.cfg != nil && g.cfg.Agent.ToolLog.Enabled
+}
+
+// emitToolProgress reports a tool call of turn to its chat.
+func (g *Gateway) emitToolProgress(turn *turnContext, tool *bus.ToolProgress) {
+	msg := fmt.Sprintf("⏳ %s", tool.Name)
+	if rendered := formatProgressParams(tool.Params); rendered != "" {
+		msg += "\n" + rendered
+	}
+	// Tool progress should stay as independent tool blocks.
+	g.bus.PublishOutbound(bus.OutboundMessage{
+		Channel: turn.Channel,
+		ChatID:  turn.ChatID,
+		Kind:    bus.KindToolProgress,
+		Content: msg,
+		Tool:    tool,
+	})
+}
+
 // resetSession clears the session history for the given sessionID.
 func (g *Gateway) resetSession(sessionID string) error {
 	if err := g.runtime.ClearSession(sessionID); err != nil {
@@ -352,6 +405,7 @@ func (g *Gateway) start(ctx context.Context) error {
 	rpcSrv := rpc.NewServer(g.logger)
 	rpc.RegisterCronHandlers(rpcSrv, g.cron)
 	rpc.RegisterNotifyHandlers(rpcSrv, g.bus)
+	rpc.RegisterDeadLetterHandlers(rpcSrv, g)
 	if err := rpcSrv.Start(ctx, rpcAddr); err != nil {
 		return fmt.Errorf("rpc server: %w", err)
 	}
@@ -370,6 +424,8 @@ func (g *Gateway) start(ctx context.Context) error {
 	g.channels.StartAll(ctx)
 	g.logger.Infof("[gateway] channels configured: %v", g.channels.EnabledChannels())
 
+	g.replayJournal(ctx)
+
 	g.logger.Infof("[gateway] running on ws://%s", rpcAddr)
 
 	// Send startup notification
@@ -405,6 +461,7 @@ func (g *Gateway) processLoop(ctx context.Context) {
 		select {
 		case msg := <-g.bus.Inbound:
 			g.logger.Infof("[gateway] inbound from %s/%s: %s", msg.Channel, msg.SenderID, truncate(msg.Content, 80))
+			msg = g.resolveIdentity(msg)
 
 			// Check if this is a special command
 			var cmdResult channel.CommandResult
@@ -413,32 +470,31 @@ func (g *Gateway) processLoop(ctx context.Context) {
 			}
 			if cmdResult.Handled {
 				g.logger.Infof("[gateway] command handled: %s", truncate(msg.Content, 40))
+				// Commands are never replayed, in particular /restart.
+				g.journal.MarkInbound(msg, journal.StateDone)
 
 				// Stop typing indicator for commands
-				if stopTyping, ok := msg.Metadata["stop_typing"].(chan struct{}); ok {
-					close(stopTyping)
-				}
+				msg.Typing.Stop()
 
-				meta := map[string]any{}
-				if msg.Channel == "telegram" && strings.TrimSpace(cmdResult.Event) != "" {
-					meta[telegramEventKey] = strings.TrimSpace(cmdResult.Event)
-				}
+				// The reply targets the command, which is how Discord answers
+				// a slash command and a sync webhook call finds its reply.
 				outMsg := bus.OutboundMessage{
-					Channel:  msg.Channel,
-					ChatID:   msg.ChatID,
-					Content:  cmdResult.Response,
-					Media:    cmdResult.Files,
-					Metadata: meta,
+					Channel:     msg.Channel,
+					ChatID:      msg.ChatID,
+					Content:     cmdResult.Response,
+					ReplyTo:     msg.MessageID,
+					Attachments: bus.PathAttachments(cmdResult.Files...),
+					Buttons:     cmdResult.Buttons,
+				}
+				if msg.Channel == "telegram" {
+					outMsg.Kind = cmdResult.Kind
 				}
 
 				if cmdResult.Restart {
 					// Keep Telegram restart pre-notice as standalone text.
 					// Feishu keeps default rendering (interactive card).
 					if strings.EqualFold(strings.TrimSpace(msg.Channel), "telegram") {
-						if outMsg.Metadata == nil {
-							outMsg.Metadata = map[string]any{}
-						}
-						outMsg.Metadata[telegramEventKey] = telegramEventUsageHUD
+						outMsg.Kind = bus.KindUsageHUD
 					}
 
 					sendNow := g.sendNowFn
@@ -469,35 +525,101 @@ func (g *Gateway) processLoop(ctx context.Context) {
 					continue
 				}
 
-				if outMsg.Content != "" || len(outMsg.Media) > 0 {
-					g.bus.Outbound <- outMsg
+				if outMsg.Content != "" || len(outMsg.Attachments) > 0 {
+					g.bus.PublishOutbound(outMsg)
 				}
 				continue
 			}
 
-			// 异步处理 agent
-			go g.processAgent(ctx, msg)
+			// 合并短时间内的连续消息，再按会话排队异步处理 agent
+			g.debounce.add(msg, g.debounceWindow(msg.Channel), func(merged bus.InboundMessage) {
+				g.enqueueAgent(ctx, merged)
+			})
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// resolveIdentity tags msg with its sender's role and the user the sender's
+// account is linked to. With shared sessions on, a direct chat of a linked
+// user joins the user's session instead of the chat's own. Senders of a role
+// with its own runtime get a session of their own in every chat.
+func (g *Gateway) resolveIdentity(msg bus.InboundMessage) bus.InboundMessage {
+	account := identity.Account(msg.Channel, msg.SenderID)
+	user := g.identities.User(account)
+	role := g.identities.Role(account)
+	if msg.Channel == "webchat" {
+		// Web chat is the operator's console, guarded by the gateway token.
+		role = identity.RoleOwner
+	}
+	msg.User = user
+	msg.Role = role
+	if user != "" && g.cfg != nil && g.cfg.Identities.SharedSession && msg.Direct {
+		msg.Session = "user:" + user
+	}
+	if key := g.roleSessionKey(msg.SessionKey(), role); key != msg.SessionKey() {
+		msg.Session = key
+	}
+	return msg
+}
+
+// scheduler returns the turn scheduler, creating it from config on first use.
+func (g *Gateway) scheduler() *sessionScheduler {
+	g.schedOnce.Do(func() {
+		maxConcurrent := config.DefaultMaxConcurrentTurns
+		maxPerSession := config.DefaultMaxQueuedPerSession
+		if g.cfg != nil {
+			q := g.cfg.Gateway.Queue
+			if q.MaxConcurrent > 0 {
+				maxConcurrent = q.MaxConcurrent
+			}
+			if q.MaxPerSession != nil {
+				maxPerSession = *q.MaxPerSession
+			}
+		}
+		g.sched = newSessionScheduler(maxConcurrent, maxPerSession)
+	})
+	return g.sched
+}
+
+// enqueueAgent schedules msg behind earlier turns of the same session.
+// When the session queue is full the sender gets a busy reply instead.
+func (g *Gateway) enqueueAgent(ctx context.Context, msg bus.InboundMessage) {
+	err := g.scheduler().submit(ctx, msg.SessionKey(), func(ctx context.Context) {
+		g.processAgent(ctx, msg)
+	}, func() {
+		g.dropInbound(msg)
+	})
+	if err == nil {
+		return
+	}
+	g.logger.Warnf("[gateway] %s rejected: %v", msg.SessionKey(), err)
+	g.dropInbound(msg)
+	g.bus.PublishOutbound(bus.OutboundMessage{
+		Channel: msg.Channel,
+		ChatID:  msg.ChatID,
+		ReplyTo: msg.MessageID,
+		Content: "⏳ 前面的消息还在处理中，排队已满，请稍后再发。",
+	})
+}
+
 func (g *Gateway) processAgent(ctx context.Context, msg bus.InboundMessage) {
-	// Set current execution context for realtime callbacks
-	g.currentChannelID = msg.Channel
-	g.currentChatID = msg.ChatID
-	g.currentReplyTo = inboundReplyTo(msg)
+	// Register the turn so realtime callbacks reach this chat and /stop can cancel it.
+	parent := ctx
+	ctx, turn := g.turns.begin(ctx, msg)
+	defer g.turns.end(turn)
+
+	g.journal.MarkInbound(msg, journal.StateProcessing)
 	defer func() {
-		g.currentChannelID = ""
-		g.currentChatID = ""
-		g.currentReplyTo = ""
+		// A turn cut short by shutdown stays unfinished and is replayed on start.
+		if parent.Err() == nil || turn.Stopped() {
+			g.journal.MarkInbound(msg, journal.StateDone)
+		}
 	}()
 
 	// Stop typing indicator when processing completes (deferred)
-	if stopTyping, ok := msg.Metadata["stop_typing"].(chan struct{}); ok {
-		defer close(stopTyping)
-	}
+	defer msg.Typing.Stop()
 
 	attachments := buildAttachments(msg)
 	if len(attachments) > 0 {
@@ -514,20 +636,34 @@ func (g *Gateway) processAgent(ctx context.Context, msg bus.InboundMessage) {
 		g.logger.Infof("[gateway] processing attachments: total=%d image=%d audio=%d", len(attachments), imageCount, audioCount)
 	}
 
+	// Chat instructions extend the system prompt of this turn only.
+	ctx = runtimeopts.WithInstructions(ctx, msg.Instructions)
 	req := api.Request{
 		Prompt:      msg.Content,
-		SessionID:   msg.SessionKey(),
+		SessionID:   turn.SessionID,
+		RequestID:   turn.ID,
 		Attachments: attachments,
+		Metadata:    turnMetadata(msg),
 	}
 
-	// Channels with preview support: prefer stream path with message preview editing.
-	if supportsPreviewStream(msg.Channel) {
-		if handled := g.processAgentStream(ctx, msg, req); handled {
+	// Channels with preview support: prefer stream path with message preview
+	// editing. Tool progress also needs the stream, as only the turn's own
+	// events tell which turn ran a tool.
+	if preview := g.supportsPreviewStream(msg.Channel); preview || g.toolLogEnabled() {
+		if handled := g.processAgentStream(ctx, msg, req, turn, preview); handled {
 			return
 		}
 	}
 
-	resp, err := g.runtime.Run(ctx, req)
+	resp, err := g.runtimeFor(msg.Role).Run(ctx, req)
+	if err != nil && turn.Stopped() {
+		g.emitCancelled(msg, "", false)
+		return
+	}
+	if err != nil && parent.Err() != nil {
+		// Shutting down: the journal replays this turn on the next start.
+		return
+	}
 	if err != nil {
 		g.emitAgentError(msg, err)
 		return
@@ -536,18 +672,16 @@ func (g *Gateway) processAgent(ctx context.Context, msg bus.InboundMessage) {
 }
 
 const (
-	telegramEventKey           = "telegram_event"
-	telegramEventPreviewUpdate = "preview_update"
-	telegramEventPreviewFinal  = "preview_final"
-	telegramEventToolProgress  = "tool_progress"
-	telegramEventUsageHUD      = "usage_hud"
-	usageMark30                = 1 << 0
-	usageMark50                = 1 << 1
-	usageMark80                = 1 << 2
+	usageMark30 = 1 << 0
+	usageMark50 = 1 << 1
+	usageMark80 = 1 << 2
 )
 
-func (g *Gateway) processAgentStream(ctx context.Context, msg bus.InboundMessage, req api.Request) bool {
-	stream, err := g.runtime.RunStream(ctx, req)
+// processAgentStream runs a turn on the streaming API, reporting its tool
+// calls when toolLog is enabled. Without preview the reply is only sent once
+// complete.
+func (g *Gateway) processAgentStream(ctx context.Context, msg bus.InboundMessage, req api.Request, turn *turnContext, preview bool) bool {
+	stream, err := g.runtimeFor(msg.Role).RunStream(ctx, req)
 	if err != nil {
 		g.logger.Warnf("[gateway] stream unavailable, fallback to non-stream: %v", err)
 		return false
@@ -559,37 +693,51 @@ func (g *Gateway) processAgentStream(ctx context.Context, msg bus.InboundMessage
 		streamErr      error
 		finalResp      *api.Response
 		previewSent    bool
+		tools          *turnTools
 	)
+	if g.toolLogEnabled() {
+		tools = newTurnTools(g.cfg.Agent.ToolLog.Interval)
+	}
 	ticker := time.NewTicker(700 * time.Millisecond)
 	defer ticker.Stop()
 
-	sendPreview := func(mode string, content string) {
+	sendPreview := func(kind bus.MessageKind, content string) {
 		if content == "" {
 			return
 		}
-		meta := map[string]any{telegramEventKey: mode}
-		g.bus.Outbound <- bus.OutboundMessage{
-			Channel:  msg.Channel,
-			ChatID:   msg.ChatID,
-			ReplyTo:  inboundReplyTo(msg),
-			Content:  content,
-			Metadata: meta,
-		}
+		g.bus.PublishOutbound(bus.OutboundMessage{
+			Channel: msg.Channel,
+			ChatID:  msg.ChatID,
+			Kind:    kind,
+			ReplyTo: msg.MessageID,
+			Content: content,
+		})
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
+			if turn.Stopped() {
+				// Let the runtime unwind and persist the session before the
+				// next queued turn starts.
+				for range stream {
+				}
+				g.emitCancelled(msg, sb.String(), previewSent)
+			}
 			return true
 		case <-ticker.C:
 			cur := sb.String()
-			if cur != "" && len(cur) != lastPreviewLen {
-				sendPreview(telegramEventPreviewUpdate, cur)
+			if preview && cur != "" && len(cur) != lastPreviewLen {
+				sendPreview(bus.KindPreviewUpdate, cur)
 				lastPreviewLen = len(cur)
 				previewSent = true
 			}
 		case evt, ok := <-stream:
 			if !ok {
+				if turn.Stopped() && finalResp == nil {
+					g.emitCancelled(msg, sb.String(), previewSent)
+					return true
+				}
 				if streamErr != nil {
 					g.emitAgentError(msg, streamErr)
 					return true
@@ -601,11 +749,20 @@ func (g *Gateway) processAgentStream(ctx context.Context, msg bus.InboundMessage
 				// No final response, fallback to accumulated text if present.
 				raw := strings.TrimSpace(sb.String())
 				if raw != "" {
-					sendPreview(telegramEventPreviewFinal, raw)
+					kind := bus.KindPreviewFinal
+					if !preview {
+						kind = bus.KindPlain
+					}
+					sendPreview(kind, raw)
 				}
 				return true
 			}
 
+			if tools != nil {
+				if tool := tools.observe(evt); tool != nil {
+					g.emitToolProgress(turn, tool)
+				}
+			}
 			switch evt.Type {
 			case api.EventError:
 				if s, ok := evt.Output.(string); ok && s != "" {
@@ -630,6 +787,49 @@ func (g *Gateway) processAgentStream(ctx context.Context, msg bus.InboundMessage
 	}
 }
 
+// StopTurn cancels the running agent turn of sessionKey and drops the
+// messages still waiting for a turn there, debounced or queued. It reports
+// whether a turn was running and how many messages were dropped.
+func (g *Gateway) StopTurn(sessionKey string) (bool, int) {
+	// Waiting messages go first so none starts once the turn is cancelled.
+	pending := g.debounce.clear(sessionKey)
+	for _, msg := range pending {
+		g.dropInbound(msg)
+	}
+	dropped := len(pending) + g.scheduler().clear(sessionKey)
+	if dropped > 0 {
+		g.logger.Infof("[gateway] %d waiting message(s) dropped by user: %s", dropped, sessionKey)
+	}
+	if !g.turns.stop(sessionKey) {
+		return false, dropped
+	}
+	g.logger.Infof("[gateway] turn stopped by user: %s", sessionKey)
+	return true, dropped
+}
+
+// dropInbound settles a message that will never get a turn.
+func (g *Gateway) dropInbound(msg bus.InboundMessage) {
+	g.journal.MarkInbound(msg, journal.StateDropped)
+	msg.Typing.Stop()
+}
+
+// emitCancelled finalizes a turn stopped via /stop. Partial output streamed so
+// far is kept and marked as cancelled; the runtime has already persisted the
+// completed part of the turn to the session.
+func (g *Gateway) emitCancelled(msg bus.InboundMessage, partial string, previewSent bool) {
+	content := "⏹️ 已取消"
+	if raw := strings.TrimSpace(partial); raw != "" {
+		content = raw + "\n\n" + content
+	}
+	g.bus.PublishOutbound(bus.OutboundMessage{
+		Channel: msg.Channel,
+		ChatID:  msg.ChatID,
+		Kind:    finalKind(previewSent),
+		ReplyTo: msg.MessageID,
+		Content: content,
+	})
+}
+
 func (g *Gateway) emitAgentError(msg bus.InboundMessage, err error) {
 	g.logger.Errorf("[gateway] agent error: %v", err)
 	var errorMsg string
@@ -640,12 +840,12 @@ func (g *Gateway) emitAgentError(msg bus.InboundMessage, err error) {
 	} else {
 		errorMsg = "抱歉，处理您的消息时遇到了错误。"
 	}
-	g.bus.Outbound <- bus.OutboundMessage{
+	g.bus.PublishOutbound(bus.OutboundMessage{
 		Channel: msg.Channel,
 		ChatID:  msg.ChatID,
-		ReplyTo: inboundReplyTo(msg),
+		ReplyTo: msg.MessageID,
 		Content: errorMsg,
-	}
+	})
 }
 
 func (g *Gateway) deliverAgentResponse(msg bus.InboundMessage, resp *api.Response, previewSent bool) {
@@ -672,26 +872,23 @@ func (g *Gateway) deliverAgentResponse(msg bus.InboundMessage, resp *api.Respons
 	hookResult := g.processHookEvents(resp)
 	for _, filePath := range hookResult.sendFiles {
 		g.logger.Infof("[gateway] SendFile detected: %s", filePath)
-		g.bus.Outbound <- bus.OutboundMessage{
-			Channel: msg.Channel,
-			ChatID:  msg.ChatID,
-			Media:   []string{filePath},
-		}
+		g.bus.PublishOutbound(bus.OutboundMessage{
+			Channel:     msg.Channel,
+			ChatID:      msg.ChatID,
+			Attachments: bus.PathAttachments(filePath),
+		})
 	}
 
 	if hookResult.askQuestion != "" {
 		g.logger.Infof("[gateway] AskUserQuestion: %s", truncate(hookResult.askQuestion, 60))
-		meta := map[string]any{}
-		if previewSent && supportsPreviewStream(msg.Channel) {
-			meta[telegramEventKey] = telegramEventPreviewFinal
-		}
-		g.bus.Outbound <- bus.OutboundMessage{
-			Channel:  msg.Channel,
-			ChatID:   msg.ChatID,
-			ReplyTo:  inboundReplyTo(msg),
-			Content:  hookResult.askQuestion,
-			Metadata: meta,
-		}
+		g.bus.PublishOutbound(bus.OutboundMessage{
+			Channel: msg.Channel,
+			ChatID:  msg.ChatID,
+			Kind:    finalKind(previewSent),
+			ReplyTo: msg.MessageID,
+			Content: hookResult.askQuestion,
+			Buttons: hookResult.askButtons,
+		})
 		return
 	}
 
@@ -708,33 +905,29 @@ func (g *Gateway) deliverAgentResponse(msg bus.InboundMessage, resp *api.Respons
 
 	if result != "" {
 		g.logger.Infof("[gateway] outbound to %s/%s: %s", msg.Channel, msg.ChatID, truncate(result, 80))
-		meta := map[string]any{}
-		if previewSent && supportsPreviewStream(msg.Channel) {
-			meta[telegramEventKey] = telegramEventPreviewFinal
-		}
-		g.bus.Outbound <- bus.OutboundMessage{
-			Channel:  msg.Channel,
-			ChatID:   msg.ChatID,
-			ReplyTo:  inboundReplyTo(msg),
-			Content:  result,
-			Metadata: meta,
-		}
+		g.bus.PublishOutbound(bus.OutboundMessage{
+			Channel: msg.Channel,
+			ChatID:  msg.ChatID,
+			Kind:    finalKind(previewSent),
+			ReplyTo: msg.MessageID,
+			Content: result,
+		})
 	} else if len(hookResult.sendFiles) == 0 {
 		g.logger.Warnf("[gateway] no response generated for %s/%s", msg.Channel, msg.SenderID)
 	}
 
 	if hookResult.memoryNotice != "" {
-		g.bus.Outbound <- bus.OutboundMessage{
+		g.bus.PublishOutbound(bus.OutboundMessage{
 			Channel: msg.Channel,
 			ChatID:  msg.ChatID,
-			ReplyTo: inboundReplyTo(msg),
+			ReplyTo: msg.MessageID,
 			Content: hookResult.memoryNotice,
-		}
+		})
 	}
 }
 
 func (g *Gateway) emitTelegramUsageHUD(msg bus.InboundMessage, resp *api.Response) {
-	if !supportsPreviewStream(msg.Channel) || g.runtime == nil {
+	if !g.supportsPreviewStream(msg.Channel) || g.runtime == nil {
 		return
 	}
 	contextWindowTokens := 0
@@ -763,28 +956,38 @@ func (g *Gateway) emitTelegramUsageHUD(msg bus.InboundMessage, resp *api.Respons
 	g.usageNotified[sessionID] = prev | reached
 	g.usageMu.Unlock()
 
-	stats := g.runtime.GetSessionStats(msg.SessionKey())
+	stats := g.runtimeFor(msg.Role).GetSessionStats(msg.SessionKey())
 	if stats == nil {
 		return
 	}
 	content := formatUsageHUD(stats, resp, contextWindowTokens)
-	g.bus.Outbound <- bus.OutboundMessage{
+	g.bus.PublishOutbound(bus.OutboundMessage{
 		Channel: msg.Channel,
 		ChatID:  msg.ChatID,
+		Kind:    bus.KindUsageHUD,
 		Content: content,
-		Metadata: map[string]any{
-			telegramEventKey: telegramEventUsageHUD,
-		},
+	})
+}
+
+// finalKind is the kind of a turn's final reply: it replaces the streamed
+// preview when one was shown.
+func finalKind(previewSent bool) bus.MessageKind {
+	if previewSent {
+		return bus.KindPreviewFinal
 	}
+	return bus.KindPlain
 }
 
-func supportsPreviewStream(channel string) bool {
-	switch strings.ToLower(strings.TrimSpace(channel)) {
-	case "telegram", "feishu":
-		return true
-	default:
+// supportsPreviewStream reports whether channel renders streamed replies, as
+// declared by the channel itself.
+func (g *Gateway) supportsPreviewStream(channel string) bool {
+	if g.previewStreamFn != nil {
+		return g.previewStreamFn(channel)
+	}
+	if g.channels == nil {
 		return false
 	}
+	return g.channels.SupportsPreviewStream(channel)
 }
 
 func formatUsageHUD(stats *api.SessionTokenStats, resp *api.Response, contextWindowTokens int) string {
@@ -816,6 +1019,7 @@ func usageThresholdMask(percent float64) uint8 {
 type hookEventResult struct {
 	sendFiles    []string
 	askQuestion  string
+	askButtons   [][]bus.Button
 	memoryNotice string
 }
 
@@ -848,6 +1052,7 @@ func (g *Gateway) processHookEvents(resp *api.Response) hookEventResult {
 			case "AskUserQuestion", "ask_user_question":
 				if output, ok := payload.Result.(string); ok && output != "" {
 					res.askQuestion = output
+					res.askButtons = askUserQuestionButtons(payload.Params)
 				}
 
 			case "memory_write":
@@ -908,12 +1113,43 @@ func (g *Gateway) processHookEvents(resp *api.Response) hookEventResult {
 	return res
 }
 
+// askUserQuestionButtons turns the options of a single-choice question into
+// reply buttons, one per row. Several questions or multi-select answers
+// need free text, so they get none.
+func askUserQuestionButtons(params map[string]any) [][]bus.Button {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil
+	}
+	var input struct {
+		Questions []struct {
+			MultiSelect bool `json:"multiSelect"`
+			Options     []struct {
+				Label string `json:"label"`
+			} `json:"options"`
+		} `json:"questions"`
+	}
+	if json.Unmarshal(raw, &input) != nil || len(input.Questions) != 1 || input.Questions[0].MultiSelect {
+		return nil
+	}
+	var rows [][]bus.Button
+	for _, opt := range input.Questions[0].Options {
+		if label := strings.TrimSpace(opt.Label); label != "" {
+			rows = append(rows, []bus.Button{{Label: label, Data: label}})
+		}
+	}
+	return rows
+}
+
 func (g *Gateway) Shutdown() error {
 	g.cron.Stop()
 	_ = g.channels.StopAll()
 	if g.runtime != nil {
 		g.runtime.Close()
 	}
+	if err := g.journal.Close(); err != nil {
+		g.logger.Warnf("[gateway] close message journal: %v", err)
+	}
 	g.logger.Infof("[gateway] shutdown complete")
 	return nil
 }
@@ -957,6 +1193,20 @@ func (g *Gateway) sendStartupNotification(ctx context.Context) {
 	startupMsg := fmt.Sprintf("✅ **Gateway Restarted Successfully**\n\nPID: %d\nTime: %s",
 		pid, time.Now().Format("2006-01-02 15:04:05"))
 
+	g.whenChannelReady(ctx, channelName, func() {
+		g.logger.Infof("[gateway] sending restart notification to %s/%s", channelName, chatID)
+		g.bus.PublishOutbound(bus.OutboundMessage{
+			Channel: channelName,
+			ChatID:  chatID,
+			Content: startupMsg,
+		})
+		_ = os.Remove(restartTriggerFile)
+	})
+}
+
+// whenChannelReady runs fn once the named channel is running: immediately if
+// it already is, otherwise in the background after it becomes ready.
+func (g *Gateway) whenChannelReady(ctx context.Context, channelName string, fn func()) {
 	isRunning := func(name string) bool {
 		if g.channelStatesFn != nil {
 			if st, ok := g.channelStatesFn()[name]; ok {
@@ -973,18 +1223,8 @@ func (g *Gateway) sendStartupNotification(ctx context.Context) {
 		return false
 	}
 
-	send := func() {
-		g.logger.Infof("[gateway] sending restart notification to %s/%s", channelName, chatID)
-		g.bus.Outbound <- bus.OutboundMessage{
-			Channel: channelName,
-			ChatID:  chatID,
-			Content: startupMsg,
-		}
-		_ = os.Remove(restartTriggerFile)
-	}
-
 	if isRunning(channelName) {
-		send()
+		fn()
 		return
 	}
 
@@ -993,14 +1233,14 @@ func (g *Gateway) sendStartupNotification(ctx context.Context) {
 		waitReady = g.channels.WaitReady
 	}
 	if waitReady == nil {
-		g.logger.Warnf("[gateway] startup notification skipped: no channel wait-ready hook for %s/%s", channelName, chatID)
+		g.logger.Warnf("[gateway] %s not ready and no wait-ready hook, skipping", channelName)
 		return
 	}
 	go func() {
 		if !waitReady(ctx, channelName) {
 			return
 		}
-		send()
+		fn()
 	}()
 }
 
@@ -1008,8 +1248,11 @@ func (g *Gateway) sendStartupNotification(ctx context.Context) {
 // It sends to the last active session, falling back to the first configured
 // Telegram allowFrom user if no session is currently active.
 func (g *Gateway) heartbeatNotify(result string) {
-	channelID := g.currentChannelID
-	chatID := g.currentChatID
+	var channelID, chatID string
+	if turn := g.turns.last(); turn != nil {
+		channelID = turn.Channel
+		chatID = turn.ChatID
+	}
 
 	// Fallback: use first Telegram allowFrom
 	if channelID == "" || chatID == "" {
@@ -1025,11 +1268,11 @@ func (g *Gateway) heartbeatNotify(result string) {
 	}
 
 	g.logger.Infof("[heartbeat] notifying user channel=%s chatID=%s", channelID, chatID)
-	g.bus.Outbound <- bus.OutboundMessage{
+	g.bus.PublishOutbound(bus.OutboundMessage{
 		Channel: channelID,
 		ChatID:  chatID,
 		Content: result,
-	}
+	})
 }
 
 func truncate(s string, n int) string {
@@ -1039,36 +1282,6 @@ func truncate(s string, n int) string {
 	return s[:n] + "..."
 }
 
-func inboundReplyTo(msg bus.InboundMessage) string {
-	if msg.Metadata == nil {
-		return ""
-	}
-	v, ok := msg.Metadata["message_id"]
-	if !ok || v == nil {
-		return ""
-	}
-	switch id := v.(type) {
-	case int:
-		if id > 0 {
-			return strconv.Itoa(id)
-		}
-	case int64:
-		if id > 0 {
-			return strconv.FormatInt(id, 10)
-		}
-	case float64:
-		if id > 0 {
-			return strconv.Itoa(int(id))
-		}
-	case string:
-		id = strings.TrimSpace(id)
-		if id != "" {
-			return id
-		}
-	}
-	return ""
-}
-
 func formatProgressParams(raw string) string {
 	raw = strings.TrimSpace(raw)
 	if raw == "" || raw == "{}" {
@@ -1077,57 +1290,46 @@ func formatProgressParams(raw string) string {
 	return "```text\n" + raw + "\n```"
 }
 
-func buildAttachments(msg bus.InboundMessage) []api.Attachment {
-	if len(msg.Media) == 0 {
+// turnMetadata is the request metadata of a turn: the sender's role and
+// linked user, for hooks and subagents.
+func turnMetadata(msg bus.InboundMessage) map[string]any {
+	meta := make(map[string]any, 2)
+	if msg.Role != "" {
+		meta["role"] = msg.Role
+	}
+	if msg.User != "" {
+		meta["user"] = msg.User
+	}
+	if len(meta) == 0 {
 		return nil
 	}
-	typeMap := mapStringFromMeta(msg.Metadata, "media_types")
-	mimeMap := mapStringFromMeta(msg.Metadata, "media_mime_types")
+	return meta
+}
 
-	attachments := make([]api.Attachment, 0, len(msg.Media))
-	for _, mediaPath := range msg.Media {
-		if strings.TrimSpace(mediaPath) == "" {
+func buildAttachments(msg bus.InboundMessage) []api.Attachment {
+	if len(msg.Attachments) == 0 {
+		return nil
+	}
+	attachments := make([]api.Attachment, 0, len(msg.Attachments))
+	for _, att := range msg.Attachments {
+		if strings.TrimSpace(att.Path) == "" {
 			continue
 		}
-		attType := strings.ToLower(strings.TrimSpace(typeMap[mediaPath]))
-		switch attType {
-		case "image", "audio", "file":
+		attType := strings.ToLower(strings.TrimSpace(string(att.Kind)))
+		switch bus.AttachmentKind(attType) {
+		case bus.AttachmentImage, bus.AttachmentAudio, bus.AttachmentFile:
 		default:
 			continue
 		}
-		mime := strings.TrimSpace(mimeMap[mediaPath])
+		mime := strings.TrimSpace(att.MIME)
 		if mime == "" {
-			mime = api.DetectAttachmentMIME(attType, mediaPath)
+			mime = api.DetectAttachmentMIME(attType, att.Path)
 		}
 		attachments = append(attachments, api.Attachment{
 			Type:     attType,
-			FilePath: mediaPath,
+			FilePath: att.Path,
 			MimeType: mime,
 		})
 	}
 	return attachments
 }
-
-func mapStringFromMeta(meta map[string]any, key string) map[string]string {
-	if len(meta) == 0 {
-		return nil
-	}
-	raw, ok := meta[key]
-	if !ok || raw == nil {
-		return nil
-	}
-	if typed, ok := raw.(map[string]string); ok {
-		return typed
-	}
-	generic, ok := raw.(map[string]any)
-	if !ok {
-		return nil
-	}
-	out := make(map[string]string, len(generic))
-	for k, v := range generic {
-		if s, ok := v.(string); ok {
-			out[k] = s
-		}
-	}
-	return out
-}
@@ -10,13 +10,17 @@ import (
 	"time"
 
 	"github.com/riverfjs/agentsdk-go/pkg/api"
+	"github.com/riverfjs/agentsdk-go/pkg/core/events"
 	sdklogger "github.com/riverfjs/agentsdk-go/pkg/logger"
+	"github.com/riverfjs/agentsdk-go/pkg/message"
 	"go.uber.org/zap"
 	"github.com/riverfjs/aevitas/internal/bus"
 	"github.com/riverfjs/aevitas/internal/channel"
 	"github.com/riverfjs/aevitas/internal/config"
 	"github.com/riverfjs/aevitas/internal/cron"
 	"github.com/riverfjs/aevitas/internal/heartbeat"
+	"github.com/riverfjs/aevitas/internal/identity"
+	"github.com/riverfjs/aevitas/internal/runtimeopts"
 )
 
 // newTestLogger returns a no-op logger for unit tests.
@@ -33,6 +37,7 @@ type mockRuntime struct {
 	clearSessionError  error
 	sessionStats       *api.SessionTokenStats
 	totalStats         *api.SessionTokenStats
+	history            []message.Message
 }
 
 func (m *mockRuntime) Run(ctx context.Context, req api.Request) (*api.Response, error) {
@@ -63,6 +68,10 @@ func (m *mockRuntime) GetTotalStats() *api.SessionTokenStats {
 }
 
 
+func (m *mockRuntime) GetHistory(sessionID string) ([]message.Message, error) {
+	return m.history, nil
+}
+
 func (m *mockRuntime) Close() {
 	m.closed = true
 }
@@ -304,8 +313,8 @@ func TestGateway_DeliverAgentResponse_WithTelegramPreviewFinal(t *testing.T) {
 		if out.Content != "final answer" {
 			t.Fatalf("unexpected content: %q", out.Content)
 		}
-		if mode, _ := out.Metadata[telegramEventKey].(string); mode != telegramEventPreviewFinal {
-			t.Fatalf("expected preview final metadata, got %#v", out.Metadata)
+		if out.Kind != bus.KindPreviewFinal {
+			t.Fatalf("expected preview final kind, got %q", out.Kind)
 		}
 	case <-time.After(time.Second):
 		t.Fatal("timeout waiting outbound message")
@@ -330,8 +339,9 @@ func TestGateway_DeliverAgentResponse_EmitsTelegramUsageHUD(t *testing.T) {
 				CacheCreated: 10,
 			},
 		},
-		logger:        newTestLogger(),
-		usageNotified: make(map[string]uint8),
+		logger:          newTestLogger(),
+		usageNotified:   make(map[string]uint8),
+		previewStreamFn: func(string) bool { return true },
 	}
 	in := bus.InboundMessage{Channel: "telegram", ChatID: "chat1", SenderID: "u1", Content: "hello"}
 	resp := &api.Response{
@@ -353,15 +363,13 @@ func TestGateway_DeliverAgentResponse_EmitsTelegramUsageHUD(t *testing.T) {
 			if out.Content == "final answer" {
 				gotResult = true
 			}
-			if out.Metadata != nil {
-				if v, ok := out.Metadata[telegramEventKey].(string); ok && v == telegramEventUsageHUD {
-					gotUsage = true
-					if !strings.Contains(out.Content, "Context window:") {
-						t.Fatalf("expected context window in usage hud, got %q", out.Content)
-					}
-					if !strings.Contains(out.Content, "🟨") || !strings.Contains(out.Content, "⬜") {
-						t.Fatalf("expected emoji usage bar in usage hud, got %q", out.Content)
-					}
+			if out.Kind == bus.KindUsageHUD {
+				gotUsage = true
+				if !strings.Contains(out.Content, "Context window:") {
+					t.Fatalf("expected context window in usage hud, got %q", out.Content)
+				}
+				if !strings.Contains(out.Content, "🟨") || !strings.Contains(out.Content, "⬜") {
+					t.Fatalf("expected emoji usage bar in usage hud, got %q", out.Content)
 				}
 			}
 		case <-timeout:
@@ -388,8 +396,9 @@ func TestGateway_DeliverAgentResponse_UsageThresholdAndDedup(t *testing.T) {
 				CacheCreated: 10,
 			},
 		},
-		logger:        newTestLogger(),
-		usageNotified: make(map[string]uint8),
+		logger:          newTestLogger(),
+		usageNotified:   make(map[string]uint8),
+		previewStreamFn: func(string) bool { return true },
 	}
 	in := bus.InboundMessage{Channel: "telegram", ChatID: "chat1", SenderID: "u1", Content: "hello"}
 	resp := &api.Response{Result: &api.Result{Output: "ok"}}
@@ -414,7 +423,7 @@ func TestGateway_DeliverAgentResponse_UsageThresholdAndDedup(t *testing.T) {
 	var gotUsage30 bool
 	select {
 	case out := <-msgBus.Outbound:
-		gotUsage30 = out.Metadata[telegramEventKey] == telegramEventUsageHUD
+		gotUsage30 = out.Kind == bus.KindUsageHUD
 	case <-time.After(time.Second):
 		t.Fatal("expected usage message at 30% threshold")
 	}
@@ -438,8 +447,8 @@ func TestGateway_DeliverAgentResponse_UsageThresholdAndDedup(t *testing.T) {
 	_ = <-msgBus.Outbound // result
 	select {
 	case out := <-msgBus.Outbound:
-		if out.Metadata[telegramEventKey] != telegramEventUsageHUD {
-			t.Fatalf("expected usage event at 50%%, got %#v", out.Metadata)
+		if out.Kind != bus.KindUsageHUD {
+			t.Fatalf("expected usage event at 50%%, got %q", out.Kind)
 		}
 	case <-time.After(time.Second):
 		t.Fatal("expected usage message at 50% threshold")
@@ -838,13 +847,17 @@ func TestGateway_RealtimeModelSwitch_EmitsStandaloneMessage(t *testing.T) {
 		t.Fatal("realtime callback should be captured")
 	}
 
-	g.currentChannelID = "telegram"
-	g.currentChatID = "5821086579"
-	g.currentReplyTo = "123"
+	_, turn := g.turns.begin(context.Background(), bus.InboundMessage{
+		Channel:   "telegram",
+		ChatID:    "5821086579",
+		MessageID: "123",
+	})
+	defer g.turns.end(turn)
 
 	captured(api.RealtimeEvent{
-		Type:    api.RealtimeEventModelSwitch,
-		Message: "Model fallback switch: anthropic/claude-opus-4.6 -> deepseek/deepseek-v3.2",
+		Type:      api.RealtimeEventModelSwitch,
+		Message:   "Model fallback switch: anthropic/claude-opus-4.6 -> deepseek/deepseek-v3.2",
+		SessionID: turn.SessionID,
 	})
 
 	select {
@@ -1023,8 +1036,8 @@ func TestGateway_RestartCommand_SendsPreNoticeBeforeRestart(t *testing.T) {
 	if sent.Channel != "feishu" || sent.ChatID != "oc_123" {
 		t.Fatalf("unexpected pre-restart target: %+v", sent)
 	}
-	if _, ok := sent.Metadata[telegramEventKey]; ok {
-		t.Fatalf("feishu pre-restart message should use default card flow, got metadata=%v", sent.Metadata)
+	if sent.Kind != bus.KindPlain {
+		t.Fatalf("feishu pre-restart message should use default card flow, got kind=%q", sent.Kind)
 	}
 
 	trigger := filepath.Join(tmpHome, ".aevitas", "restart_trigger.txt")
@@ -1037,6 +1050,31 @@ func TestGateway_RestartCommand_SendsPreNoticeBeforeRestart(t *testing.T) {
 	}
 }
 
+func TestGateway_CommandReplyTargetsItsMessage(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	msgBus := bus.NewMessageBus(10)
+	g := &Gateway{
+		bus:        msgBus,
+		logger:     newTestLogger(),
+		cmdHandler: channel.NewCommandHandler(nil, "", 200000),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.processLoop(ctx)
+
+	for _, name := range []string{"discord", "telegram", "webhook"} {
+		msgBus.Inbound <- bus.InboundMessage{Channel: name, ChatID: "C1", SenderID: "u1", MessageID: "I1", Content: "/start"}
+		select {
+		case out := <-msgBus.Outbound:
+			if out.Channel != name || out.ReplyTo != "I1" {
+				t.Fatalf("%s command reply should target its command, got %+v", name, out)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s command reply was not published", name)
+		}
+	}
+}
+
 func TestGateway_RestartCommand_DoesNotRestartWhenPreNoticeFails(t *testing.T) {
 	tmpHome := t.TempDir()
 	t.Setenv("HOME", tmpHome)
@@ -1379,3 +1417,185 @@ func TestGateway_CommandHandler_Integration(t *testing.T) {
 		t.Errorf("Expected Aevitas in response, got: %s", result.Response)
 	}
 }
+
+func TestGateway_SessionHistory_FoldsToolCalls(t *testing.T) {
+	g := &Gateway{runtime: &mockRuntime{history: []message.Message{
+		{Role: "system", Content: "prompt"},
+		{Role: "user", Content: "weather?"},
+		{Role: "assistant", ToolCalls: []message.ToolCall{{Name: "WebSearch"}}},
+		{Role: "tool", Content: "sunny"},
+		{Role: "assistant", Content: "Sunny today."},
+		{Role: "user", Content: "thanks"},
+		{Role: "assistant", ToolCalls: []message.ToolCall{{Name: "Read"}}},
+	}}}
+
+	got, err := g.SessionHistory(bus.InboundMessage{Channel: "webchat", ChatID: "main", Direct: true})
+	if err != nil {
+		t.Fatalf("SessionHistory: %v", err)
+	}
+	want := []channel.HistoryEntry{
+		{Role: "user", Content: "weather?"},
+		{Role: "assistant", Content: "Sunny today.", Tools: []string{"WebSearch"}},
+		{Role: "user", Content: "thanks"},
+		{Role: "assistant", Tools: []string{"Read"}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Role != want[i].Role || got[i].Content != want[i].Content || strings.Join(got[i].Tools, ",") != strings.Join(want[i].Tools, ",") {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGateway_ProcessHookEvents_AskUserQuestionButtons(t *testing.T) {
+	g := &Gateway{logger: newTestLogger()}
+	ask := func(params map[string]any) hookEventResult {
+		return g.processHookEvents(&api.Response{HookEvents: []events.Event{{
+			Type:    events.PostToolUse,
+			Payload: events.ToolResultPayload{Name: "AskUserQuestion", Params: params, Result: "Which database?"},
+		}}})
+	}
+	question := map[string]any{
+		"question": "Which database?",
+		"options": []any{
+			map[string]any{"label": "Postgres", "description": "relational"},
+			map[string]any{"label": "SQLite"},
+		},
+	}
+
+	res := ask(map[string]any{"questions": []any{question}})
+	if res.askQuestion != "Which database?" || len(res.askButtons) != 2 || res.askButtons[1][0] != (bus.Button{Label: "SQLite", Data: "SQLite"}) {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	multi := map[string]any{"question": "Which?", "multiSelect": true, "options": question["options"]}
+	if res := ask(map[string]any{"questions": []any{multi}}); res.askButtons != nil {
+		t.Fatalf("multi-select question should not get buttons: %+v", res.askButtons)
+	}
+	if res := ask(map[string]any{"questions": []any{question, question}}); res.askButtons != nil {
+		t.Fatalf("several questions should not get buttons: %+v", res.askButtons)
+	}
+}
+
+// instructionsRuntime records the chat instructions each turn runs with.
+type instructionsRuntime struct {
+	mockRuntime
+	prompt, instructions string
+}
+
+func (r *instructionsRuntime) Run(ctx context.Context, req api.Request) (*api.Response, error) {
+	r.prompt, r.instructions = req.Prompt, runtimeopts.Instructions(ctx)
+	return &api.Response{Result: &api.Result{Output: "ok"}}, nil
+}
+
+func TestProcessAgent_PassesChatInstructionsOutsideThePrompt(t *testing.T) {
+	rt := &instructionsRuntime{}
+	g := &Gateway{cfg: &config.Config{}, bus: bus.NewMessageBus(10), runtime: rt, logger: newTestLogger()}
+
+	g.processAgent(context.Background(), bus.InboundMessage{
+		Channel: "test", ChatID: "-100", Content: "hello", Instructions: " Answer in French. ",
+	})
+	if rt.prompt != "hello" || rt.instructions != "Answer in French." {
+		t.Fatalf("prompt %q, instructions %q", rt.prompt, rt.instructions)
+	}
+}
+
+func TestResolveIdentity_SharedSession(t *testing.T) {
+	cfg := config.IdentitiesConfig{
+		SharedSession: true,
+		Users:         map[string]config.UserIdentity{"alice": {Accounts: []string{"telegram:1", "wecom:alice", "matrix:@alice:example.org"}}},
+	}
+	reg, err := identity.Open(cfg, "")
+	if err != nil {
+		t.Fatalf("identity.Open: %v", err)
+	}
+	g := &Gateway{cfg: &config.Config{Identities: cfg}, identities: reg}
+
+	dm := g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "1", ChatID: "1", Direct: true})
+	wecom := g.resolveIdentity(bus.InboundMessage{Channel: "wecom", SenderID: "alice", ChatID: "alice", Direct: true})
+	matrix := g.resolveIdentity(bus.InboundMessage{Channel: "matrix", SenderID: "@alice:example.org", ChatID: "!dm:example.org", Direct: true})
+	if dm.SessionKey() != "user:alice" || wecom.SessionKey() != "user:alice" || matrix.SessionKey() != "user:alice" || dm.User != "alice" {
+		t.Fatalf("direct chats not shared: %q %q %q %+v", dm.SessionKey(), wecom.SessionKey(), matrix.SessionKey(), dm)
+	}
+	group := g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "1", ChatID: "-100"})
+	if group.SessionKey() != "telegram:-100" || group.User != "alice" {
+		t.Fatalf("group chat: session %q, user %q", group.SessionKey(), group.User)
+	}
+	other := g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "2", ChatID: "2"})
+	if other.SessionKey() != "telegram:2" || other.User != "" || other.Role != identity.RoleOwner {
+		t.Fatalf("unlinked sender: %+v", other)
+	}
+}
+
+func TestRoleRouter_RoutesRoleSessions(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workspace, ".claude"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(roleSettingsPath(workspace, identity.RoleGuest), []byte(`{"permissions":{"deny":["Bash"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Agent:      config.AgentConfig{Workspace: workspace},
+		Identities: config.IdentitiesConfig{DefaultRole: identity.RoleGuest, Users: map[string]config.UserIdentity{"alice": {Accounts: []string{"telegram:1"}, Role: identity.RoleOwner}}},
+	}
+	base := &mockRuntime{}
+	guest := &mockRuntime{}
+	var settings []string
+	rt, err := newRoleRouter(cfg, base, func(roleCfg *config.Config) (Runtime, error) {
+		settings = append(settings, roleCfg.Agent.SettingsPath)
+		return guest, nil
+	})
+	if err != nil {
+		t.Fatalf("newRoleRouter: %v", err)
+	}
+	if len(settings) != 1 || settings[0] != roleSettingsPath(workspace, identity.RoleGuest) || cfg.Agent.SettingsPath != "" {
+		t.Fatalf("role runtimes created with %v", settings)
+	}
+	reg, err := identity.Open(cfg.Identities, "")
+	if err != nil {
+		t.Fatalf("identity.Open: %v", err)
+	}
+	g := &Gateway{cfg: cfg, identities: reg, runtime: rt}
+
+	owner := g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "1", ChatID: "-100"})
+	visitor := g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "2", ChatID: "-100"})
+	if owner.SessionKey() != "telegram:-100" || visitor.SessionKey() != "role:guest:telegram:-100" || visitor.Role != identity.RoleGuest {
+		t.Fatalf("sessions: owner %q, guest %q", owner.SessionKey(), visitor.SessionKey())
+	}
+	_ = g.runtimeFor(visitor.Role).ClearSession(visitor.SessionKey())
+	if !guest.clearSessionCalled || base.clearSessionCalled {
+		t.Fatal("guest session not routed to the guest runtime")
+	}
+	_ = g.runtimeFor(owner.Role).ClearSession(owner.SessionKey())
+	if !base.clearSessionCalled {
+		t.Fatal("owner session not routed to the base runtime")
+	}
+
+	// The runtime follows the resolved role, whatever the chat ID says.
+	guest.clearSessionCalled = false
+	forged := g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "1", ChatID: "-100#guest"})
+	if forged.SessionKey() != "telegram:-100#guest" || g.runtimeFor(forged.Role) != base {
+		t.Fatalf("forged chat ID picked session %q", forged.SessionKey())
+	}
+	forged = g.resolveIdentity(bus.InboundMessage{Channel: "telegram", SenderID: "2", ChatID: "-100#owner"})
+	if g.runtimeFor(forged.Role) != guest {
+		t.Fatal("a guest must stay on the guest runtime")
+	}
+	cmd := channel.NewCommandHandler(g.runtime, workspace, 200000)
+	forged.Content = "/reset"
+	cmd.HandleCommand(forged)
+	if !guest.clearSessionCalled {
+		t.Fatal("/reset did not clear the sender's session on the guest runtime")
+	}
+	if meta := turnMetadata(visitor); meta["role"] != identity.RoleGuest {
+		t.Fatalf("turn metadata = %v", meta)
+	}
+
+	g.runtime.Close()
+	if !base.closed || !guest.closed {
+		t.Fatal("runtimes not closed")
+	}
+}
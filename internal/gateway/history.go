@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"strings"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/channel"
+)
+
+// SessionHistory returns the user and assistant messages of the session msg
+// would be handled in. Tool calls are folded into the assistant reply that
+// follows them; tool results and system messages are left out.
+func (g *Gateway) SessionHistory(msg bus.InboundMessage) ([]channel.HistoryEntry, error) {
+	msg = g.resolveIdentity(msg)
+	msgs, err := g.runtimeFor(msg.Role).GetHistory(msg.SessionKey())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		entries []channel.HistoryEntry
+		tools   []string
+	)
+	flushTools := func() {
+		if len(tools) > 0 {
+			entries = append(entries, channel.HistoryEntry{Role: "assistant", Tools: tools})
+			tools = nil
+		}
+	}
+	for _, m := range msgs {
+		content := strings.TrimSpace(m.Content)
+		switch m.Role {
+		case "user":
+			flushTools()
+			if content != "" {
+				entries = append(entries, channel.HistoryEntry{Role: "user", Content: content})
+			}
+		case "assistant":
+			for _, call := range m.ToolCalls {
+				tools = append(tools, call.Name)
+			}
+			if content != "" && len(m.ToolCalls) == 0 {
+				entries = append(entries, channel.HistoryEntry{Role: "assistant", Content: content, Tools: tools})
+				tools = nil
+			}
+		}
+	}
+	flushTools()
+	return entries, nil
+}
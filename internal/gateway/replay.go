@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/journal"
+)
+
+// replayJournal re-sends replies that were never delivered and re-queues
+// turns that were interrupted before they finished. Work for each channel
+// waits until that channel is running.
+func (g *Gateway) replayJournal(ctx context.Context) {
+	if g.journal == nil {
+		return
+	}
+	outbound := map[string][]bus.OutboundMessage{}
+	inbound := map[string][]bus.InboundMessage{}
+	var order []string
+	seen := map[string]bool{}
+	note := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			order = append(order, name)
+		}
+	}
+
+	for _, msg := range g.journal.PendingOutbound() {
+		note(msg.Channel)
+		outbound[msg.Channel] = append(outbound[msg.Channel], msg)
+	}
+	for _, msg := range g.journal.PendingInbound() {
+		// A command caught by a crash is not re-run; /restart would loop.
+		if strings.HasPrefix(strings.TrimSpace(msg.Content), "/") {
+			g.journal.MarkInbound(msg, journal.StateDropped)
+			continue
+		}
+		note(msg.Channel)
+		inbound[msg.Channel] = append(inbound[msg.Channel], msg)
+	}
+
+	for _, name := range order {
+		out, in := outbound[name], inbound[name]
+		g.logger.Infof("[gateway] journal replay for %s: %d undelivered, %d unfinished", name, len(out), len(in))
+		g.whenChannelReady(ctx, name, func() {
+			go func() {
+				for _, msg := range out {
+					select {
+					case g.bus.Outbound <- msg:
+					case <-ctx.Done():
+						return
+					}
+				}
+				for _, msg := range in {
+					select {
+					case g.bus.Inbound <- msg:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/channel"
+	"github.com/riverfjs/aevitas/internal/config"
+	"github.com/riverfjs/aevitas/internal/journal"
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+)
+
+func TestGateway_ReplayJournal_ResendsAndRequeues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.jsonl")
+	j, err := journal.Open(path)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	// Simulate the previous process: one reply never acked, one turn in
+	// flight, and a /restart that was received but not handled.
+	reply := bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "late reply"}
+	j.RecordOutbound(&reply)
+	turn := bus.InboundMessage{Channel: "telegram", ChatID: "1", MessageID: "5", Content: "do work"}
+	j.RecordInbound(&turn)
+	j.MarkInbound(turn, journal.StateProcessing)
+	restart := bus.InboundMessage{Channel: "telegram", ChatID: "1", MessageID: "6", Content: "/restart"}
+	j.RecordInbound(&restart)
+	_ = j.Close()
+
+	j, err = journal.Open(path)
+	if err != nil {
+		t.Fatalf("reopen journal: %v", err)
+	}
+	defer j.Close()
+
+	msgBus := bus.NewMessageBus(10)
+	msgBus.SetJournal(j)
+	g := &Gateway{
+		cfg:     &config.Config{},
+		bus:     msgBus,
+		runtime: &mockRuntime{response: &api.Response{Result: &api.Result{Output: "done"}}},
+		logger:  newTestLogger(),
+		journal: j,
+		channelStatesFn: func() map[string]channel.ChannelState {
+			return map[string]channel.ChannelState{"telegram": {Running: true}}
+		},
+	}
+	g.replayJournal(context.Background())
+
+	select {
+	case out := <-msgBus.Outbound:
+		if out.Content != "late reply" || out.JournalID != reply.JournalID {
+			t.Fatalf("unexpected replayed reply: %+v", out)
+		}
+		msgBus.AckOutbound(out, nil)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting replayed reply")
+	}
+
+	var replayed bus.InboundMessage
+	select {
+	case replayed = <-msgBus.Inbound:
+		if replayed.Content != "do work" || !replayed.Replayed {
+			t.Fatalf("unexpected replayed turn: %+v", replayed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting replayed turn")
+	}
+	select {
+	case msg := <-msgBus.Inbound:
+		t.Fatalf("command should not be replayed: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.processAgent(context.Background(), replayed)
+	if pending := j.PendingInbound(); len(pending) != 0 {
+		t.Fatalf("replayed turn should be finished, %d pending", len(pending))
+	}
+	if pending := j.PendingOutbound(); len(pending) != 1 || pending[0].Content != "done" {
+		t.Fatalf("agent reply should be journaled until acked: %+v", pending)
+	}
+}
+
+func TestGateway_ProcessAgent_LeavesTurnUnfinishedOnShutdown(t *testing.T) {
+	j, err := journal.Open(filepath.Join(t.TempDir(), "messages.jsonl"))
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	defer j.Close()
+	msgBus := bus.NewMessageBus(10)
+	msgBus.SetJournal(j)
+	rt := &stoppableRuntime{started: make(chan struct{}, 1)}
+	g := &Gateway{
+		cfg:     &config.Config{},
+		bus:     msgBus,
+		runtime: rt,
+		logger:  newTestLogger(),
+		journal: j,
+	}
+	msg := bus.InboundMessage{Channel: "test", ChatID: "1", Content: "long task"}
+	msgBus.PublishInbound(msg)
+	msg = <-msgBus.Inbound
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.processAgent(ctx, msg)
+	}()
+	<-rt.started
+	cancel()
+	<-done
+
+	if pending := j.PendingInbound(); len(pending) != 1 {
+		t.Fatalf("interrupted turn should stay pending for replay, got %d", len(pending))
+	}
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/riverfjs/aevitas/internal/channel"
+	"github.com/riverfjs/aevitas/internal/config"
+	"github.com/riverfjs/aevitas/internal/identity"
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+	"github.com/riverfjs/agentsdk-go/pkg/message"
+)
+
+// roleSettingsPath is the settings file layered over .claude/settings.json
+// for the turns of senders with role.
+func roleSettingsPath(workspace, role string) string {
+	return filepath.Join(workspace, ".claude", "settings."+role+".json")
+}
+
+// roleSession is the session of a chat for senders of a role that has its
+// own runtime. Histories are cached per runtime, so one session must never
+// be run by two of them. Chat sessions start with their channel's name and
+// shared ones with "user:", so no chat ID can name a role session.
+func roleSession(sessionKey, role string) string {
+	return "role:" + role + ":" + sessionKey
+}
+
+// newRoleRouter creates a runtime for every role that has its own settings
+// file. It returns base unchanged when no role has one.
+func newRoleRouter(cfg *config.Config, base Runtime, create func(*config.Config) (Runtime, error)) (Runtime, error) {
+	roles := make(map[string]Runtime)
+	for _, role := range identity.Roles {
+		path := roleSettingsPath(cfg.Agent.Workspace, role)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		roleCfg := *cfg
+		roleCfg.Agent.SettingsPath = path
+		rt, err := create(&roleCfg)
+		if err != nil {
+			for _, created := range roles {
+				created.Close()
+			}
+			return nil, err
+		}
+		roles[role] = rt
+	}
+	if len(roles) == 0 {
+		return base, nil
+	}
+	return &roleRouter{base: base, roles: roles}, nil
+}
+
+// roleRouter holds the runtimes of roles with their own settings file. The
+// runtime of a turn is picked by the sender's resolved role (see forRole),
+// never from the session ID; used as a plain Runtime, the router runs
+// everything on the base runtime.
+type roleRouter struct {
+	base  Runtime
+	roles map[string]Runtime
+}
+
+// scoped reports whether role has its own runtime.
+func (r *roleRouter) scoped(role string) bool {
+	_, ok := r.roles[role]
+	return ok
+}
+
+// forRole returns the runtime for senders with role.
+func (r *roleRouter) forRole(role string) Runtime {
+	if rt, ok := r.roles[role]; ok {
+		return rt
+	}
+	return r.base
+}
+
+// ForRole implements channel.RoleRuntimes.
+func (r *roleRouter) ForRole(role string) channel.SessionResetter {
+	return r.forRole(role)
+}
+
+func (r *roleRouter) Run(ctx context.Context, req api.Request) (*api.Response, error) {
+	return r.base.Run(ctx, req)
+}
+
+func (r *roleRouter) RunStream(ctx context.Context, req api.Request) (<-chan api.StreamEvent, error) {
+	return r.base.RunStream(ctx, req)
+}
+
+func (r *roleRouter) ClearSession(sessionID string) error {
+	return r.base.ClearSession(sessionID)
+}
+
+func (r *roleRouter) GetSessionStats(sessionID string) *api.SessionTokenStats {
+	return r.base.GetSessionStats(sessionID)
+}
+
+// GetTotalStats adds up the usage of all runtimes.
+func (r *roleRouter) GetTotalStats() *api.SessionTokenStats {
+	total := r.base.GetTotalStats()
+	for _, rt := range r.roles {
+		stats := rt.GetTotalStats()
+		if stats == nil {
+			continue
+		}
+		if total == nil {
+			total = &api.SessionTokenStats{}
+		}
+		total.TotalInput += stats.TotalInput
+		total.TotalOutput += stats.TotalOutput
+		total.TotalTokens += stats.TotalTokens
+		total.CacheCreated += stats.CacheCreated
+		total.CacheRead += stats.CacheRead
+		total.RequestCount += stats.RequestCount
+		for name, m := range stats.ByModel {
+			if total.ByModel == nil {
+				total.ByModel = make(map[string]*api.ModelStats)
+			}
+			sum, ok := total.ByModel[name]
+			if !ok {
+				sum = &api.ModelStats{}
+				total.ByModel[name] = sum
+			}
+			sum.InputTokens += m.InputTokens
+			sum.OutputTokens += m.OutputTokens
+			sum.TotalTokens += m.TotalTokens
+			sum.CacheCreation += m.CacheCreation
+			sum.CacheRead += m.CacheRead
+			sum.RequestCount += m.RequestCount
+		}
+		if total.FirstRequest.IsZero() || (!stats.FirstRequest.IsZero() && stats.FirstRequest.Before(total.FirstRequest)) {
+			total.FirstRequest = stats.FirstRequest
+		}
+		if stats.LastRequest.After(total.LastRequest) {
+			total.LastRequest = stats.LastRequest
+		}
+	}
+	return total
+}
+
+func (r *roleRouter) GetHistory(sessionID string) ([]message.Message, error) {
+	return r.base.GetHistory(sessionID)
+}
+
+// runtimeFor returns the runtime that runs the turns of senders with role.
+func (g *Gateway) runtimeFor(role string) Runtime {
+	if router, ok := g.runtime.(*roleRouter); ok {
+		return router.forRole(role)
+	}
+	return g.runtime
+}
+
+// roleSessionKey is the session senders with role use for sessionKey: a
+// session of its own when the role has its own runtime.
+func (g *Gateway) roleSessionKey(sessionKey, role string) string {
+	if router, ok := g.runtime.(*roleRouter); ok && router.scoped(role) {
+		return roleSession(sessionKey, role)
+	}
+	return sessionKey
+}
+
+func (r *roleRouter) Close() {
+	r.base.Close()
+	for _, rt := range r.roles {
+		rt.Close()
+	}
+}
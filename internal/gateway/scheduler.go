@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/channel"
+)
+
+// errSessionBusy is returned by sessionScheduler.submit when a session
+// already has the maximum number of turns waiting.
+var errSessionBusy = errors.New("session queue is full")
+
+// sessionScheduler serializes agent turns per session and bounds how many
+// sessions run at the same time. Each session with pending work owns one
+// worker goroutine that drains its queue in order; the worker holds a global
+// slot only while a turn is actually running.
+type sessionScheduler struct {
+	maxConcurrent int
+	maxPerSession int
+	slots         chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*sessionQueue
+	running  int
+	rejected int64
+	waitN    int64
+	waitSum  time.Duration
+	waitMax  time.Duration
+	waitLast time.Duration
+}
+
+type sessionQueue struct {
+	pending []scheduledTurn
+	running bool
+}
+
+type scheduledTurn struct {
+	run        func(context.Context)
+	drop       func() // called instead of run when the turn is cleared; may be nil
+	enqueuedAt time.Time
+}
+
+func newSessionScheduler(maxConcurrent, maxPerSession int) *sessionScheduler {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	if maxPerSession < 0 {
+		maxPerSession = 0
+	}
+	return &sessionScheduler{
+		maxConcurrent: maxConcurrent,
+		maxPerSession: maxPerSession,
+		slots:         make(chan struct{}, maxConcurrent),
+		sessions:      make(map[string]*sessionQueue),
+	}
+}
+
+// submit queues run for the given session. It returns errSessionBusy when
+// the session already has maxPerSession turns waiting. drop, if not nil, is
+// called instead of run when the turn is cleared before it starts.
+func (s *sessionScheduler) submit(ctx context.Context, sessionKey string, run func(context.Context), drop func()) error {
+	s.mu.Lock()
+	q, ok := s.sessions[sessionKey]
+	if !ok {
+		q = &sessionQueue{}
+		s.sessions[sessionKey] = q
+	}
+	// The turn in flight does not count against the waiting limit.
+	if q.running && len(q.pending) >= s.maxPerSession {
+		s.rejected++
+		s.mu.Unlock()
+		return errSessionBusy
+	}
+	q.pending = append(q.pending, scheduledTurn{run: run, drop: drop, enqueuedAt: time.Now()})
+	startWorker := !q.running
+	q.running = true
+	s.mu.Unlock()
+
+	if startWorker {
+		go s.drain(ctx, sessionKey, q)
+	}
+	return nil
+}
+
+// drain runs the queued turns of one session in order until it is empty.
+func (s *sessionScheduler) drain(ctx context.Context, sessionKey string, q *sessionQueue) {
+	for {
+		s.mu.Lock()
+		if len(q.pending) == 0 || ctx.Err() != nil {
+			q.pending = nil
+			q.running = false
+			delete(s.sessions, sessionKey)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+
+		s.mu.Lock()
+		if len(q.pending) == 0 {
+			// Cleared while waiting for a slot.
+			s.mu.Unlock()
+			<-s.slots
+			continue
+		}
+		next := q.pending[0]
+		q.pending = q.pending[1:]
+		s.running++
+		wait := time.Since(next.enqueuedAt)
+		s.waitN++
+		s.waitSum += wait
+		s.waitLast = wait
+		if wait > s.waitMax {
+			s.waitMax = wait
+		}
+		s.mu.Unlock()
+
+		next.run(ctx)
+
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+		<-s.slots
+	}
+}
+
+// clear drops the turns waiting in a session's queue, leaving the running
+// one alone, and returns how many it dropped.
+func (s *sessionScheduler) clear(sessionKey string) int {
+	s.mu.Lock()
+	var dropped []scheduledTurn
+	if q, ok := s.sessions[sessionKey]; ok {
+		dropped = q.pending
+		q.pending = nil
+	}
+	s.mu.Unlock()
+	for _, turn := range dropped {
+		if turn.drop != nil {
+			turn.drop()
+		}
+	}
+	return len(dropped)
+}
+
+// QueueStats reports scheduler state for /status.
+func (s *sessionScheduler) QueueStats(sessionKey string) channel.QueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := channel.QueueStats{
+		Running:       s.running,
+		Sessions:      len(s.sessions),
+		MaxConcurrent: s.maxConcurrent,
+		MaxPerSession: s.maxPerSession,
+		Rejected:      s.rejected,
+		LastWait:      s.waitLast,
+		MaxWait:       s.waitMax,
+	}
+	if s.waitN > 0 {
+		stats.AvgWait = s.waitSum / time.Duration(s.waitN)
+	}
+	for key, q := range s.sessions {
+		stats.Queued += len(q.pending)
+		if key == sessionKey {
+			stats.SessionQueued = len(q.pending)
+			stats.SessionActive = q.running
+		}
+	}
+	return stats
+}
@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+)
+
+func TestSessionScheduler_RunsSessionTurnsInOrder(t *testing.T) {
+	s := newSessionScheduler(4, 10)
+	var mu sync.Mutex
+	var got []int
+	done := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		i := i
+		if err := s.submit(context.Background(), "telegram:1", func(context.Context) {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			got = append(got, i)
+			n := len(got)
+			mu.Unlock()
+			if n == 5 {
+				close(done)
+			}
+		}, nil); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting queued turns")
+	}
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("turns ran out of order: %v", got)
+		}
+	}
+}
+
+func TestSessionScheduler_LimitsConcurrencyAcrossSessions(t *testing.T) {
+	s := newSessionScheduler(2, 1)
+	release := make(chan struct{})
+	started := make(chan string, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		key := key
+		if err := s.submit(context.Background(), key, func(context.Context) {
+			started <- key
+			<-release
+		}, nil); err != nil {
+			t.Fatalf("submit %s: %v", key, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting first turns")
+		}
+	}
+	select {
+	case key := <-started:
+		t.Fatalf("turn %s started beyond the concurrency limit", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats := s.QueueStats("")
+	if stats.Running != 2 || stats.Queued != 1 || stats.Sessions != 3 {
+		t.Fatalf("unexpected stats while saturated: %+v", stats)
+	}
+
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("third turn never started")
+	}
+	if s.QueueStats("").MaxWait <= 0 {
+		t.Fatal("expected wait time to be recorded")
+	}
+}
+
+func TestSessionScheduler_RejectsWhenSessionQueueFull(t *testing.T) {
+	s := newSessionScheduler(1, 1)
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+	block := func(context.Context) {
+		started <- struct{}{}
+		<-release
+	}
+
+	if err := s.submit(context.Background(), "k", block, nil); err != nil {
+		t.Fatalf("first submit: %v", err)
+	}
+	<-started
+	if err := s.submit(context.Background(), "k", block, nil); err != nil {
+		t.Fatalf("second submit should queue: %v", err)
+	}
+	if err := s.submit(context.Background(), "k", block, nil); err != errSessionBusy {
+		t.Fatalf("third submit err = %v, want errSessionBusy", err)
+	}
+	// Other sessions are unaffected by a full queue.
+	if err := s.submit(context.Background(), "other", block, nil); err != nil {
+		t.Fatalf("other session submit: %v", err)
+	}
+	if got := s.QueueStats("k").Rejected; got != 1 {
+		t.Fatalf("rejected = %d, want 1", got)
+	}
+}
+
+func TestGateway_EnqueueAgent_RepliesBusyWhenQueueFull(t *testing.T) {
+	msgBus := bus.NewMessageBus(10)
+	rt := &realtimeRuntime{
+		started: make(chan string, 4),
+		release: make(chan struct{}),
+	}
+	maxPerSession := 1
+	g := &Gateway{
+		cfg: &config.Config{Gateway: config.GatewayConfig{
+			Queue: config.TurnQueueConfig{MaxConcurrent: 1, MaxPerSession: &maxPerSession},
+		}},
+		bus:     msgBus,
+		runtime: rt,
+		logger:  newTestLogger(),
+	}
+	rt.emit = g.handleRealtimeEvent
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msg := bus.InboundMessage{Channel: "test", ChatID: "1", Content: "hi"}
+	g.enqueueAgent(ctx, msg)
+	select {
+	case <-rt.started:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting first turn")
+	}
+	g.enqueueAgent(ctx, msg)
+
+	stopTyping := make(chan struct{})
+	busy := msg
+	busy.Typing = bus.NewTyping(func() { close(stopTyping) })
+	g.enqueueAgent(ctx, busy)
+
+	select {
+	case out := <-msgBus.Outbound:
+		if out.ChatID != "1" || !strings.Contains(out.Content, "排队已满") {
+			t.Fatalf("unexpected busy reply: %+v", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting busy reply")
+	}
+	select {
+	case <-stopTyping:
+	default:
+		t.Fatal("typing indicator should stop for rejected message")
+	}
+	close(rt.release)
+}
+
+func TestGateway_Scheduler_MaxPerSessionZeroDisablesWaiting(t *testing.T) {
+	g := &Gateway{cfg: config.DefaultConfig()}
+	if got := g.scheduler().maxPerSession; got != config.DefaultMaxQueuedPerSession {
+		t.Fatalf("unset maxPerSession = %d, want default %d", got, config.DefaultMaxQueuedPerSession)
+	}
+
+	none := 0
+	g = &Gateway{cfg: &config.Config{Gateway: config.GatewayConfig{
+		Queue: config.TurnQueueConfig{MaxPerSession: &none},
+	}}}
+	s := g.scheduler()
+	if s.maxPerSession != 0 {
+		t.Fatalf("maxPerSession = %d, want 0", s.maxPerSession)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	block := func(context.Context) { <-release }
+	if err := s.submit(context.Background(), "k", block, nil); err != nil {
+		t.Fatalf("first submit: %v", err)
+	}
+	if err := s.submit(context.Background(), "k", block, nil); err != errSessionBusy {
+		t.Fatalf("second submit should be refused without waiting room, got %v", err)
+	}
+}
+
+func TestSessionScheduler_ClearDropsWaitingTurns(t *testing.T) {
+	s := newSessionScheduler(1, 10)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	finished := make(chan struct{})
+	if err := s.submit(context.Background(), "k", func(context.Context) {
+		started <- struct{}{}
+		<-release
+		close(finished)
+	}, nil); err != nil {
+		t.Fatalf("first submit: %v", err)
+	}
+	<-started
+
+	var dropped []int
+	for i := range 2 {
+		run := func(context.Context) { t.Errorf("cleared turn %d ran", i) }
+		if err := s.submit(context.Background(), "k", run, func() { dropped = append(dropped, i) }); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	if n := s.clear("k"); n != 2 || len(dropped) != 2 {
+		t.Fatalf("clear = %d, dropped %v, want 2", n, dropped)
+	}
+	if n := s.clear("k"); n != 0 {
+		t.Fatalf("second clear = %d, want 0", n)
+	}
+
+	// The running turn is left to finish.
+	close(release)
+	<-finished
+	deadline := time.Now().Add(time.Second)
+	for s.QueueStats("k").SessionActive {
+		if time.Now().After(deadline) {
+			t.Fatal("session worker did not exit")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGateway_StopTurn_DropsWaitingMessages(t *testing.T) {
+	g := &Gateway{cfg: &config.Config{}, bus: bus.NewMessageBus(10), logger: newTestLogger()}
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	if err := g.scheduler().submit(context.Background(), "telegram:1", func(context.Context) {
+		close(started)
+		<-release
+	}, nil); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	<-started
+
+	var typingStopped []string
+	typing := func(id string) *bus.Typing {
+		return bus.NewTyping(func() { typingStopped = append(typingStopped, id) })
+	}
+	g.enqueueAgent(context.Background(), bus.InboundMessage{Channel: "telegram", ChatID: "1", MessageID: "queued", Typing: typing("queued")})
+	g.debounce.add(bus.InboundMessage{Channel: "telegram", ChatID: "1", SenderID: "u", MessageID: "batched", Typing: typing("batched")},
+		time.Hour, func(bus.InboundMessage) { t.Error("cleared batch was flushed") })
+	g.debounce.add(bus.InboundMessage{Channel: "telegram", ChatID: "2", SenderID: "u", MessageID: "other"},
+		time.Hour, func(bus.InboundMessage) {})
+
+	stopped, dropped := g.StopTurn("telegram:1")
+	if stopped || dropped != 2 {
+		t.Fatalf("StopTurn = %v, %d, want false, 2", stopped, dropped)
+	}
+	if len(typingStopped) != 2 {
+		t.Fatalf("typing stopped for %v, want both dropped messages", typingStopped)
+	}
+	if len(g.debounce.pending) != 1 {
+		t.Fatalf("other sessions' batches must stay, pending = %d", len(g.debounce.pending))
+	}
+}
@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+)
+
+// turnContext is the routing target of one in-flight agent turn.
+// Realtime events emitted by the runtime are delivered to the chat recorded
+// here, so concurrent turns in different chats never see each other's events.
+type turnContext struct {
+	ID        string
+	SessionID string
+	Channel   string
+	ChatID    string
+	ReplyTo   string
+	StartedAt time.Time
+
+	cancel  context.CancelFunc
+	stopped atomic.Bool
+}
+
+// Stopped reports whether the turn was cancelled by the user via /stop.
+func (tc *turnContext) Stopped() bool {
+	return tc != nil && tc.stopped.Load()
+}
+
+// turnRegistry tracks active turns keyed by session ID.
+// The zero value is ready to use.
+type turnRegistry struct {
+	mu        sync.Mutex
+	seq       uint64
+	bySession map[string]*turnContext
+	latest    *turnContext
+}
+
+// begin registers a new turn for msg and returns its routing context along
+// with a child of ctx that is cancelled when the turn is stopped.
+func (r *turnRegistry) begin(ctx context.Context, msg bus.InboundMessage) (context.Context, *turnContext) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bySession == nil {
+		r.bySession = make(map[string]*turnContext)
+	}
+	r.seq++
+	tc := &turnContext{
+		ID:        fmt.Sprintf("turn-%d-%d", time.Now().UnixNano(), r.seq),
+		SessionID: msg.SessionKey(),
+		Channel:   msg.Channel,
+		ChatID:    msg.ChatID,
+		ReplyTo:   msg.MessageID,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	r.bySession[tc.SessionID] = tc
+	r.latest = tc
+	return ctx, tc
+}
+
+// end unregisters tc and releases its context.
+// A newer turn on the same session is left untouched.
+func (r *turnRegistry) end(tc *turnContext) {
+	if tc == nil {
+		return
+	}
+	tc.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cur, ok := r.bySession[tc.SessionID]; ok && cur == tc {
+		delete(r.bySession, tc.SessionID)
+	}
+	if r.latest == tc {
+		r.latest = nil
+		for _, cur := range r.bySession {
+			if r.latest == nil || cur.StartedAt.After(r.latest.StartedAt) {
+				r.latest = cur
+			}
+		}
+	}
+}
+
+// lookup resolves the turn a realtime event belongs to. Events without a
+// session ID cannot be attributed and return nil.
+func (r *turnRegistry) lookup(sessionID string) *turnContext {
+	if sessionID == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bySession[sessionID]
+}
+
+// stop cancels the active turn of sessionID.
+// It reports false when the session has no turn in flight.
+func (r *turnRegistry) stop(sessionID string) bool {
+	r.mu.Lock()
+	tc := r.bySession[sessionID]
+	r.mu.Unlock()
+	if tc == nil {
+		return false
+	}
+	tc.stopped.Store(true)
+	tc.cancel()
+	return true
+}
+
+// last returns the most recently started turn that is still active.
+func (r *turnRegistry) last() *turnContext {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latest
+}
+
+// turnTools follows the tool calls of one turn on the turn's own event
+// stream. The SDK's progress callback carries no session, so reading the
+// stream is the only way to tell which turn ran a tool.
+type turnTools struct {
+	interval int
+	count    int
+	blocks   map[int]string // content block index -> tool use ID
+	inputs   map[string]*strings.Builder
+}
+
+// newTurnTools reports every interval-th finished tool call; interval <= 0
+// uses the SDK default of 5.
+func newTurnTools(interval int) *turnTools {
+	if interval <= 0 {
+		interval = 5
+	}
+	return &turnTools{
+		interval: interval,
+		blocks:   make(map[int]string),
+		inputs:   make(map[string]*strings.Builder),
+	}
+}
+
+// observe records evt and returns the tool call to report when evt
+// finishes one that is due.
+func (t *turnTools) observe(evt api.StreamEvent) *bus.ToolProgress {
+	switch evt.Type {
+	case api.EventContentBlockStart:
+		if evt.Index != nil && evt.ContentBlock != nil && evt.ContentBlock.Type == "tool_use" {
+			t.blocks[*evt.Index] = evt.ContentBlock.ID
+			t.inputs[evt.ContentBlock.ID] = &strings.Builder{}
+		}
+	case api.EventContentBlockDelta:
+		if evt.Index == nil || evt.Delta == nil || evt.Delta.Type != "input_json_delta" {
+			return nil
+		}
+		input := t.inputs[t.blocks[*evt.Index]]
+		if input == nil {
+			return nil
+		}
+		// Each delta is a JSON string holding the next slice of the input.
+		var chunk string
+		if err := json.Unmarshal(evt.Delta.PartialJSON, &chunk); err == nil {
+			input.WriteString(chunk)
+		}
+	case api.EventToolExecutionResult:
+		params := ""
+		if input := t.inputs[evt.ToolUseID]; input != nil {
+			params = input.String()
+			delete(t.inputs, evt.ToolUseID)
+		}
+		t.count++
+		if t.count%t.interval != 0 {
+			return nil
+		}
+		if len(params) > 200 {
+			params = params[:200] + "..."
+		}
+		return &bus.ToolProgress{Name: evt.Name, Params: params, At: time.Now()}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+	"github.com/riverfjs/aevitas/internal/config"
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+)
+
+// realtimeRuntime blocks each Run until released and then emits a realtime
+// event tagged with the request's session, like the SDK does mid-turn.
+type realtimeRuntime struct {
+	mockRuntime
+	emit    func(api.RealtimeEvent)
+	started chan string
+	release chan struct{}
+}
+
+func (r *realtimeRuntime) Run(ctx context.Context, req api.Request) (*api.Response, error) {
+	r.started <- req.SessionID
+	<-r.release
+	r.emit(api.RealtimeEvent{
+		Type:      api.RealtimeEventContextWindowWarn,
+		Message:   "warn for " + req.SessionID,
+		SessionID: req.SessionID,
+	})
+	return &api.Response{Result: &api.Result{Output: "done " + req.SessionID}}, nil
+}
+
+func TestGateway_RealtimeEvents_RouteToOriginatingChat(t *testing.T) {
+	msgBus := bus.NewMessageBus(20)
+	rt := &realtimeRuntime{
+		started: make(chan string, 2),
+		release: make(chan struct{}),
+	}
+	g := &Gateway{
+		cfg:     &config.Config{},
+		bus:     msgBus,
+		runtime: rt,
+		logger:  newTestLogger(),
+	}
+	rt.emit = g.handleRealtimeEvent
+
+	chats := []string{"chatA", "chatB"}
+	var wg sync.WaitGroup
+	for i, chatID := range chats {
+		wg.Add(1)
+		go func(chatID string, msgID int) {
+			defer wg.Done()
+			g.processAgent(context.Background(), bus.InboundMessage{
+				Channel:   "test",
+				ChatID:    chatID,
+				MessageID: strconv.Itoa(msgID),
+				Content:   "hello",
+			})
+		}(chatID, i+1)
+	}
+
+	// Both turns are in flight before either emits its realtime event.
+	for range chats {
+		select {
+		case <-rt.started:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for turns to start")
+		}
+	}
+	close(rt.release)
+	wg.Wait()
+
+	got := map[string][]string{}
+	for i := 0; i < 4; i++ {
+		select {
+		case out := <-msgBus.Outbound:
+			got[out.ChatID] = append(got[out.ChatID], out.Content)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting outbound message %d", i)
+		}
+	}
+	for _, chatID := range chats {
+		session := "test:" + chatID
+		if len(got[chatID]) != 2 {
+			t.Fatalf("chat %s got %d messages, want 2: %v", chatID, len(got[chatID]), got[chatID])
+		}
+		for _, content := range got[chatID] {
+			if !strings.HasSuffix(content, session) {
+				t.Fatalf("chat %s received message for another session: %q", chatID, content)
+			}
+		}
+	}
+}
+
+func TestGateway_RealtimeEvent_WithoutSessionIsDropped(t *testing.T) {
+	msgBus := bus.NewMessageBus(10)
+	g := &Gateway{
+		cfg: &config.Config{Agent: config.AgentConfig{
+			ToolLog: config.ToolLogConfig{Enabled: true},
+		}},
+		bus:    msgBus,
+		logger: newTestLogger(),
+	}
+
+	// Even a single active turn does not own session-less events.
+	_, turn := g.turns.begin(context.Background(), bus.InboundMessage{Channel: "telegram", ChatID: "1"})
+	g.handleRealtimeEvent(api.RealtimeEvent{Type: api.RealtimeEventProgressUpdate, LastTool: "Bash"})
+	select {
+	case out := <-msgBus.Outbound:
+		t.Fatalf("session-less progress should be dropped, got %+v", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.turns.end(turn)
+	g.handleRealtimeEvent(api.RealtimeEvent{
+		Type:      api.RealtimeEventContextWindowWarn,
+		Message:   "late",
+		SessionID: turn.SessionID,
+	})
+	select {
+	case out := <-msgBus.Outbound:
+		t.Fatalf("event after turn end should be dropped, got %+v", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// toolStreamRuntime streams one tool call per turn, with the chat in the
+// tool input, once every turn has started.
+type toolStreamRuntime struct {
+	mockRuntime
+	started chan string
+	release chan struct{}
+}
+
+func (r *toolStreamRuntime) RunStream(ctx context.Context, req api.Request) (<-chan api.StreamEvent, error) {
+	r.started <- req.SessionID
+	ch := make(chan api.StreamEvent, 8)
+	go func() {
+		defer close(ch)
+		<-r.release
+		idx := 0
+		input, _ := json.Marshal(`{"command":"ls ` + req.SessionID + `"}`)
+		ch <- api.StreamEvent{Type: api.EventContentBlockStart, Index: &idx, ContentBlock: &api.ContentBlock{Type: "tool_use", ID: "t1", Name: "Bash"}}
+		ch <- api.StreamEvent{Type: api.EventContentBlockDelta, Index: &idx, Delta: &api.Delta{Type: "input_json_delta", PartialJSON: input}}
+		ch <- api.StreamEvent{Type: api.EventToolExecutionStart, ToolUseID: "t1", Name: "Bash"}
+		ch <- api.StreamEvent{Type: api.EventToolExecutionResult, ToolUseID: "t1", Name: "Bash"}
+		ch <- api.StreamEvent{Type: api.EventFinalResponse, Output: &api.Response{Result: &api.Result{Output: "done"}}}
+	}()
+	return ch, nil
+}
+
+func TestGateway_ToolProgress_RoutesFromTurnStream(t *testing.T) {
+	msgBus := bus.NewMessageBus(20)
+	rt := &toolStreamRuntime{
+		started: make(chan string, 2),
+		release: make(chan struct{}),
+	}
+	g := &Gateway{
+		cfg: &config.Config{Agent: config.AgentConfig{
+			ToolLog: config.ToolLogConfig{Enabled: true, Interval: 1},
+		}},
+		bus:     msgBus,
+		runtime: rt,
+		logger:  newTestLogger(),
+	}
+
+	chats := []string{"chatA", "chatB"}
+	var wg sync.WaitGroup
+	for i, chatID := range chats {
+		wg.Add(1)
+		go func(chatID string, msgID int) {
+			defer wg.Done()
+			g.processAgent(context.Background(), bus.InboundMessage{
+				Channel:   "test",
+				ChatID:    chatID,
+				MessageID: strconv.Itoa(msgID),
+				Content:   "hello",
+			})
+		}(chatID, i+1)
+	}
+	for range chats {
+		select {
+		case <-rt.started:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for turns to start")
+		}
+	}
+	close(rt.release)
+	wg.Wait()
+
+	progress := map[string]bus.OutboundMessage{}
+	for i := 0; i < 4; i++ {
+		select {
+		case out := <-msgBus.Outbound:
+			if out.Kind == bus.KindToolProgress {
+				progress[out.ChatID] = out
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting outbound message %d", i)
+		}
+	}
+	for _, chatID := range chats {
+		out, ok := progress[chatID]
+		if !ok {
+			t.Fatalf("chat %s got no tool progress: %v", chatID, progress)
+		}
+		want := `{"command":"ls test:` + chatID + `"}`
+		if out.Tool == nil || out.Tool.Name != "Bash" || out.Tool.Params != want || !strings.Contains(out.Content, want) {
+			t.Fatalf("chat %s got progress for another turn: %+v", chatID, out)
+		}
+	}
+}
+
+func TestGateway_HeartbeatNotify_UsesLatestActiveTurn(t *testing.T) {
+	msgBus := bus.NewMessageBus(10)
+	g := &Gateway{
+		cfg:    &config.Config{},
+		bus:    msgBus,
+		logger: newTestLogger(),
+	}
+
+	_, first := g.turns.begin(context.Background(), bus.InboundMessage{Channel: "telegram", ChatID: "1"})
+	_, second := g.turns.begin(context.Background(), bus.InboundMessage{Channel: "feishu", ChatID: "oc_2"})
+	g.turns.end(second)
+
+	g.heartbeatNotify("ping")
+	select {
+	case out := <-msgBus.Outbound:
+		if out.Channel != "telegram" || out.ChatID != "1" {
+			t.Fatalf("heartbeat routed to %s/%s, want telegram/1", out.Channel, out.ChatID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting heartbeat message")
+	}
+	g.turns.end(first)
+}
+
+// stoppableRuntime streams partial text and then blocks until its context
+// is cancelled, like a turn stuck in a long tool loop.
+type stoppableRuntime struct {
+	mockRuntime
+	started chan struct{}
+}
+
+func (r *stoppableRuntime) Run(ctx context.Context, req api.Request) (*api.Response, error) {
+	r.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (r *stoppableRuntime) RunStream(ctx context.Context, req api.Request) (<-chan api.StreamEvent, error) {
+	ch := make(chan api.StreamEvent, 4)
+	go func() {
+		defer close(ch)
+		ch <- api.StreamEvent{
+			Type:  api.EventContentBlockDelta,
+			Delta: &api.Delta{Type: "text_delta", Text: "partial answer"},
+		}
+		r.started <- struct{}{}
+		<-ctx.Done()
+		ch <- api.StreamEvent{Type: api.EventError, Output: ctx.Err().Error()}
+	}()
+	return ch, nil
+}
+
+func TestGateway_StopTurn_FinalizesWithCancelledMarker(t *testing.T) {
+	for _, channelName := range []string{"telegram", "test"} {
+		t.Run(channelName, func(t *testing.T) {
+			msgBus := bus.NewMessageBus(10)
+			rt := &stoppableRuntime{started: make(chan struct{}, 1)}
+			g := &Gateway{
+				cfg:     &config.Config{},
+				bus:     msgBus,
+				runtime: rt,
+				logger:  newTestLogger(),
+
+				previewStreamFn: func(name string) bool { return name == "telegram" },
+			}
+			msg := bus.InboundMessage{Channel: channelName, ChatID: "1", Content: "loop forever"}
+			if stopped, dropped := g.StopTurn(msg.SessionKey()); stopped || dropped != 0 {
+				t.Fatal("StopTurn should report false when nothing is running")
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				g.processAgent(context.Background(), msg)
+			}()
+			select {
+			case <-rt.started:
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting turn to start")
+			}
+			if stopped, _ := g.StopTurn(msg.SessionKey()); !stopped {
+				t.Fatal("StopTurn should cancel the running turn")
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("processAgent did not return after stop")
+			}
+
+			var final bus.OutboundMessage
+			for len(msgBus.Outbound) > 0 {
+				final = <-msgBus.Outbound
+			}
+			if !strings.Contains(final.Content, "已取消") {
+				t.Fatalf("expected cancelled marker, got %q", final.Content)
+			}
+			if channelName == "telegram" && !strings.HasPrefix(final.Content, "partial answer") {
+				t.Fatalf("partial output should be kept, got %q", final.Content)
+			}
+			if rt.clearSessionCalled {
+				t.Fatal("stopping a turn must not clear the session")
+			}
+			if g.turns.lookup(msg.SessionKey()) != nil {
+				t.Fatal("stopped turn should be unregistered")
+			}
+		})
+	}
+}
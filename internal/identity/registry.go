@@ -0,0 +1,288 @@
+// Package identity links the accounts one person uses on different channels
+// into a single user.
+package identity
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/config"
+)
+
+// LinkCodeTTL is how long a /link pairing code stays valid.
+const LinkCodeTTL = 10 * time.Minute
+
+// linkCodeAlphabet leaves out characters that are easy to mix up.
+const linkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Roles, from most to least trusted.
+const (
+	RoleOwner  = "owner"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+)
+
+// Roles lists the known roles, from most to least trusted.
+var Roles = []string{RoleOwner, RoleMember, RoleGuest}
+
+var roleRank = map[string]int{RoleGuest: 1, RoleMember: 2, RoleOwner: 3}
+
+// Allows reports whether role may do what needs at least min. An empty min
+// allows every role.
+func Allows(role, min string) bool {
+	return min == "" || roleRank[role] >= roleRank[min]
+}
+
+// Account names a sender on a channel, as written in the config.
+func Account(channel, senderID string) string {
+	return strings.TrimSpace(channel) + ":" + strings.TrimSpace(senderID)
+}
+
+type pendingLink struct {
+	account string
+	expires time.Time
+}
+
+// Registry resolves accounts to users. Users come from the config and from
+// links made in chat, which are saved to a JSON file.
+type Registry struct {
+	path string
+	now  func() time.Time
+
+	defaultRole string
+	roles       map[string]string // user -> role, from the config
+
+	mu         sync.Mutex
+	configured map[string]string // account -> user, from the config
+	linked     map[string]string // account -> user, from /link
+	codes      map[string]pendingLink
+}
+
+// Open builds a registry from cfg and the links saved at path, if any.
+func Open(cfg config.IdentitiesConfig, path string) (*Registry, error) {
+	r := &Registry{
+		path:        path,
+		now:         time.Now,
+		defaultRole: RoleOwner,
+		roles:       make(map[string]string),
+		configured:  make(map[string]string),
+		linked:      make(map[string]string),
+		codes:       make(map[string]pendingLink),
+	}
+	if role := strings.TrimSpace(cfg.DefaultRole); role != "" {
+		if _, ok := roleRank[role]; !ok {
+			return nil, fmt.Errorf("unknown default role %q", role)
+		}
+		r.defaultRole = role
+	}
+	for user, profile := range cfg.Users {
+		if role := strings.TrimSpace(profile.Role); role != "" {
+			if _, ok := roleRank[role]; !ok {
+				return nil, fmt.Errorf("user %s has unknown role %q", user, role)
+			}
+			r.roles[user] = role
+		}
+		for _, account := range profile.Accounts {
+			account = strings.TrimSpace(account)
+			if prev, ok := r.configured[account]; ok && prev != user {
+				return nil, fmt.Errorf("account %s belongs to both %s and %s", account, prev, user)
+			}
+			r.configured[account] = user
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	var saved struct {
+		Accounts map[string]string `json:"accounts"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse identities: %w", err)
+	}
+	for account, user := range saved.Accounts {
+		// The config wins over links made in chat.
+		if _, ok := r.configured[account]; !ok {
+			r.linked[account] = user
+		}
+	}
+	return r, nil
+}
+
+// User returns the user account belongs to, or "" if it is not linked.
+func (r *Registry) User(account string) string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.userLocked(account)
+}
+
+func (r *Registry) userLocked(account string) string {
+	if user, ok := r.configured[account]; ok {
+		return user
+	}
+	return r.linked[account]
+}
+
+// Role returns the role of account: its user's role, or the default role.
+// A nil registry treats every sender as owner.
+func (r *Registry) Role(account string) string {
+	if r == nil {
+		return RoleOwner
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.userRoleLocked(r.userLocked(account))
+}
+
+// userRoleLocked returns the role of user, or the default role for "" and
+// users without one.
+func (r *Registry) userRoleLocked(user string) string {
+	if role, ok := r.roles[user]; ok {
+		return role
+	}
+	return r.defaultRole
+}
+
+// Accounts returns the accounts of user, sorted.
+func (r *Registry) Accounts(user string) []string {
+	if r == nil || user == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.accountsLocked(user)
+}
+
+func (r *Registry) accountsLocked(user string) []string {
+	var accounts []string
+	for _, m := range []map[string]string{r.configured, r.linked} {
+		for account, u := range m {
+			if u == user {
+				accounts = append(accounts, account)
+			}
+		}
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// StartLink returns a one-time code that links another account to account
+// when sent from it with /link within LinkCodeTTL. A new code replaces the
+// account's previous one. Guests cannot create codes.
+func (r *Registry) StartLink(account string) (string, error) {
+	if role := r.Role(account); !Allows(role, RoleMember) {
+		return "", fmt.Errorf("the %s role cannot link accounts", role)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = linkCodeAlphabet[int(b[i])%len(linkCodeAlphabet)]
+	}
+	code := string(b)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for c, p := range r.codes {
+		if p.account == account || now.After(p.expires) {
+			delete(r.codes, c)
+		}
+	}
+	r.codes[code] = pendingLink{account: account, expires: now.Add(LinkCodeTTL)}
+	return code, nil
+}
+
+// Link joins account, which entered code, to the user of the account that
+// created it, and returns that user. Two accounts without a user get a new
+// one. An account never gains a role by a link: it could be anyone the code
+// was passed to.
+func (r *Registry) Link(code, account string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending, ok := r.codes[code]
+	if !ok || r.now().After(pending.expires) {
+		delete(r.codes, code)
+		return "", fmt.Errorf("unknown or expired code")
+	}
+	if pending.account == account {
+		return "", fmt.Errorf("send the code from your other account")
+	}
+	delete(r.codes, code)
+
+	user, other := r.userLocked(pending.account), r.userLocked(account)
+	switch {
+	case other != "" && other == user:
+		return user, nil
+	case other != "":
+		return "", fmt.Errorf("%s already belongs to another user; /unlink it first", account)
+	}
+	if role, target := r.userRoleLocked(other), r.userRoleLocked(user); !Allows(role, target) {
+		return "", fmt.Errorf("linking would raise %s from %s to %s; link it in the config instead", account, role, target)
+	}
+	if user == "" {
+		id := make([]byte, 4)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		user = "u-" + hex.EncodeToString(id)
+	}
+	for _, a := range []string{pending.account, account} {
+		if _, ok := r.configured[a]; !ok {
+			r.linked[a] = user
+		}
+	}
+	return user, r.saveLocked()
+}
+
+// Unlink removes a link made with /link. Accounts set in the config can
+// only be changed there.
+func (r *Registry) Unlink(account string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.configured[account]; ok {
+		return fmt.Errorf("%s is linked in the config", account)
+	}
+	user, ok := r.linked[account]
+	if !ok {
+		return fmt.Errorf("%s is not linked", account)
+	}
+	delete(r.linked, account)
+	// A user left with a single account has nothing to share.
+	if rest := r.accountsLocked(user); len(rest) == 1 {
+		if _, ok := r.configured[rest[0]]; !ok {
+			delete(r.linked, rest[0])
+		}
+	}
+	return r.saveLocked()
+}
+
+func (r *Registry) saveLocked() error {
+	if r.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(map[string]any{"accounts": r.linked}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0644)
+}
@@ -0,0 +1,138 @@
+package identity
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/config"
+)
+
+func TestRegistry_LinkAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	cfg := config.IdentitiesConfig{Users: map[string]config.UserIdentity{
+		"alice": {Accounts: []string{"telegram:1", "feishu:ou_a"}},
+	}}
+	r, err := Open(cfg, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if r.User("telegram:1") != "alice" || r.User("wecom:bob") != "" {
+		t.Fatal("configured accounts not resolved")
+	}
+
+	// A configured user gains an account.
+	code, err := r.StartLink("telegram:1")
+	if err != nil || len(code) != 8 {
+		t.Fatalf("StartLink = %q, %v", code, err)
+	}
+	if _, err := r.Link(code, "telegram:1"); err == nil {
+		t.Fatal("linking an account to itself should fail")
+	}
+	if user, err := r.Link(strings.ToLower(code), "wecom:alice"); err != nil || user != "alice" {
+		t.Fatalf("Link = %q, %v", user, err)
+	}
+	if _, err := r.Link(code, "slack:U1"); err == nil {
+		t.Fatal("a code should only be used once")
+	}
+
+	// Two unknown accounts become a new user.
+	code, _ = r.StartLink("slack:U1")
+	bob, err := r.Link(code, "discord:9")
+	if err != nil || !strings.HasPrefix(bob, "u-") {
+		t.Fatalf("Link = %q, %v", bob, err)
+	}
+
+	// Accounts of different users are not merged.
+	code, _ = r.StartLink("slack:U1")
+	if _, err := r.Link(code, "wecom:alice"); err == nil {
+		t.Fatal("linking accounts of two users should fail")
+	}
+
+	r, err = Open(cfg, path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got, want := r.Accounts("alice"), []string{"feishu:ou_a", "telegram:1", "wecom:alice"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("alice accounts = %v, want %v", got, want)
+	}
+	if r.User("discord:9") != bob {
+		t.Fatal("link not persisted")
+	}
+
+	if err := r.Unlink("telegram:1"); err == nil {
+		t.Fatal("configured accounts should not be unlinked from chat")
+	}
+	if err := r.Unlink("discord:9"); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+	if r.User("discord:9") != "" || r.User("slack:U1") != "" {
+		t.Fatal("a user left with one account should be dropped")
+	}
+}
+
+func TestRegistry_CodeExpires(t *testing.T) {
+	r, _ := Open(config.IdentitiesConfig{}, "")
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	code, _ := r.StartLink("telegram:1")
+	now = now.Add(LinkCodeTTL + time.Second)
+	if _, err := r.Link(code, "feishu:ou_a"); err == nil {
+		t.Fatal("expired code accepted")
+	}
+}
+
+func TestRegistry_Roles(t *testing.T) {
+	cfg := config.IdentitiesConfig{
+		DefaultRole: RoleGuest,
+		Users: map[string]config.UserIdentity{
+			"alice": {Accounts: []string{"telegram:1"}, Role: RoleOwner},
+			"bob":   {Accounts: []string{"slack:U2"}},
+		},
+	}
+	r, err := Open(cfg, "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if r.Role("telegram:1") != RoleOwner || r.Role("slack:U2") != RoleGuest || r.Role("wecom:eve") != RoleGuest {
+		t.Fatal("roles not resolved")
+	}
+	// Guests cannot create codes, and an account entering the owner's code
+	// would gain the owner role.
+	if _, err := r.StartLink("wecom:eve"); err == nil {
+		t.Fatal("a guest created a link code")
+	}
+	code, err := r.StartLink("telegram:1")
+	if err != nil {
+		t.Fatalf("StartLink: %v", err)
+	}
+	if _, err := r.Link(code, "feishu:ou_a"); err == nil || r.Role("feishu:ou_a") != RoleGuest {
+		t.Fatal("a link raised a guest to owner")
+	}
+
+	// Accounts of the same role link; the one entering the code joins the
+	// user of the one that created it.
+	cfg.DefaultRole = RoleMember
+	r, _ = Open(cfg, "")
+	code, _ = r.StartLink("wecom:eve")
+	if _, err := r.Link(code, "telegram:1"); err == nil {
+		t.Fatal("the owner's account joined another user")
+	}
+	code, _ = r.StartLink("slack:U2")
+	if user, err := r.Link(code, "wecom:eve"); err != nil || user != "bob" || r.Role("wecom:eve") != RoleMember {
+		t.Fatalf("Link = %q, %v", user, err)
+	}
+
+	if !Allows(RoleOwner, RoleMember) || Allows(RoleGuest, RoleMember) || !Allows(RoleGuest, "") || Allows("", RoleGuest) {
+		t.Fatal("unexpected role order")
+	}
+	if (*Registry)(nil).Role("telegram:1") != RoleOwner {
+		t.Fatal("nil registry should allow everything")
+	}
+	cfg.DefaultRole = "admin"
+	if _, err = Open(cfg, ""); err == nil {
+		t.Fatal("unknown role accepted")
+	}
+}
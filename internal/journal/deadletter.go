@@ -0,0 +1,168 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+// DeadLetter is an outbound message that could not be delivered. The parts
+// of a split message are stored separately, with IDs of the form "id#n".
+type DeadLetter struct {
+	ID          string           `json:"id"`
+	Channel     string           `json:"channel"`
+	ChatID      string           `json:"chatId"`
+	Kind        bus.MessageKind  `json:"kind,omitempty"`
+	Content     string           `json:"content,omitempty"`
+	ReplyTo     string           `json:"replyTo,omitempty"`
+	Attachments []bus.Attachment `json:"attachments,omitempty"`
+	Buttons     [][]bus.Button   `json:"buttons,omitempty"`
+	Metadata    map[string]any   `json:"metadata,omitempty"`
+	Error       string           `json:"error"`
+	FailedAt    time.Time        `json:"failedAt"`
+}
+
+// Message rebuilds the outbound message for another delivery attempt.
+func (d DeadLetter) Message() bus.OutboundMessage {
+	// Delivered as a fresh message with a new journal entry.
+	meta := copyMetadata(d.Metadata)
+	kind := d.Kind
+	if kind == bus.KindPreviewFinal {
+		// The preview it finalized is long gone.
+		kind = bus.KindPlain
+	}
+	return bus.OutboundMessage{
+		Channel:     d.Channel,
+		ChatID:      d.ChatID,
+		Kind:        kind,
+		Content:     d.Content,
+		ReplyTo:     d.ReplyTo,
+		Attachments: append([]bus.Attachment(nil), d.Attachments...),
+		Buttons:     d.Buttons,
+		Metadata:    meta,
+	}
+}
+
+// DeadLetters is a small JSON file of undeliverable messages. It implements
+// bus.DeadLetterSink.
+type DeadLetters struct {
+	path string
+
+	mu      sync.Mutex
+	seq     uint64
+	letters []DeadLetter
+}
+
+var _ bus.DeadLetterSink = (*DeadLetters)(nil)
+
+// OpenDeadLetters loads the dead-letter file at path, if it exists.
+func OpenDeadLetters(path string) (*DeadLetters, error) {
+	d := &DeadLetters{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.letters); err != nil {
+		return nil, fmt.Errorf("parse dead letters: %w", err)
+	}
+	return d, nil
+}
+
+// Add stores msg with the reason it failed. Ephemeral events are ignored.
+func (d *DeadLetters) Add(msg bus.OutboundMessage, reason error) {
+	if d == nil || msg.Kind.Ephemeral() {
+		return
+	}
+	errText := "unknown error"
+	if reason != nil {
+		errText = reason.Error()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := msg.JournalID
+	if id == "" {
+		d.seq++
+		id = fmt.Sprintf("dl-%d-%d", time.Now().UnixNano(), d.seq)
+	}
+	if msg.Part > 0 {
+		id = fmt.Sprintf("%s#%d", id, msg.Part)
+	}
+	d.letters = append(d.letters, DeadLetter{
+		ID:          id,
+		Channel:     msg.Channel,
+		ChatID:      msg.ChatID,
+		Kind:        msg.Kind,
+		Content:     msg.Content,
+		ReplyTo:     msg.ReplyTo,
+		Attachments: msg.Attachments,
+		Buttons:     msg.Buttons,
+		Metadata:    encodableMetadata(msg.Metadata),
+		Error:       errText,
+		FailedAt:    time.Now(),
+	})
+	_ = d.saveLocked()
+}
+
+// List returns the stored dead letters, oldest first.
+func (d *DeadLetters) List() []DeadLetter {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter(nil), d.letters...)
+}
+
+// Take removes and returns the dead letter with the given ID, or all of
+// them when id is "all".
+func (d *DeadLetters) Take(id string) ([]DeadLetter, error) {
+	if d == nil {
+		return nil, fmt.Errorf("dead-letter store not available")
+	}
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return nil, fmt.Errorf("missing id")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var taken, kept []DeadLetter
+	for _, l := range d.letters {
+		if id == "all" || l.ID == id {
+			taken = append(taken, l)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, fmt.Errorf("dead letter %q not found", id)
+	}
+	d.letters = kept
+	if err := d.saveLocked(); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+func (d *DeadLetters) saveLocked() error {
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		return err
+	}
+	letters := d.letters
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	data, err := json.MarshalIndent(letters, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.path, data, 0644)
+}
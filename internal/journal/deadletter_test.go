@@ -0,0 +1,106 @@
+package journal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+func TestDeadLetters_AddTakeAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.json")
+	d, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatalf("OpenDeadLetters: %v", err)
+	}
+
+	d.Add(bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "draft",
+		Kind: bus.KindPreviewUpdate}, errors.New("ignored"))
+	d.Add(bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "final", Kind: bus.KindPreviewFinal,
+		Attachments: bus.PathAttachments("/tmp/report.pdf"),
+		JournalID:   "out-1"}, errors.New("blocked"))
+	d.Add(bus.OutboundMessage{Channel: "feishu", ChatID: "oc", Content: "other"}, nil)
+
+	d, err = OpenDeadLetters(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	letters := d.List()
+	if len(letters) != 2 {
+		t.Fatalf("dead letters = %d, want 2 (ephemeral ignored)", len(letters))
+	}
+	if letters[0].ID != "out-1" || letters[0].Error != "blocked" {
+		t.Fatalf("unexpected first letter: %+v", letters[0])
+	}
+	msg := letters[0].Message()
+	if msg.JournalID != "" {
+		t.Fatal("retried message should get a fresh journal id")
+	}
+	if msg.Kind != bus.KindPlain {
+		t.Fatal("retried message should be sent as a fresh message")
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Path != "/tmp/report.pdf" {
+		t.Fatalf("attachments not kept: %+v", msg.Attachments)
+	}
+
+	if _, err := d.Take("missing"); err == nil {
+		t.Fatal("taking an unknown id should fail")
+	}
+	taken, err := d.Take("out-1")
+	if err != nil || len(taken) != 1 {
+		t.Fatalf("Take(out-1) = %v, %v", taken, err)
+	}
+	taken, err = d.Take("all")
+	if err != nil || len(taken) != 1 || taken[0].Content != "other" {
+		t.Fatalf("Take(all) = %v, %v", taken, err)
+	}
+	if d, _ = OpenDeadLetters(path); len(d.List()) != 0 {
+		t.Fatal("taken letters should be removed from disk")
+	}
+}
+
+func TestJournal_DeadLetteredOutboundIsNotReplayed(t *testing.T) {
+	j, path := openTemp(t)
+	msg := bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "undeliverable"}
+	j.RecordOutbound(&msg)
+	j.AckOutbound(msg, errors.New("forbidden"))
+	j.DeadLetterOutbound(msg)
+
+	j = reopen(t, j, path)
+	if pending := j.PendingOutbound(); len(pending) != 0 {
+		t.Fatalf("dead-lettered message should not be replayed: %+v", pending)
+	}
+}
+
+func TestDeadLetters_SplitPartsAndButtons(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.json")
+	d, err := OpenDeadLetters(path)
+	if err != nil {
+		t.Fatalf("OpenDeadLetters: %v", err)
+	}
+	buttons := [][]bus.Button{{{Label: "Yes", Data: "yes"}}}
+	for part := 2; part <= 3; part++ {
+		d.Add(bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "part", Buttons: buttons,
+			JournalID: "out-1", Part: part}, errors.New("forbidden"))
+	}
+
+	d, err = OpenDeadLetters(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	letters := d.List()
+	if len(letters) != 2 || letters[0].ID != "out-1#2" || letters[1].ID != "out-1#3" {
+		t.Fatalf("each part should have its own id: %+v", letters)
+	}
+	msg := letters[1].Message()
+	if msg.Part != 0 || msg.JournalID != "" {
+		t.Fatal("retried part should be sent as a message of its own")
+	}
+	if len(msg.Buttons) != 1 || msg.Buttons[0][0].Data != "yes" {
+		t.Fatalf("buttons not kept: %+v", msg.Buttons)
+	}
+	if taken, err := d.Take("out-1#2"); err != nil || len(taken) != 1 || len(d.List()) != 1 {
+		t.Fatalf("Take(out-1#2) = %v, %v", taken, err)
+	}
+}
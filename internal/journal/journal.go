@@ -0,0 +1,511 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+// Inbound processing states.
+const (
+	StateReceived   = "received"
+	StateProcessing = "processing"
+	StateDone       = "done"
+	StateDropped    = "dropped"
+)
+
+// DefaultRetention is how long finished entries are kept for deduplication.
+const DefaultRetention = 24 * time.Hour
+
+// compactMinLines is the smallest file, in lines, that is compacted while
+// running. The file is compacted once it has grown to twice the size the
+// last compaction left, so rewrites stay proportional to the live entries.
+const compactMinLines = 1000
+
+const (
+	opInbound       = "in"
+	opInboundState  = "in_state"
+	opOutbound      = "out"
+	opOutboundAck   = "out_ack"
+	opOutboundDead  = "out_dead"
+)
+
+// entry is one line of the journal file.
+type entry struct {
+	Op       string               `json:"op"`
+	ID       string               `json:"id"`
+	At       time.Time            `json:"at"`
+	State    string               `json:"state,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	Inbound  *bus.InboundMessage  `json:"inbound,omitempty"`
+	Outbound *bus.OutboundMessage `json:"outbound,omitempty"`
+}
+
+type inboundState struct {
+	seq    uint64
+	record *bus.InboundMessage
+	state  string
+	at     time.Time
+}
+
+type outboundState struct {
+	seq       uint64
+	record    *bus.OutboundMessage
+	delivered bool
+	dead      bool
+	attempts  int
+	lastErr   string
+	at        time.Time
+}
+
+// Journal is an append-only on-disk log of bus traffic. It implements
+// bus.Journal and keeps an in-memory index of unfinished work for replay.
+type Journal struct {
+	path      string
+	retention time.Duration
+
+	mu        sync.Mutex
+	f         *os.File
+	seq       uint64
+	inbound   map[string]*inboundState
+	outbound  map[string]*outboundState
+	lines     int // lines in the file
+	compacted int // lines left by the last compaction
+}
+
+var _ bus.Journal = (*Journal)(nil)
+
+// Open loads the journal at path, compacts away entries that no longer
+// matter, and opens it for appending. The file is compacted again as it
+// grows.
+func Open(path string) (*Journal, error) {
+	j := &Journal{
+		path:      path,
+		retention: DefaultRetention,
+		inbound:   make(map[string]*inboundState),
+		outbound:  make(map[string]*outboundState),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := j.load(); err != nil {
+		return nil, fmt.Errorf("load journal: %w", err)
+	}
+	if err := j.compact(); err != nil {
+		return nil, fmt.Errorf("compact journal: %w", err)
+	}
+	if err := j.openAppend(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) openAppend() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return nil
+}
+
+// Close flushes and closes the journal file.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// RecordInbound stores msg under a stable ID and reports false if that ID
+// was already recorded, e.g. when a channel redelivers after a restart.
+func (j *Journal) RecordInbound(msg *bus.InboundMessage) bool {
+	if j == nil || msg == nil {
+		return true
+	}
+	id := inboundID(msg)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if id == "" {
+		j.seq++
+		id = fmt.Sprintf("in-%d-%d", time.Now().UnixNano(), j.seq)
+	} else if _, seen := j.inbound[id]; seen {
+		return false
+	}
+	msg.JournalID = id
+	rec := *msg
+	rec.Typing = nil
+	rec.Merged = nil
+	rec.Metadata = encodableMetadata(msg.Metadata)
+	j.seq++
+	now := time.Now()
+	j.inbound[id] = &inboundState{seq: j.seq, record: &rec, state: StateReceived, at: now}
+	j.appendLocked(entry{Op: opInbound, ID: id, At: now, State: StateReceived, Inbound: &rec})
+	return true
+}
+
+// MarkInbound records a new processing state for every journal ID carried
+// by msg. Messages without an ID are ignored.
+func (j *Journal) MarkInbound(msg bus.InboundMessage, state string) {
+	if j == nil {
+		return
+	}
+	ids := IDs(msg)
+	if len(ids) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, id := range ids {
+		st, ok := j.inbound[id]
+		if !ok || st.state == state {
+			continue
+		}
+		st.state = state
+		st.at = now
+		j.appendLocked(entry{Op: opInboundState, ID: id, At: now, State: state})
+	}
+}
+
+// RecordOutbound stores msg under a new ID unless it is ephemeral or was
+// already recorded (a replayed delivery keeps its original ID).
+func (j *Journal) RecordOutbound(msg *bus.OutboundMessage) {
+	if j == nil || msg == nil || msg.Kind.Ephemeral() {
+		return
+	}
+	if msg.JournalID != "" {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	id := fmt.Sprintf("out-%d-%d", time.Now().UnixNano(), j.seq)
+	msg.JournalID = id
+	rec := *msg
+	rec.Metadata = encodableMetadata(msg.Metadata)
+	now := time.Now()
+	j.outbound[id] = &outboundState{seq: j.seq, record: &rec, at: now}
+	j.appendLocked(entry{Op: opOutbound, ID: id, At: now, Outbound: &rec})
+}
+
+// AckOutbound records whether a recorded message reached its channel.
+// Ephemeral messages are never recorded, even if they carry a copied ID.
+func (j *Journal) AckOutbound(msg bus.OutboundMessage, err error) {
+	if j == nil || msg.Kind.Ephemeral() {
+		return
+	}
+	id := msg.JournalID
+	if id == "" {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st, ok := j.outbound[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	e := entry{Op: opOutboundAck, ID: id, At: now, State: StateDone}
+	st.attempts++
+	st.at = now
+	if err != nil {
+		st.lastErr = err.Error()
+		e.State = ""
+		e.Error = err.Error()
+	} else {
+		st.delivered = true
+		st.lastErr = ""
+	}
+	j.appendLocked(e)
+}
+
+// DeadLetterOutbound marks a recorded message as moved to the dead-letter
+// store, so it is no longer replayed.
+func (j *Journal) DeadLetterOutbound(msg bus.OutboundMessage) {
+	if j == nil || msg.Kind.Ephemeral() {
+		return
+	}
+	id := msg.JournalID
+	if id == "" {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st, ok := j.outbound[id]
+	if !ok || st.dead {
+		return
+	}
+	st.dead = true
+	st.at = time.Now()
+	j.appendLocked(entry{Op: opOutboundDead, ID: id, At: st.at})
+}
+
+// PendingInbound returns messages that were received but never finished,
+// oldest first. Replayed messages carry their original journal ID.
+func (j *Journal) PendingInbound() []bus.InboundMessage {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var states []*inboundState
+	for _, st := range j.inbound {
+		if st.record != nil && (st.state == StateReceived || st.state == StateProcessing) {
+			states = append(states, st)
+		}
+	}
+	sort.Slice(states, func(a, b int) bool { return states[a].seq < states[b].seq })
+	out := make([]bus.InboundMessage, 0, len(states))
+	for _, st := range states {
+		msg := *st.record
+		msg.Attachments = append([]bus.Attachment(nil), msg.Attachments...)
+		msg.Metadata = copyMetadata(msg.Metadata)
+		msg.Replayed = true
+		out = append(out, msg)
+	}
+	return out
+}
+
+// PendingOutbound returns recorded deliveries that were never acknowledged
+// as successful, oldest first.
+func (j *Journal) PendingOutbound() []bus.OutboundMessage {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var states []*outboundState
+	for _, st := range j.outbound {
+		if !st.delivered && !st.dead && st.record != nil {
+			states = append(states, st)
+		}
+	}
+	sort.Slice(states, func(a, b int) bool { return states[a].seq < states[b].seq })
+	out := make([]bus.OutboundMessage, 0, len(states))
+	for _, st := range states {
+		msg := *st.record
+		// The preview being finalized is gone after a restart; send fresh.
+		msg.Kind = bus.KindPlain
+		msg.Attachments = append([]bus.Attachment(nil), msg.Attachments...)
+		msg.Metadata = copyMetadata(msg.Metadata)
+		out = append(out, msg)
+	}
+	return out
+}
+
+// IDs returns the journal IDs carried by msg: its own and those of the
+// messages merged into it.
+func IDs(msg bus.InboundMessage) []string {
+	ids := append([]string(nil), msg.JournalIDs...)
+	if id := msg.JournalID; id != "" {
+		for _, seen := range ids {
+			if seen == id {
+				return ids
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// inboundID derives a stable ID from the platform message ID so redelivered
+// messages can be recognized. It returns "" when the channel provides none.
+func inboundID(msg *bus.InboundMessage) string {
+	if msg.JournalID != "" {
+		return msg.JournalID
+	}
+	if raw := strings.TrimSpace(msg.MessageID); raw != "" && raw != "0" {
+		return msg.Channel + ":" + msg.ChatID + ":" + raw
+	}
+	return ""
+}
+
+// encodableMetadata drops channel extras that cannot be written as JSON.
+func encodableMetadata(meta map[string]any) map[string]any {
+	if len(meta) == 0 {
+		return nil
+	}
+	out := make(map[string]any, len(meta))
+	for k, v := range meta {
+		if _, err := json.Marshal(v); err == nil {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func copyMetadata(meta map[string]any) map[string]any {
+	out := make(map[string]any, len(meta))
+	for k, v := range meta {
+		out[k] = v
+	}
+	return out
+}
+
+func (j *Journal) appendLocked(e entry) {
+	if j.f == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	if _, err := j.f.Write(data); err != nil {
+		return
+	}
+	_ = j.f.Sync()
+	j.lines++
+	if j.lines >= compactMinLines && j.lines >= 2*j.compacted {
+		j.compactLocked()
+	}
+}
+
+// compactLocked compacts the open file. On failure the journal keeps
+// appending to the old file and tries again once it has doubled.
+func (j *Journal) compactLocked() {
+	if err := j.f.Close(); err != nil {
+		return
+	}
+	j.f = nil
+	if err := j.compact(); err != nil {
+		j.compacted = j.lines
+	}
+	_ = j.openAppend()
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e entry
+		// A torn last line after a crash is skipped.
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.ID == "" {
+			continue
+		}
+		j.seq++
+		switch e.Op {
+		case opInbound:
+			j.inbound[e.ID] = &inboundState{seq: j.seq, record: e.Inbound, state: e.State, at: e.At}
+		case opInboundState:
+			if st, ok := j.inbound[e.ID]; ok {
+				st.state = e.State
+				st.at = e.At
+			}
+		case opOutbound:
+			j.outbound[e.ID] = &outboundState{seq: j.seq, record: e.Outbound, at: e.At}
+		case opOutboundAck:
+			if st, ok := j.outbound[e.ID]; ok {
+				st.attempts++
+				st.at = e.At
+				st.delivered = e.Error == ""
+				st.lastErr = e.Error
+			}
+		case opOutboundDead:
+			if st, ok := j.outbound[e.ID]; ok {
+				st.dead = true
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the file with unfinished work plus recently finished
+// inbound IDs (kept for deduplication). Everything else is dropped.
+func (j *Journal) compact() error {
+	cutoff := time.Now().Add(-j.retention)
+	type keep struct {
+		seq uint64
+		e   []entry
+	}
+	var kept []keep
+	for id, st := range j.inbound {
+		unfinished := st.state == StateReceived || st.state == StateProcessing
+		if !unfinished && st.at.Before(cutoff) {
+			delete(j.inbound, id)
+			continue
+		}
+		rec := st.record
+		if !unfinished {
+			// Finished messages only need their ID for deduplication.
+			rec = nil
+			st.record = nil
+		}
+		kept = append(kept, keep{st.seq, []entry{{Op: opInbound, ID: id, At: st.at, State: st.state, Inbound: rec}}})
+	}
+	for id, st := range j.outbound {
+		if st.delivered || st.dead {
+			delete(j.outbound, id)
+			continue
+		}
+		es := []entry{{Op: opOutbound, ID: id, At: st.at, Outbound: st.record}}
+		for i := 0; i < st.attempts; i++ {
+			es = append(es, entry{Op: opOutboundAck, ID: id, At: st.at, Error: st.lastErr})
+		}
+		kept = append(kept, keep{st.seq, es})
+	}
+	sort.Slice(kept, func(a, b int) bool { return kept[a].seq < kept[b].seq })
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, k := range kept {
+		for _, e := range k.e {
+			if err := enc.Encode(e); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	lines := 0
+	for _, k := range kept {
+		lines += len(k.e)
+	}
+	j.lines, j.compacted = lines, lines
+	return nil
+}
@@ -0,0 +1,199 @@
+package journal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/riverfjs/aevitas/internal/bus"
+)
+
+func openTemp(t *testing.T) (*Journal, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal", "messages.jsonl")
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = j.Close() })
+	return j, path
+}
+
+func reopen(t *testing.T, j *Journal, path string) *Journal {
+	t.Helper()
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	j2, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = j2.Close() })
+	return j2
+}
+
+func TestJournal_InboundReplayAndDedup(t *testing.T) {
+	j, path := openTemp(t)
+
+	first := bus.InboundMessage{
+		Channel: "telegram", ChatID: "1", MessageID: "7", Content: "hello",
+		Attachments: []bus.Attachment{{Path: "/tmp/a.jpg", Kind: bus.AttachmentImage, MIME: "image/jpeg", Size: 42}},
+		Typing:      bus.NewTyping(func() {}),
+		Metadata:    map[string]any{"username": "alice", "callback": func() {}},
+	}
+	if !j.RecordInbound(&first) {
+		t.Fatal("first delivery should be recorded")
+	}
+	if got := first.JournalID; got != "telegram:1:7" {
+		t.Fatalf("journal id = %v, want telegram:1:7", got)
+	}
+	redelivered := bus.InboundMessage{Channel: "telegram", ChatID: "1", MessageID: "7", Content: "hello"}
+	if j.RecordInbound(&redelivered) {
+		t.Fatal("redelivered message should be reported as duplicate")
+	}
+
+	done := bus.InboundMessage{Channel: "feishu", ChatID: "oc_1", MessageID: "om_1", Content: "finished"}
+	j.RecordInbound(&done)
+	j.MarkInbound(done, StateDone)
+
+	j = reopen(t, j, path)
+	pending := j.PendingInbound()
+	if len(pending) != 1 {
+		t.Fatalf("pending inbound = %d, want 1", len(pending))
+	}
+	msg := pending[0]
+	if msg.Content != "hello" || msg.MessageID != "7" || !msg.Replayed || msg.JournalID != "telegram:1:7" {
+		t.Fatalf("unexpected replayed message: %+v", msg)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0] != first.Attachments[0] {
+		t.Fatalf("attachments not restored: %+v", msg.Attachments)
+	}
+	if msg.Typing != nil {
+		t.Fatal("typing handle should not be journaled")
+	}
+	if msg.Metadata["username"] != "alice" {
+		t.Fatalf("metadata not restored: %+v", msg.Metadata)
+	}
+	if _, ok := msg.Metadata["callback"]; ok {
+		t.Fatal("non-serializable metadata should not be journaled")
+	}
+	// Finished IDs survive compaction so late redeliveries are still dropped.
+	again := bus.InboundMessage{Channel: "feishu", ChatID: "oc_1", MessageID: "om_1"}
+	if j.RecordInbound(&again) {
+		t.Fatal("finished message should still be deduplicated after reopen")
+	}
+}
+
+func TestJournal_MarkMergedIDs(t *testing.T) {
+	j, _ := openTemp(t)
+	a := bus.InboundMessage{Channel: "wecom", ChatID: "c", MessageID: "a"}
+	b := bus.InboundMessage{Channel: "wecom", ChatID: "c", MessageID: "b"}
+	j.RecordInbound(&a)
+	j.RecordInbound(&b)
+
+	merged := b
+	merged.JournalIDs = []string{a.JournalID, b.JournalID}
+	j.MarkInbound(merged, StateDone)
+	if pending := j.PendingInbound(); len(pending) != 0 {
+		t.Fatalf("merged messages should all be finished, got %d pending", len(pending))
+	}
+}
+
+func TestJournal_OutboundAckAndReplay(t *testing.T) {
+	j, path := openTemp(t)
+
+	preview := bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "draft", Kind: bus.KindPreviewUpdate}
+	j.RecordOutbound(&preview)
+	if preview.JournalID != "" {
+		t.Fatal("ephemeral preview should not be journaled")
+	}
+
+	delivered := bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "ok"}
+	j.RecordOutbound(&delivered)
+	j.AckOutbound(delivered, nil)
+
+	failed := bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "final", Kind: bus.KindPreviewFinal}
+	j.RecordOutbound(&failed)
+	j.AckOutbound(failed, errors.New("network down"))
+
+	unsent := bus.OutboundMessage{Channel: "feishu", ChatID: "oc", Content: "queued"}
+	j.RecordOutbound(&unsent)
+
+	j = reopen(t, j, path)
+	pending := j.PendingOutbound()
+	if len(pending) != 2 {
+		t.Fatalf("pending outbound = %d, want 2", len(pending))
+	}
+	if pending[0].Content != "final" || pending[1].Content != "queued" {
+		t.Fatalf("unexpected replay order: %q, %q", pending[0].Content, pending[1].Content)
+	}
+	if pending[0].Kind != bus.KindPlain {
+		t.Fatal("replayed preview_final should be sent as a fresh message")
+	}
+	if pending[0].JournalID != failed.JournalID {
+		t.Fatal("replayed message should keep its journal id")
+	}
+
+	// Replaying keeps the ID, so a successful ack clears it for good.
+	replayed := pending[0]
+	j.RecordOutbound(&replayed)
+	j.AckOutbound(replayed, nil)
+	j = reopen(t, j, path)
+	if pending := j.PendingOutbound(); len(pending) != 1 || pending[0].Content != "queued" {
+		t.Fatalf("unexpected pending after ack: %+v", pending)
+	}
+}
+
+func TestJournal_CompactsWhileRunning(t *testing.T) {
+	j, path := openTemp(t)
+
+	unsent := bus.OutboundMessage{Channel: "feishu", ChatID: "oc", Content: "queued"}
+	j.RecordOutbound(&unsent)
+	for i := 0; i < compactMinLines; i++ {
+		msg := bus.OutboundMessage{Channel: "telegram", ChatID: "1", Content: "ok"}
+		j.RecordOutbound(&msg)
+		j.AckOutbound(msg, nil)
+	}
+
+	// An ephemeral message carrying a copied ID must not ack the original.
+	progress := bus.OutboundMessage{Kind: bus.KindToolProgress, JournalID: unsent.JournalID}
+	j.AckOutbound(progress, nil)
+	j.DeadLetterOutbound(progress)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n >= compactMinLines {
+		t.Fatalf("journal has %d lines, want it compacted below %d", n, compactMinLines)
+	}
+	j = reopen(t, j, path)
+	if pending := j.PendingOutbound(); len(pending) != 1 || pending[0].Content != "queued" {
+		t.Fatalf("unexpected pending after compaction: %+v", pending)
+	}
+}
+
+func TestJournal_SkipsTornLine(t *testing.T) {
+	j, path := openTemp(t)
+	msg := bus.InboundMessage{Channel: "telegram", ChatID: "1", Content: "kept"}
+	j.RecordInbound(&msg)
+	_ = j.Close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"op":"in","id":"half`)
+	_ = f.Close()
+
+	j2, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open after torn write: %v", err)
+	}
+	defer j2.Close()
+	if pending := j2.PendingInbound(); len(pending) != 1 || pending[0].Content != "kept" {
+		t.Fatalf("unexpected pending: %+v", pending)
+	}
+}
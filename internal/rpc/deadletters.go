@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/riverfjs/aevitas/internal/journal"
+)
+
+// DeadLetterAdmin lists and resolves outbound messages that could not be delivered.
+type DeadLetterAdmin interface {
+	ListDeadLetters() []journal.DeadLetter
+	RetryDeadLetters(id string) (int, error)
+	DropDeadLetters(id string) (int, error)
+}
+
+// RegisterDeadLetterHandlers registers the deadletters.* RPC methods on s.
+//
+//	deadletters.list  → { letters: [...] }
+//	deadletters.retry → params { id: "<id>" | "all" }, re-queues for delivery
+//	deadletters.drop  → params { id: "<id>" | "all" }, discards
+func RegisterDeadLetterHandlers(s *Server, admin DeadLetterAdmin) {
+	s.Register("deadletters.list", func(params json.RawMessage, respond RespondFn) {
+		letters := admin.ListDeadLetters()
+		if letters == nil {
+			letters = []journal.DeadLetter{}
+		}
+		respond(true, map[string]interface{}{"letters": letters}, "")
+	})
+
+	resolve := func(action func(string) (int, error)) Handler {
+		return func(params json.RawMessage, respond RespondFn) {
+			var p struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(params, &p); err != nil {
+				respond(false, nil, fmt.Sprintf("invalid params: %v", err))
+				return
+			}
+			if p.ID == "" {
+				respond(false, nil, "missing id")
+				return
+			}
+			n, err := action(p.ID)
+			if err != nil {
+				respond(false, nil, err.Error())
+				return
+			}
+			respond(true, map[string]interface{}{"ok": true, "count": n}, "")
+		}
+	}
+	s.Register("deadletters.retry", resolve(admin.RetryDeadLetters))
+	s.Register("deadletters.drop", resolve(admin.DropDeadLetters))
+}
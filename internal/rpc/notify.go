@@ -43,11 +43,11 @@ func RegisterNotifyHandlers(s *Server, b *bus.MessageBus) {
 			p.Channel = "telegram"
 		}
 		// Write to outbound bus — channel adapter delivers to the target chat.
-		b.Outbound <- bus.OutboundMessage{
+		b.PublishOutbound(bus.OutboundMessage{
 			Channel: p.Channel,
 			ChatID:  p.ChatID,
 			Content: p.Message,
-		}
+		})
 		respond(true, map[string]interface{}{"ok": true}, "")
 	})
 }
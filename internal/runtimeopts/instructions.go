@@ -0,0 +1,60 @@
+package runtimeopts
+
+import (
+	"context"
+	"strings"
+
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+	"github.com/riverfjs/agentsdk-go/pkg/model"
+)
+
+type instructionsKey struct{}
+
+// WithInstructions returns ctx carrying extra instructions, such as a group
+// chat's systemPrompt, for the turn run with it. They are added to the
+// system prompt of the turn's model calls and never enter the history.
+func WithInstructions(ctx context.Context, instructions string) context.Context {
+	if instructions = strings.TrimSpace(instructions); instructions == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, instructionsKey{}, instructions)
+}
+
+// Instructions returns the instructions ctx carries, if any.
+func Instructions(ctx context.Context) string {
+	instructions, _ := ctx.Value(instructionsKey{}).(string)
+	return instructions
+}
+
+// instructionsProvider wraps the models of a provider so they apply the
+// instructions of the request context.
+type instructionsProvider struct {
+	api.ModelFactory
+}
+
+func (p instructionsProvider) Model(ctx context.Context) (model.Model, error) {
+	mdl, err := p.ModelFactory.Model(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return instructionsModel{mdl}, nil
+}
+
+type instructionsModel struct {
+	model.Model
+}
+
+func (m instructionsModel) Complete(ctx context.Context, req model.Request) (*model.Response, error) {
+	return m.Model.Complete(ctx, withInstructions(ctx, req))
+}
+
+func (m instructionsModel) CompleteStream(ctx context.Context, req model.Request, cb model.StreamHandler) error {
+	return m.Model.CompleteStream(ctx, withInstructions(ctx, req), cb)
+}
+
+func withInstructions(ctx context.Context, req model.Request) model.Request {
+	if instructions := Instructions(ctx); instructions != "" {
+		req.System = strings.TrimSpace(req.System + "\n\n## Chat Instructions\n\n" + instructions)
+	}
+	return req
+}
@@ -0,0 +1,52 @@
+package runtimeopts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/riverfjs/agentsdk-go/pkg/api"
+	"github.com/riverfjs/agentsdk-go/pkg/model"
+)
+
+// systemRecorder records the system prompt of every call.
+type systemRecorder struct {
+	systems []string
+}
+
+func (r *systemRecorder) Complete(ctx context.Context, req model.Request) (*model.Response, error) {
+	r.systems = append(r.systems, req.System)
+	return &model.Response{}, nil
+}
+
+func (r *systemRecorder) CompleteStream(ctx context.Context, req model.Request, cb model.StreamHandler) error {
+	r.systems = append(r.systems, req.System)
+	return nil
+}
+
+func TestInstructionsProvider_AddsContextInstructionsToSystem(t *testing.T) {
+	rec := &systemRecorder{}
+	mdl, err := instructionsProvider{api.ModelFactoryFunc(func(context.Context) (model.Model, error) {
+		return rec, nil
+	})}.Model(context.Background())
+	if err != nil {
+		t.Fatalf("Model: %v", err)
+	}
+
+	req := model.Request{System: "base", Messages: []model.Message{{Role: "user", Content: "hello"}}}
+	mdl.Complete(context.Background(), req)
+	mdl.CompleteStream(WithInstructions(context.Background(), " Answer in French. "), req, nil)
+	mdl.Complete(WithInstructions(context.Background(), "  "), req)
+
+	want := []string{"base", "base\n\n## Chat Instructions\n\nAnswer in French.", "base"}
+	if len(rec.systems) != len(want) {
+		t.Fatalf("got %d calls, want %d", len(rec.systems), len(want))
+	}
+	for i := range want {
+		if rec.systems[i] != want[i] {
+			t.Fatalf("call %d system = %q, want %q", i, rec.systems[i], want[i])
+		}
+	}
+	if req.Messages[0].Content != "hello" {
+		t.Fatalf("user message changed: %q", req.Messages[0].Content)
+	}
+}
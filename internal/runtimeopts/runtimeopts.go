@@ -36,7 +36,8 @@ func BuildAPIOptions(cfg *config.Config, provider api.ModelFactory, sysPrompt st
 
 	return api.Options{
 		ProjectRoot:             cfg.Agent.Workspace,
-		ModelFactory:            provider,
+		SettingsPath:            cfg.Agent.SettingsPath,
+		ModelFactory:            instructionsProvider{provider},
 		PromptGuardModelFactory: promptGuardFactory,
 		PromptGuardEnabled:      boolPtr(inputGuardEnabled),
 		OutputGuardEnabled:      boolPtr(outputGuardEnabled),